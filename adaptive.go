@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// batchSizer sizes the commits of bulk operations from their observed
+// latencies and errors.
+type batchSizer struct {
+	mu     sync.Mutex
+	size   int
+	target time.Duration
+}
+
+// SetAdaptiveBatches makes the bulk writes of Insert, Clear, Reap and
+// UpsertMulti size their commits dynamically instead of always packing
+// MaxMutations mutations. The size is halved when a commit fails with an
+// aborted, deadline exceeded, resource exhausted or unavailable error, in
+// which case commits which can safely be retried are retried with the smaller
+// size. It is reduced when commits take longer than target and grows back
+// progressively while they are faster. A zero target disables adaptive
+// sizing.
+func (d *Handler) SetAdaptiveBatches(target time.Duration) *Handler {
+	d.batches = nil
+	if target > 0 {
+		d.batches = &batchSizer{size: MaxMutations, target: target}
+	}
+	return d
+}
+
+// batchSize returns the current maximum number of mutations per commit.
+func (d *Handler) batchSize() int {
+	if d.batches == nil {
+		return MaxMutations
+	}
+	d.batches.mu.Lock()
+	defer d.batches.mu.Unlock()
+	return d.batches.size
+}
+
+// observeBatch adapts the batch size to the outcome of a commit which took
+// elapsed, and returns whether err calls for a smaller batch.
+func (d *Handler) observeBatch(elapsed time.Duration, err error) bool {
+	b := d.batches
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size = nextBatchSize(b.size, elapsed, b.target, err)
+	return shrinkable(err)
+}
+
+// nextBatchSize returns the batch size following a commit of the given
+// outcome.
+func nextBatchSize(size int, elapsed, target time.Duration, err error) int {
+	switch {
+	case shrinkable(err):
+		size /= 2
+	case err != nil:
+		return size
+	case elapsed > target:
+		size = size * 3 / 4
+	default:
+		step := size / 10
+		if step < 1 {
+			step = 1
+		}
+		size += step
+	}
+	if size < 1 {
+		size = 1
+	}
+	if size > MaxMutations {
+		size = MaxMutations
+	}
+	return size
+}
+
+// shrinkable returns whether err may be avoided with smaller commits.
+func shrinkable(err error) bool {
+	switch status.Code(err) {
+	case codes.Aborted, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Unavailable:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNextBatchSize(t *testing.T) {
+	target := time.Second
+	tests := []struct {
+		size    int
+		elapsed time.Duration
+		err     error
+		want    int
+	}{
+		{400, 100 * time.Millisecond, nil, 440},
+		{MaxMutations, 100 * time.Millisecond, nil, MaxMutations},
+		{5, 100 * time.Millisecond, nil, 6},
+		{400, 2 * time.Second, nil, 300},
+		{400, 0, status.Error(codes.Aborted, "aborted"), 200},
+		{1, 0, status.Error(codes.DeadlineExceeded, "deadline"), 1},
+		{400, 0, errors.New("invalid"), 400},
+	}
+	for _, tt := range tests {
+		if got := nextBatchSize(tt.size, tt.elapsed, target, tt.err); got != tt.want {
+			t.Errorf("nextBatchSize(%d, %v, %v) = %d, want %d", tt.size, tt.elapsed, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/datastore/apiv1/datastorepb"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// AggregateOp is an aggregation computed by Datastore.
+type AggregateOp int
+
+const (
+	// AggregateCount counts the items.
+	AggregateCount AggregateOp = iota
+	// AggregateSum sums the numeric values of a field.
+	AggregateSum
+	// AggregateAvg averages the numeric values of a field.
+	AggregateAvg
+	// AggregateMin is the lowest value of a field, only computed by GroupBy.
+	AggregateMin
+	// AggregateMax is the highest value of a field, only computed by
+	// GroupBy.
+	AggregateMax
+)
+
+// Aggregation is an aggregation of the items returned under Alias.
+type Aggregation struct {
+	Alias string
+	Op    AggregateOp
+	// Field aggregated by sums and averages.
+	Field string
+}
+
+// AggregateResult holds the aggregations by alias: int64 counts, int64 sums
+// of integers, float64 sums of floats and float64 averages. The sums and
+// averages of items lacking numeric values are 0 and nil.
+type AggregateResult map[string]interface{}
+
+// Int returns the integer value of the aggregation alias.
+func (r AggregateResult) Int(alias string) int64 {
+	switch v := r[alias].(type) {
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+// Float returns the value of the aggregation alias as a float.
+func (r AggregateResult) Float(alias string) float64 {
+	switch v := r[alias].(type) {
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+// Aggregate runs the count, sum and average aggregations of the items matching
+// the predicate of q server-side, so reports don't need to read the items. The
+// window of q bounds the aggregated items; its sort is ignored. Up to 5
+// aggregations can be run at once. Aggregated fields can't be hashed,
+// encrypted or have a codec, whose stored values are not the item values.
+func (d *Handler) Aggregate(ctx context.Context, q *query.Query, aggs ...Aggregation) (res AggregateResult, err error) {
+	ctx, op := d.startOperation(ctx, "Aggregate", queryAttrs(q)...)
+	defer func() { err = op.end(len(res), err) }()
+	for _, a := range aggs {
+		if a.Op > AggregateAvg {
+			return nil, fmt.Errorf("aggregation %d is not supported by Datastore", a.Op)
+		}
+		if a.Op == AggregateCount {
+			continue
+		}
+		if c, _ := d.fieldCodec(a.Field); c != nil || !d.queryable(a.Field) || d.hashedFields[a.Field] || d.encryptedField(a.Field) {
+			return nil, &ErrUnsupportedPredicate{Expression: "aggregate " + a.Field}
+		}
+	}
+	p, ok, err := d.normalizePredicate(q.Predicate)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// No item can match
+		res = AggregateResult{}
+		for _, a := range aggs {
+			res[a.Alias] = nil
+			if a.Op != AggregateAvg {
+				res[a.Alias] = int64(0)
+			}
+		}
+		return res, nil
+	}
+	qry, err := d.getQuery(ctx, &query.Query{Predicate: p})
+	if err != nil {
+		return nil, err
+	}
+	if q.Window != nil {
+		qry = applyWindow(qry, *q.Window)
+	}
+	aq := qry.NewAggregationQuery()
+	for _, a := range aggs {
+		switch a.Op {
+		case AggregateCount:
+			aq = aq.WithCount(a.Alias)
+		case AggregateSum:
+			aq = aq.WithSum(getField(a.Field), a.Alias)
+		case AggregateAvg:
+			aq = aq.WithAvg(getField(a.Field), a.Alias)
+		}
+	}
+	err = d.retry(ctx, true, func() error {
+		if err := d.throttle(ctx, 1); err != nil {
+			return err
+		}
+		ar, err := d.client.RunAggregationQuery(ctx, aq)
+		if err != nil {
+			return err
+		}
+		res = make(AggregateResult, len(ar))
+		for alias, v := range ar {
+			res[alias] = aggregateValue(v)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// aggregateValue converts a value of an aggregation result.
+func aggregateValue(v interface{}) interface{} {
+	pv, ok := v.(*datastorepb.Value)
+	if !ok {
+		return v
+	}
+	switch t := pv.GetValueType().(type) {
+	case *datastorepb.Value_IntegerValue:
+		return t.IntegerValue
+	case *datastorepb.Value_DoubleValue:
+		return t.DoubleValue
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package datastore
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore/apiv1/datastorepb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestAggregateValue(t *testing.T) {
+	res := AggregateResult{
+		"count": aggregateValue(&datastorepb.Value{ValueType: &datastorepb.Value_IntegerValue{IntegerValue: 3}}),
+		"avg":   aggregateValue(&datastorepb.Value{ValueType: &datastorepb.Value_DoubleValue{DoubleValue: 1.5}}),
+		"none":  aggregateValue(&datastorepb.Value{ValueType: &datastorepb.Value_NullValue{NullValue: structpb.NullValue_NULL_VALUE}}),
+	}
+	if res["count"] != int64(3) || res.Float("count") != 3 {
+		t.Errorf("count: got %v", res["count"])
+	}
+	if res["avg"] != 1.5 || res.Int("avg") != 1 {
+		t.Errorf("avg: got %v", res["avg"])
+	}
+	if res["none"] != nil || res.Float("none") != 0 {
+		t.Errorf("none: got %v", res["none"])
+	}
+}
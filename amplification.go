@@ -0,0 +1,164 @@
+package datastore
+
+import (
+	"reflect"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+)
+
+// WriteReport holds the estimated index writes generated by the writes of a
+// handler, to find the fields which dominate the write costs.
+type WriteReport struct {
+	// Ops counts the reported operations per type, insert or update.
+	Ops map[string]int64
+	// IndexWrites estimates the index entries written or deleted per
+	// operation type and top level property.
+	IndexWrites map[string]map[string]int64
+}
+
+// writeTracker aggregates the write report of a handler.
+type writeTracker struct {
+	mu     sync.Mutex
+	report WriteReport
+}
+
+// SetWriteReport enables estimating the index writes of Insert and Update,
+// available with WriteReport. Each indexed value is counted twice for the
+// ascending and descending built-in indexes, list values once per element;
+// composite indexes are not accounted for. Updates only count the properties
+// whose value changed, for both their old and new entries.
+func (d *Handler) SetWriteReport(enabled bool) *Handler {
+	d.writes = nil
+	if enabled {
+		d.writes = &writeTracker{}
+		d.writes.reset()
+	}
+	return d
+}
+
+// WriteReport returns a copy of the write report aggregated since the report
+// was enabled or last reset.
+func (d *Handler) WriteReport() WriteReport {
+	r := WriteReport{Ops: map[string]int64{}, IndexWrites: map[string]map[string]int64{}}
+	if d.writes == nil {
+		return r
+	}
+	d.writes.mu.Lock()
+	defer d.writes.mu.Unlock()
+	for op, n := range d.writes.report.Ops {
+		r.Ops[op] = n
+	}
+	for op, fields := range d.writes.report.IndexWrites {
+		r.IndexWrites[op] = make(map[string]int64, len(fields))
+		for f, n := range fields {
+			r.IndexWrites[op][f] = n
+		}
+	}
+	return r
+}
+
+// ResetWriteReport clears the write report.
+func (d *Handler) ResetWriteReport() {
+	if d.writes != nil {
+		d.writes.reset()
+	}
+}
+
+func (t *writeTracker) reset() {
+	t.mu.Lock()
+	t.report = WriteReport{Ops: map[string]int64{}, IndexWrites: map[string]map[string]int64{}}
+	t.mu.Unlock()
+}
+
+// reportWrite adds the index writes of replacing previous, nil for an
+// insertion, by e to the write report.
+func (d *Handler) reportWrite(op string, previous, e *Entity) {
+	if d.writes == nil {
+		return
+	}
+	writes, err := indexWrites(previous, e)
+	if err != nil {
+		return
+	}
+	t := d.writes
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.report.Ops[op]++
+	fields := t.report.IndexWrites[op]
+	if fields == nil {
+		fields = map[string]int64{}
+		t.report.IndexWrites[op] = fields
+	}
+	for f, n := range writes {
+		fields[f] += int64(n)
+	}
+}
+
+// indexWrites estimates the index writes per property of replacing previous,
+// nil for an insertion, by e.
+func indexWrites(previous, e *Entity) (map[string]int, error) {
+	ps, err := e.Save()
+	if err != nil {
+		return nil, err
+	}
+	old := map[string]datastore.Property{}
+	if previous != nil {
+		pps, err := previous.Save()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range pps {
+			old[p.Name] = p
+		}
+	}
+	writes := make(map[string]int, len(ps))
+	for _, p := range ps {
+		o, found := old[p.Name]
+		delete(old, p.Name)
+		if found && o.NoIndex == p.NoIndex && reflect.DeepEqual(o.Value, p.Value) {
+			continue
+		}
+		if n := indexEntries(p) + indexEntries(o); n > 0 {
+			writes[p.Name] = n
+		}
+	}
+	// Removed properties have their entries deleted
+	for name, o := range old {
+		if n := indexEntries(o); n > 0 {
+			writes[name] = n
+		}
+	}
+	return writes, nil
+}
+
+// indexEntries estimates the number of built-in index entries of p.
+func indexEntries(p datastore.Property) int {
+	if p.NoIndex {
+		return 0
+	}
+	return 2 * indexedValues(p.Value)
+}
+
+func indexedValues(v interface{}) int {
+	switch t := v.(type) {
+	case nil:
+		return 0
+	case []interface{}:
+		n := 0
+		for _, e := range t {
+			n += indexedValues(e)
+		}
+		return n
+	case *datastore.Entity:
+		n := 0
+		for _, p := range t.Properties {
+			if !p.NoIndex {
+				n += indexedValues(p.Value)
+			}
+		}
+		return n
+	default:
+		return 1
+	}
+}
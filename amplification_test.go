@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestIndexWrites(t *testing.T) {
+	updated := time.Date(2017, time.March, 15, 0, 0, 0, 0, time.UTC)
+	previous := &Entity{
+		ID:      "1",
+		ETag:    "a",
+		Updated: updated,
+		Payload: map[string]interface{}{
+			"name": "john",
+			"tags": []interface{}{"a", "b"},
+			"bio":  "long text",
+			"old":  "removed",
+		},
+		NoIndexProps: map[string]bool{"bio": true},
+	}
+	e := &Entity{
+		ID:      "1",
+		ETag:    "b",
+		Updated: updated,
+		Payload: map[string]interface{}{
+			"name": "john",
+			"tags": []interface{}{"a", "b", "c"},
+			"bio":  "longer text",
+			"address": &datastore.Entity{Properties: []datastore.Property{
+				{Name: "city", Value: "Paris"},
+				{Name: "street", Value: "rue de Rivoli", NoIndex: true},
+			}},
+		},
+		NoIndexProps: map[string]bool{"bio": true},
+	}
+	writes, err := indexWrites(previous, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"_etag": 4, "tags": 10, "address": 2, "old": 2}
+	if len(writes) != len(want) {
+		t.Errorf("got %v, want %v", writes, want)
+	}
+	for f, n := range want {
+		if writes[f] != n {
+			t.Errorf("%s: got %d index writes, want %d", f, writes[f], n)
+		}
+	}
+	writes, err = indexWrites(nil, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writes["tags"] != 6 || writes["name"] != 2 || writes["bio"] != 0 {
+		t.Errorf("unexpected insert writes: %v", writes)
+	}
+}
@@ -0,0 +1,162 @@
+package datastore
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema"
+)
+
+// AppEngineCodec is an EntityCodec reading the entities written by the
+// google.golang.org/appengine datastore package, so projects migrating off
+// the App Engine SDK can serve their existing data. Guided by the resource
+// schema, it converts:
+//
+//   - times stored as microseconds since the epoch to time.Time;
+//   - blobs and byte strings to strings for string fields;
+//   - keys, used for references, to the id of the referenced entity;
+//   - multi-valued properties to lists, and single values of list fields
+//     to lists of one value;
+//   - slices of structs, flattened as "Field.Sub" multi-valued properties, to
+//     lists of objects.
+//
+// Entities are written with the default layout, so they converge as they are
+// updated.
+type AppEngineCodec struct {
+	Schema *schema.Schema
+}
+
+// Encode implements the EntityCodec interface
+func (c AppEngineCodec) Encode(payload map[string]interface{}) ([]datastore.Property, error) {
+	ps := make([]datastore.Property, 0, len(payload))
+	for k, v := range payload {
+		ps = append(ps, datastore.Property{Name: k, Value: v})
+	}
+	return ps, nil
+}
+
+// Decode implements the EntityCodec interface
+func (c AppEngineCodec) Decode(ps []datastore.Property) (map[string]interface{}, error) {
+	payload := make(map[string]interface{}, len(ps))
+	flattened := map[string]map[string]interface{}{}
+	for _, p := range ps {
+		if i := strings.IndexByte(p.Name, '.'); i > 0 {
+			parent, sub := p.Name[:i], p.Name[i+1:]
+			if flattened[parent] == nil {
+				flattened[parent] = map[string]interface{}{}
+			}
+			flattened[parent][sub] = p.Value
+			continue
+		}
+		payload[p.Name] = p.Value
+	}
+	for parent, subs := range flattened {
+		payload[parent] = unflatten(subs)
+	}
+	for k, v := range payload {
+		payload[k] = c.convert(c.field(k), v)
+	}
+	return payload, nil
+}
+
+func (c AppEngineCodec) field(name string) *schema.Field {
+	if c.Schema == nil {
+		return nil
+	}
+	return c.Schema.GetField(name)
+}
+
+// convert converts v to the representation expected by f.
+func (c AppEngineCodec) convert(f *schema.Field, v interface{}) interface{} {
+	if f == nil {
+		return v
+	}
+	if a, ok := f.Validator.(*schema.Array); ok {
+		l, isList := v.([]interface{})
+		if !isList {
+			if v == nil {
+				return nil
+			}
+			l = []interface{}{v}
+		}
+		r := make([]interface{}, len(l))
+		for i, e := range l {
+			r[i] = c.convert(&a.Values, e)
+		}
+		return r
+	}
+	if l, ok := v.([]interface{}); ok {
+		// Multi-valued property of a single valued field
+		switch len(l) {
+		case 0:
+			return nil
+		case 1:
+			v = l[0]
+		default:
+			return v
+		}
+	}
+	switch t := v.(type) {
+	case int64:
+		if _, ok := f.Validator.(*schema.Time); ok {
+			return time.Unix(0, t*int64(time.Microsecond)).UTC()
+		}
+	case []byte:
+		if _, ok := f.Validator.(*schema.String); ok {
+			return string(t)
+		}
+	case *datastore.Key:
+		if t.Name != "" {
+			return t.Name
+		}
+		return strconv.FormatInt(t.ID, 10)
+	case map[string]interface{}:
+		if f.Schema != nil {
+			nested := AppEngineCodec{Schema: f.Schema}
+			for k, e := range t {
+				t[k] = nested.convert(nested.field(k), e)
+			}
+		}
+	}
+	return v
+}
+
+// unflatten rebuilds the objects of a slice of structs saved as multi-valued
+// "Field.Sub" properties. Single values give a single object.
+func unflatten(subs map[string]interface{}) interface{} {
+	n, multi := 0, false
+	for _, v := range subs {
+		if l, ok := v.([]interface{}); ok {
+			multi = true
+			if len(l) > n {
+				n = len(l)
+			}
+		}
+	}
+	if !multi {
+		return subs
+	}
+	names := make([]string, 0, len(subs))
+	for k := range subs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	objects := make([]interface{}, n)
+	for i := range objects {
+		o := make(map[string]interface{}, len(subs))
+		for _, k := range names {
+			if l, ok := subs[k].([]interface{}); ok {
+				if i < len(l) {
+					o[k] = l[i]
+				}
+			} else if i == 0 {
+				o[k] = subs[k]
+			}
+		}
+		objects[i] = o
+	}
+	return objects
+}
@@ -0,0 +1,52 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema"
+)
+
+func TestAppEngineCodecDecode(t *testing.T) {
+	s := &schema.Schema{Fields: schema.Fields{
+		"created": {Validator: &schema.Time{}},
+		"bio":     {Validator: &schema.String{}},
+		"owner":   {Validator: &schema.Reference{Path: "users"}},
+		"tags":    {Validator: &schema.Array{Values: schema.Field{Validator: &schema.String{}}}},
+		"name":    {Validator: &schema.String{}},
+		"addresses": {Validator: &schema.Array{Values: schema.Field{Schema: &schema.Schema{Fields: schema.Fields{
+			"city": {Validator: &schema.String{}},
+			"zip":  {Validator: &schema.String{}},
+		}}}}},
+	}}
+	created := time.Date(2017, time.March, 15, 10, 0, 0, 0, time.UTC)
+	ps := []datastore.Property{
+		{Name: "created", Value: created.UnixNano() / 1000},
+		{Name: "bio", Value: []byte("hello")},
+		{Name: "owner", Value: datastore.NameKey("users", "u1", nil)},
+		{Name: "tags", Value: "single"},
+		{Name: "name", Value: []interface{}{"john"}},
+		{Name: "addresses.city", Value: []interface{}{"Paris", "Lyon"}},
+		{Name: "addresses.zip", Value: []interface{}{"75001", "69001"}},
+	}
+	payload, err := AppEngineCodec{Schema: s}.Decode(ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"created": created,
+		"bio":     "hello",
+		"owner":   "u1",
+		"tags":    []interface{}{"single"},
+		"name":    "john",
+		"addresses": []interface{}{
+			map[string]interface{}{"city": "Paris", "zip": "75001"},
+			map[string]interface{}{"city": "Lyon", "zip": "69001"},
+		},
+	}
+	if !reflect.DeepEqual(payload, want) {
+		t.Errorf("got %v, want %v", payload, want)
+	}
+}
@@ -0,0 +1,71 @@
+package datastore
+
+import (
+	"context"
+)
+
+// Names of the audit meta properties.
+const (
+	createdProperty   = "_created"
+	createdByProperty = "_created_by"
+	updatedByProperty = "_updated_by"
+)
+
+// ActorFunc extracts the identity of the actor performing a write from the
+// request context. An empty string means unknown.
+type ActorFunc func(ctx context.Context) string
+
+// SetAuditFields enables the _created, _created_by and _updated_by meta
+// properties. The creation time is set on insert and kept on updates, while
+// actor is called on every write to get the identity stored in _created_by
+// and _updated_by. When expose is true, the audit properties are added to the
+// payload of loaded items under the same names, which should be declared as
+// read only fields of the schema.
+func (d *Handler) SetAuditFields(actor ActorFunc, expose bool) *Handler {
+	d.audit = true
+	d.auditActor = actor
+	d.auditExpose = expose
+	return d
+}
+
+// isAuditField tells if a payload field is an exposed audit property, which
+// is stored as meta property only.
+func isAuditField(field string) bool {
+	return field == createdProperty || field == createdByProperty || field == updatedByProperty
+}
+
+// stampAudit sets the audit meta properties of e, carrying the creation ones
+// over from the stored entity previous if not nil.
+func (d *Handler) stampAudit(ctx context.Context, e *Entity, previous *Entity) {
+	if !d.audit {
+		return
+	}
+	var actor string
+	if d.auditActor != nil {
+		actor = d.auditActor(ctx)
+	}
+	if previous != nil {
+		e.Created = previous.Created
+		e.CreatedBy = previous.CreatedBy
+	} else {
+		e.Created = d.now()
+		e.CreatedBy = actor
+	}
+	e.UpdatedBy = actor
+}
+
+// exposeAudit adds the audit meta properties of e to payload if configured.
+func (d *Handler) exposeAudit(e *Entity, payload map[string]interface{}) {
+	if !d.auditExpose {
+		return
+	}
+	if !e.Created.IsZero() {
+		payload[createdProperty] = e.Created
+	}
+	if e.CreatedBy != "" {
+		payload[createdByProperty] = e.CreatedBy
+	}
+	if e.UpdatedBy != "" {
+		payload[updatedByProperty] = e.UpdatedBy
+	}
+}
@@ -0,0 +1,198 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// backupTimeFormat is the format of the times naming the backups.
+const backupTimeFormat = "20060102T150405Z"
+
+// Backup describes recurring backups of the entities of a set of handlers to
+// a Cloud Storage bucket, each under the Name/<UTC time>/ prefix.
+type Backup struct {
+	// Name prefixes the objects of the backups.
+	Name string
+	// Schedule of the backups, parsed by ParseSchedule.
+	Schedule string
+	// Handlers whose entities are backed up, in their namespace for the
+	// context given to StartBackups.
+	Handlers []*Handler
+	// Bucket receiving the backups.
+	Bucket *storage.BucketHandle
+	// Managed, if not nil, runs managed exports of the kinds of the handlers,
+	// waiting for their completion. Otherwise the items of each handler are
+	// exported as NDJSON in a <kind>.ndjson object.
+	Managed *ManagedExport
+	// Shards is the number of key ranges read concurrently by NDJSON exports.
+	Shards int
+	// Retention is the age after which backups are deleted, never when zero.
+	// The Keep most recent backups are never deleted.
+	Retention time.Duration
+	Keep      int
+}
+
+// Run backs up the entities of the handlers and returns the prefix of the
+// backup, then deletes the expired backups.
+func (b *Backup) Run(ctx context.Context) (string, error) {
+	now := time.Now().UTC()
+	prefix := b.Name + "/" + now.Format(backupTimeFormat) + "/"
+	if b.Managed != nil {
+		op, err := b.Managed.Export(ctx, "gs://"+b.Bucket.BucketName()+"/"+strings.TrimSuffix(prefix, "/"), b.Handlers...)
+		if err != nil {
+			return "", err
+		}
+		if _, err = op.Wait(ctx); err != nil {
+			return "", err
+		}
+	} else {
+		for _, h := range b.Handlers {
+			if err := b.exportNDJSON(ctx, h, prefix+h.entity+".ndjson"); err != nil {
+				return "", err
+			}
+		}
+	}
+	return prefix, b.Prune(ctx, now)
+}
+
+// exportNDJSON exports the items of h to the object with name.
+func (b *Backup) exportNDJSON(ctx context.Context, h *Handler, name string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := b.Bucket.Object(name).NewWriter(ctx)
+	w.ContentType = "application/x-ndjson"
+	if _, err := (&Exporter{Handler: h, Shards: b.Shards}).Export(ctx, w); err != nil {
+		// Canceling the context discards the object
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Prune deletes the backups expired at now.
+func (b *Backup) Prune(ctx context.Context, now time.Time) error {
+	if b.Retention <= 0 {
+		return nil
+	}
+	var backups []string
+	it := b.Bucket.Objects(ctx, &storage.Query{Prefix: b.Name + "/", Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if attrs.Prefix != "" {
+			backups = append(backups, attrs.Prefix)
+		}
+	}
+	for _, prefix := range expiredBackups(b.Name, backups, now, b.Retention, b.Keep) {
+		if err := b.deletePrefix(ctx, prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expiredBackups returns the prefixes of the backups of name older than
+// retention at now, but the keep most recent ones. Prefixes not named by a
+// backup time are ignored.
+func expiredBackups(name string, prefixes []string, now time.Time, retention time.Duration, keep int) []string {
+	type backup struct {
+		prefix string
+		t      time.Time
+	}
+	var backups []backup
+	for _, p := range prefixes {
+		t, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(p, name+"/"), "/"))
+		if err == nil {
+			backups = append(backups, backup{p, t})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].t.After(backups[j].t)
+	})
+	var expired []string
+	for i, bk := range backups {
+		if i >= keep && now.Sub(bk.t) > retention {
+			expired = append(expired, bk.prefix)
+		}
+	}
+	return expired
+}
+
+// deletePrefix deletes the objects with prefix.
+func (b *Backup) deletePrefix(ctx context.Context, prefix string) error {
+	it := b.Bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = b.Bucket.Object(attrs.Name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+}
+
+// StartBackups runs the backups on their schedule in the background until
+// the returned stop function or Close of one of their handlers is called.
+// Errors are passed to onError if not nil.
+func StartBackups(ctx context.Context, onError func(b *Backup, err error), backups ...*Backup) (stop func(), err error) {
+	schedules := make([]Schedule, len(backups))
+	for i, b := range backups {
+		if schedules[i], err = ParseSchedule(b.Schedule); err != nil {
+			return nil, fmt.Errorf("backup %s: %v", b.Name, err)
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{}, len(backups))
+	for i, b := range backups {
+		go func(b *Backup, s Schedule) {
+			defer func() { done <- struct{}{} }()
+			for {
+				next := s.Next(time.Now())
+				if next.IsZero() {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Until(next)):
+					if _, err := b.Run(ctx); err != nil && onError != nil && ctx.Err() == nil {
+						onError(b, err)
+					}
+				}
+			}
+		}(b, schedules[i])
+	}
+	stopped := make(chan struct{})
+	go func() {
+		for range backups {
+			<-done
+		}
+		close(stopped)
+	}()
+	stop = func() {
+		cancel()
+		<-stopped
+	}
+	for _, b := range backups {
+		for _, h := range b.Handlers {
+			h.startedWorker(stop)
+		}
+	}
+	return stop, nil
+}
@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// MaxMutations is the maximum number of mutations Datastore accepts in a
+// single commit.
+const MaxMutations = 500
+
+// ChunkMutations splits muts into consecutive chunks of at most size
+// mutations, each of which can be committed with a single Mutate call. A size
+// lower than 1 or greater than MaxMutations defaults to MaxMutations.
+func ChunkMutations(muts []*datastore.Mutation, size int) [][]*datastore.Mutation {
+	if size < 1 || size > MaxMutations {
+		size = MaxMutations
+	}
+	chunks := make([][]*datastore.Mutation, 0, (len(muts)+size-1)/size)
+	for len(muts) > size {
+		chunks = append(chunks, muts[:size])
+		muts = muts[size:]
+	}
+	if len(muts) > 0 {
+		chunks = append(chunks, muts)
+	}
+	return chunks
+}
+
+// RunWithRetryableTx runs f in a transaction, running it again up to attempts
+// times in total when the commit fails because of a concurrent transaction.
+// Errors returned by f abort the transaction and are returned as is.
+func RunWithRetryableTx(ctx context.Context, client Client, attempts int, f func(tx Transaction) error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	_, err := client.RunInTransaction(ctx, f, datastore.MaxAttempts(attempts))
+	return err
+}
+
+// StreamKeys runs q as a keys-only query and calls fn with each key in result
+// order. Iteration stops at the first error returned by fn or by the query,
+// or when ctx is done.
+func StreamKeys(ctx context.Context, client Client, q *datastore.Query, fn func(key *datastore.Key) error) error {
+	t := client.Run(ctx, q.KeysOnly())
+	for {
+		key, err := t.Next(nil)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = fn(key); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+// StorageMode defines how the item payload is laid out in stored entities.
+type StorageMode int
+
+const (
+	// PropertyStorage stores each payload field as its own property. This is
+	// the default mode.
+	PropertyStorage StorageMode = iota
+	// BlobStorage stores the whole payload as a single noindex JSON property,
+	// avoiding index explosion and property name restrictions. Only the id can
+	// be used in filters and sorts.
+	BlobStorage
+	// HybridStorage stores the fields declared with SetQueryableFields as
+	// regular properties, so they can be filtered and sorted on, and everything
+	// else as a single compressed noindex JSON property.
+	HybridStorage
+)
+
+// blobProperty is the name of the property holding the serialized payload.
+const blobProperty = "_payload"
+
+// SetQueryableFields sets the top level fields stored as regular properties in
+// HybridStorage mode.
+func (d *Handler) SetQueryableFields(fields []string) *Handler {
+	f := make(map[string]bool, len(fields))
+	for _, v := range fields {
+		f[v] = true
+	}
+	d.queryableFields = f
+	return d
+}
+
+// queryable tells if a field is stored as an indexed property which can be
+// used in filters and sorts.
+func (d *Handler) queryable(field string) bool {
+	switch d.mode {
+	case BlobStorage:
+		return field == "id"
+	case HybridStorage:
+		return field == "id" || d.queryableFields[strings.SplitN(field, ".", 2)[0]]
+	}
+	return true
+}
+
+// Compression defines the codec used to compress blob properties.
+type Compression int
+
+const (
+	// DefaultCompression uses GzipCompression in HybridStorage mode and
+	// NoCompression in BlobStorage mode.
+	DefaultCompression Compression = iota
+	// NoCompression stores the JSON payload as is.
+	NoCompression
+	// GzipCompression compresses the payload with gzip.
+	GzipCompression
+	// SnappyCompression compresses the payload with snappy, trading some
+	// compression ratio for speed.
+	SnappyCompression
+)
+
+// blobHeader marks compressed blobs. It is followed by a byte identifying the
+// codec. The marker can't start a JSON document nor a gzip stream.
+const blobHeader = 0xff
+
+// SetCompression sets the codec used to compress the payload property in
+// BlobStorage and HybridStorage modes. Blobs are decompressed on load
+// whatever the current setting, so it can be changed at any time.
+func (d *Handler) SetCompression(c Compression) *Handler {
+	d.compression = c
+	return d
+}
+
+// blobCompression resolves the compression used for the handler storage mode.
+func (d *Handler) blobCompression() Compression {
+	if d.compression != DefaultCompression {
+		return d.compression
+	}
+	if d.mode == HybridStorage {
+		return GzipCompression
+	}
+	return NoCompression
+}
+
+// encodeBlob serializes the payload for blob storage, compressing it with c.
+func encodeBlob(payload map[string]interface{}, c Compression) ([]byte, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case GzipCompression:
+		buf := bytes.NewBuffer([]byte{blobHeader, 'g'})
+		w := gzip.NewWriter(buf)
+		if _, err = w.Write(b); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case SnappyCompression:
+		return append([]byte{blobHeader, 's'}, snappy.Encode(nil, b)...), nil
+	}
+	return b, nil
+}
+
+// decodeBlob deserializes a blob property into payload, decompressing it if
+// needed. Headerless gzip blobs written by earlier versions are detected using
+// the gzip magic number.
+func decodeBlob(b []byte, payload map[string]interface{}) error {
+	var err error
+	switch {
+	case len(b) > 1 && b[0] == blobHeader:
+		switch b[1] {
+		case 'g':
+			b, err = gunzip(b[2:])
+		case 's':
+			b, err = snappy.Decode(nil, b[2:])
+		default:
+			err = fmt.Errorf("unknown blob codec %q", b[1])
+		}
+	case len(b) > 1 && b[0] == 0x1f && b[1] == 0x8b:
+		b, err = gunzip(b)
+	}
+	if err != nil {
+		return err
+	}
+	var p map[string]interface{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	for k, v := range p {
+		payload[k] = v
+	}
+	return nil
+}
+
+func gunzip(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,33 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBlobRoundTrip(t *testing.T) {
+	payload := map[string]interface{}{
+		"name": "John",
+		"tags": []interface{}{"a", "b"},
+		"meta": map[string]interface{}{"age": 42.0},
+	}
+	for _, c := range []Compression{NoCompression, GzipCompression, SnappyCompression} {
+		b, err := encodeBlob(payload, c)
+		if err != nil {
+			t.Fatalf("compression %d: encode: %v", c, err)
+		}
+		got := map[string]interface{}{}
+		if err = decodeBlob(b, got); err != nil {
+			t.Fatalf("compression %d: decode: %v", c, err)
+		}
+		if !reflect.DeepEqual(got, payload) {
+			t.Errorf("compression %d: got %v, want %v", c, got, payload)
+		}
+	}
+}
+
+func TestDecodeBlobUnknownCodec(t *testing.T) {
+	if err := decodeBlob([]byte{blobHeader, 'x', '{', '}'}, map[string]interface{}{}); err == nil {
+		t.Error("expected an error")
+	}
+}
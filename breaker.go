@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/rest-layer/rest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrUnavailable is returned without calling Datastore while the circuit
+// breaker of the handler is open.
+type ErrUnavailable struct {
+	// Kind of the handler.
+	Kind string
+	// Until is the time the breaker lets a call through again.
+	Until time.Time
+}
+
+// Error implements the error interface
+func (e *ErrUnavailable) Error() string {
+	return fmt.Sprintf("datastore unavailable for %s until %s", e.Kind, e.Until.Format(time.RFC3339))
+}
+
+// RESTError reports the outage as a 503 Service Unavailable.
+func (e *ErrUnavailable) RESTError() *rest.Error {
+	return &rest.Error{Code: http.StatusServiceUnavailable, Message: e.Error()}
+}
+
+// circuitBreaker counts the consecutive Datastore calls failing because of an
+// outage.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	// probing is set while the call testing a half open breaker runs.
+	probing bool
+}
+
+// SetCircuitBreaker makes the handler fail fast with an *ErrUnavailable after
+// failures consecutive Datastore calls failed with UNAVAILABLE or
+// DEADLINE_EXCEEDED, instead of piling up timeouts during an outage. After
+// cooldown, a single call is let through: the breaker closes if it succeeds
+// and opens for another cooldown otherwise. A failures lower than 1 disables
+// the breaker.
+func (d *Handler) SetCircuitBreaker(failures int, cooldown time.Duration) *Handler {
+	d.breaker = nil
+	if failures > 0 {
+		d.breaker = &circuitBreaker{threshold: failures, cooldown: cooldown}
+	}
+	return d
+}
+
+// allow returns an *ErrUnavailable if no call can be made at now.
+func (b *circuitBreaker) allow(kind string, now time.Time) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return &ErrUnavailable{Kind: kind, Until: b.openUntil}
+	}
+	b.probing = true
+	return nil
+}
+
+// record records the outcome of an allowed call.
+func (b *circuitBreaker) record(err error, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		b.failures++
+		if b.probing || b.failures >= b.threshold {
+			b.openUntil = now.Add(b.cooldown)
+		}
+	default:
+		b.failures = 0
+		b.openUntil = time.Time{}
+	}
+	b.probing = false
+}
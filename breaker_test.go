@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, cooldown: time.Minute}
+	now := time.Now()
+	outage := status.Error(codes.Unavailable, "down")
+	b.record(outage, now)
+	if err := b.allow("users", now); err != nil {
+		t.Fatalf("expected the breaker to be closed after one failure, got %v", err)
+	}
+	b.record(outage, now)
+	var unavailable *ErrUnavailable
+	if err := b.allow("users", now); !errors.As(err, &unavailable) {
+		t.Fatalf("expected the breaker to be open, got %v", err)
+	}
+	later := now.Add(2 * time.Minute)
+	if err := b.allow("users", later); err != nil {
+		t.Fatalf("expected a probe to be allowed after the cooldown, got %v", err)
+	}
+	if err := b.allow("users", later); err == nil {
+		t.Fatal("expected a single probe")
+	}
+	b.record(nil, later)
+	if err := b.allow("users", later); err != nil {
+		t.Errorf("expected the breaker to close after a successful probe, got %v", err)
+	}
+}
+
+func TestCircuitBreakerFixedClock(t *testing.T) {
+	ctx := context.Background()
+	down := status.Error(codes.Unavailable, "down")
+	fixed := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := NewHandler(failingClient{err: down}, "", "users").
+		SetClock(func() time.Time { return fixed }).
+		SetRetryPolicy(nil).
+		SetCircuitBreaker(1, time.Millisecond)
+	if err := h.Check(ctx); err != down {
+		t.Fatalf("expected the outage error, got %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := h.Check(ctx); err != down {
+		t.Errorf("expected a probe once the cooldown elapsed despite the fixed clock, got %v", err)
+	}
+}
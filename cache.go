@@ -0,0 +1,378 @@
+package datastore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+const (
+	// cacheWindow is the observation period after which the cache policy is
+	// tuned.
+	cacheWindow = time.Minute
+	// minCacheTTL is the shortest TTL chosen by the cache policy.
+	minCacheTTL = time.Second
+	// minRepeatRatio is the share of repeated queries above which query
+	// results are cached.
+	minRepeatRatio = 0.2
+	// maxTrackedQueries bounds the number of distinct queries tracked per
+	// window to estimate the repeat ratio.
+	maxTrackedQueries = 10000
+)
+
+// CacheDeletePolicy defines whether cached Find results may serve items which
+// were just deleted.
+type CacheDeletePolicy int
+
+const (
+	// InvalidateDeleted drops the cached item lookups of deleted items and
+	// all the cached query results as soon as the deletion commits. This is
+	// the default.
+	InvalidateDeleted CacheDeletePolicy = iota
+	// HideDeleted also remembers the deleted ids for the maximum TTL of the
+	// cache and filters them out of cached results, so the results of finds
+	// running concurrently with a deletion never serve the deleted items.
+	HideDeleted
+	// KeepDeleted only drops the item lookups of deleted items; cached query
+	// results may list them until they expire. It avoids flushing query
+	// results on kinds with frequent deletions.
+	KeepDeleted
+)
+
+// CacheStats exposes the activity and the current decisions of the adaptive
+// cache.
+type CacheStats struct {
+	// Hits and misses of single item lookups by id.
+	ItemHits, ItemMisses int64
+	// Hits and misses of the other queries.
+	QueryHits, QueryMisses int64
+	// Writes invalidating cached entries.
+	Writes int64
+	// Entries currently cached.
+	Entries int
+	// TTL currently given to cached items and query results.
+	ItemTTL, QueryTTL time.Duration
+	// CacheQueries is true when query results are cached, not only items.
+	CacheQueries bool
+}
+
+// CacheMetrics is implemented by the Metrics counting the activity of the
+// cache, such as *PrometheusMetrics and *OpenCensusMetrics.
+type CacheMetrics interface {
+	// ObserveCache records a cache event: hit, miss, admit or evict, of an
+	// entry, item for single item lookups and query for the others.
+	ObserveCache(kind, namespace, entry, event string)
+}
+
+// cacheEntry is a cached Find result.
+type cacheEntry struct {
+	list    *resource.ItemList
+	expires time.Time
+	// id of the looked up item, empty for query results.
+	id string
+}
+
+// adaptiveCache caches Find results in memory and tunes its policy from the
+// hit rates and write churn it observes.
+type adaptiveCache struct {
+	mu      sync.Mutex
+	size    int
+	maxTTL  time.Duration
+	entries map[string]cacheEntry
+	stats   CacheStats
+	// Activity of the current observation window.
+	windowStart time.Time
+	writes      int64
+	queries     int64
+	repeats     int64
+	seen        map[string]bool
+	// Recently deleted ids hidden from cached results, with the time until
+	// which they are hidden.
+	deleted map[string]time.Time
+}
+
+// SetCache enables an in-memory cache of at most size Find results whose
+// policy adapts to the access pattern of the kind. Every minute, the TTL of
+// cached entries is set to the average interval between writes observed on
+// the kind, up to maxTTL, and query results are cached in addition to single
+// items only when queries repeat often enough to be worth it. The decisions
+// are exposed by CacheStats, and the hits, misses, admissions and evictions
+// are reported to the metrics implementing CacheMetrics.
+//
+// Writes made through the handler invalidate the cached entries, but writes
+// made by other processes are only seen once the entries expire. A size of 0
+// disables the cache.
+func (d *Handler) SetCache(size int, maxTTL time.Duration) *Handler {
+	d.cache = nil
+	if size > 0 {
+		d.cache = &adaptiveCache{
+			size:    size,
+			maxTTL:  maxTTL,
+			entries: map[string]cacheEntry{},
+			seen:    map[string]bool{},
+			deleted: map[string]time.Time{},
+			stats:   CacheStats{ItemTTL: maxTTL, QueryTTL: maxTTL / 2},
+		}
+	}
+	return d
+}
+
+// SetCacheDeletePolicy sets how the cache handles the items deleted by
+// Delete, Clear and Reap.
+func (d *Handler) SetCacheDeletePolicy(policy CacheDeletePolicy) *Handler {
+	d.cacheDeletes = policy
+	return d
+}
+
+// CacheStats returns the statistics and current decisions of the cache.
+func (d *Handler) CacheStats() CacheStats {
+	if d.cache == nil {
+		return CacheStats{}
+	}
+	c := d.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.entries)
+	return s
+}
+
+// cacheKey returns the cache key of the Find query q in ctx, the id of the
+// looked up item if q is a single item lookup, and whether q can be cached.
+func (d *Handler) cacheKey(ctx context.Context, q *query.Query) (string, string, bool) {
+	if d.cache == nil {
+		return "", "", false
+	}
+	key, ok := d.findKey(ctx, q)
+	if !ok {
+		return "", "", false
+	}
+	if len(q.Predicate) == 1 && q.Window == nil {
+		if e, ok := q.Predicate[0].(*query.Equal); ok && e.Field == "id" {
+			if id, ok := e.Value.(string); ok {
+				return key, id, true
+			}
+		}
+	}
+	return key, "", true
+}
+
+// cached returns a copy of the cached result for key, the lookup of the item
+// with id if not empty.
+func (d *Handler) cached(ctx context.Context, key, id string) (*resource.ItemList, bool) {
+	c := d.cache
+	item := id != ""
+	now := d.now()
+	event := "miss"
+	// Reported once the lock is released
+	defer func() { d.observeCache(ctx, id, event) }()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d.tuneCache(now)
+	if !item {
+		c.queries++
+		if c.seen[key] {
+			c.repeats++
+		} else if len(c.seen) < maxTrackedQueries {
+			c.seen[key] = true
+		}
+	}
+	e, found := c.entries[key]
+	if found && !now.Before(e.expires) {
+		delete(c.entries, key)
+		found = false
+	}
+	switch {
+	case item && found:
+		c.stats.ItemHits++
+	case item:
+		c.stats.ItemMisses++
+	case found:
+		c.stats.QueryHits++
+	default:
+		c.stats.QueryMisses++
+	}
+	if !found {
+		return nil, false
+	}
+	event = "hit"
+	return d.hideDeleted(copyList(e.list), now), true
+}
+
+// storeCache caches a copy of list under key, if the policy allows it.
+func (d *Handler) storeCache(ctx context.Context, key, id string, list *resource.ItemList) {
+	c := d.cache
+	now := d.now()
+	// Events of the entries of the given ids, reported once the lock is
+	// released
+	var events [][2]string
+	defer func() {
+		for _, e := range events {
+			d.observeCache(ctx, e[0], e[1])
+		}
+	}()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ttl := c.stats.ItemTTL
+	if id == "" {
+		if !c.stats.CacheQueries {
+			return
+		}
+		ttl = c.stats.QueryTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	if _, found := c.entries[key]; !found && len(c.entries) >= c.size {
+		// Evict an arbitrary entry
+		for k, e := range c.entries {
+			delete(c.entries, k)
+			events = append(events, [2]string{e.id, "evict"})
+			break
+		}
+	}
+	c.entries[key] = cacheEntry{list: d.hideDeleted(copyList(list), now), expires: now.Add(ttl), id: id}
+	events = append(events, [2]string{id, "admit"})
+}
+
+// observeCache reports a cache event of the lookup of the item with id, or of
+// a query result if id is empty, to the metrics implementing CacheMetrics.
+func (d *Handler) observeCache(ctx context.Context, id, event string) {
+	cm, ok := d.metrics.(CacheMetrics)
+	if !ok {
+		return
+	}
+	entry := "item"
+	if id == "" {
+		entry = "query"
+	}
+	cm.ObserveCache(d.entity, d.getNamespace(ctx), entry, event)
+}
+
+// invalidateDeleted drops the cached entries holding the deleted items with
+// ids following the delete policy.
+func (d *Handler) invalidateDeleted(ids []string) {
+	if d.cache == nil {
+		return
+	}
+	if d.cacheDeletes != KeepDeleted {
+		d.invalidateCache(ids)
+		if d.cacheDeletes == HideDeleted {
+			c := d.cache
+			until := d.now().Add(c.maxTTL)
+			c.mu.Lock()
+			for _, id := range ids {
+				c.deleted[id] = until
+			}
+			c.mu.Unlock()
+		}
+		return
+	}
+	c := d.cache
+	items := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		items[id] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes++
+	c.stats.Writes++
+	for k, e := range c.entries {
+		if items[e.id] {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// hideDeleted removes the recently deleted items from list. It must be
+// called with the cache lock held.
+func (d *Handler) hideDeleted(list *resource.ItemList, now time.Time) *resource.ItemList {
+	c := d.cache
+	if len(c.deleted) == 0 {
+		return list
+	}
+	items := list.Items[:0]
+	for _, item := range list.Items {
+		id, _ := item.ID.(string)
+		if until, found := c.deleted[id]; found && now.Before(until) {
+			continue
+		}
+		items = append(items, item)
+	}
+	list.Items = items
+	return list
+}
+
+// invalidateCache drops the cached query results and the cached items with
+// the given ids, or all the cached items when ids is nil.
+func (d *Handler) invalidateCache(ids []string) {
+	c := d.cache
+	if c == nil {
+		return
+	}
+	items := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		items[id] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes++
+	c.stats.Writes++
+	for _, id := range ids {
+		// The id may be written again after a deletion
+		delete(c.deleted, id)
+	}
+	for k, e := range c.entries {
+		if e.id == "" || ids == nil || items[e.id] {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// tuneCache updates the cache policy at the end of each observation window.
+// It must be called with the cache lock held.
+func (d *Handler) tuneCache(now time.Time) {
+	c := d.cache
+	if c.windowStart.IsZero() {
+		c.windowStart = now
+		return
+	}
+	elapsed := now.Sub(c.windowStart)
+	if elapsed < cacheWindow {
+		return
+	}
+	c.stats.ItemTTL, c.stats.QueryTTL, c.stats.CacheQueries = cachePolicy(elapsed, c.writes, c.queries, c.repeats, c.maxTTL)
+	c.windowStart = now
+	c.writes, c.queries, c.repeats = 0, 0, 0
+	c.seen = map[string]bool{}
+	for id, until := range c.deleted {
+		if !now.Before(until) {
+			delete(c.deleted, id)
+		}
+	}
+}
+
+// cachePolicy returns the item and query TTLs and whether to cache query
+// results, given the writes, queries and repeated queries observed during
+// elapsed. Entries live for the average interval between writes, as they
+// are likely stale after that for the other processes; query results half
+// as long as any write invalidates them.
+func cachePolicy(elapsed time.Duration, writes, queries, repeats int64, maxTTL time.Duration) (time.Duration, time.Duration, bool) {
+	ttl := maxTTL
+	if writes > 0 {
+		ttl = elapsed / time.Duration(writes)
+		if ttl < minCacheTTL {
+			ttl = minCacheTTL
+		}
+		if ttl > maxTTL {
+			ttl = maxTTL
+		}
+	}
+	cacheQueries := queries > 0 &&
+		float64(repeats)/float64(queries) >= minRepeatRatio &&
+		writes < queries
+	return ttl, ttl / 2, cacheQueries
+}
@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+)
+
+func TestCachePolicy(t *testing.T) {
+	tests := []struct {
+		writes, queries, repeats int64
+		ttl                      time.Duration
+		cacheQueries             bool
+	}{
+		{0, 100, 50, 10 * time.Minute, true},
+		{6, 100, 10, 10 * time.Second, false},
+		{6000, 100, 90, minCacheTTL, false},
+		{0, 0, 0, 10 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		ttl, qttl, cq := cachePolicy(time.Minute, tt.writes, tt.queries, tt.repeats, 10*time.Minute)
+		if ttl != tt.ttl || qttl != tt.ttl/2 || cq != tt.cacheQueries {
+			t.Errorf("cachePolicy(%d, %d, %d) = %v, %v, %v", tt.writes, tt.queries, tt.repeats, ttl, qttl, cq)
+		}
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := NewHandler(nil, "", "items").
+		SetClock(func() time.Time { return now }).
+		SetCache(10, time.Minute)
+	ctx := context.Background()
+	list := &resource.ItemList{Items: []*resource.Item{{ID: "a", Payload: map[string]interface{}{"id": "a"}}}}
+	if _, found := h.cached(ctx, "k", "a"); found {
+		t.Fatal("unexpected hit")
+	}
+	h.storeCache(ctx, "k", "a", list)
+	h.storeCache(ctx, "q", "", list)
+	got, found := h.cached(ctx, "k", "a")
+	if !found || got.Items[0].ID != "a" {
+		t.Fatalf("expected a hit, got %v", got)
+	}
+	got.Items[0].Payload["id"] = "changed"
+	if got, _ := h.cached(ctx, "k", "a"); got.Items[0].Payload["id"] != "a" {
+		t.Error("cached item was modified through a copy")
+	}
+	h.invalidateCache([]string{"b"})
+	if _, found := h.cached(ctx, "k", "a"); !found {
+		t.Error("unrelated write invalidated the item")
+	}
+	h.invalidateCache([]string{"a"})
+	if _, found := h.cached(ctx, "k", "a"); found {
+		t.Error("write did not invalidate the item")
+	}
+	now = now.Add(2 * time.Minute)
+	h.storeCache(ctx, "k", "a", list)
+	now = now.Add(2 * time.Minute)
+	if _, found := h.cached(ctx, "k", "a"); found {
+		t.Error("expired item was returned")
+	}
+	s := h.CacheStats()
+	if s.ItemHits != 3 || s.Writes != 2 || s.CacheQueries {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestCacheDeletePolicy(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	list := func() *resource.ItemList {
+		return &resource.ItemList{Items: []*resource.Item{{ID: "a", Payload: map[string]interface{}{"id": "a"}}}}
+	}
+	h := NewHandler(nil, "", "items").
+		SetClock(func() time.Time { return now }).
+		SetCache(10, time.Minute).
+		SetCacheDeletePolicy(HideDeleted)
+	ctx := context.Background()
+	h.invalidateDeleted([]string{"a"})
+	// A find started before the deletion stores its result afterwards
+	h.storeCache(ctx, "k", "a", list())
+	if got, found := h.cached(ctx, "k", "a"); !found || len(got.Items) != 0 {
+		t.Errorf("expected the deleted item to be hidden, got %v", got)
+	}
+	h.invalidateCache([]string{"a"})
+	h.storeCache(ctx, "k", "a", list())
+	if got, _ := h.cached(ctx, "k", "a"); len(got.Items) != 1 {
+		t.Errorf("expected the inserted item to be visible again, got %v", got)
+	}
+
+	h.SetCacheDeletePolicy(KeepDeleted)
+	h.cache.stats.CacheQueries = true
+	h.storeCache(ctx, "q", "", list())
+	h.invalidateDeleted([]string{"a"})
+	if _, found := h.cached(ctx, "q", ""); !found {
+		t.Error("expected query results to be kept")
+	}
+	if _, found := h.cached(ctx, "k", "a"); found {
+		t.Error("expected the item lookup to be dropped")
+	}
+}
+
+type cacheMetrics struct {
+	Metrics
+	events []string
+}
+
+func (m *cacheMetrics) ObserveCache(kind, namespace, entry, event string) {
+	m.events = append(m.events, entry+" "+event)
+}
+
+func TestCacheMetrics(t *testing.T) {
+	m := &cacheMetrics{}
+	h := NewHandler(nil, "", "items").SetCache(1, time.Minute).SetMetrics(m)
+	h.cache.stats.CacheQueries = true
+	ctx := context.Background()
+	list := &resource.ItemList{Items: []*resource.Item{{ID: "a", Payload: map[string]interface{}{"id": "a"}}}}
+	h.cached(ctx, "k", "a")
+	h.storeCache(ctx, "k", "a", list)
+	h.cached(ctx, "k", "a")
+	// The cache holds a single entry
+	h.storeCache(ctx, "q", "", list)
+	h.cached(ctx, "q", "")
+	want := []string{"item miss", "item admit", "item hit", "item evict", "query admit", "query hit"}
+	if !reflect.DeepEqual(m.events, want) {
+		t.Errorf("got events %v, want %v", m.events, want)
+	}
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+// SetCascadeDelete makes Delete, Clear and Reap also delete the descendants
+// of the deleted entities, the entities of any kind whose key has them as
+// ancestor, such as sub-resources stored with ancestor keys. Descendants are
+// found with a kindless ancestor query and deleted in batched transactions
+// after their parent; the revisions of the history kind are kept. Failures to
+// delete descendants don't fail the deletion, they are reported with
+// SetCleanupErrorHandler.
+func (d *Handler) SetCascadeDelete(enabled bool) *Handler {
+	d.cascadeDelete = enabled
+	return d
+}
+
+// SetCleanupErrorHandler sets the function receiving the errors of the
+// cleanups run once a deletion is committed, the cascade delete of the
+// descendants and the nullification of the references. The deletion has
+// succeeded when they run, so their errors never fail the request; they are
+// also logged with the debug logger.
+func (d *Handler) SetCleanupErrorHandler(onError func(error)) *Handler {
+	d.cleanupError = onError
+	return d
+}
+
+// cleanupFailed reports the error of a cleanup following a deletion.
+func (d *Handler) cleanupFailed(ctx context.Context, err error) {
+	if d.logger != nil {
+		d.logger.Debug(ctx, "datastore delete cleanup failed", map[string]interface{}{
+			"kind":  d.entity,
+			"error": err.Error(),
+		})
+	}
+	if d.cleanupError != nil {
+		d.cleanupError(err)
+	}
+}
+
+// deleteDescendants deletes the descendants of the given keys.
+func (d *Handler) deleteDescendants(ctx context.Context, keys []*datastore.Key) error {
+	if !d.cascadeDelete {
+		return nil
+	}
+	for _, key := range keys {
+		qry := datastore.NewQuery("").
+			Namespace(key.Namespace).
+			Ancestor(key).
+			KeysOnly()
+		var descendants []*datastore.Key
+		err := StreamKeys(ctx, d.client, qry, func(k *datastore.Key) error {
+			if !k.Equal(key) && k.Kind != d.historyKind {
+				descendants = append(descendants, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for len(descendants) > 0 {
+			n := len(descendants)
+			if n > MaxMutations {
+				n = MaxMutations
+			}
+			batch := descendants[:n]
+			err := d.runTx(ctx, func(tx Transaction) error {
+				return tx.DeleteMulti(batch)
+			})
+			if err != nil {
+				return err
+			}
+			descendants = descendants[n:]
+		}
+	}
+	return nil
+}
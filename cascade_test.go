@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"google.golang.org/api/iterator"
+)
+
+// ancestorClient answers queries like a kindless keys-only query on
+// ancestor.
+type ancestorClient struct {
+	*mockClient
+	ancestor *datastore.Key
+}
+
+func (c ancestorClient) Run(ctx context.Context, q *datastore.Query) Iterator {
+	var keys []*datastore.Key
+	for _, key := range c.keys {
+		if _, found := c.entities[key.String()]; !found {
+			continue
+		}
+		for k := key; k != nil; k = k.Parent {
+			if k.Equal(c.ancestor) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return &keysIterator{keys: keys}
+}
+
+type keysIterator struct {
+	keys []*datastore.Key
+}
+
+func (it *keysIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if len(it.keys) == 0 {
+		return nil, iterator.Done
+	}
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	return key, nil
+}
+
+func (it *keysIterator) Cursor() (datastore.Cursor, error) {
+	return datastore.Cursor{}, nil
+}
+
+func TestCascadeDelete(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		c := &mockClient{entities: map[string]datastore.PropertyList{}}
+		user := datastore.NameKey("users", "1", nil)
+		c.put(user, datastore.PropertyList{
+			{Name: "_id", Value: "1"},
+			{Name: "_etag", Value: "etag1"},
+		})
+		comment := datastore.NameKey("comments", "c", user)
+		reply := datastore.NameKey("replies", "r", comment)
+		revision := datastore.NameKey("users_history", "v1", user)
+		other := datastore.NameKey("comments", "c", datastore.NameKey("users", "2", nil))
+		for _, key := range []*datastore.Key{comment, reply, revision, other} {
+			c.put(key, datastore.PropertyList{})
+		}
+		h := NewHandler(ancestorClient{c, user}, "", "users").
+			SetHistory("users_history").
+			SetCascadeDelete(enabled)
+		if err := h.Delete(context.Background(), &resource.Item{ID: "1", ETag: "etag1"}); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []*datastore.Key{comment, reply} {
+			if _, found := c.entities[key.String()]; found == enabled {
+				t.Errorf("cascade %v: unexpected descendant %v found %v", enabled, key, found)
+			}
+		}
+		for _, key := range []*datastore.Key{revision, other} {
+			if _, found := c.entities[key.String()]; !found {
+				t.Errorf("cascade %v: expected %v to be kept", enabled, key)
+			}
+		}
+	}
+}
+
+func TestCascadeDeleteError(t *testing.T) {
+	unavailable := errors.New("unavailable")
+	var reported []error
+	h := NewHandler(failingClient{err: unavailable}, "", "users").
+		SetCascadeDelete(true).
+		SetCleanupErrorHandler(func(err error) { reported = append(reported, err) })
+	err := h.deleteDescendants(context.Background(), []*datastore.Key{datastore.NameKey("users", "1", nil)})
+	if err != unavailable {
+		t.Errorf("expected the query error, got %v", err)
+	}
+	h.cleanupFailed(context.Background(), err)
+	if len(reported) != 1 || reported[0] != unavailable {
+		t.Errorf("expected the error to be reported, got %v", reported)
+	}
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Change operations.
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// Change records a mutation of an item.
+type Change struct {
+	ID string `datastore:"_id"`
+	// Op is one of ChangeInsert, ChangeUpdate or ChangeDelete.
+	Op string `datastore:"_op"`
+	// ETagBefore is the etag of the item before the mutation, empty for
+	// insertions and for deletions done by Clear or Reap.
+	ETagBefore string `datastore:"_etag_before,noindex"`
+	// ETagAfter is the etag of the item after the mutation, empty for
+	// deletions.
+	ETagAfter string `datastore:"_etag_after,noindex"`
+	// Updated is the time of the mutation.
+	Updated time.Time `datastore:"_updated"`
+}
+
+// SetChanges enables change data capture: every mutation done by the handler
+// is recorded as a Change entity of kind, in the same transaction. The kind
+// defaults to the handler kind suffixed with "_changes".
+func (d *Handler) SetChanges(kind string) *Handler {
+	if kind == "" {
+		kind = d.entity + "_changes"
+	}
+	d.changesKind = kind
+	return d
+}
+
+// changeMutation returns the mutation recording op on the item with key, or
+// nil if change data capture is disabled.
+func (d *Handler) changeMutation(key *datastore.Key, op, before, after string) *datastore.Mutation {
+	if d.changesKind == "" {
+		return nil
+	}
+	ckey := datastore.IncompleteKey(d.changesKind, nil)
+	ckey.Namespace = key.Namespace
+	return datastore.NewInsert(ckey, &Change{
+		ID:         key.Name,
+		Op:         op,
+		ETagBefore: before,
+		ETagAfter:  after,
+		Updated:    d.now(),
+	})
+}
+
+// recordMutations returns the mutations recording op on the item with key, to
+// be committed along with the mutation of the item.
+func (d *Handler) recordMutations(key *datastore.Key, op, before, after string) []*datastore.Mutation {
+	var muts []*datastore.Mutation
+	if m := d.changeMutation(key, op, before, after); m != nil {
+		muts = append(muts, m)
+	}
+	etag := after
+	if op == ChangeDelete {
+		etag = before
+	}
+	if m := d.outboxMutation(key, op, etag); m != nil {
+		muts = append(muts, m)
+	}
+	return muts
+}
+
+// recordsPerWrite returns the number of record mutations written along with
+// each mutation of an item.
+func (d *Handler) recordsPerWrite() int {
+	n := 0
+	if d.changesKind != "" {
+		n++
+	}
+	if d.outboxTx {
+		n++
+	}
+	return n
+}
+
+// Changes lists at most limit changes recorded after since, oldest first. A
+// negative limit means no limit.
+func (d *Handler) Changes(ctx context.Context, since time.Time, limit int) ([]*Change, error) {
+	if d.changesKind == "" {
+		return nil, nil
+	}
+	qry := datastore.NewQuery(d.changesKind).
+		Namespace(d.getNamespace(ctx)).
+		Filter("_updated >", since).
+		Order("_updated").
+		Limit(limit)
+	var changes []*Change
+	for t := d.client.Run(ctx, qry); ; {
+		var c Change
+		_, err := t.Next(&c)
+		if err == iterator.Done {
+			return changes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, &c)
+	}
+}
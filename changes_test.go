@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// changesClient answers queries with changes, as if they matched.
+type changesClient struct {
+	Client
+	changes []Change
+}
+
+func (c changesClient) Run(ctx context.Context, q *datastore.Query) Iterator {
+	return &changesIterator{changes: c.changes}
+}
+
+type changesIterator struct {
+	changes []Change
+}
+
+func (it *changesIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if len(it.changes) == 0 {
+		return nil, iterator.Done
+	}
+	props, err := datastore.SaveStruct(&it.changes[0])
+	if err != nil {
+		return nil, err
+	}
+	it.changes = it.changes[1:]
+	return datastore.IncompleteKey("users_changes", nil), datastore.LoadStruct(dst, props)
+}
+
+func (it *changesIterator) Cursor() (datastore.Cursor, error) {
+	return datastore.Cursor{}, nil
+}
+
+func TestChanges(t *testing.T) {
+	now := time.Now().Truncate(time.Microsecond)
+	c := changesClient{changes: []Change{
+		{ID: "1", Op: ChangeInsert, ETagAfter: "a", Updated: now},
+		{ID: "1", Op: ChangeUpdate, ETagBefore: "a", ETagAfter: "b", Updated: now.Add(time.Second)},
+		{ID: "1", Op: ChangeDelete, ETagBefore: "b", Updated: now.Add(2 * time.Second)},
+	}}
+	h := NewHandler(c, "", "users")
+	ctx := context.Background()
+	if changes, err := h.Changes(ctx, time.Time{}, -1); changes != nil || err != nil {
+		t.Errorf("expected no changes when disabled, got %v, %v", changes, err)
+	}
+	h.SetChanges("")
+	if h.changesKind != "users_changes" {
+		t.Errorf("expected the default changes kind, got %q", h.changesKind)
+	}
+	changes, err := h.Changes(ctx, time.Time{}, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %v", changes)
+	}
+	for i, want := range c.changes {
+		if *changes[i] != want {
+			t.Errorf("change %d: got %+v, want %+v", i, changes[i], want)
+		}
+	}
+	unavailable := errors.New("unavailable")
+	h = NewHandler(failingClient{err: unavailable}, "", "users").SetChanges("")
+	if _, err = h.Changes(ctx, now, 10); err != unavailable {
+		t.Errorf("expected the query error, got %v", err)
+	}
+}
+
+func TestRecordMutations(t *testing.T) {
+	key := datastore.NameKey("users", "1", nil)
+	h := NewHandler(nil, "", "users")
+	if muts := h.recordMutations(key, ChangeUpdate, "a", "b"); len(muts) != 0 || h.recordsPerWrite() != 0 {
+		t.Errorf("expected no records when disabled, got %v", muts)
+	}
+	h.SetChanges("")
+	if muts := h.recordMutations(key, ChangeUpdate, "a", "b"); len(muts) != 1 || h.recordsPerWrite() != 1 {
+		t.Errorf("expected a change record, got %v", muts)
+	}
+	h.SetOutbox("")
+	if muts := h.recordMutations(key, ChangeDelete, "b", ""); len(muts) != 2 || h.recordsPerWrite() != 2 {
+		t.Errorf("expected a change record and an outbox event, got %v", muts)
+	}
+}
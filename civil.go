@@ -0,0 +1,190 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"cloud.google.com/go/civil"
+	"github.com/rs/rest-layer/schema"
+)
+
+// Date validates date-only values such as birthdays or deadlines. Values are
+// accepted as "2006-01-02" strings, YYYYMMDD integers, civil.Date or
+// time.Time, and stored in a single representation which sorts like the
+// dates, so range filters compare dates with dates. The same conversion is
+// applied to query values. Dates are serialized as "2006-01-02" strings.
+type Date struct {
+	// AsInt stores dates as YYYYMMDD integers instead of strings.
+	AsInt bool
+	// Location is the time zone in which the date of time.Time values is
+	// taken, UTC if nil.
+	Location *time.Location
+}
+
+var errInvalidDate = errors.New("not a valid date")
+
+// Validate implements the schema.FieldValidator interface
+func (v Date) Validate(value interface{}) (interface{}, error) {
+	d, err := v.parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if v.AsInt {
+		return int64(d.Year*10000 + int(d.Month)*100 + d.Day), nil
+	}
+	return d.String(), nil
+}
+
+// ValidateQuery implements the schema.FieldQueryValidator interface
+func (v Date) ValidateQuery(value interface{}) (interface{}, error) {
+	return v.Validate(value)
+}
+
+// Serialize implements the schema.FieldSerializer interface
+func (v Date) Serialize(value interface{}) (interface{}, error) {
+	d, err := v.parse(value)
+	if err != nil {
+		return nil, err
+	}
+	return d.String(), nil
+}
+
+// LessFunc implements the schema.FieldComparator interface
+func (v Date) LessFunc() schema.LessFunc {
+	return func(value, other interface{}) bool {
+		d, err1 := v.parse(value)
+		o, err2 := v.parse(other)
+		return err1 == nil && err2 == nil && d.Before(o)
+	}
+}
+
+func (v Date) parse(value interface{}) (civil.Date, error) {
+	switch t := value.(type) {
+	case civil.Date:
+		if t.IsValid() {
+			return t, nil
+		}
+	case string:
+		return civil.ParseDate(t)
+	case time.Time:
+		return civil.DateOf(t.In(location(v.Location))), nil
+	default:
+		if n, ok := wholeNumber(value); ok {
+			d := civil.Date{Year: int(n / 10000), Month: time.Month(n / 100 % 100), Day: int(n % 100)}
+			if d.IsValid() {
+				return d, nil
+			}
+		}
+	}
+	return civil.Date{}, errInvalidDate
+}
+
+// TimeOfDay validates time-only values such as opening hours, with a second
+// precision. Values are accepted as "15:04:05" strings, numbers of seconds
+// since midnight, civil.Time or time.Time, and stored in a single
+// representation which sorts like the times of day. The same conversion is
+// applied to query values. Times are serialized as "15:04:05" strings.
+type TimeOfDay struct {
+	// AsInt stores times as a number of seconds since midnight instead of
+	// strings.
+	AsInt bool
+	// Location is the time zone in which the time of day of time.Time values
+	// is taken, UTC if nil.
+	Location *time.Location
+}
+
+var errInvalidTimeOfDay = errors.New("not a valid time of day")
+
+// Validate implements the schema.FieldValidator interface
+func (v TimeOfDay) Validate(value interface{}) (interface{}, error) {
+	t, err := v.parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if v.AsInt {
+		return int64(t.Hour*3600 + t.Minute*60 + t.Second), nil
+	}
+	return formatTimeOfDay(t), nil
+}
+
+// ValidateQuery implements the schema.FieldQueryValidator interface
+func (v TimeOfDay) ValidateQuery(value interface{}) (interface{}, error) {
+	return v.Validate(value)
+}
+
+// Serialize implements the schema.FieldSerializer interface
+func (v TimeOfDay) Serialize(value interface{}) (interface{}, error) {
+	t, err := v.parse(value)
+	if err != nil {
+		return nil, err
+	}
+	return formatTimeOfDay(t), nil
+}
+
+// LessFunc implements the schema.FieldComparator interface
+func (v TimeOfDay) LessFunc() schema.LessFunc {
+	return func(value, other interface{}) bool {
+		t, err1 := v.parse(value)
+		o, err2 := v.parse(other)
+		return err1 == nil && err2 == nil && formatTimeOfDay(t) < formatTimeOfDay(o)
+	}
+}
+
+func (v TimeOfDay) parse(value interface{}) (civil.Time, error) {
+	var t civil.Time
+	switch tv := value.(type) {
+	case civil.Time:
+		t = tv
+	case string:
+		var err error
+		if t, err = civil.ParseTime(tv); err != nil {
+			return t, err
+		}
+	case time.Time:
+		t = civil.TimeOf(tv.In(location(v.Location)))
+	default:
+		n, ok := wholeNumber(value)
+		if !ok || n < 0 || n >= 86400 {
+			return t, errInvalidTimeOfDay
+		}
+		t = civil.Time{Hour: int(n / 3600), Minute: int(n / 60 % 60), Second: int(n % 60)}
+	}
+	if !t.IsValid() {
+		return t, errInvalidTimeOfDay
+	}
+	t.Nanosecond = 0
+	return t, nil
+}
+
+// formatTimeOfDay formats t with a fixed width so string values sort in time
+// order.
+func formatTimeOfDay(t civil.Time) string {
+	return fmt.Sprintf("%02d:%02d:%02d", t.Hour, t.Minute, t.Second)
+}
+
+func location(loc *time.Location) *time.Location {
+	if loc == nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// wholeNumber converts integer values, including whole floats decoded from
+// JSON, to int64.
+func wholeNumber(value interface{}) (int64, bool) {
+	switch n := value.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
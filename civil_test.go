@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/civil"
+)
+
+func TestDateValidate(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	late := time.Date(2017, time.March, 14, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		v     Date
+		value interface{}
+		want  interface{}
+	}{
+		{Date{}, "2017-03-15", "2017-03-15"},
+		{Date{}, float64(20170315), "2017-03-15"},
+		{Date{}, civil.Date{Year: 2017, Month: time.March, Day: 15}, "2017-03-15"},
+		{Date{}, late, "2017-03-14"},
+		{Date{Location: paris}, late, "2017-03-15"},
+		{Date{AsInt: true}, "2017-03-15", int64(20170315)},
+		{Date{AsInt: true}, int64(20170315), int64(20170315)},
+	}
+	for _, tt := range tests {
+		got, err := tt.v.Validate(tt.value)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%v: got %#v, want %#v", tt.value, got, tt.want)
+		}
+	}
+	for _, value := range []interface{}{"2017-02-30", "15/03/2017", 20171315, 2017.5, true} {
+		if _, err := (Date{}).Validate(value); err == nil {
+			t.Errorf("%v: expected an error", value)
+		}
+	}
+}
+
+func TestDateSerialize(t *testing.T) {
+	got, err := Date{AsInt: true}.Serialize(int64(20170315))
+	if err != nil || got != "2017-03-15" {
+		t.Errorf("got %v, %v", got, err)
+	}
+	less := Date{AsInt: true}.LessFunc()
+	if !less(int64(20170315), int64(20170401)) || less(int64(20170401), int64(20170315)) {
+		t.Error("unexpected order")
+	}
+}
+
+func TestTimeOfDayValidate(t *testing.T) {
+	tests := []struct {
+		v     TimeOfDay
+		value interface{}
+		want  interface{}
+	}{
+		{TimeOfDay{}, "09:05:00", "09:05:00"},
+		{TimeOfDay{}, "09:05:00.250", "09:05:00"},
+		{TimeOfDay{}, float64(32700), "09:05:00"},
+		{TimeOfDay{}, time.Date(2017, time.March, 14, 9, 5, 0, 0, time.UTC), "09:05:00"},
+		{TimeOfDay{AsInt: true}, "09:05:00", int64(32700)},
+	}
+	for _, tt := range tests {
+		got, err := tt.v.Validate(tt.value)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%v: got %#v, want %#v", tt.value, got, tt.want)
+		}
+	}
+	for _, value := range []interface{}{"25:00:00", "9h", 86400, -1} {
+		if _, err := (TimeOfDay{}).Validate(value); err == nil {
+			t.Errorf("%v: expected an error", value)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Client is the subset of the methods of *datastore.Client used by the
+// handler, so tests can inject mocks and services can wrap the client with
+// instrumentation or compatibility shims. Queries and transactions go through
+// the Iterator and Transaction interfaces, as their *datastore types can't be
+// built without a real client. WrapClient adapts a *datastore.Client.
+type Client interface {
+	Get(ctx context.Context, key *datastore.Key, dst interface{}) error
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error
+	GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error)
+	Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+	PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+	Delete(ctx context.Context, key *datastore.Key) error
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+	Mutate(ctx context.Context, muts ...*datastore.Mutation) ([]*datastore.Key, error)
+	Run(ctx context.Context, q *datastore.Query) Iterator
+	RunAggregationQuery(ctx context.Context, aq *datastore.AggregationQuery) (datastore.AggregationResult, error)
+	RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts ...datastore.TransactionOption) (*datastore.Commit, error)
+	Close() error
+}
+
+// Iterator is the result of a query run by a Client. *datastore.Iterator
+// implements it.
+type Iterator interface {
+	Next(dst interface{}) (*datastore.Key, error)
+	Cursor() (datastore.Cursor, error)
+}
+
+// Transaction is the subset of the methods of *datastore.Transaction used by
+// the handler. *datastore.Transaction implements it.
+type Transaction interface {
+	Get(key *datastore.Key, dst interface{}) error
+	GetMulti(keys []*datastore.Key, dst interface{}) error
+	Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error)
+	PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error)
+	Delete(key *datastore.Key) error
+	DeleteMulti(keys []*datastore.Key) error
+	Mutate(muts ...*datastore.Mutation) ([]*datastore.PendingKey, error)
+}
+
+var (
+	_ Iterator    = (*datastore.Iterator)(nil)
+	_ Transaction = (*datastore.Transaction)(nil)
+)
+
+// WrapClient returns the Client running queries and transactions with c.
+func WrapClient(c *datastore.Client) Client {
+	return datastoreClient{c}
+}
+
+// datastoreClient adapts *datastore.Client to Client.
+type datastoreClient struct {
+	*datastore.Client
+}
+
+// Run implements Client.
+func (c datastoreClient) Run(ctx context.Context, q *datastore.Query) Iterator {
+	return c.Client.Run(ctx, q)
+}
+
+// RunInTransaction implements Client.
+func (c datastoreClient) RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts ...datastore.TransactionOption) (*datastore.Commit, error) {
+	return c.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(tx)
+	}, opts...)
+}
+
+// sameClient tells if a and b wrap the same *datastore.Client, so their
+// queries can run in the transactions of each other.
+func sameClient(a, b Client) bool {
+	ca, ok := a.(datastoreClient)
+	cb, ok2 := b.(datastoreClient)
+	return ok && ok2 && ca.Client == cb.Client
+}
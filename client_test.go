@@ -0,0 +1,258 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"google.golang.org/api/iterator"
+)
+
+// mockClient stores entities in memory. Queries return every entity of their
+// kind, in key order.
+type mockClient struct {
+	Client
+	keys     []*datastore.Key
+	entities map[string]datastore.PropertyList
+}
+
+func (c *mockClient) put(key *datastore.Key, props datastore.PropertyList) {
+	if _, found := c.entities[key.String()]; !found {
+		c.keys = append(c.keys, key)
+	}
+	c.entities[key.String()] = props
+}
+
+func (c *mockClient) getMulti(keys []*datastore.Key, dst interface{}) error {
+	entities := dst.([]Entity)
+	var merr datastore.MultiError
+	for i, key := range keys {
+		props, found := c.entities[key.String()]
+		if !found {
+			if merr == nil {
+				merr = make(datastore.MultiError, len(keys))
+			}
+			merr[i] = datastore.ErrNoSuchEntity
+			continue
+		}
+		if err := entities[i].Load(props); err != nil {
+			return err
+		}
+	}
+	if merr != nil {
+		return merr
+	}
+	return nil
+}
+
+func (c *mockClient) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return c.getMulti(keys, dst)
+}
+
+func (c *mockClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	var keys []*datastore.Key
+	for _, key := range c.keys {
+		if _, found := c.entities[key.String()]; found {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (c *mockClient) Run(ctx context.Context, q *datastore.Query) Iterator {
+	return &mockIterator{c: c}
+}
+
+func (c *mockClient) RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts ...datastore.TransactionOption) (*datastore.Commit, error) {
+	return nil, f(&mockTx{c: c})
+}
+
+type mockIterator struct {
+	c *mockClient
+	i int
+}
+
+func (it *mockIterator) Next(dst interface{}) (*datastore.Key, error) {
+	for ; it.i < len(it.c.keys); it.i++ {
+		key := it.c.keys[it.i]
+		if props, found := it.c.entities[key.String()]; found {
+			it.i++
+			return key, dst.(datastore.PropertyLoadSaver).Load(props)
+		}
+	}
+	return nil, iterator.Done
+}
+
+func (it *mockIterator) Cursor() (datastore.Cursor, error) {
+	return datastore.Cursor{}, nil
+}
+
+type mockTx struct {
+	Transaction
+	c *mockClient
+}
+
+func (tx *mockTx) Get(key *datastore.Key, dst interface{}) error {
+	props, found := tx.c.entities[key.String()]
+	if !found {
+		return datastore.ErrNoSuchEntity
+	}
+	return dst.(datastore.PropertyLoadSaver).Load(props)
+}
+
+func (tx *mockTx) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	return tx.c.getMulti(keys, dst)
+}
+
+func (tx *mockTx) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	props, err := src.(*Entity).Save()
+	if err != nil {
+		return nil, err
+	}
+	tx.c.put(key, props)
+	return nil, nil
+}
+
+func (tx *mockTx) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error) {
+	for i, e := range src.([]*Entity) {
+		props, err := e.Save()
+		if err != nil {
+			return nil, err
+		}
+		tx.c.put(keys[i], props)
+	}
+	return nil, nil
+}
+
+func (tx *mockTx) Mutate(muts ...*datastore.Mutation) ([]*datastore.PendingKey, error) {
+	return nil, nil
+}
+
+func (tx *mockTx) Delete(key *datastore.Key) error {
+	delete(tx.c.entities, key.String())
+	return nil
+}
+
+func (tx *mockTx) DeleteMulti(keys []*datastore.Key) error {
+	for _, key := range keys {
+		delete(tx.c.entities, key.String())
+	}
+	return nil
+}
+
+func TestMockClient(t *testing.T) {
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	for _, id := range []string{"1", "2"} {
+		c.put(datastore.NameKey("users", id, nil), datastore.PropertyList{
+			{Name: "_id", Value: id},
+			{Name: "_etag", Value: "etag" + id},
+			{Name: "_updated", Value: time.Now()},
+			{Name: "name", Value: "user " + id},
+		})
+	}
+	h := NewHandler(c, "", "users")
+	ctx := context.Background()
+	list, err := h.Find(ctx, &query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 2 || list.Items[1].ID != "2" || list.Items[1].Payload["name"] != "user 2" {
+		t.Errorf("unexpected items %v", list.Items)
+	}
+	if err = h.Delete(ctx, &resource.Item{ID: "1", ETag: "stale"}); err != resource.ErrConflict {
+		t.Errorf("expected a conflict for a stale etag, got %v", err)
+	}
+	if err = h.Delete(ctx, &resource.Item{ID: "1", ETag: "etag1"}); err != nil {
+		t.Fatal(err)
+	}
+	if list, err = h.Find(ctx, &query.Query{}); err != nil || len(list.Items) != 1 {
+		t.Errorf("expected one item left, got %v, %v", list, err)
+	}
+}
+
+// failingClient fails its queries with err.
+type failingClient struct {
+	Client
+	err error
+}
+
+func (c failingClient) Run(ctx context.Context, q *datastore.Query) Iterator {
+	return failingIterator{c.err}
+}
+
+func (c failingClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	return nil, c.err
+}
+
+type failingIterator struct {
+	err error
+}
+
+func (it failingIterator) Next(dst interface{}) (*datastore.Key, error) {
+	return nil, it.err
+}
+
+func (it failingIterator) Cursor() (datastore.Cursor, error) {
+	return datastore.Cursor{}, it.err
+}
+
+func TestDeleteCleanupError(t *testing.T) {
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	c.put(datastore.NameKey("users", "1", nil), datastore.PropertyList{
+		{Name: "_id", Value: "1"},
+		{Name: "_etag", Value: "etag1"},
+	})
+	unavailable := errors.New("unavailable")
+	comments := NewHandler(failingClient{err: unavailable}, "", "comments")
+	var reported []error
+	h := NewHandler(c, "", "users").
+		SetReferrers(Referrer{Handler: comments, Field: "author", Action: NullifyReferences}).
+		SetCleanupErrorHandler(func(err error) { reported = append(reported, err) })
+	if err := h.Delete(context.Background(), &resource.Item{ID: "1", ETag: "etag1"}); err != nil {
+		t.Fatalf("expected the deletion to succeed, got %v", err)
+	}
+	if _, found := c.entities[datastore.NameKey("users", "1", nil).String()]; found {
+		t.Error("expected the item to be deleted")
+	}
+	if len(reported) != 1 || !strings.Contains(reported[0].Error(), "unavailable") {
+		t.Errorf("expected the nullification error to be reported, got %v", reported)
+	}
+}
+
+// ownerClient answers every query with a sentinel owned by "1".
+type ownerClient struct {
+	Client
+	queries int
+}
+
+func (c *ownerClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	c.queries++
+	entities := dst.(*[]datastore.PropertyList)
+	*entities = append(*entities, datastore.PropertyList{{Name: "_owner", Value: "1"}})
+	return []*datastore.Key{datastore.NameKey("users_unique_email", fmt.Sprint("a", c.queries), nil)}, nil
+}
+
+func TestOwnedKeys(t *testing.T) {
+	c := &ownerClient{}
+	h := NewHandler(c, "", "users")
+	keys := make([]*datastore.Key, MaxInValues+1)
+	for i := range keys {
+		keys[i] = datastore.NameKey("users", fmt.Sprint(i+1), nil)
+	}
+	owned := map[string][]*datastore.Key{}
+	if err := h.ownedKeys(context.Background(), "users_unique_email", "_owner", keys, owned); err != nil {
+		t.Fatal(err)
+	}
+	if c.queries != 2 {
+		t.Errorf("expected a query per %d owners, got %d queries", MaxInValues, c.queries)
+	}
+	if len(owned) != 1 || len(owned[keys[0].String()]) != 2 {
+		t.Errorf("expected the sentinels to be indexed by owner, got %v", owned)
+	}
+}
@@ -0,0 +1,46 @@
+package datastore
+
+import "context"
+
+// SetCloseClient makes Close close the client of the handler, which must then
+// not be shared with other handlers still in use.
+func (d *Handler) SetCloseClient(enabled bool) *Handler {
+	d.closeClient = enabled
+	return d
+}
+
+// Close shuts the handler down: it stops the background workers, such as the
+// reapers started with StartReaper and read repairs, waits for the pending
+// background work, such as shadow reads, and closes the client if set with
+// SetCloseClient. It returns the context error if ctx is done before the work
+// completes. The handler must not be used after Close.
+func (d *Handler) Close(ctx context.Context) error {
+	d.workersMu.Lock()
+	workers := d.workers
+	d.workers = nil
+	d.workersMu.Unlock()
+	for _, stop := range workers {
+		stop()
+	}
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+	}
+	if d.closeClient && d.client != nil {
+		return d.client.Close()
+	}
+	return nil
+}
+
+// startedWorker registers the stop function of a background worker.
+func (d *Handler) startedWorker(stop func()) {
+	d.workersMu.Lock()
+	d.workers = append(d.workers, stop)
+	d.workersMu.Unlock()
+}
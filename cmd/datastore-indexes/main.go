@@ -0,0 +1,58 @@
+// Command datastore-indexes prints the index.yaml declaring the composite
+// indexes needed by the query patterns of a patterns file:
+//
+//	kinds:
+//	  - kind: users
+//	    folded: [name]
+//	    queries:
+//	      - filter: '{"country": "fr", "age": {"$gt": 18}}'
+//	        sort: -age
+//
+// Usage:
+//
+//	datastore-indexes -patterns patterns.yaml > index.yaml
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ajcrowe/rest-layer-datastore"
+	"gopkg.in/yaml.v3"
+)
+
+type patterns struct {
+	Kinds []struct {
+		Kind string `yaml:"kind"`
+		// Folded and Hashed list the fields stored with a shadow property.
+		Folded  []string                 `yaml:"folded"`
+		Hashed  []string                 `yaml:"hashed"`
+		Queries []datastore.QueryPattern `yaml:"queries"`
+	} `yaml:"kinds"`
+}
+
+func main() {
+	file := flag.String("patterns", "patterns.yaml", "file listing the query patterns of each kind")
+	flag.Parse()
+
+	b, err := os.ReadFile(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var p patterns
+	if err = yaml.Unmarshal(b, &p); err != nil {
+		log.Fatalf("%s: %v", *file, err)
+	}
+	var f datastore.IndexFile
+	for _, k := range p.Kinds {
+		h := datastore.NewHandler(nil, "", k.Kind).SetFoldedFields(k.Folded).SetHashedFields(k.Hashed)
+		indexes, err := h.Indexes(nil, k.Queries...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f.Add(indexes...)
+	}
+	fmt.Print(f.YAML())
+}
@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"golang.org/x/sync/singleflight"
+)
+
+// SetCoalescing makes identical Find queries running concurrently share a
+// single Datastore execution, protecting hot list endpoints from traffic
+// spikes and cache stampedes. Queries are identical when they have the same
+// namespace, predicate, sort and window, and the same sampling, keyset and
+// excluded fields options. Queries using a query modifier or profiled with
+// WithProfile are never coalesced.
+func (d *Handler) SetCoalescing(enabled bool) *Handler {
+	d.coalesce = nil
+	if enabled {
+		d.coalesce = &singleflight.Group{}
+	}
+	return d
+}
+
+// coalesceKey returns the canonical form of the Find query q in ctx, and
+// whether it can be coalesced.
+func (d *Handler) coalesceKey(ctx context.Context, q *query.Query) (string, bool) {
+	if d.coalesce == nil || profileOf(ctx) != nil {
+		return "", false
+	}
+	return d.findKey(ctx, q)
+}
+
+// findKey returns the canonical form of the Find query q in ctx, or false
+// when it uses a query modifier.
+func (d *Handler) findKey(ctx context.Context, q *query.Query) (string, bool) {
+	if _, found := ctx.Value(modifierCtxKey).(QueryModifier); found {
+		return "", false
+	}
+	key := fmt.Sprintf("%s\x00%s\x00%v", d.getNamespace(ctx), q.Predicate.String(), q.Sort)
+	if w := q.Window; w != nil {
+		key += fmt.Sprintf("\x00%d,%d", w.Offset, w.Limit)
+	}
+	if n, _ := ctx.Value(sampleCtxKey).(int); n > 0 {
+		key += fmt.Sprintf("\x00sample=%d", n)
+	}
+	if k, ok := ctx.Value(keysetCtxKey).(Keyset); ok {
+		key += "\x00keyset=" + k.Token()
+	}
+	if include, _ := ctx.Value(excludedCtxKey).(bool); include {
+		key += "\x00excluded"
+	}
+	return key, true
+}
+
+// findShared runs q once for all the concurrent callers with the same key
+// and returns a copy of the shared result.
+func (d *Handler) findShared(ctx context.Context, key string, q *query.Query) (*resource.ItemList, error) {
+	ch := d.coalesce.DoChan(key, func() (interface{}, error) {
+		// The query must not fail for all the callers when the caller
+		// running it goes away
+		sctx := detach(ctx)
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			sctx, cancel = context.WithDeadline(sctx, deadline)
+			defer cancel()
+		}
+		return d.findList(sctx, q)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return copyList(r.Val.(*resource.ItemList)), nil
+	}
+}
+
+// copyList copies list and its items, so callers sharing a result can modify
+// their copy.
+func copyList(list *resource.ItemList) *resource.ItemList {
+	l := *list
+	l.Items = make([]*resource.Item, len(list.Items))
+	for i, item := range list.Items {
+		c := *item
+		c.Payload = make(map[string]interface{}, len(item.Payload))
+		for k, v := range item.Payload {
+			c.Payload[k] = v
+		}
+		l.Items[i] = &c
+	}
+	return &l
+}
@@ -0,0 +1,226 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+)
+
+// ValueCodec converts payload values to Datastore property values and back,
+// giving control over how custom types like decimals, UUIDs or enums are
+// stored.
+type ValueCodec interface {
+	// Encode converts a payload value to the value stored in the Datastore.
+	Encode(value interface{}) (interface{}, error)
+	// Decode converts a stored value back to the payload value.
+	Decode(value interface{}) (interface{}, error)
+}
+
+// RegisterCodec registers codec for the fields whose schema validator has
+// the type of sample, for instance &schema.Time{}, or when sample is not a
+// schema.FieldValidator, for the payload values of the Go type of sample.
+//
+// Codecs registered by schema type need the schema bound with SetSchema, and
+// apply to the elements of list fields validated by that type. Stored values
+// are only decoded by codecs registered by schema type, as the Go type of a
+// payload value can't be known from its stored form. Filter values are
+// encoded the same way as payload values. Values not handled by a codec are
+// stored as is, objects being converted to nested entities.
+func (d *Handler) RegisterCodec(sample interface{}, codec ValueCodec) *Handler {
+	t := reflect.TypeOf(sample)
+	if _, ok := sample.(schema.FieldValidator); ok {
+		if d.fieldCodecs == nil {
+			d.fieldCodecs = map[reflect.Type]ValueCodec{}
+		}
+		d.fieldCodecs[t] = codec
+	} else {
+		if d.typeCodecs == nil {
+			d.typeCodecs = map[reflect.Type]ValueCodec{}
+		}
+		d.typeCodecs[t] = codec
+	}
+	return d
+}
+
+// fieldCodec returns the codec registered for the schema type of the field
+// with path, and whether it applies to the elements of a list.
+func (d *Handler) fieldCodec(path string) (ValueCodec, bool) {
+	if !d.hasFieldCodecs() {
+		return nil, false
+	}
+	f := d.schema.GetField(path)
+	if f == nil || f.Validator == nil {
+		return nil, false
+	}
+	if c, found := d.referenceCodec(f.Validator); found {
+		return c, false
+	}
+	if c, found := d.fieldCodecs[reflect.TypeOf(f.Validator)]; found {
+		return c, false
+	}
+	if isGeoPoint(f.Validator) {
+		return GeoPointCodec{}, false
+	}
+	if a, ok := f.Validator.(*schema.Array); ok && a.Values.Validator != nil {
+		if c, found := d.referenceCodec(a.Values.Validator); found {
+			return c, true
+		}
+		if c, found := d.fieldCodecs[reflect.TypeOf(a.Values.Validator)]; found {
+			return c, true
+		}
+		if isGeoPoint(a.Values.Validator) {
+			return GeoPointCodec{}, true
+		}
+	}
+	return nil, false
+}
+
+// hasFieldCodecs returns whether fields of the schema may have a codec.
+func (d *Handler) hasFieldCodecs() bool {
+	return d.schema != nil && (len(d.fieldCodecs) > 0 || len(d.referenceKinds) > 0 || d.geoPoints)
+}
+
+// hasCodecs returns whether payload values may need encoding.
+func (d *Handler) hasCodecs() bool {
+	return len(d.fieldCodecs) > 0 || len(d.typeCodecs) > 0 || len(d.referenceKinds) > 0 || d.geoPoints
+}
+
+// encodeItem returns a copy of item with its payload values encoded by the
+// registered codecs.
+func (d *Handler) encodeItem(item *resource.Item) (*resource.Item, error) {
+	if !d.hasCodecs() {
+		return item, nil
+	}
+	payload := make(map[string]interface{}, len(item.Payload))
+	for k, v := range item.Payload {
+		if k == "id" {
+			payload[k] = v
+			continue
+		}
+		ev, err := d.encodeValue(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		payload[k] = ev
+	}
+	i := *item
+	i.Payload = payload
+	return &i, nil
+}
+
+// encodeValue encodes the value of the field with path.
+func (d *Handler) encodeValue(path string, value interface{}) (interface{}, error) {
+	if c, elements := d.fieldCodec(path); c != nil {
+		return applyCodec(value, elements, c.Encode)
+	}
+	if c, found := d.typeCodecs[reflect.TypeOf(value)]; found {
+		return c.Encode(value)
+	}
+	switch t := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			ev, err := d.encodeValue(path+"."+k, v)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = ev
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, v := range t {
+			if c, found := d.typeCodecs[reflect.TypeOf(v)]; found {
+				ev, err := c.Encode(v)
+				if err != nil {
+					return nil, err
+				}
+				l[i] = ev
+				continue
+			}
+			if m, ok := v.(map[string]interface{}); ok {
+				// Fields of objects in lists are resolved against the list
+				// field, like rest-layer does
+				ev, err := d.encodeValue(path, m)
+				if err != nil {
+					return nil, err
+				}
+				l[i] = ev
+				continue
+			}
+			l[i] = v
+		}
+		return l, nil
+	}
+	return value, nil
+}
+
+// decodeValues decodes the payload values of the fields using a registered
+// schema type codec in place.
+func (d *Handler) decodeValues(payload map[string]interface{}, prefix string) error {
+	if !d.hasFieldCodecs() {
+		return nil
+	}
+	for k, v := range payload {
+		path := prefix + k
+		if c, elements := d.fieldCodec(path); c != nil {
+			dv, err := applyCodec(v, elements, c.Decode)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			payload[k] = dv
+			continue
+		}
+		if m, ok := toMap(v); ok {
+			if err := d.decodeValues(m, path+"."); err != nil {
+				return err
+			}
+			payload[k] = m
+		}
+	}
+	return nil
+}
+
+// applyCodec applies f to value, or to each of its elements.
+func applyCodec(value interface{}, elements bool, f func(interface{}) (interface{}, error)) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	l, ok := value.([]interface{})
+	if !elements || !ok {
+		return f(value)
+	}
+	r := make([]interface{}, len(l))
+	for i, v := range l {
+		var err error
+		if r[i], err = f(v); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// encodeFilterValue encodes the value of a filter on field, a list of values
+// for the in operator.
+func (d *Handler) encodeFilterValue(field string, value interface{}, list bool) (interface{}, error) {
+	if !d.hasCodecs() {
+		return value, nil
+	}
+	if c, _ := d.fieldCodec(field); c != nil {
+		return applyCodec(value, list, c.Encode)
+	}
+	l, ok := value.([]interface{})
+	if !list || !ok {
+		return d.encodeValue(field, value)
+	}
+	r := make([]interface{}, len(l))
+	for i, v := range l {
+		var err error
+		if r[i], err = d.encodeValue(field, v); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
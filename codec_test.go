@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+)
+
+// centsCodec stores amounts as integer cents.
+type centsCodec struct{}
+
+func (centsCodec) Encode(v interface{}) (interface{}, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return nil, errors.New("not a float")
+	}
+	return int64(math.Round(f * 100)), nil
+}
+
+func (centsCodec) Decode(v interface{}) (interface{}, error) {
+	return float64(v.(int64)) / 100, nil
+}
+
+type color int
+
+type colorCodec struct{}
+
+func (colorCodec) Encode(v interface{}) (interface{}, error) {
+	return []string{"red", "green"}[v.(color)], nil
+}
+
+func (colorCodec) Decode(v interface{}) (interface{}, error) {
+	return v, nil
+}
+
+func TestCodecs(t *testing.T) {
+	s := &schema.Schema{Fields: schema.Fields{
+		"price":  {Validator: &schema.Float{}},
+		"prices": {Validator: &schema.Array{Values: schema.Field{Validator: &schema.Float{}}}},
+		"meta": {Schema: &schema.Schema{Fields: schema.Fields{
+			"cost": {Validator: &schema.Float{}},
+		}}},
+	}}
+	h := NewHandler(nil, "", "products").
+		SetSchema(s).
+		RegisterCodec(&schema.Float{}, centsCodec{}).
+		RegisterCodec(color(0), colorCodec{})
+	item := &resource.Item{ID: "1", Payload: map[string]interface{}{
+		"id":     "1",
+		"price":  12.5,
+		"prices": []interface{}{1.0, 2.25},
+		"meta":   map[string]interface{}{"cost": 3.1, "tint": color(1)},
+		"color":  color(0),
+	}}
+	encoded, err := h.encodeItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"id":     "1",
+		"price":  int64(1250),
+		"prices": []interface{}{int64(100), int64(225)},
+		"meta":   map[string]interface{}{"cost": int64(310), "tint": "green"},
+		"color":  "red",
+	}
+	if !reflect.DeepEqual(encoded.Payload, want) {
+		t.Errorf("encode: got %v, want %v", encoded.Payload, want)
+	}
+	if item.Payload["price"] != 12.5 {
+		t.Error("encode modified the original item")
+	}
+	if err = h.decodeValues(encoded.Payload, ""); err != nil {
+		t.Fatal(err)
+	}
+	if encoded.Payload["price"] != 12.5 || encoded.Payload["meta"].(map[string]interface{})["cost"] != 3.1 ||
+		!reflect.DeepEqual(encoded.Payload["prices"], []interface{}{1.0, 2.25}) {
+		t.Errorf("decode: got %v", encoded.Payload)
+	}
+	v, err := h.encodeFilterValue("prices", []interface{}{1.5}, true)
+	if err != nil || !reflect.DeepEqual(v, []interface{}{int64(150)}) {
+		t.Errorf("filter: got %v, %v", v, err)
+	}
+}
@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"fmt"
+
+	"github.com/rs/rest-layer/resource"
+)
+
+// ComputeFunc derives the value of a computed field from an item payload. A
+// nil value removes the field.
+type ComputeFunc func(payload map[string]interface{}) (interface{}, error)
+
+// computedField is a field computed at write time.
+type computedField struct {
+	name    string
+	compute ComputeFunc
+}
+
+// AddComputedField registers a field whose value is computed from the payload
+// by compute whenever an item is written by Insert, Update, UpsertMulti or
+// RewriteReferences, for instance a full name or a geohash, so queries can
+// filter and sort on derived values without clients sending them. Computed
+// fields are stored and loaded like the others, and should be declared
+// read-only in the schema. Fields are computed in registration order, so a
+// field can be derived from a previously computed one.
+func (d *Handler) AddComputedField(name string, compute ComputeFunc) *Handler {
+	d.computedFields = append(d.computedFields, computedField{name: name, compute: compute})
+	return d
+}
+
+// computeFields returns a copy of item with its computed fields set.
+func (d *Handler) computeFields(item *resource.Item) (*resource.Item, error) {
+	if len(d.computedFields) == 0 {
+		return item, nil
+	}
+	payload := make(map[string]interface{}, len(item.Payload)+len(d.computedFields))
+	for k, v := range item.Payload {
+		payload[k] = v
+	}
+	for _, f := range d.computedFields {
+		v, err := f.compute(payload)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+		if v == nil {
+			delete(payload, f.name)
+		} else {
+			payload[f.name] = v
+		}
+	}
+	i := *item
+	i.Payload = payload
+	return &i, nil
+}
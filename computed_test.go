@@ -0,0 +1,38 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+)
+
+func TestComputeFields(t *testing.T) {
+	h := NewHandler(nil, "", "users").
+		AddComputedField("fullName", func(p map[string]interface{}) (interface{}, error) {
+			return p["first"].(string) + " " + p["last"].(string), nil
+		}).
+		AddComputedField("initials", func(p map[string]interface{}) (interface{}, error) {
+			if p["fullName"] == "" {
+				return nil, nil
+			}
+			return p["fullName"].(string)[:1], nil
+		})
+	item := &resource.Item{ID: "1", Payload: map[string]interface{}{"id": "1", "first": "Ada", "last": "Lovelace", "initials": "x"}}
+	computed, err := h.computeFields(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if computed.Payload["fullName"] != "Ada Lovelace" || computed.Payload["initials"] != "A" {
+		t.Errorf("unexpected payload %v", computed.Payload)
+	}
+	if _, found := item.Payload["fullName"]; found {
+		t.Error("expected the original payload to be left unchanged")
+	}
+	h.AddComputedField("fails", func(p map[string]interface{}) (interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	if _, err := h.computeFields(item); err == nil || err.Error() != "fails: boom" {
+		t.Errorf("expected the field error, got %v", err)
+	}
+}
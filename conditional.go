@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"google.golang.org/api/iterator"
+)
+
+// MultiGetIfNoneMatch revalidates cached items. It takes the etags known by
+// the caller indexed by id, and returns the items whose etag changed along with
+// the ids of the items which are unchanged. Ids of deleted and expired items
+// are part of neither list.
+//
+// Current etags are read with cheap projection queries on _etag, and only the
+// changed entities are fully fetched. Entities missing from the projections,
+// such as legacy entities without an indexed _etag, are fetched in full, as
+// are all entities with SetExpiration, whose expiration time isn't projected.
+func (d *Handler) MultiGetIfNoneMatch(ctx context.Context, etags map[string]string) ([]*resource.Item, []string, error) {
+	ids := make([]query.Value, 0, len(etags))
+	for id := range etags {
+		ids = append(ids, id)
+	}
+	var changed, lookup []query.Value
+	var unchanged []string
+	if d.expirationField != "" {
+		lookup = ids
+	} else {
+		seen := make(map[string]bool, len(ids))
+		for _, chunk := range chunkValues(ids, MaxInValues) {
+			// The client only takes []interface{} values for IN filters
+			keys := make([]interface{}, len(chunk))
+			for i, id := range chunk {
+				key := datastore.NameKey(d.entity, id.(string), nil)
+				key.Namespace = d.getNamespace(ctx)
+				keys[i] = key
+			}
+			qry := datastore.NewQuery(d.entity).
+				Namespace(d.getNamespace(ctx)).
+				Filter("__key__ in", keys).
+				Project("_etag")
+			for t := d.client.Run(ctx, qry); ; {
+				var e Entity
+				key, err := t.Next(&e)
+				if err == iterator.Done {
+					break
+				}
+				if err != nil {
+					return nil, nil, err
+				}
+				seen[key.Name] = true
+				if e.ETag == etags[key.Name] {
+					unchanged = append(unchanged, key.Name)
+				} else {
+					changed = append(changed, key.Name)
+				}
+			}
+		}
+		for _, id := range ids {
+			if !seen[id.(string)] {
+				lookup = append(lookup, id)
+			}
+		}
+	}
+	items := []*resource.Item{}
+	for _, chunk := range chunkValues(changed, maxGetMulti) {
+		i, err := d.getMulti(ctx, chunk)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, i...)
+	}
+	for _, chunk := range chunkValues(lookup, maxGetMulti) {
+		i, err := d.getMulti(ctx, chunk)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, item := range i {
+			if item.ETag == etags[item.ID.(string)] {
+				unchanged = append(unchanged, item.ID.(string))
+			} else {
+				items = append(items, item)
+			}
+		}
+	}
+	return items, unchanged, nil
+}
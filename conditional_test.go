@@ -0,0 +1,102 @@
+package datastore
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// projectionClient answers queries like a projection on _etag, leaving out
+// the entities without one.
+type projectionClient struct {
+	*mockClient
+}
+
+func (c projectionClient) Run(ctx context.Context, q *datastore.Query) Iterator {
+	projected := &mockClient{entities: map[string]datastore.PropertyList{}}
+	for _, key := range c.keys {
+		for _, p := range c.entities[key.String()] {
+			if p.Name == "_etag" {
+				projected.put(key, datastore.PropertyList{p})
+			}
+		}
+	}
+	return &mockIterator{c: projected}
+}
+
+func TestMultiGetIfNoneMatch(t *testing.T) {
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	for _, id := range []string{"1", "2"} {
+		c.put(datastore.NameKey("users", id, nil), datastore.PropertyList{
+			{Name: "_id", Value: id},
+			{Name: "_etag", Value: "etag" + id},
+			{Name: "_updated", Value: time.Now()},
+		})
+	}
+	for _, id := range []string{"3", "4"} {
+		// Legacy entities without meta properties
+		c.put(datastore.NameKey("users", id, nil), datastore.PropertyList{
+			{Name: "_id", Value: id},
+			{Name: "name", Value: "user " + id},
+		})
+	}
+	h := NewHandler(projectionClient{c}, "", "users")
+	ctx := context.Background()
+	legacy, err := h.getMulti(ctx, []query.Value{"3"})
+	if err != nil || len(legacy) != 1 {
+		t.Fatal(legacy, err)
+	}
+	items, unchanged, err := h.MultiGetIfNoneMatch(ctx, map[string]string{
+		"1": "etag1",
+		"2": "stale",
+		"3": legacy[0].ETag,
+		"4": "stale",
+		"5": "deleted",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(unchanged)
+	if !reflect.DeepEqual(unchanged, []string{"1", "3"}) {
+		t.Errorf("expected 1 and 3 to be unchanged, got %v", unchanged)
+	}
+	var ids []string
+	for _, item := range items {
+		ids = append(ids, item.ID.(string))
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"2", "4"}) {
+		t.Errorf("expected the changed items 2 and 4, got %v", ids)
+	}
+}
+
+func TestMultiGetIfNoneMatchExpired(t *testing.T) {
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	now := time.Now()
+	for i, expires := range []time.Time{now.Add(time.Hour), now.Add(-time.Hour)} {
+		id := string(rune('1' + i))
+		c.put(datastore.NameKey("users", id, nil), datastore.PropertyList{
+			{Name: "_id", Value: id},
+			{Name: "_etag", Value: "etag" + id},
+			{Name: "_updated", Value: now},
+			{Name: "_expires", Value: expires},
+			{Name: "expires", Value: expires},
+		})
+	}
+	h := NewHandler(projectionClient{c}, "", "users").SetExpiration("expires")
+	items, unchanged, err := h.MultiGetIfNoneMatch(context.Background(), map[string]string{
+		"1": "etag1",
+		"2": "etag2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 || !reflect.DeepEqual(unchanged, []string{"1"}) {
+		t.Errorf("expected the expired item to be left out, got %v and %v", items, unchanged)
+	}
+}
@@ -0,0 +1,172 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// maxViolations bounds the number of violations detailed by a consistency
+// report.
+const maxViolations = 100
+
+// clockSkew is the tolerated drift of _updated times in the future.
+const clockSkew = time.Minute
+
+// etagRegexp matches the etags computed by rest-layer.
+var etagRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Violation is an entity breaking the invariants of the handler.
+type Violation struct {
+	Key *datastore.Key
+	// Problems describes the broken invariants.
+	Problems []string
+	// Repaired is set when the entity was repaired.
+	Repaired bool
+}
+
+// ConsistencyReport is the result of a consistency check.
+type ConsistencyReport struct {
+	Scanned  int
+	Invalid  int
+	Repaired int
+	// Violations details the first invalid entities.
+	Violations []*Violation
+}
+
+// CheckConsistency scans the entities of the kind and checks the invariants
+// the handler relies on, which edits in the console or other writers can
+// break: keys are named, the _id property matches the key name, the _etag is
+// an MD5 hex digest and _updated is set, not in the future nor before
+// _created. With repair, invalid entities get their id from the key name, an
+// etag computed from their payload and the current time as update time, like
+// legacy entities repaired on read. Entities with numeric keys can't be
+// repaired.
+func (d *Handler) CheckConsistency(ctx context.Context, repair bool) (*ConsistencyReport, error) {
+	if repair {
+		if err := d.checkFence(ctx); err != nil {
+			return nil, err
+		}
+	}
+	report := &ConsistencyReport{}
+	var keys []*datastore.Key
+	check := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		props := make([]datastore.PropertyList, len(keys))
+		err := d.retry(ctx, true, func() error {
+			return d.client.GetMulti(ctx, keys, props)
+		})
+		merr, _ := err.(datastore.MultiError)
+		if err != nil && merr == nil {
+			return err
+		}
+		now := d.now()
+		for i, key := range keys {
+			if merr != nil && merr[i] != nil {
+				if merr[i] == datastore.ErrNoSuchEntity {
+					continue
+				}
+				return merr[i]
+			}
+			report.Scanned++
+			problems := checkEntity(key, props[i], now)
+			if len(problems) == 0 {
+				continue
+			}
+			v := &Violation{Key: key, Problems: problems}
+			if repair && key.Name != "" {
+				if err := d.repairEntity(ctx, key); err != nil {
+					return err
+				}
+				v.Repaired = true
+				report.Repaired++
+			}
+			report.Invalid++
+			if len(report.Violations) < maxViolations {
+				report.Violations = append(report.Violations, v)
+			}
+		}
+		keys = keys[:0]
+		return nil
+	}
+	qry := datastore.NewQuery(d.entity).Namespace(d.getNamespace(ctx)).KeysOnly()
+	err := StreamKeys(ctx, d.client, qry, func(key *datastore.Key) error {
+		if keys = append(keys, key); len(keys) < MaxMutations {
+			return nil
+		}
+		return check()
+	})
+	if err != nil {
+		return report, err
+	}
+	return report, check()
+}
+
+// checkEntity returns the invariants broken by the entity with key and props
+// at now.
+func checkEntity(key *datastore.Key, props datastore.PropertyList, now time.Time) []string {
+	var problems []string
+	if key.Name == "" {
+		problems = append(problems, fmt.Sprintf("numeric key %d", key.ID))
+	}
+	values := make(map[string]interface{}, len(props))
+	for _, p := range props {
+		values[p.Name] = p.Value
+	}
+	switch id, ok := values["_id"].(string); {
+	case values["_id"] == nil:
+		problems = append(problems, "missing _id")
+	case !ok || id != key.Name:
+		problems = append(problems, fmt.Sprintf("_id %v doesn't match the key name", values["_id"]))
+	}
+	switch etag, ok := values["_etag"].(string); {
+	case !ok || etag == "":
+		problems = append(problems, "missing _etag")
+	case !etagRegexp.MatchString(etag):
+		problems = append(problems, fmt.Sprintf("malformed _etag %q", etag))
+	}
+	updated, ok := values["_updated"].(time.Time)
+	created, hasCreated := values[createdProperty].(time.Time)
+	switch {
+	case !ok || updated.IsZero():
+		problems = append(problems, "missing _updated")
+	case updated.After(now.Add(clockSkew)):
+		problems = append(problems, fmt.Sprintf("_updated %v in the future", updated))
+	case hasCreated && updated.Before(created):
+		problems = append(problems, fmt.Sprintf("_updated %v before _created %v", updated, created))
+	}
+	return problems
+}
+
+// repairEntity rewrites the meta properties of the entity with key.
+func (d *Handler) repairEntity(ctx context.Context, key *datastore.Key) error {
+	return d.runTx(ctx, func(tx Transaction) error {
+		var props datastore.PropertyList
+		if err := tx.Get(key, &props); err != nil {
+			return err
+		}
+		var e Entity
+		if err := e.Load(props); err != nil {
+			return err
+		}
+		now := d.now()
+		if len(checkEntity(key, props, now)) == 0 {
+			// Repaired or updated since checked
+			return nil
+		}
+		e.ID = key.Name
+		if !etagRegexp.MatchString(e.ETag) {
+			e.ETag = payloadETag(e.ID, e.Payload)
+		}
+		if e.Updated.IsZero() || e.Updated.After(now.Add(clockSkew)) || e.Updated.Before(e.Created) {
+			e.Updated = now
+		}
+		_, err := tx.Put(key, d.configureEntity(&e))
+		return err
+	})
+}
@@ -0,0 +1,33 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestCheckEntity(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := datastore.NameKey("users", "1", nil)
+	valid := datastore.PropertyList{
+		{Name: "_id", Value: "1"},
+		{Name: "_etag", Value: "d41d8cd98f00b204e9800998ecf8427e"},
+		{Name: "_updated", Value: now.Add(-time.Hour)},
+		{Name: createdProperty, Value: now.Add(-2 * time.Hour)},
+	}
+	if problems := checkEntity(key, valid, now); len(problems) != 0 {
+		t.Errorf("valid entity: got %v", problems)
+	}
+	invalid := datastore.PropertyList{
+		{Name: "_id", Value: "2"},
+		{Name: "_etag", Value: "W/abc"},
+		{Name: "_updated", Value: now.Add(time.Hour)},
+	}
+	if problems := checkEntity(key, invalid, now); len(problems) != 3 {
+		t.Errorf("invalid entity: got %v, want 3 problems", problems)
+	}
+	if problems := checkEntity(datastore.IDKey("users", 1, nil), nil, now); len(problems) != 4 {
+		t.Errorf("empty entity: got %v, want 4 problems", problems)
+	}
+}
@@ -2,36 +2,207 @@ package datastore
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
 	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
 	"github.com/rs/rest-layer/schema/query"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 // Wrap datastore.NewClient to avoid user having to import this
-func NewClient(ctx context.Context, projectID string, opts ...option.ClientOption) (*datastore.Client, error) {
-	return datastore.NewClient(ctx, projectID, opts...)
+func NewClient(ctx context.Context, projectID string, opts ...option.ClientOption) (Client, error) {
+	c, err := datastore.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return WrapClient(c), nil
 }
 
 // Handler handles resource storage in Google Datastore.
 type Handler struct {
-	// datastore.Client struct for executing our queries.
-	client *datastore.Client
+	// Client executing our queries, usually a wrapped *datastore.Client.
+	client Client
 	// Kind of the entity this handler will create.
 	entity string
 	// Namespace in which these entities will be.
 	namespace string
 	// Properties which should not be indexed.
 	noIndexProps map[string]bool
+	// Clock used to resolve relative time expressions in queries.
+	clock func() time.Time
+	// Layout of the payload in stored entities.
+	mode StorageMode
+	// Fields stored as properties in HybridStorage mode.
+	queryableFields map[string]bool
+	// Codec used to compress blob properties.
+	compression Compression
+	// Write the sample property used by sampled finds.
+	sampling bool
+	// Fields which can't be changed by Update.
+	immutableFields []string
+	// Secondary store used for shadow reads and its divergence reporter.
+	shadow       resource.Storer
+	shadowReport ShadowReporter
+	// Fraction of the finds shadow read without WithShadowRead.
+	shadowRate float64
+	// Number of items GroupBy reads at most.
+	groupByLimit int
+	// Cloud Storage bucket receiving payload values larger than threshold.
+	overflowBucket    *storage.BucketHandle
+	overflowThreshold int
+	// Fields encrypted with keys protected by keyProvider.
+	keyProvider     KeyProvider
+	encryptedFields []string
+	// Fields which are stored but never loaded.
+	writeOnlyFields map[string]bool
+	// Fields omitted from Find results unless requested.
+	readExcludedFields map[string]bool
+	// Audit meta properties configuration.
+	audit       bool
+	auditActor  ActorFunc
+	auditExpose bool
+	// Schema of the stored resource, if bound.
+	schema *schema.Schema
+	// Time before the request deadline at which writes are aborted.
+	deadlineMargin time.Duration
+	// Minimum interval between read repair writes, 0 to disable.
+	repairInterval time.Duration
+	repairKeys     chan *datastore.Key
+	repairOnce     sync.Once
+	// Companion kind receiving deletion tombstones and their time to live.
+	tombstoneKind string
+	tombstoneTTL  time.Duration
+	// Kind receiving the previous versions of items.
+	historyKind string
+	// Kind receiving the change records of items.
+	changesKind string
+	// Write notifications to the outbox kind in the mutation commit.
+	outboxTx bool
+	// Pub/Sub topic notified of mutations, its error reporter and the kind
+	// receiving unpublished notifications.
+	topic       *pubsub.Topic
+	notifyError func(error)
+	outboxKind  string
+	// Receives the errors of the cleanups following deletions.
+	cleanupError func(error)
+	// Value codecs by schema validator type and by Go type.
+	fieldCodecs map[reflect.Type]ValueCodec
+	typeCodecs  map[reflect.Type]ValueCodec
+	// Datastore kinds of the referenced resources stored as keys, by path.
+	referenceKinds map[string]string
+	// Whether the schema has GeoPoint fields.
+	geoPoints bool
+	// Fields of other resources referencing the items, checked on Delete.
+	referrers []Referrer
+	// Delete the descendants of deleted entities.
+	cascadeDelete bool
+	// Large string fields filtered through an indexed hash.
+	hashedFields map[string]bool
+	// String fields filtered case and accent insensitively.
+	foldedFields map[string]bool
+	// Previous versions of the key provider, by version.
+	decryptionKeys map[string]KeyProvider
+	// Fields computed from the payload at write time.
+	computedFields []computedField
+	// Adaptive commit sizes of bulk writes, nil when disabled.
+	batches *batchSizer
+	// Operation log receiving the mutations, nil when disabled.
+	opLog *opLog
+	// Top level fields whose values are unique among the items.
+	uniqueFields []string
+	// Companion kinds emulating indexes for unsupported query shapes.
+	emulatedIndexes []EmulatedIndex
+	// Materialized views maintained on write.
+	views []View
+	// Tracer of the operation spans, nil when tracing is disabled.
+	tracer trace.Tracer
+	// Receiver of the operation metrics, nil when disabled.
+	metrics Metrics
+	// Debug logger, nil when disabled.
+	logger Logger
+	// Slow Find and Clear reporting, nil when disabled.
+	slowQueries *slowQueryLog
+	// Retries of the calls failing with transient errors, nil when
+	// disabled.
+	retryPolicy *RetryPolicy
+	// Attempts of the transactions in case of contention, DefaultTxAttempts
+	// when zero.
+	txAttempts int
+	// Circuit breaker of the Datastore calls, nil when disabled.
+	breaker *circuitBreaker
+	// Rate limit of the Datastore requests, nil when unlimited.
+	limiter *rate.Limiter
+	// Delay before hedging reads, zero when disabled.
+	hedgeDelay time.Duration
+	// Whether the typed errors are returned instead of the REST layer
+	// errors they match.
+	typedErrors bool
+	// Adaptive Find result cache, nil when disabled, and how it handles
+	// deleted items.
+	cache        *adaptiveCache
+	cacheDeletes CacheDeletePolicy
+	// Coalesces identical concurrent finds, nil when disabled.
+	coalesce *singleflight.Group
+	// Codec replacing the default payload layout.
+	entityCodec EntityCodec
+	// Only rewrite the properties changed by updates.
+	diffUpdates bool
+	// Functions called around storage operations.
+	hooks Hooks
+	// Estimated index writes report, nil when disabled.
+	writes *writeTracker
+	// Payload field holding the expiration time of items.
+	expirationField string
+	// Write fence checks and cached fence state.
+	fenceCheck   bool
+	fenceTTL     time.Duration
+	fenceMu      sync.Mutex
+	fence        *writeFence
+	fenceChecked time.Time
+	// Maintenance mode state, nil when disabled.
+	maintenance *writeFence
+	// Background work in progress.
+	pending sync.WaitGroup
+	// Mirror of the written entities, nil when disabled.
+	dualWrite *DualWrite
+	// Stop functions of the background workers, called by Close.
+	workersMu sync.Mutex
+	workers   []func()
+	// Whether Close closes the client.
+	closeClient bool
 }
 
+// ctxKey is the type of the context keys used by the handler.
+type ctxKey int
+
+const (
+	sampleCtxKey ctxKey = iota
+	shadowCtxKey
+	excludedCtxKey
+	keysetCtxKey
+	fenceBypassCtxKey
+	projectionCtxKey
+	modifierCtxKey
+	profileCtxKey
+	tenantCtxKey
+)
+
 // NewHandler creates a new Google Datastore handler
-func NewHandler(client *datastore.Client, namespace, entity string) *Handler {
+func NewHandler(client Client, namespace, entity string) *Handler {
 	return &Handler{
 		client:    client,
 		entity:    entity,
@@ -44,31 +215,113 @@ type Entity struct {
 	ID           string
 	ETag         string
 	Updated      time.Time
+	Created      time.Time
+	Expires      time.Time
+	CreatedBy    string
+	UpdatedBy    string
 	Payload      map[string]interface{}
 	NoIndexProps map[string]bool
+	Mode         StorageMode
+	Queryable    map[string]bool
+	Compression  Compression
+	Sample       bool
+	// Hashed lists the fields stored with an indexed hash.
+	Hashed map[string]bool
+	// Folded lists the fields stored with a normalized shadow.
+	Folded map[string]bool
+	// Omit lists the properties which are not loaded.
+	Omit map[string]bool
+	// Legacy is set on load when the entity lacks meta properties, which are
+	// then synthesized.
+	Legacy bool
 }
 
 // Load implements the PropertyLoadSaver interface to process our dynamic payload data
 // see https://godoc.org/cloud.google.com/go/datastore#hdr-The_PropertyLoadSaver_Interface
 func (e *Entity) Load(ps []datastore.Property) error {
-	e.Payload = make(map[string]interface{}, len(ps)-3)
+	e.Payload = make(map[string]interface{}, len(ps))
+	hasETag, hasUpdated := false, false
 	for _, prop := range ps {
 		// Load our hard coded fields if property name matches
-		// otherwise load the dynamic property into Payload map
+		// otherwise load the dynamic property into Payload map. Meta fields
+		// of unexpected types are ignored so legacy entities can be loaded.
 		switch prop.Name {
 		case "_id":
-			e.ID = prop.Value.(string)
+			if id, ok := prop.Value.(string); ok {
+				e.ID = id
+			}
 		case "_etag":
-			e.ETag = prop.Value.(string)
+			e.ETag, hasETag = prop.Value.(string)
 		case "_updated":
-			e.Updated = prop.Value.(time.Time)
+			e.Updated, hasUpdated = prop.Value.(time.Time)
+		case createdProperty:
+			e.Created, _ = prop.Value.(time.Time)
+		case createdByProperty:
+			e.CreatedBy, _ = prop.Value.(string)
+		case expiresProperty:
+			e.Expires, _ = prop.Value.(time.Time)
+		case updatedByProperty:
+			e.UpdatedBy, _ = prop.Value.(string)
+		case sampleProperty:
+			// Only used to select samples
+		case blobProperty:
+			if err := decodeBlob(prop.Value.([]byte), e.Payload); err != nil {
+				return err
+			}
 		default:
+			if isHashProperty(prop.Name) || isFoldedProperty(prop.Name) {
+				// Only used to filter on hashed and folded fields
+				continue
+			}
 			e.Payload[prop.Name] = prop.Value
+			if prop.NoIndex {
+				// Kept so entities written by an entity codec can be saved
+				// again as is
+				if e.NoIndexProps == nil {
+					e.NoIndexProps = map[string]bool{}
+				}
+				e.NoIndexProps[prop.Name] = true
+			}
 		}
 	}
+	if !hasETag || e.ETag == "" || !hasUpdated {
+		// Synthesize missing meta fields so legacy entities can be served
+		// and updated. The etag only depends on the stored payload so it is
+		// stable until the entity is repaired.
+		e.Legacy = true
+		if !hasETag || e.ETag == "" {
+			e.ETag = payloadETag(e.ID, e.Payload)
+		}
+	}
+	// Strip omitted fields, whether stored as properties or in a blob
+	for f := range e.Omit {
+		delete(e.Payload, f)
+	}
 	return nil
 }
 
+// LoadKey implements the KeyLoader interface so entities written without an
+// _id property get their id from the key name.
+func (e *Entity) LoadKey(k *datastore.Key) error {
+	e.ID = k.Name
+	return nil
+}
+
+// payloadETag computes an etag the same way rest-layer does, from the payload
+// including its id.
+func payloadETag(id string, payload map[string]interface{}) string {
+	p := make(map[string]interface{}, len(payload)+1)
+	for k, v := range payload {
+		p[k] = v
+	}
+	p["id"] = id
+	b, err := json.Marshal(p)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", md5.Sum(b))
+}
+
 // Save implements the PropertyLoadSaver interface to process our dynamic payload data
 // see https://godoc.org/cloud.google.com/go/datastore#hdr-The_PropertyLoadSaver_Interface
 func (e *Entity) Save() ([]datastore.Property, error) {
@@ -87,14 +340,80 @@ func (e *Entity) Save() ([]datastore.Property, error) {
 			Value: e.Updated,
 		},
 	}
+	if !e.Created.IsZero() {
+		ps = append(ps, datastore.Property{
+			Name:  createdProperty,
+			Value: e.Created,
+		})
+	}
+	if !e.Expires.IsZero() {
+		ps = append(ps, datastore.Property{
+			Name:  expiresProperty,
+			Value: e.Expires,
+		})
+	}
+	if e.CreatedBy != "" {
+		ps = append(ps, datastore.Property{
+			Name:  createdByProperty,
+			Value: e.CreatedBy,
+		})
+	}
+	if e.UpdatedBy != "" {
+		ps = append(ps, datastore.Property{
+			Name:  updatedByProperty,
+			Value: e.UpdatedBy,
+		})
+	}
+	if e.Sample {
+		ps = append(ps, datastore.Property{
+			Name:  sampleProperty,
+			Value: sampleValues(e.ID),
+		})
+	}
+	if e.Mode == BlobStorage {
+		b, err := encodeBlob(e.Payload, e.Compression)
+		if err != nil {
+			return nil, err
+		}
+		return append(ps, datastore.Property{
+			Name:    blobProperty,
+			Value:   b,
+			NoIndex: true,
+		}), nil
+	}
+	var blob map[string]interface{}
+	if e.Mode == HybridStorage {
+		blob = make(map[string]interface{}, len(e.Payload))
+	}
 	// Range over the payload and create the datastore.Properties
 	for k, v := range e.Payload {
+		if blob != nil && !e.Queryable[k] {
+			blob[k] = v
+			continue
+		}
 		prop := datastore.Property{
 			Name:    k,
 			Value:   v,
-			NoIndex: e.NoIndexProps[k],
+			NoIndex: e.NoIndexProps[k] || e.Hashed[k],
 		}
 		ps = append(ps, prop)
+		if e.Hashed[k] {
+			ps = append(ps, hashProperty(k, v))
+		}
+		if e.Folded[k] {
+			ps = append(ps, foldedProperty(k, v))
+		}
+	}
+	if len(blob) > 0 {
+		b, err := encodeBlob(blob, e.Compression)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, datastore.Property{
+			Name:    blobProperty,
+			Value:   b,
+			NoIndex: true,
+		})
 	}
 	return ps, nil
 }
@@ -110,12 +429,40 @@ func newItem(e *Entity) *resource.Item {
 	}
 }
 
-// transformValue transforms slices and maps to entities that can be stored in Datastore.
+// loadItem converts an entity loaded from the Datastore into a resource.Item,
+// resolving the parts of the payload stored outside of the entity.
+func (d *Handler) loadItem(ctx context.Context, e *Entity) (*resource.Item, error) {
+	if err := d.decodeEntity(e); err != nil {
+		return nil, err
+	}
+	if err := d.rehydrate(ctx, e.Payload); err != nil {
+		return nil, err
+	}
+	if err := d.decryptFields(ctx, e.Payload); err != nil {
+		return nil, err
+	}
+	if err := d.decodeValues(e.Payload, ""); err != nil {
+		return nil, err
+	}
+	if e.Legacy {
+		d.scheduleRepair(ctx, e.ID)
+	}
+	item := newItem(e)
+	d.exposeAudit(e, item.Payload)
+	return item, nil
+}
+
+// transformValue transforms slices and maps to entities that can be stored in
+// Datastore. It is the default conversion of values not handled by a codec.
 func (d *Handler) transformValue(value interface{}, key string) interface{} {
 	reflectValue := reflect.ValueOf(value)
 	switch reflectValue.Kind() {
 	case reflect.Slice:
-		sliceValue := value.([]interface{})
+		sliceValue, ok := value.([]interface{})
+		if !ok {
+			// Blobs such as encrypted values are stored as is
+			return value
+		}
 		for index := 0; index < reflectValue.Len(); index++ {
 			innerValue := sliceValue[index]
 			switch innerValue.(type) {
@@ -165,17 +512,62 @@ func (d *Handler) mapToDatastoreEntity(m map[string]interface{}, parentKey strin
 func (d *Handler) newEntity(i *resource.Item) *Entity {
 	p := make(map[string]interface{}, len(i.Payload))
 	for key, value := range i.Payload {
-		if key != "id" {
+		if key == "id" || isAuditField(key) {
+			continue
+		}
+		if d.mode == BlobStorage || (d.mode == HybridStorage && !d.queryableFields[key]) {
+			p[key] = value
+		} else {
 			p[key] = d.transformValue(value, key)
 		}
 	}
-	return &Entity{
-		ID:           i.ID.(string),
-		ETag:         i.ETag,
-		Updated:      i.Updated,
-		Payload:      p,
-		NoIndexProps: d.noIndexProps,
+	e := &Entity{
+		ID:      i.ID.(string),
+		ETag:    i.ETag,
+		Updated: i.Updated,
+		Payload: p,
 	}
+	if d.expirationField != "" {
+		e.Expires, _ = i.Payload[d.expirationField].(time.Time)
+	}
+	return d.configureEntity(e)
+}
+
+// configureEntity sets how the entity should be saved according to the
+// handler configuration.
+func (d *Handler) configureEntity(e *Entity) *Entity {
+	if d.entityCodec == nil {
+		e.NoIndexProps = d.entityNoIndex()
+		e.Mode = d.mode
+	} else {
+		// Entities loaded with a codec keep their stored noindex flags
+		if e.NoIndexProps == nil {
+			e.NoIndexProps = d.entityNoIndex()
+		}
+		e.Mode = PropertyStorage
+	}
+	e.Queryable = d.queryableFields
+	e.Compression = d.blobCompression()
+	e.Sample = d.sampling
+	e.Hashed = d.hashedFields
+	e.Folded = d.foldedFields
+	return e
+}
+
+// entityNoIndex returns the top level properties which should not be indexed,
+// including the encrypted fields.
+func (d *Handler) entityNoIndex() map[string]bool {
+	if len(d.encryptedFields) == 0 {
+		return d.noIndexProps
+	}
+	p := make(map[string]bool, len(d.noIndexProps)+len(d.encryptedFields))
+	for k, v := range d.noIndexProps {
+		p[k] = v
+	}
+	for _, f := range d.encryptedFields {
+		p[f] = true
+	}
+	return p
 }
 
 // SetNoIndexProperties sets the handlers properties which should have noindex set.
@@ -188,6 +580,73 @@ func (d *Handler) SetNoIndexProperties(props []string) *Handler {
 	return d
 }
 
+// prepareEntity converts an item into the entity to be stored under key,
+// encrypting and offloading its fields as configured and checking its size,
+// which is reported unless the item is partial.
+func (d *Handler) prepareEntity(ctx context.Context, key *datastore.Key, item *resource.Item, partial bool) (*Entity, error) {
+	item, err := d.encodeItem(item)
+	if err != nil {
+		return nil, err
+	}
+	if item, err = d.encryptFields(ctx, item); err != nil {
+		return nil, err
+	}
+	if item, err = d.offload(ctx, item); err != nil {
+		return nil, err
+	}
+	entity := d.newEntity(item)
+	if err = d.encodeEntity(entity); err != nil {
+		return nil, err
+	}
+	if partial {
+		err = checkEntitySize(key, entity)
+	} else {
+		err = d.checkWriteSize(ctx, key, entity)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+
+// SetStorageMode sets how the item payload is laid out in stored entities.
+func (d *Handler) SetStorageMode(mode StorageMode) *Handler {
+	d.mode = mode
+	return d
+}
+
+// SetWriteOnlyFields sets top level fields which are stored but never loaded,
+// so they can't leak through Find, matching the semantics of rest-layer
+// Hidden/Password fields at the storage layer. Update keeps the stored value
+// of a write-only field when the new payload doesn't set it, so those fields
+// should not be Required in the schema.
+func (d *Handler) SetWriteOnlyFields(fields []string) *Handler {
+	f := make(map[string]bool, len(fields))
+	for _, v := range fields {
+		f[v] = true
+	}
+	d.writeOnlyFields = f
+	return d
+}
+
+// SetClock sets the function giving the current time of the handler, which
+// resolves DateMath expressions in query filters, expires entities and cached
+// results, and timestamps audit fields, revisions, change records, outbox
+// events, tombstones and write fences. It defaults to time.Now. The circuit
+// breaker and the retries always use the wall clock.
+func (d *Handler) SetClock(clock func() time.Time) *Handler {
+	d.clock = clock
+	return d
+}
+
+// now returns the current time according to the handler clock.
+func (d *Handler) now() time.Time {
+	if d.clock != nil {
+		return d.clock()
+	}
+	return time.Now()
+}
+
 func (d *Handler) getNamespace(ctx context.Context) string {
 	namespace := ctx.Value("namespace")
 	if namespace != nil {
@@ -197,31 +656,126 @@ func (d *Handler) getNamespace(ctx context.Context) string {
 }
 
 // Insert inserts new entities
-func (d *Handler) Insert(ctx context.Context, items []*resource.Item) error {
-	for _, item := range items {
+func (d *Handler) Insert(ctx context.Context, items []*resource.Item) (err error) {
+	ctx, op := d.startOperation(ctx, "Insert")
+	defer func() { err = op.end(len(items), err) }()
+	op.touch(items...)
+	if h := d.hooks.AfterInsert; h != nil {
+		defer func() { h(ctx, items, err) }()
+	}
+	if h := d.hooks.BeforeInsert; h != nil {
+		if err = h(ctx, items); err != nil {
+			return err
+		}
+	}
+	if err := d.checkFence(ctx); err != nil {
+		return err
+	}
+	// Each insertion comes with its records, committed in the same
+	// transaction
+	groups := make([][]*datastore.Mutation, 0, len(items))
+	claimed := map[string]bool{}
+	entities := make([]*Entity, len(items))
+	ids := make([]string, len(items))
+	etags := make([]string, len(items))
+	keys := make([]*datastore.Key, len(items))
+	for i, item := range items {
+		ids[i], etags[i] = item.ID.(string), item.ETag
 		key := datastore.NameKey(d.entity, item.ID.(string), nil)
 		key.Namespace = d.getNamespace(ctx)
-		entity := d.newEntity(item)
-		_, err := d.client.Mutate(ctx, datastore.NewInsert(key, entity))
+		keys[i] = key
+		item, err := d.computeFields(item)
+		if err != nil {
+			return err
+		}
+		entity, err := d.prepareEntity(ctx, key, item, false)
+		if err != nil {
+			return err
+		}
+		d.stampAudit(ctx, entity, nil)
+		entities[i] = entity
+		group := []*datastore.Mutation{datastore.NewInsert(key, entity)}
+		group = append(group, d.recordMutations(key, ChangeInsert, "", entity.ETag)...)
+		unique, err := d.uniqueInserts(key, item.Payload, claimed)
+		if err != nil {
+			return err
+		}
+		group = append(group, unique...)
+		rows, err := d.indexChanges(key, nil, item.Payload)
 		if err != nil {
 			return err
 		}
+		views, err := d.viewChanges(key, entity, item.Payload)
+		if err != nil {
+			return err
+		}
+		group = append(append(group, rows...), views...)
+		group = append(group, d.mirrorChanges(key, entity)...)
+		groups = append(groups, group)
+	}
+	var committed int
+	err = d.withDeadline(ctx, "insert", func(ctx context.Context) (err error) {
+		committed, err = d.commitGroups(ctx, groups, false)
+		return d.uniqueConflict(err)
+	})
+	if err != nil {
+		for _, e := range entities[committed:] {
+			d.purgeOverflow(ctx, e.Payload)
+		}
+		return err
 	}
+	for _, e := range entities {
+		d.reportWrite(ChangeInsert, nil, e)
+	}
+	d.mirror(ctx, keys, entities)
+	d.invalidateCache(ids)
+	d.logOps(ctx, ChangeInsert, items, nil)
+	d.notify(ctx, ChangeInsert, ids, etags)
 	return nil
 }
 
 // Update replace an entity by a new one in the Datastore
-func (d *Handler) Update(ctx context.Context, item *resource.Item, original *resource.Item) error {
-	var err error
-
-	entity := d.newEntity(item)
+func (d *Handler) Update(ctx context.Context, item *resource.Item, original *resource.Item) (err error) {
+	ctx, op := d.startOperation(ctx, "Update")
+	defer func() { err = op.end(1, err) }()
+	op.touch(item)
+	if h := d.hooks.AfterUpdate; h != nil {
+		defer func() { h(ctx, item, original, err) }()
+	}
+	if h := d.hooks.BeforeUpdate; h != nil {
+		if err = h(ctx, item, original); err != nil {
+			return err
+		}
+	}
+	if err := d.checkFence(ctx); err != nil {
+		return err
+	}
+	computed, err := d.computeFields(item)
+	if err != nil {
+		return err
+	}
+	var diff *payloadDiff
+	prepared := computed
+	if d.diffUpdates {
+		// Only the changed fields are prepared, the others are merged from
+		// the stored entity
+		diff = diffPayload(original.Payload, computed.Payload)
+		prepared = diff.item(computed)
+	}
+	key := datastore.NameKey(d.entity, original.ID.(string), nil)
+	key.Namespace = d.getNamespace(ctx)
+	entity, err := d.prepareEntity(ctx, key, prepared, diff != nil)
+	if err != nil {
+		return err
+	}
+	if diff != nil && d.expirationField != "" {
+		entity.Expires, _ = computed.Payload[d.expirationField].(time.Time)
+	}
+	var current Entity
+	var written *Entity
 	// Run a transaction to update the Entity if the Entity exist and the ETags match
-	tx := func(tx *datastore.Transaction) error {
-		// Create a key for our current Entity
-		key := datastore.NameKey(d.entity, original.ID.(string), nil)
-		key.Namespace = d.getNamespace(ctx)
-
-		var current Entity
+	tx := func(tx Transaction) error {
+		current = Entity{}
 		// Attempt to get the existing Entity
 		if err = tx.Get(key, &current); err != nil {
 			if err == datastore.ErrNoSuchEntity {
@@ -232,45 +786,181 @@ func (d *Handler) Update(ctx context.Context, item *resource.Item, original *res
 		if current.ETag != original.ETag {
 			return resource.ErrConflict
 		}
+		if len(d.immutableFields) > 0 {
+			stored, derr := d.decodedPayload(ctx, &current)
+			if derr != nil {
+				return derr
+			}
+			if err = d.checkImmutable(stored, computed.Payload); err != nil {
+				return err
+			}
+		}
+		written = entity
+		if diff != nil {
+			written = diff.merge(&current, entity)
+			if err = d.checkWriteSize(ctx, key, written); err != nil {
+				return err
+			}
+		}
+		d.stampAudit(ctx, written, &current)
+		// Write-only and read-excluded fields may be missing from the
+		// original item so they must be carried over
+		for _, fields := range []map[string]bool{d.writeOnlyFields, d.readExcludedFields} {
+			for f := range fields {
+				if _, found := written.Payload[f]; !found && current.Payload[f] != nil {
+					written.Payload[f] = current.Payload[f]
+				}
+			}
+		}
+		var muts []*datastore.Mutation
+		if m := d.historyMutation(key, &current, "update"); m != nil {
+			muts = append(muts, m)
+		}
+		muts = append(muts, d.recordMutations(key, ChangeUpdate, current.ETag, written.ETag)...)
+		unique, uerr := d.uniqueChanges(tx, key, original.Payload, computed.Payload)
+		if uerr != nil {
+			return uerr
+		}
+		muts = append(muts, unique...)
+		rows, uerr := d.indexChanges(key, original.Payload, computed.Payload)
+		if uerr != nil {
+			return uerr
+		}
+		views, uerr := d.viewChanges(key, written, computed.Payload)
+		if uerr != nil {
+			return uerr
+		}
+		muts = append(append(muts, rows...), views...)
+		muts = append(muts, d.mirrorChanges(key, written)...)
+		if len(muts) > 0 {
+			if _, err = tx.Mutate(muts...); err != nil {
+				return err
+			}
+		}
 		// Update the Entity
-		_, err = tx.Put(key, entity)
+		_, err = tx.Put(key, written)
 		return err
 	}
-	_, err = d.client.RunInTransaction(ctx, tx, datastore.MaxAttempts(1))
-	return err
+	err = d.withDeadline(ctx, "update", func(ctx context.Context) error {
+		return d.runTx(ctx, tx)
+	})
+	if err != nil {
+		// The values offloaded for the write are pointed to by no entity
+		d.purgeOverflow(ctx, entity.Payload)
+		return err
+	}
+	if d.historyKind == "" {
+		d.purgeReplaced(ctx, current.Payload, written.Payload)
+	}
+	d.reportWrite(ChangeUpdate, d.configureEntity(&current), written)
+	d.mirror(ctx, []*datastore.Key{key}, []*Entity{written})
+	d.invalidateCache([]string{entity.ID})
+	d.logOps(ctx, ChangeUpdate, []*resource.Item{item}, nil)
+	d.notify(ctx, ChangeUpdate, []string{entity.ID}, []string{entity.ETag})
+	return nil
 }
 
 // Delete deletes an item from the datastore
-func (d *Handler) Delete(ctx context.Context, item *resource.Item) error {
-	var err error
+func (d *Handler) Delete(ctx context.Context, item *resource.Item) (err error) {
+	ctx, op := d.startOperation(ctx, "Delete")
+	defer func() { err = op.end(1, err) }()
+	op.touch(item)
+	if h := d.hooks.AfterDelete; h != nil {
+		defer func() { h(ctx, item, err) }()
+	}
+	if h := d.hooks.BeforeDelete; h != nil {
+		if err = h(ctx, item); err != nil {
+			return err
+		}
+	}
+	if err := d.checkFence(ctx); err != nil {
+		return err
+	}
+	key := datastore.NameKey(d.entity, item.ID.(string), nil)
+	key.Namespace = d.getNamespace(ctx)
+	var deleted Entity
 	// Run a transaction to update the Entity if the Entity exist and the ETags match
-	tx := func(tx *datastore.Transaction) error {
-		// Create a key for our target Entity
-		key := datastore.NameKey(d.entity, item.ID.(string), nil)
-		key.Namespace = d.getNamespace(ctx)
-
-		var e Entity
+	tx := func(tx Transaction) error {
 		// Attempt to get the existing Entity
-		if err = tx.Get(key, &e); err != nil {
+		if err = tx.Get(key, &deleted); err != nil {
 			if err == datastore.ErrNoSuchEntity {
 				return resource.ErrNotFound
 			}
 			return err
 		}
-		if e.ETag != item.ETag {
+		if deleted.ETag != item.ETag {
 			return resource.ErrConflict
 		}
+		if err = d.checkReferrers(ctx, tx, item.ID.(string)); err != nil {
+			return err
+		}
 		// Delete the Entity
-		err = tx.Delete(key)
+		if err = tx.Delete(key); err != nil {
+			return err
+		}
+		muts := d.deleteCompanions(key, deleted.ETag)
+		muts = append(muts, d.uniqueReleases(key, item.Payload)...)
+		rows, uerr := d.indexChanges(key, item.Payload, nil)
+		if uerr != nil {
+			return uerr
+		}
+		views, uerr := d.viewChanges(key, nil, nil)
+		if uerr != nil {
+			return uerr
+		}
+		muts = append(append(muts, rows...), views...)
+		muts = append(muts, d.mirrorChanges(key, nil)...)
+		if m := d.historyMutation(key, &deleted, "delete"); m != nil {
+			muts = append(muts, m)
+		}
+		if len(muts) > 0 {
+			_, err = tx.Mutate(muts...)
+		}
+		return err
+	}
+	err = d.withDeadline(ctx, "delete", func(ctx context.Context) error {
+		return d.runTx(ctx, tx)
+	})
+	if err != nil {
 		return err
 	}
-	_, err = d.client.RunInTransaction(ctx, tx, datastore.MaxAttempts(1))
-	return err
+	if d.historyKind == "" {
+		d.purgeOverflow(ctx, deleted.Payload)
+	}
+	d.invalidateDeleted([]string{deleted.ID})
+	d.logOps(ctx, ChangeDelete, nil, []string{deleted.ID})
+	d.notify(ctx, ChangeDelete, []string{deleted.ID}, []string{deleted.ETag})
+	d.mirror(ctx, []*datastore.Key{key}, nil)
+	if err := d.deleteDescendants(ctx, []*datastore.Key{key}); err != nil {
+		d.cleanupFailed(ctx, err)
+	}
+	d.nullifyReferrers(ctx, deleted.ID)
+	return nil
 }
 
 // Clear clears all entities matching the lookup from the Datastore
-func (d *Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
-	qry, err := getQuery(d.entity, d.getNamespace(ctx), q)
+func (d *Handler) Clear(ctx context.Context, q *query.Query) (deleted int, err error) {
+	ctx, op := d.startOperation(ctx, "Clear", queryAttrs(q)...)
+	defer func() { err = op.end(deleted, err) }()
+	op.query = q
+	if h := d.hooks.AfterClear; h != nil {
+		defer func() { h(ctx, q, deleted, err) }()
+	}
+	if h := d.hooks.BeforeClear; h != nil {
+		if err = h(ctx, q); err != nil {
+			return 0, err
+		}
+	}
+	if err := d.checkFence(ctx); err != nil {
+		return 0, err
+	}
+	p, ok, err := d.normalizePredicate(q.Predicate)
+	if err != nil || !ok {
+		return 0, err
+	}
+	nq := *q
+	nq.Predicate = p
+	qry, err := d.getQuery(ctx, &nq)
 	if err != nil {
 		return 0, err
 	}
@@ -279,36 +969,257 @@ func (d *Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
 		qry = applyWindow(qry, *q.Window)
 	}
 
-	c, err := d.client.Count(ctx, qry)
+	var keys []*datastore.Key
+	err = StreamKeys(ctx, d.client, qry, func(key *datastore.Key) error {
+		keys = append(keys, key)
+		return nil
+	})
 	if err != nil {
 		return 0, err
 	}
-
-	// TODO: Check wheter if DeleteMulti is better here than delete on every
-	// iteration here or not.
-	mKeys := make([]*datastore.Key, c)
-	for t, i := d.client.Run(ctx, qry), 0; ; i++ {
-		var e Entity
-		key, err := t.Next(&e)
-		if err == iterator.Done {
-			break
+	n, err := d.deleteKeys(ctx, keys)
+	if n > 0 && d.topic != nil {
+		ids := make([]string, n)
+		for i, key := range keys[:n] {
+			ids[i] = key.Name
 		}
-		mKeys[i] = key
+		d.notify(ctx, ChangeDelete, ids, nil)
 	}
+	return n, err
+}
 
-	err = d.client.DeleteMulti(ctx, mKeys)
+// deleteKeys deletes the entities with the given keys in batches, along with
+// their companion mutations, and returns the number of deleted entities.
+func (d *Handler) deleteKeys(ctx context.Context, keys []*datastore.Key) (int, error) {
+	// Each deletion comes with its companion mutations, committed in the
+	// same transaction
+	groups := make([][]*datastore.Mutation, len(keys))
+	stored, err := d.loadDeleted(ctx, keys)
 	if err != nil {
 		return 0, err
 	}
-	return len(mKeys), nil
+	// The payloads are unknown, the sentinels and index rows are found by
+	// the name of their owner
+	owned := map[string][]*datastore.Key{}
+	for _, f := range d.uniqueFields {
+		if err := d.ownedKeys(ctx, d.entity+"_unique_"+f, "_owner", keys, owned); err != nil {
+			return 0, err
+		}
+	}
+	for _, idx := range d.emulatedIndexes {
+		if err := d.ownedKeys(ctx, d.indexKind(idx), "_id", keys, owned); err != nil {
+			return 0, err
+		}
+	}
+	for i, key := range keys {
+		groups[i] = append([]*datastore.Mutation{datastore.NewDelete(key)}, d.deleteCompanions(key, "")...)
+		if stored != nil && stored[i] != nil {
+			if m := d.historyMutation(key, stored[i], "delete"); m != nil {
+				groups[i] = append(groups[i], m)
+			}
+		}
+		for _, k := range owned[key.String()] {
+			groups[i] = append(groups[i], datastore.NewDelete(k))
+		}
+		views, err := d.viewChanges(key, nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		groups[i] = append(groups[i], views...)
+		groups[i] = append(groups[i], d.mirrorChanges(key, nil)...)
+	}
+	n, err := d.commitGroups(ctx, groups, true)
+	if n > 0 {
+		d.mirror(ctx, keys[:n], nil)
+		ids := make([]string, n)
+		for i, key := range keys[:n] {
+			ids[i] = key.Name
+		}
+		d.invalidateDeleted(ids)
+		d.logOps(ctx, ChangeDelete, nil, ids)
+		if d.historyKind == "" && stored != nil {
+			for _, e := range stored[:n] {
+				if e != nil {
+					d.purgeOverflow(ctx, e.Payload)
+				}
+			}
+		}
+		if err := d.deleteDescendants(ctx, keys[:n]); err != nil {
+			d.cleanupFailed(ctx, err)
+		}
+	}
+	return n, err
+}
+
+// loadDeleted returns the stored entities with keys, nil for the missing
+// ones, when their deletion needs them to record their revision or to purge
+// their overflow objects, and nil otherwise.
+func (d *Handler) loadDeleted(ctx context.Context, keys []*datastore.Key) ([]*Entity, error) {
+	if d.historyKind == "" && d.overflowBucket == nil {
+		return nil, nil
+	}
+	stored := make([]*Entity, len(keys))
+	for start := 0; start < len(keys); start += maxGetMulti {
+		end := start + maxGetMulti
+		if end > len(keys) {
+			end = len(keys)
+		}
+		entities := make([]Entity, end-start)
+		err := d.retry(ctx, true, func() error {
+			return d.client.GetMulti(ctx, keys[start:end], entities)
+		})
+		merr, _ := err.(datastore.MultiError)
+		if err != nil && merr == nil {
+			return nil, err
+		}
+		for i := range entities {
+			if merr == nil || merr[i] == nil {
+				stored[start+i] = &entities[i]
+			} else if merr[i] != datastore.ErrNoSuchEntity {
+				return nil, merr[i]
+			}
+		}
+	}
+	return stored, nil
+}
+
+// ownedKeys adds to owned the keys of the entities of kind whose property
+// holds the name of one of keys, indexed by the string form of that key. They
+// are found with a query per namespace and MaxInValues names.
+func (d *Handler) ownedKeys(ctx context.Context, kind, property string, keys []*datastore.Key, owned map[string][]*datastore.Key) error {
+	names := map[string][]interface{}{}
+	for _, key := range keys {
+		names[key.Namespace] = append(names[key.Namespace], key.Name)
+	}
+	for ns, all := range names {
+		for start := 0; start < len(all); start += MaxInValues {
+			end := start + MaxInValues
+			if end > len(all) {
+				end = len(all)
+			}
+			qry := datastore.NewQuery(kind).
+				Namespace(ns).
+				Filter(property+" in", all[start:end])
+			var entities []datastore.PropertyList
+			found, err := d.client.GetAll(ctx, qry, &entities)
+			if err != nil {
+				return err
+			}
+			for i, props := range entities {
+				for _, p := range props {
+					if name, ok := p.Value.(string); ok && p.Name == property {
+						owner := datastore.NameKey(d.entity, name, nil)
+						owner.Namespace = ns
+						owned[owner.String()] = append(owned[owner.String()], found[i])
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// commitGroups commits groups of mutations in as few transactions as possible,
+// never splitting a group, and returns the number of committed groups.
+// Non-transactional commits may apply some mutations only, so each commit is
+// a transaction applying all of its mutations or none. With adaptive batches,
+// commits of idempotent mutations failing because of their size are retried
+// with fewer groups.
+func (d *Handler) commitGroups(ctx context.Context, groups [][]*datastore.Mutation, idempotent bool) (int, error) {
+	committed := 0
+	for len(groups) > 0 {
+		limit := d.batchSize()
+		var commit []*datastore.Mutation
+		n := 0
+		for ; n < len(groups) && len(commit)+len(groups[n]) <= MaxMutations; n++ {
+			if n > 0 && len(commit)+len(groups[n]) > limit {
+				break
+			}
+			commit = append(commit, groups[n]...)
+		}
+		start := time.Now()
+		err := d.retry(ctx, idempotent, func() error {
+			if err := d.throttle(ctx, len(commit)); err != nil {
+				return err
+			}
+			_, err := d.client.RunInTransaction(ctx, func(tx Transaction) error {
+				_, err := tx.Mutate(commit...)
+				return err
+			})
+			return err
+		})
+		d.observeCommit(ctx, len(commit))
+		if d.observeBatch(time.Since(start), err) && idempotent && n > 1 {
+			continue
+		}
+		if err != nil {
+			return committed, err
+		}
+		committed += n
+		groups = groups[n:]
+	}
+	return committed, nil
+}
+
+// deleteCompanions returns the mutations to commit along with the deletion of
+// the entity with key and etag, which may be unknown.
+func (d *Handler) deleteCompanions(key *datastore.Key, etag string) []*datastore.Mutation {
+	var muts []*datastore.Mutation
+	if m := d.tombstoneMutation(key); m != nil {
+		muts = append(muts, m)
+	}
+	return append(muts, d.recordMutations(key, ChangeDelete, etag, "")...)
 }
 
 // Find entities matching the provided lookup from the Datastore
-func (d *Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList, error) {
-	qry, err := getQuery(d.entity, d.getNamespace(ctx), q)
-	if err != nil {
-		return nil, err
+func (d *Handler) Find(ctx context.Context, q *query.Query) (result *resource.ItemList, err error) {
+	ctx, op := d.startOperation(ctx, "Find", queryAttrs(q)...)
+	cached := false
+	defer func() {
+		n := 0
+		if result != nil {
+			n = len(result.Items)
+		}
+		profileOf(ctx).finish(n, cached, time.Since(op.start))
+		err = op.end(n, err)
+	}()
+	op.query = q
+	if h := d.hooks.AfterFind; h != nil {
+		defer func() { h(ctx, q, result, err) }()
+	}
+	if h := d.hooks.BeforeFind; h != nil {
+		if err = h(ctx, q); err != nil {
+			return nil, err
+		}
+	}
+	var list *resource.ItemList
+	cacheKey, cacheID, cacheable := d.cacheKey(ctx, q)
+	if cacheable {
+		list, _ = d.cached(ctx, cacheKey, cacheID)
+		cached = list != nil
+	}
+	if list == nil {
+		if key, ok := d.coalesceKey(ctx, q); ok {
+			list, err = d.findShared(ctx, key, q)
+		} else {
+			list, err = d.findList(ctx, q)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cacheable {
+			d.storeCache(ctx, cacheKey, cacheID, list)
+		}
 	}
+	d.shadowFind(ctx, q, list)
+	// The shadow read may still use list in the background
+	projected := *list
+	projected.Items = projectItems(ctx, list.Items, q.Projection)
+	return &projected, nil
+}
+
+// findList runs q and returns the matching items.
+func (d *Handler) findList(ctx context.Context, q *query.Query) (*resource.ItemList, error) {
 	offset := 0
 	limit := -1
 
@@ -325,27 +1236,121 @@ func (d *Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 		Total:  -1,
 		Offset: offset,
 		Limit:  limit,
-		Items:  []*resource.Item{},
+	}
+	p, ok, err := d.normalizePredicate(q.Predicate)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// The predicate is contradictory, no need to run the query
+		list.Items = []*resource.Item{}
+		return list, nil
+	}
+	nq := *q
+	nq.Predicate = p
+	if idx, rp := d.emulatedIndexFor(p); idx != nil {
+		d.planned(ctx, "emulated index "+idx.Name, &nq)
+		list.Items, err = d.findEmulated(ctx, &nq, idx, rp)
+	} else if k, ok := ctx.Value(keysetCtxKey).(Keyset); ok {
+		d.planned(ctx, "keyset", &nq)
+		list.Offset = 0
+		list.Items, err = d.findKeyset(ctx, &nq, k)
+	} else if hasGeo(p) {
+		d.planned(ctx, "geo", &nq)
+		list.Items, err = d.findGeo(ctx, &nq)
+	} else if in, rest := splitLargeIn(p); in != nil {
+		d.planned(ctx, "large in", &nq)
+		list.Items, err = d.findLargeIn(ctx, &nq, in, rest)
+	} else {
+		d.planned(ctx, "query", &nq)
+		list.Items, err = d.find(ctx, &nq)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// find runs q as a single Datastore query.
+func (d *Handler) find(ctx context.Context, q *query.Query) ([]*resource.Item, error) {
+	qry, err := d.getQuery(ctx, q)
+	if err != nil {
+		return nil, err
 	}
 	if q.Window != nil {
 		qry = applyWindow(qry, *q.Window)
 	}
+	if qry, err = applySample(ctx, qry); err != nil {
+		return nil, err
+	}
+	if q.Window == nil || q.Window.Limit < 0 {
+		return d.runQuery(ctx, qry)
+	}
+	// Pages are hedged
+	v, err := d.hedged(ctx, func(ctx context.Context) (interface{}, error) {
+		return d.runQuery(ctx, qry)
+	})
+	items, _ := v.([]*resource.Item)
+	return items, err
+}
 
+// runQuery runs qry and converts the resulting entities into items, running
+// it again from the start on transient errors.
+func (d *Handler) runQuery(ctx context.Context, qry *datastore.Query) ([]*resource.Item, error) {
+	var items []*resource.Item
+	err := d.retry(ctx, true, func() (err error) {
+		items, err = d.runQueryOnce(ctx, qry)
+		return err
+	})
+	return items, err
+}
+
+func (d *Handler) runQueryOnce(ctx context.Context, qry *datastore.Query) ([]*resource.Item, error) {
+	if err := d.throttle(ctx, 1); err != nil {
+		return nil, err
+	}
+	items := []*resource.Item{}
+	fetched := 0
+	defer func() { profileOf(ctx).fetched(fetched) }()
 	for t := d.client.Run(ctx, qry); ; {
-		var e Entity
-		_, terr := t.Next(&e)
-		if terr == iterator.Done {
-			break
+		expired := 0
+		for {
+			e := Entity{Omit: d.omittedFields(ctx)}
+			_, terr := t.Next(&e)
+			if terr == iterator.Done {
+				break
+			}
+			if terr != nil {
+				return nil, terr
+			}
+			fetched++
+			if terr = ctx.Err(); terr != nil {
+				return nil, terr
+			}
+			if d.expired(&e) {
+				expired++
+				continue
+			}
+			item, err := d.loadItem(ctx, &e)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		if expired == 0 {
+			return items, nil
 		}
-		if terr != nil {
-			return nil, terr
+		// Expired entities count in the limit of the query, fetch as many
+		// entities after them so the page isn't cut short
+		cursor, err := t.Cursor()
+		if err != nil {
+			return nil, err
 		}
-		if terr = ctx.Err(); terr != nil {
-			return nil, terr
+		if err = d.throttle(ctx, 1); err != nil {
+			return nil, err
 		}
-		list.Items = append(list.Items, newItem(&e))
+		t = d.client.Run(ctx, qry.Start(cursor).Offset(0).Limit(expired))
 	}
-	return list, nil
 }
 
 func applyWindow(qry *datastore.Query, w query.Window) *datastore.Query {
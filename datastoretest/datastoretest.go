@@ -0,0 +1,193 @@
+// Package datastoretest runs the tests of resources stored with
+// rest-layer-datastore against the Datastore emulator. Each test gets a
+// handler on a namespace of its own, seeded with items and purged when the
+// test ends, so tests can share an emulator and run in parallel:
+//
+//	var emulator *datastoretest.Emulator
+//
+//	func TestMain(m *testing.M) {
+//		var err error
+//		if emulator, err = datastoretest.Start(context.Background()); err != nil {
+//			log.Fatal(err)
+//		}
+//		code := m.Run()
+//		emulator.Stop()
+//		os.Exit(code)
+//	}
+//
+//	func TestUsers(t *testing.T) {
+//		h := emulator.Handler(t, "users", &resource.Item{ID: "1", ETag: "a", Payload: ...})
+//		...
+//	}
+package datastoretest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	rld "github.com/ajcrowe/rest-layer-datastore"
+	"github.com/rs/rest-layer/resource"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultProject is the project of the emulators started by Start.
+const DefaultProject = "datastoretest"
+
+// StartTimeout is the time Start waits for the emulator to accept requests.
+var StartTimeout = time.Minute
+
+// Emulator is a Datastore emulator tests run against.
+type Emulator struct {
+	// Host is the host:port the emulator listens on.
+	Host string
+	// Project is the project of the emulator clients.
+	Project string
+	// Client is a client of the emulator.
+	Client *datastore.Client
+	// cmd is the emulator process, nil when attached to a running emulator.
+	cmd *exec.Cmd
+}
+
+// Start attaches to the emulator of the DATASTORE_EMULATOR_HOST environment
+// variable, with the project of DATASTORE_PROJECT_ID, or starts an in-memory
+// emulator with the gcloud command and waits until it accepts requests.
+func Start(ctx context.Context) (*Emulator, error) {
+	e := &Emulator{Host: os.Getenv("DATASTORE_EMULATOR_HOST"), Project: os.Getenv("DATASTORE_PROJECT_ID")}
+	if e.Project == "" {
+		e.Project = DefaultProject
+	}
+	if e.Host == "" {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			return nil, err
+		}
+		e.Host = l.Addr().String()
+		l.Close()
+		e.cmd = exec.Command("gcloud", "beta", "emulators", "datastore", "start",
+			"--project="+e.Project, "--host-port="+e.Host, "--no-store-on-disk", "--consistency=1.0")
+		if err = e.cmd.Start(); err != nil {
+			return nil, fmt.Errorf("datastoretest: starting emulator: %v", err)
+		}
+		if err = e.wait(ctx); err != nil {
+			e.cmd.Process.Kill()
+			return nil, err
+		}
+		// The client finds the emulator with the environment
+		os.Setenv("DATASTORE_EMULATOR_HOST", e.Host)
+	}
+	c, err := datastore.NewClient(ctx, e.Project)
+	if err != nil {
+		e.Stop()
+		return nil, err
+	}
+	e.Client = c
+	return e, nil
+}
+
+// wait waits until the emulator answers its health check.
+func (e *Emulator) wait(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, StartTimeout)
+	defer cancel()
+	for {
+		if res, err := http.Get("http://" + e.Host); err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("datastoretest: emulator not ready on %s: %v", e.Host, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Stop closes the client and shuts the emulator down if it was started by
+// Start.
+func (e *Emulator) Stop() error {
+	if e.Client != nil {
+		e.Client.Close()
+	}
+	if e.cmd == nil {
+		return nil
+	}
+	if res, err := http.Post("http://"+e.Host+"/shutdown", "", nil); err == nil {
+		res.Body.Close()
+	} else {
+		e.cmd.Process.Kill()
+	}
+	return e.cmd.Wait()
+}
+
+// invalidNamespace matches the characters namespaces can't contain.
+var invalidNamespace = regexp.MustCompile(`[^0-9A-Za-z._-]`)
+
+// Namespace returns a namespace of its own for t, whose entities are deleted
+// when t ends.
+func (e *Emulator) Namespace(t testing.TB) string {
+	t.Helper()
+	b := make([]byte, 4)
+	rand.Read(b)
+	ns := invalidNamespace.ReplaceAllString(t.Name(), "_")
+	if len(ns) > 90 {
+		ns = ns[:90]
+	}
+	ns += "-" + hex.EncodeToString(b)
+	t.Cleanup(func() {
+		if err := e.Purge(context.Background(), ns); err != nil {
+			t.Errorf("datastoretest: purging namespace %s: %v", ns, err)
+		}
+	})
+	return ns
+}
+
+// Handler returns a handler on kind in a namespace of its own, seeded with
+// items, whose entities are deleted when t ends.
+func (e *Emulator) Handler(t testing.TB, kind string, items ...*resource.Item) *rld.Handler {
+	t.Helper()
+	h := rld.NewHandler(rld.WrapClient(e.Client), e.Namespace(t), kind)
+	if len(items) > 0 {
+		if err := h.Insert(context.Background(), items); err != nil {
+			t.Fatalf("datastoretest: seeding %s: %v", kind, err)
+		}
+	}
+	return h
+}
+
+// Purge deletes all the entities of namespace.
+func (e *Emulator) Purge(ctx context.Context, namespace string) error {
+	var keys []*datastore.Key
+	it := e.Client.Run(ctx, datastore.NewQuery("").Namespace(namespace).KeysOnly())
+	for {
+		key, err := it.Next(nil)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > rld.MaxMutations {
+			n = rld.MaxMutations
+		}
+		if err := e.Client.DeleteMulti(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
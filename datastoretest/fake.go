@@ -0,0 +1,207 @@
+package datastoretest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	rld "github.com/ajcrowe/rest-layer-datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// Fake is an in-memory resource.Storer with the semantics of the Datastore
+// handler, for unit tests which don't need the emulator: inserts of existing
+// ids and writes with a stale etag fail with resource.ErrConflict, items are
+// isolated by namespace, chosen like the handler does from the "namespace"
+// context value, and Find returns items in id order unless sorted, with an
+// unknown total. Find and Clear reject the queries the handler rejects, such
+// as $or and $nin filters, with the same errors.
+type Fake struct {
+	mu        sync.Mutex
+	namespace string
+	// Handler validating the queries.
+	validator *rld.Handler
+	// items by namespace and id.
+	items map[string]map[string]*resource.Item
+}
+
+// NewFake returns an empty Fake using namespace when the context gives none.
+func NewFake(namespace string) *Fake {
+	return &Fake{
+		namespace: namespace,
+		validator: rld.NewHandler(nil, namespace, "fake"),
+		items:     map[string]map[string]*resource.Item{},
+	}
+}
+
+// SetValidator sets the handler validating the queries, configured like the
+// handler replaced by the fake, for instance with its schema, hashed and
+// folded fields, so the same queries are rejected. The handler is not used to
+// store items.
+func (f *Fake) SetValidator(h *rld.Handler) *Fake {
+	f.validator = h
+	return f
+}
+
+// getItems returns the items of the namespace of ctx.
+func (f *Fake) getItems(ctx context.Context) map[string]*resource.Item {
+	ns := f.namespace
+	if v, ok := ctx.Value("namespace").(string); ok {
+		ns = v
+	}
+	items := f.items[ns]
+	if items == nil {
+		items = map[string]*resource.Item{}
+		f.items[ns] = items
+	}
+	return items
+}
+
+// Insert implements resource.Storer.
+func (f *Fake) Insert(ctx context.Context, items []*resource.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored := f.getItems(ctx)
+	for _, item := range items {
+		if _, found := stored[fmt.Sprint(item.ID)]; found {
+			return resource.ErrConflict
+		}
+	}
+	for _, item := range items {
+		stored[fmt.Sprint(item.ID)] = copyItem(item)
+	}
+	return nil
+}
+
+// Update implements resource.Storer.
+func (f *Fake) Update(ctx context.Context, item *resource.Item, original *resource.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored := f.getItems(ctx)
+	id := fmt.Sprint(original.ID)
+	o, found := stored[id]
+	if !found {
+		return resource.ErrNotFound
+	}
+	if o.ETag != original.ETag {
+		return resource.ErrConflict
+	}
+	stored[id] = copyItem(item)
+	return nil
+}
+
+// Delete implements resource.Storer.
+func (f *Fake) Delete(ctx context.Context, item *resource.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored := f.getItems(ctx)
+	id := fmt.Sprint(item.ID)
+	o, found := stored[id]
+	if !found {
+		return resource.ErrNotFound
+	}
+	if o.ETag != item.ETag {
+		return resource.ErrConflict
+	}
+	delete(stored, id)
+	return nil
+}
+
+// Clear implements resource.Storer.
+func (f *Fake) Clear(ctx context.Context, q *query.Query) (int, error) {
+	if err := f.validator.ValidateQuery(ctx, q); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored := f.getItems(ctx)
+	items := f.find(stored, q)
+	for _, item := range items {
+		delete(stored, fmt.Sprint(item.ID))
+	}
+	return len(items), nil
+}
+
+// Find implements resource.Storer.
+func (f *Fake) Find(ctx context.Context, q *query.Query) (*resource.ItemList, error) {
+	if err := f.validator.ValidateQuery(ctx, q); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := &resource.ItemList{Total: -1, Limit: -1}
+	if q.Window != nil {
+		if q.Window.Offset > 0 {
+			list.Offset = q.Window.Offset
+		}
+		list.Limit = q.Window.Limit
+	}
+	items := f.find(f.getItems(ctx), q)
+	list.Items = make([]*resource.Item, len(items))
+	for i, item := range items {
+		list.Items[i] = copyItem(item)
+	}
+	return list, nil
+}
+
+// find returns the stored items matching q, sorted and windowed.
+func (f *Fake) find(stored map[string]*resource.Item, q *query.Query) []*resource.Item {
+	items := []*resource.Item{}
+	for _, item := range stored {
+		if q.Predicate.Match(item.Payload) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		for _, s := range q.Sort {
+			c := rld.CompareValues(items[i].GetField(s.Name), items[j].GetField(s.Name))
+			if s.Reversed {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		// Like keys, ids break ties
+		return fmt.Sprint(items[i].ID) < fmt.Sprint(items[j].ID)
+	})
+	if w := q.Window; w != nil {
+		if w.Offset >= len(items) {
+			return []*resource.Item{}
+		}
+		if w.Offset > 0 {
+			items = items[w.Offset:]
+		}
+		if w.Limit > -1 && w.Limit < len(items) {
+			items = items[:w.Limit]
+		}
+	}
+	return items
+}
+
+// copyItem copies item deeply, so stored items can't be changed by callers.
+func copyItem(item *resource.Item) *resource.Item {
+	c := *item
+	c.Payload, _ = copyValue(item.Payload).(map[string]interface{})
+	return &c
+}
+
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[k] = copyValue(v)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, v := range t {
+			s[i] = copyValue(v)
+		}
+		return s
+	}
+	return v
+}
@@ -0,0 +1,90 @@
+package datastoretest
+
+import (
+	"context"
+	"testing"
+
+	rld "github.com/ajcrowe/rest-layer-datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/rest"
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestFake(t *testing.T) {
+	f := NewFake("")
+	ctx := context.Background()
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "age": 30.0}},
+		{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "age": 20.0}},
+		{ID: "3", ETag: "a", Payload: map[string]interface{}{"id": "3", "age": 40.0}},
+	}
+	if err := f.Insert(ctx, items); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Insert(ctx, items[:1]); err != resource.ErrConflict {
+		t.Errorf("expected a conflict inserting an existing id, got %v", err)
+	}
+	other := context.WithValue(ctx, "namespace", "other")
+	if err := f.Insert(other, items[:1]); err != nil {
+		t.Errorf("expected namespaces to be isolated, got %v", err)
+	}
+
+	q, err := query.New("", `{"age": {"$gte": 20}}`, "-age", query.Page(1, 2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Range filters are prepared by the REST layer
+	s := &schema.Schema{Fields: schema.Fields{"age": {Filterable: true, Sortable: true, Validator: &schema.Float{}}}}
+	if err = q.Validate(s); err != nil {
+		t.Fatal(err)
+	}
+	list, err := f.Find(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 2 || list.Items[0].ID != "3" || list.Items[1].ID != "1" || list.Total != -1 {
+		t.Errorf("unexpected page %+v", list)
+	}
+
+	stale := &resource.Item{ID: "1", ETag: "b"}
+	if err := f.Update(ctx, items[0], stale); err != resource.ErrConflict {
+		t.Errorf("expected a conflict updating with a stale etag, got %v", err)
+	}
+	if err := f.Delete(ctx, stale); err != resource.ErrConflict {
+		t.Errorf("expected a conflict deleting with a stale etag, got %v", err)
+	}
+	if err := f.Delete(ctx, &resource.Item{ID: "4"}); err != resource.ErrNotFound {
+		t.Errorf("expected not found deleting a missing item, got %v", err)
+	}
+	n, err := f.Clear(ctx, &query.Query{})
+	if err != nil || n != 3 {
+		t.Errorf("expected 3 cleared items, got %d, %v", n, err)
+	}
+}
+
+func TestFakeUnsupportedPredicates(t *testing.T) {
+	f := NewFake("")
+	ctx := context.Background()
+	for _, filter := range []string{
+		`{"$or": [{"age": 20}, {"age": 30}]}`,
+		`{"age": {"$nin": [20, 30]}}`,
+		`{"name": {"$regex": "^jo"}}`,
+	} {
+		q, err := query.New("", filter, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Find(ctx, q); rest.NewError(err).Code != 501 {
+			t.Errorf("%s: expected a 501 like the handler, got %v", filter, err)
+		}
+		if _, err = f.Clear(ctx, q); err == nil {
+			t.Errorf("%s: expected Clear to fail like the handler", filter)
+		}
+	}
+	q, _ := query.New("", `{"name": {"$regex": "^jo"}}`, "", nil)
+	f.SetValidator(rld.NewHandler(nil, "", "users").SetFoldedFields([]string{"name"}))
+	if _, err := f.Find(ctx, q); err != nil {
+		t.Errorf("expected the validator configuration to be used, got %v", err)
+	}
+}
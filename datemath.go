@@ -0,0 +1,131 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/rest-layer/schema"
+)
+
+// DateMath is a relative time expression resolved against the handler clock
+// when a query is translated. Expressions start with "now", followed by any
+// number of "+N<unit>" / "-N<unit>" offsets and an optional "/<unit>"
+// truncation, e.g. "now-7d", "now/d" or "now-1M/M".
+//
+// Supported units are s (second), m (minute), h (hour), d (day), w (week),
+// M (month) and y (year).
+type DateMath string
+
+// RelativeTime validates time based values like schema.Time but also accepts
+// DateMath expressions in query filters, so clients can express predicates
+// such as {updated: {$gte: "now-7d"}}.
+type RelativeTime struct {
+	schema.Time
+}
+
+// ValidateQuery implements schema.FieldQueryValidator interface
+func (v RelativeTime) ValidateQuery(value interface{}) (interface{}, error) {
+	if s, ok := value.(string); ok && strings.HasPrefix(s, "now") {
+		if _, err := DateMath(s).Resolve(time.Now()); err != nil {
+			return nil, err
+		}
+		return DateMath(s), nil
+	}
+	return v.Time.ValidateQuery(value)
+}
+
+// Resolve computes the absolute time described by the expression relative to now.
+func (e DateMath) Resolve(now time.Time) (time.Time, error) {
+	s := string(e)
+	if !strings.HasPrefix(s, "now") {
+		return time.Time{}, fmt.Errorf("invalid date math %q: must start with now", s)
+	}
+	t := now
+	s = s[3:]
+	for len(s) > 0 {
+		op := s[0]
+		s = s[1:]
+		switch op {
+		case '+', '-':
+			i := 0
+			for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+				i++
+			}
+			if i == 0 || i == len(s) {
+				return time.Time{}, fmt.Errorf("invalid date math %q: offset needs an amount and a unit", e)
+			}
+			n, err := strconv.Atoi(s[:i])
+			if err != nil {
+				return time.Time{}, err
+			}
+			if op == '-' {
+				n = -n
+			}
+			if t, err = addUnit(t, n, s[i]); err != nil {
+				return time.Time{}, fmt.Errorf("invalid date math %q: %v", e, err)
+			}
+			s = s[i+1:]
+		case '/':
+			if len(s) != 1 {
+				return time.Time{}, fmt.Errorf("invalid date math %q: truncation must be last", e)
+			}
+			var err error
+			if t, err = truncateUnit(t, s[0]); err != nil {
+				return time.Time{}, fmt.Errorf("invalid date math %q: %v", e, err)
+			}
+			s = s[1:]
+		default:
+			return time.Time{}, fmt.Errorf("invalid date math %q: unexpected %q", e, op)
+		}
+	}
+	return t, nil
+}
+
+var errUnknownUnit = errors.New("unknown unit")
+
+func addUnit(t time.Time, n int, unit byte) (time.Time, error) {
+	switch unit {
+	case 's':
+		return t.Add(time.Duration(n) * time.Second), nil
+	case 'm':
+		return t.Add(time.Duration(n) * time.Minute), nil
+	case 'h':
+		return t.Add(time.Duration(n) * time.Hour), nil
+	case 'd':
+		return t.AddDate(0, 0, n), nil
+	case 'w':
+		return t.AddDate(0, 0, 7*n), nil
+	case 'M':
+		return t.AddDate(0, n, 0), nil
+	case 'y':
+		return t.AddDate(n, 0, 0), nil
+	}
+	return t, errUnknownUnit
+}
+
+func truncateUnit(t time.Time, unit byte) (time.Time, error) {
+	y, mo, d := t.Date()
+	loc := t.Location()
+	switch unit {
+	case 's':
+		return t.Truncate(time.Second), nil
+	case 'm':
+		return t.Truncate(time.Minute), nil
+	case 'h':
+		return time.Date(y, mo, d, t.Hour(), 0, 0, 0, loc), nil
+	case 'd':
+		return time.Date(y, mo, d, 0, 0, 0, 0, loc), nil
+	case 'w':
+		// Weeks start on Monday
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, mo, d-offset, 0, 0, 0, 0, loc), nil
+	case 'M':
+		return time.Date(y, mo, 1, 0, 0, 0, 0, loc), nil
+	case 'y':
+		return time.Date(y, time.January, 1, 0, 0, 0, 0, loc), nil
+	}
+	return t, errUnknownUnit
+}
@@ -0,0 +1,40 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDateMathResolve(t *testing.T) {
+	now := time.Date(2017, time.March, 15, 13, 45, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"now", now},
+		{"now-7d", time.Date(2017, time.March, 8, 13, 45, 30, 0, time.UTC)},
+		{"now+1h", time.Date(2017, time.March, 15, 14, 45, 30, 0, time.UTC)},
+		{"now/d", time.Date(2017, time.March, 15, 0, 0, 0, 0, time.UTC)},
+		{"now-1M/M", time.Date(2017, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"now/w", time.Date(2017, time.March, 13, 0, 0, 0, 0, time.UTC)},
+		{"now-1y/y", time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := DateMath(tt.expr).Resolve(now)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.expr, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestDateMathResolveInvalid(t *testing.T) {
+	for _, expr := range []string{"yesterday", "now-", "now-7", "now-7x", "now/d-1d", "now*2d"} {
+		if _, err := DateMath(expr).Resolve(time.Now()); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/rest-layer/rest"
+)
+
+// TimeoutError is returned when a write operation is aborted because the
+// request deadline, minus the handler deadline margin, was reached.
+type TimeoutError struct {
+	// Op is the aborted operation.
+	Op string
+	// Elapsed is the time spent in the operation before it was aborted.
+	Elapsed time.Duration
+	// Budget is the time the operation was allowed to run.
+	Budget time.Duration
+}
+
+// Error implements the error interface
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s aborted after %s: deadline budget of %s exceeded", e.Op, e.Elapsed, e.Budget)
+}
+
+// RESTError reports the timeout to REST clients as a 504 Gateway Timeout.
+func (e *TimeoutError) RESTError() *rest.Error {
+	return &rest.Error{Code: http.StatusGatewayTimeout, Message: e.Error()}
+}
+
+// SetDeadlineMargin makes write operations abort margin before the deadline of
+// the request context, so the REST layer can return a 504 with accurate timing
+// instead of racing the client disconnect. Aborted operations return a
+// *TimeoutError.
+func (d *Handler) SetDeadlineMargin(margin time.Duration) *Handler {
+	d.deadlineMargin = margin
+	return d
+}
+
+// withDeadline runs f with a context whose deadline is moved up by the
+// deadline margin, translating its expiration into a *TimeoutError.
+func (d *Handler) withDeadline(ctx context.Context, op string, f func(ctx context.Context) error) error {
+	deadline, ok := ctx.Deadline()
+	if !ok || d.deadlineMargin <= 0 {
+		return f(ctx)
+	}
+	start := time.Now()
+	deadline = deadline.Add(-d.deadlineMargin)
+	if !deadline.After(start) {
+		return &TimeoutError{Op: op}
+	}
+	tctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	err := f(tctx)
+	if err != nil && tctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return &TimeoutError{Op: op, Elapsed: time.Since(start), Budget: deadline.Sub(start)}
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package datastore
+
+import (
+	"github.com/rs/rest-layer/resource"
+)
+
+// payloadDiff lists the top level fields changed or removed by an update.
+type payloadDiff struct {
+	changed map[string]interface{}
+	removed []string
+}
+
+// SetDiffUpdates makes Update only rewrite the top level properties changed
+// between the original and the updated item, merging them with the stored
+// entity inside the transaction. Unchanged properties keep their stored value
+// as is, so their index entries, encrypted values and overflow objects are
+// not rewritten, which reduces churn when a PATCH touches a few fields of
+// large documents.
+func (d *Handler) SetDiffUpdates(enabled bool) *Handler {
+	d.diffUpdates = enabled
+	return d
+}
+
+// diffPayload computes the fields of updated which differ from original.
+func diffPayload(original, updated map[string]interface{}) *payloadDiff {
+	diff := &payloadDiff{changed: map[string]interface{}{}}
+	for k, v := range updated {
+		if k == "id" || isAuditField(k) {
+			continue
+		}
+		if o, found := original[k]; !found || !equalValues(o, v) {
+			diff.changed[k] = v
+		}
+	}
+	for k := range original {
+		if k == "id" || isAuditField(k) {
+			continue
+		}
+		if _, found := updated[k]; !found {
+			diff.removed = append(diff.removed, k)
+		}
+	}
+	return diff
+}
+
+// item returns a copy of item only holding the changed fields.
+func (diff *payloadDiff) item(item *resource.Item) *resource.Item {
+	partial := *item
+	partial.Payload = make(map[string]interface{}, len(diff.changed)+1)
+	for k, v := range diff.changed {
+		partial.Payload[k] = v
+	}
+	partial.Payload["id"] = item.ID
+	return &partial
+}
+
+// merge returns a copy of the changes entity, prepared from the changed
+// fields, holding the stored values of the unchanged fields of current.
+func (diff *payloadDiff) merge(current, changes *Entity) *Entity {
+	e := *changes
+	e.Payload = make(map[string]interface{}, len(current.Payload)+len(changes.Payload))
+	for k, v := range current.Payload {
+		e.Payload[k] = v
+	}
+	for _, k := range diff.removed {
+		delete(e.Payload, k)
+	}
+	for k, v := range changes.Payload {
+		e.Payload[k] = v
+	}
+	return &e
+}
@@ -0,0 +1,51 @@
+package datastore
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiffPayload(t *testing.T) {
+	original := map[string]interface{}{
+		"id":       "1",
+		"name":     "john",
+		"age":      int64(30),
+		"nickname": "johnny",
+		"address":  map[string]interface{}{"city": "Paris"},
+	}
+	updated := map[string]interface{}{
+		"id":      "1",
+		"name":    "John",
+		"age":     30,
+		"address": map[string]interface{}{"city": "Paris"},
+		"email":   "john@example.com",
+	}
+	diff := diffPayload(original, updated)
+	want := map[string]interface{}{"name": "John", "email": "john@example.com"}
+	if !reflect.DeepEqual(diff.changed, want) {
+		t.Errorf("changed: got %v, want %v", diff.changed, want)
+	}
+	sort.Strings(diff.removed)
+	if !reflect.DeepEqual(diff.removed, []string{"nickname"}) {
+		t.Errorf("removed: got %v", diff.removed)
+	}
+
+	current := &Entity{Payload: map[string]interface{}{
+		"name":     "john",
+		"age":      int64(30),
+		"nickname": "johnny",
+		"secret":   []byte("ciphertext"),
+	}}
+	changes := &Entity{ETag: "b", Payload: diff.changed}
+	merged := diff.merge(current, changes)
+	wantPayload := map[string]interface{}{
+		"name":   "John",
+		"age":    int64(30),
+		"email":  "john@example.com",
+		"secret": []byte("ciphertext"),
+	}
+	if merged.ETag != "b" || !reflect.DeepEqual(merged.Payload, wantPayload) {
+		t.Errorf("merge: got %v", merged.Payload)
+	}
+}
@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"context"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema/query"
+	"google.golang.org/api/iterator"
+)
+
+// Distinct returns the distinct values of field among the items matching the
+// predicate of q, in ascending order, for facet lists such as the categories
+// of products. It runs a distinct-on projection query, which needs a
+// composite index on the filtered fields and field unless q has no filter.
+// Each element of a list field is a distinct value. The window of q bounds
+// the returned values; its sort is not supported.
+//
+// Values are decoded by the codec of field, if any. Hashed, encrypted and
+// non queryable fields are not supported.
+func (d *Handler) Distinct(ctx context.Context, field string, q *query.Query) (values []interface{}, err error) {
+	ctx, op := d.startOperation(ctx, "Distinct", queryAttrs(q)...)
+	defer func() { err = op.end(len(values), err) }()
+	if len(q.Sort) > 0 || !d.queryable(field) || d.hashedFields[field] || d.encryptedField(field) {
+		return nil, &ErrUnsupportedPredicate{Expression: "distinct " + field}
+	}
+	p, ok, err := d.normalizePredicate(q.Predicate)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []interface{}{}, nil
+	}
+	qry, err := d.getQuery(ctx, &query.Query{Predicate: p})
+	if err != nil {
+		return nil, err
+	}
+	name := getField(field)
+	qry = qry.Order(name).Project(name).DistinctOn(name)
+	if q.Window != nil {
+		qry = applyWindow(qry, *q.Window)
+	}
+	codec, _ := d.fieldCodec(field)
+	err = d.retry(ctx, true, func() error {
+		values = []interface{}{}
+		for it := d.client.Run(ctx, qry); ; {
+			var props datastore.PropertyList
+			_, err := it.Next(&props)
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			for _, p := range props {
+				v := p.Value
+				if codec != nil && v != nil {
+					if v, err = codec.Decode(v); err != nil {
+						return err
+					}
+				}
+				values = append(values, v)
+			}
+		}
+	})
+	return values, err
+}
+
+// encryptedField tells whether field or its parent is encrypted.
+func (d *Handler) encryptedField(field string) bool {
+	for _, f := range d.encryptedFields {
+		if field == f || strings.HasPrefix(field, f+".") {
+			return true
+		}
+	}
+	return false
+}
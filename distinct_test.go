@@ -0,0 +1,65 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestDistinct(t *testing.T) {
+	// The mock returns the projected entities as stored
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	for i, price := range []int64{150, 1099, 2000} {
+		c.put(datastore.IDKey("products", int64(i+1), nil), datastore.PropertyList{{Name: "price", Value: price}})
+	}
+	s := &schema.Schema{Fields: schema.Fields{
+		"price": {Validator: &schema.Float{}},
+		"name":  {Validator: &schema.String{}},
+	}}
+	h := NewHandler(c, "", "products").SetSchema(s).RegisterCodec(&schema.Float{}, centsCodec{})
+	ctx := context.Background()
+	values, err := h.Distinct(ctx, "price", &query.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{1.5, 10.99, 20.0}; !reflect.DeepEqual(values, want) {
+		t.Errorf("got %v, want %v decoded by the field codec", values, want)
+	}
+	if values, err = h.Distinct(ctx, "price", &query.Query{Predicate: query.Predicate{
+		&query.GreaterThan{Field: "price", Value: 10.0},
+		&query.LowerThan{Field: "price", Value: 5.0},
+	}}); err != nil || len(values) != 0 {
+		t.Errorf("expected no values for a contradictory predicate, got %v, %v", values, err)
+	}
+	errRun := errors.New("unavailable")
+	if _, err = NewHandler(failingClient{err: errRun}, "", "products").Distinct(ctx, "name", &query.Query{}); err != errRun {
+		t.Errorf("expected the query error, got %v", err)
+	}
+}
+
+func TestDistinctUnsupported(t *testing.T) {
+	h := NewHandler(nil, "", "products").
+		SetTypedErrors(true).
+		SetHashedFields([]string{"email"}).
+		SetEncryptedFields(xorKeyProvider(1), []string{"secret"})
+	tests := []struct {
+		field string
+		q     *query.Query
+	}{
+		{"name", &query.Query{Sort: query.Sort{{Name: "name"}}}},
+		{"email", &query.Query{}},
+		{"secret", &query.Query{}},
+		{"secret.pin", &query.Query{}},
+	}
+	for _, tt := range tests {
+		_, err := h.Distinct(context.Background(), tt.field, tt.q)
+		if _, ok := err.(*ErrUnsupportedPredicate); !ok {
+			t.Errorf("distinct %s: expected ErrUnsupportedPredicate, got %v", tt.field, err)
+		}
+	}
+}
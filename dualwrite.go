@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+// DualWrite mirrors the entities written by a handler to another kind,
+// namespace or database, to migrate them live without downtime.
+type DualWrite struct {
+	// Kind and Namespace of the mirrored entities, those of the handler when
+	// empty.
+	Kind      string
+	Namespace string
+	// Client of another database or project. The mirrored entities are then
+	// written after the commits of the mutations on a best-effort basis.
+	// When nil, they are written in the same commits.
+	Client Client
+	// OnError is called with the errors of the best-effort writes.
+	OnError func(ctx context.Context, err error)
+}
+
+// SetDualWrite mirrors every entity written or deleted by Insert, Update,
+// Delete, Clear, Reap and UpsertMulti to the kind, namespace or database of w,
+// with the same id, etag and payload. Entities written before dual writes
+// were enabled must be copied by a backfill. A nil w disables dual writes.
+func (d *Handler) SetDualWrite(w *DualWrite) *Handler {
+	d.dualWrite = w
+	return d
+}
+
+// mirrorKey returns the key of the mirror of the entity with key.
+func (w *DualWrite) mirrorKey(key *datastore.Key) *datastore.Key {
+	k := *key
+	if w.Kind != "" {
+		k.Kind = w.Kind
+	}
+	if w.Namespace != "" {
+		k.Namespace = w.Namespace
+	}
+	return &k
+}
+
+// mirrorChanges returns the mutations writing the mirror of the entity with
+// key in the same commit, its deletion when entity is nil.
+func (d *Handler) mirrorChanges(key *datastore.Key, entity *Entity) []*datastore.Mutation {
+	w := d.dualWrite
+	if w == nil || w.Client != nil {
+		return nil
+	}
+	if entity == nil {
+		return []*datastore.Mutation{datastore.NewDelete(w.mirrorKey(key))}
+	}
+	return []*datastore.Mutation{datastore.NewUpsert(w.mirrorKey(key), entity)}
+}
+
+// mirror writes the mirrors of the committed entities with keys to the
+// database of the dual write, or deletes them when entities is nil.
+func (d *Handler) mirror(ctx context.Context, keys []*datastore.Key, entities []*Entity) {
+	w := d.dualWrite
+	if w == nil || w.Client == nil || len(keys) == 0 {
+		return
+	}
+	// The mutation is done, the mirror must not miss it if the request is
+	// canceled
+	ctx, cancel := context.WithTimeout(detach(ctx), notifyTimeout)
+	defer cancel()
+	mirrored := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		mirrored[i] = w.mirrorKey(key)
+	}
+	for len(mirrored) > 0 {
+		n := len(mirrored)
+		if n > MaxMutations {
+			n = MaxMutations
+		}
+		var err error
+		if entities == nil {
+			err = w.Client.DeleteMulti(ctx, mirrored[:n])
+		} else {
+			_, err = w.Client.PutMulti(ctx, mirrored[:n], entities[:n])
+			entities = entities[n:]
+		}
+		if err != nil && w.OnError != nil {
+			w.OnError(ctx, err)
+		}
+		mirrored = mirrored[n:]
+	}
+}
@@ -0,0 +1,28 @@
+package datastore
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestMirrorChanges(t *testing.T) {
+	h := NewHandler(nil, "", "users")
+	key := datastore.NameKey("users", "1", nil)
+	key.Namespace = "acme"
+	if muts := h.mirrorChanges(key, &Entity{ID: "1"}); muts != nil {
+		t.Errorf("expected no mutations without dual writes, got %v", muts)
+	}
+	w := &DualWrite{Kind: "users_v2"}
+	h.SetDualWrite(w)
+	if k := w.mirrorKey(key); k.Kind != "users_v2" || k.Name != "1" || k.Namespace != "acme" {
+		t.Errorf("unexpected mirror key %v", k)
+	}
+	if muts := h.mirrorChanges(key, nil); len(muts) != 1 {
+		t.Errorf("expected the deletion of the mirror, got %v", muts)
+	}
+	w.Client = WrapClient(&datastore.Client{})
+	if muts := h.mirrorChanges(key, &Entity{ID: "1"}); muts != nil {
+		t.Errorf("expected best-effort writes with another client, got %v", muts)
+	}
+}
@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema/query"
+	"google.golang.org/api/iterator"
+)
+
+// DuplicateSet is a group of items sharing the values of a natural key.
+type DuplicateSet struct {
+	// Values of the natural key fields.
+	Values []interface{}
+	// Keys of the items, in key order.
+	Keys []*datastore.Key
+}
+
+// Duplicates scans the items and returns the sets of items sharing the values
+// of fields, a natural key such as an email, to clean up existing data before
+// making fields unique with SetUniqueFields. Values are compared by their
+// string form, like unique fields, and items missing one of the fields are
+// ignored. Sets are returned in the order of their first key.
+//
+// The values of all items are held in memory during the scan.
+func (d *Handler) Duplicates(ctx context.Context, fields ...string) ([]DuplicateSet, error) {
+	its, err := d.ParallelScan(ctx, &query.Query{}, 1)
+	if err != nil || len(its) == 0 {
+		return nil, err
+	}
+	ns := d.getNamespace(ctx)
+	sets := map[string]*DuplicateSet{}
+	for {
+		item, err := its[0].Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(fields))
+		names := make([]string, len(fields))
+		missing := false
+		for i, f := range fields {
+			if values[i] = item.GetField(f); values[i] == nil {
+				missing = true
+				break
+			}
+			names[i] = fmt.Sprint(values[i])
+		}
+		if missing {
+			continue
+		}
+		name := strings.Join(names, "\x00")
+		set := sets[name]
+		if set == nil {
+			set = &DuplicateSet{Values: values}
+			sets[name] = set
+		}
+		key := datastore.NameKey(d.entity, fmt.Sprint(item.ID), nil)
+		key.Namespace = ns
+		set.Keys = append(set.Keys, key)
+	}
+	var dups []DuplicateSet
+	for _, set := range sets {
+		if len(set.Keys) > 1 {
+			dups = append(dups, *set)
+		}
+	}
+	// Items are scanned in key order
+	sort.Slice(dups, func(i, j int) bool {
+		return compareKeys(dups[i].Keys[0], dups[j].Keys[0]) < 0
+	})
+	return dups, nil
+}
@@ -0,0 +1,210 @@
+package datastore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/rs/rest-layer/resource"
+)
+
+// KeyProvider wraps and unwraps the data encryption keys used to encrypt
+// fields. Each write of an item encrypts its fields with a random AES-256
+// key, which is stored wrapped by the KeyProvider next to each ciphertext, so
+// reading an item unwraps a single key.
+type KeyProvider interface {
+	// WrapKey encrypts a data encryption key.
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+	// UnwrapKey decrypts a data encryption key wrapped by WrapKey.
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// encryptedVersion is the first byte of the encrypted values format:
+// version, wrapped key length (uint16), wrapped key, nonce, ciphertext.
+// Values encrypted with a VersionedKeyProvider use taggedVersion, followed by
+// the key version length (uint8) and key version, then the same fields.
+const (
+	encryptedVersion = 1
+	taggedVersion    = 2
+)
+
+// ErrInvalidCiphertext is returned when an encrypted field can't be decoded.
+var ErrInvalidCiphertext = errors.New("invalid encrypted value")
+
+// SetEncryptedFields sets the top level fields encrypted with keys protected
+// by kp before being stored. Encrypted fields are stored as noindex blobs and
+// thus can't be filtered or sorted on.
+//
+// Values stored before a field was encrypted are read as is, and encrypted
+// when they are next written. Plaintext which happens to parse as an
+// encrypted envelope fails to decrypt with ErrInvalidCiphertext.
+func (d *Handler) SetEncryptedFields(kp KeyProvider, fields []string) *Handler {
+	d.keyProvider = kp
+	d.encryptedFields = fields
+	return d
+}
+
+// encryptFields returns a copy of item with the encrypted fields replaced by
+// their ciphertext.
+func (d *Handler) encryptFields(ctx context.Context, item *resource.Item) (*resource.Item, error) {
+	if d.keyProvider == nil {
+		return item, nil
+	}
+	payload := make(map[string]interface{}, len(item.Payload))
+	for k, v := range item.Payload {
+		payload[k] = v
+	}
+	var dk *dataKey
+	for _, f := range d.encryptedFields {
+		v, found := payload[f]
+		if !found {
+			continue
+		}
+		var err error
+		if dk == nil {
+			if dk, err = d.newDataKey(ctx); err != nil {
+				return nil, err
+			}
+		}
+		b, err := dk.seal(f, v)
+		if err != nil {
+			return nil, err
+		}
+		payload[f] = b
+	}
+	i := *item
+	i.Payload = payload
+	return &i, nil
+}
+
+// decryptFields decrypts the encrypted fields of payload in place, unwrapping
+// each data key once. Values which are not encrypted envelopes are left as
+// is.
+func (d *Handler) decryptFields(ctx context.Context, payload map[string]interface{}) error {
+	if d.keyProvider == nil {
+		return nil
+	}
+	keys := map[[2]string][]byte{}
+	for _, f := range d.encryptedFields {
+		var b []byte
+		switch v := payload[f].(type) {
+		case []byte:
+			b = v
+		case string:
+			// Encoded as base64 in JSON blobs
+			var err error
+			if b, err = base64.StdEncoding.DecodeString(v); err != nil {
+				continue
+			}
+		default:
+			continue
+		}
+		if _, _, _, err := parseEnvelope(b); err != nil {
+			// Plaintext written before the field was encrypted
+			continue
+		}
+		v, err := d.openValue(ctx, f, b, keys)
+		if err != nil {
+			return err
+		}
+		payload[f] = v
+	}
+	return nil
+}
+
+// dataKey is a data encryption key along with its wrapped form.
+type dataKey struct {
+	aead    cipher.AEAD
+	version string
+	wrapped []byte
+}
+
+// newDataKey returns a random data key wrapped by the key provider.
+func (d *Handler) newDataKey(ctx context.Context) (*dataKey, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	wrapped, err := d.keyProvider.WrapKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{aead: aead, version: keyVersion(d.keyProvider), wrapped: wrapped}, nil
+}
+
+// seal encrypts the value v of field.
+func (k *dataKey) seal(field string, v interface{}) ([]byte, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	b := envelopeHeader(k.version, k.wrapped)
+	b = append(b, nonce...)
+	// The field name is authenticated so values can't be swapped between fields
+	return k.aead.Seal(b, nonce, plaintext, []byte(field)), nil
+}
+
+func (d *Handler) encryptValue(ctx context.Context, field string, v interface{}) ([]byte, error) {
+	dk, err := d.newDataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dk.seal(field, v)
+}
+
+func (d *Handler) decryptValue(ctx context.Context, field string, b []byte) (interface{}, error) {
+	return d.openValue(ctx, field, b, map[[2]string][]byte{})
+}
+
+// openValue decrypts the value b of field, looking up its data key in keys
+// by wrapped form before unwrapping it.
+func (d *Handler) openValue(ctx context.Context, field string, b []byte, keys map[[2]string][]byte) (interface{}, error) {
+	tag, wrapped, b, err := parseEnvelope(b)
+	if err != nil {
+		return nil, err
+	}
+	key, found := keys[[2]string{tag, string(wrapped)}]
+	if !found {
+		if key, err = d.decryptionKey(tag).UnwrapKey(ctx, wrapped); err != nil {
+			return nil, err
+		}
+		keys[[2]string{tag, string(wrapped)}] = key
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+	plaintext, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(field))
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	var v interface{}
+	if err = json.Unmarshal(plaintext, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
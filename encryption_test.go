@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+)
+
+// xorKeyProvider is a KeyProvider for tests, not for real use.
+type xorKeyProvider byte
+
+func (p xorKeyProvider) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	w := make([]byte, len(key))
+	for i, b := range key {
+		w[i] = b ^ byte(p)
+	}
+	return w, nil
+}
+
+func (p xorKeyProvider) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return p.WrapKey(ctx, wrapped)
+}
+
+func TestEncryptFields(t *testing.T) {
+	ctx := context.Background()
+	d := (&Handler{}).SetEncryptedFields(xorKeyProvider(42), []string{"ssn"})
+	item := &resource.Item{ID: "1", Payload: map[string]interface{}{"id": "1", "ssn": "123-45-6789", "name": "John"}}
+	enc, err := d.encryptFields(ctx, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := enc.Payload["ssn"].([]byte); !ok {
+		t.Fatalf("ssn is not encrypted: %#v", enc.Payload["ssn"])
+	}
+	if item.Payload["ssn"] != "123-45-6789" {
+		t.Fatal("original item was modified")
+	}
+	if !d.entityNoIndex()["ssn"] {
+		t.Error("encrypted field should not be indexed")
+	}
+	if err = d.decryptFields(ctx, enc.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(enc.Payload, item.Payload) {
+		t.Errorf("got %v, want %v", enc.Payload, item.Payload)
+	}
+}
+
+// countingKeyProvider counts the keys it unwraps.
+type countingKeyProvider struct {
+	xorKeyProvider
+	unwrapped *int
+}
+
+func (p countingKeyProvider) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	*p.unwrapped++
+	return p.xorKeyProvider.UnwrapKey(ctx, wrapped)
+}
+
+func TestDecryptFieldsUnwrapOnce(t *testing.T) {
+	ctx := context.Background()
+	unwrapped := 0
+	d := (&Handler{}).SetEncryptedFields(countingKeyProvider{xorKeyProvider(42), &unwrapped}, []string{"ssn", "iban"})
+	item := &resource.Item{ID: "1", Payload: map[string]interface{}{"ssn": "123-45-6789", "iban": "FR76"}}
+	enc, err := d.encryptFields(ctx, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = d.decryptFields(ctx, enc.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(enc.Payload, item.Payload) {
+		t.Errorf("got %v, want %v", enc.Payload, item.Payload)
+	}
+	if unwrapped != 1 {
+		t.Errorf("expected the data key of the item to be unwrapped once, got %d unwraps", unwrapped)
+	}
+}
+
+func TestDecryptFieldsPlaintext(t *testing.T) {
+	d := (&Handler{}).SetEncryptedFields(xorKeyProvider(42), []string{"ssn", "pin"})
+	payload := map[string]interface{}{"ssn": "123-45-6789", "pin": "MTIzNA=="}
+	if err := d.decryptFields(context.Background(), payload); err != nil {
+		t.Fatalf("expected plaintext written before encryption to be read, got %v", err)
+	}
+	if payload["ssn"] != "123-45-6789" || payload["pin"] != "MTIzNA==" {
+		t.Errorf("expected plaintext values to be left as is, got %v", payload)
+	}
+}
+
+func TestDecryptFieldTampered(t *testing.T) {
+	ctx := context.Background()
+	d := (&Handler{}).SetEncryptedFields(xorKeyProvider(42), []string{"a", "b"})
+	b, err := d.encryptValue(ctx, "a", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Values can't be moved to another field
+	if err = d.decryptFields(ctx, map[string]interface{}{"b": b}); err != ErrInvalidCiphertext {
+		t.Errorf("expected ErrInvalidCiphertext, got %v", err)
+	}
+}
+
+// versionedKeyProvider is a versioned xorKeyProvider.
+type versionedKeyProvider struct {
+	xorKeyProvider
+	version string
+}
+
+func (p versionedKeyProvider) KeyVersion() string {
+	return p.version
+}
+
+func TestRotateKeys(t *testing.T) {
+	ctx := context.Background()
+	v1 := versionedKeyProvider{xorKeyProvider(1), "v1"}
+	v2 := versionedKeyProvider{xorKeyProvider(2), "v2"}
+	old := (&Handler{}).SetEncryptedFields(v1, []string{"ssn"})
+	b, err := old.encryptValue(ctx, "ssn", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _, _, err := parseEnvelope(b); err != nil || version != "v1" {
+		t.Fatalf("expected a v1 tagged value, got %q, %v", version, err)
+	}
+	d := (&Handler{}).SetEncryptedFields(v2, []string{"ssn"}).AddDecryptionKeys(v1)
+	if v, err := d.decryptValue(ctx, "ssn", b); err != nil || v != "secret" {
+		t.Fatalf("expected the old version to decrypt, got %v, %v", v, err)
+	}
+	r, ok, err := rewrap(ctx, b, v1, v2, map[string][]byte{})
+	if err != nil || !ok {
+		t.Fatalf("rewrap failed: %v, %v", ok, err)
+	}
+	if version, _, _, _ := parseEnvelope(r.([]byte)); version != "v2" {
+		t.Errorf("expected a v2 tagged value, got %q", version)
+	}
+	if v, err := (&Handler{}).SetEncryptedFields(v2, []string{"ssn"}).decryptValue(ctx, "ssn", r.([]byte)); err != nil || v != "secret" {
+		t.Errorf("expected the new version to decrypt, got %v, %v", v, err)
+	}
+	if _, ok, _ := rewrap(ctx, r, v1, v2, map[string][]byte{}); ok {
+		t.Error("rotated values must be skipped")
+	}
+}
@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"encoding/json"
+	"sort"
+
+	"cloud.google.com/go/datastore"
+)
+
+// EntityCodec converts item payloads to the properties of stored entities
+// and back, replacing the default layout of the payload. The meta properties
+// (_id, _etag, _updated...) are still managed by the handler, so the
+// transaction and etag machinery keeps working.
+type EntityCodec interface {
+	// Encode converts a payload, without its id, to properties.
+	Encode(payload map[string]interface{}) ([]datastore.Property, error)
+	// Decode converts the stored properties, meta properties excluded, to a
+	// payload.
+	Decode(ps []datastore.Property) (map[string]interface{}, error)
+}
+
+// SetEntityCodec replaces the encoding of payloads into properties by codec.
+// The storage mode is ignored when a codec is set.
+func (d *Handler) SetEntityCodec(codec EntityCodec) *Handler {
+	d.entityCodec = codec
+	return d
+}
+
+// encodeEntity replaces the payload of e by the properties encoded by the
+// entity codec.
+func (d *Handler) encodeEntity(e *Entity) error {
+	if d.entityCodec == nil {
+		return nil
+	}
+	ps, err := d.entityCodec.Encode(e.Payload)
+	if err != nil {
+		return err
+	}
+	e.Payload = make(map[string]interface{}, len(ps))
+	noIndex := make(map[string]bool, len(e.NoIndexProps))
+	for k, v := range e.NoIndexProps {
+		noIndex[k] = v
+	}
+	for _, p := range ps {
+		e.Payload[p.Name] = p.Value
+		if p.NoIndex {
+			noIndex[p.Name] = true
+		}
+	}
+	e.NoIndexProps = noIndex
+	return nil
+}
+
+// decodeEntity replaces the stored properties of e by the payload decoded by
+// the entity codec.
+func (d *Handler) decodeEntity(e *Entity) error {
+	if d.entityCodec == nil {
+		return nil
+	}
+	ps := make([]datastore.Property, 0, len(e.Payload))
+	for k, v := range e.Payload {
+		ps = append(ps, datastore.Property{Name: k, Value: v})
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].Name < ps[j].Name
+	})
+	payload, err := d.entityCodec.Decode(ps)
+	if err != nil {
+		return err
+	}
+	e.Payload = payload
+	return nil
+}
+
+// StructCodec is an EntityCodec storing payloads with the layout of a struct
+// model, so existing struct based models and their datastore tags can be
+// reused. Payloads are converted to and from the model through JSON, so the
+// json tags of the model must match the schema field names.
+type StructCodec struct {
+	// New returns a pointer to a new model struct.
+	New func() interface{}
+}
+
+// Encode implements the EntityCodec interface
+func (c StructCodec) Encode(payload map[string]interface{}) ([]datastore.Property, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	m := c.New()
+	if err = json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return datastore.SaveStruct(m)
+}
+
+// Decode implements the EntityCodec interface
+func (c StructCodec) Decode(ps []datastore.Property) (map[string]interface{}, error) {
+	m := c.New()
+	if err := datastore.LoadStruct(m, ps); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var payload map[string]interface{}
+	err = json.Unmarshal(b, &payload)
+	return payload, err
+}
@@ -0,0 +1,47 @@
+package datastore
+
+import "testing"
+
+type testModel struct {
+	Name  string   `json:"name" datastore:"name"`
+	Bio   string   `json:"bio" datastore:"bio,noindex"`
+	Tags  []string `json:"tags" datastore:"tags"`
+	Score int      `json:"score" datastore:"score"`
+}
+
+func TestStructCodec(t *testing.T) {
+	h := NewHandler(nil, "", "users").SetEntityCodec(StructCodec{
+		New: func() interface{} { return &testModel{} },
+	})
+	e := h.configureEntity(&Entity{ID: "1", Payload: map[string]interface{}{
+		"name":  "john",
+		"bio":   "long text",
+		"tags":  []interface{}{"a", "b"},
+		"score": 12,
+	}})
+	if err := h.encodeEntity(e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Payload["score"] != int64(12) || !e.NoIndexProps["bio"] || e.NoIndexProps["name"] {
+		t.Errorf("unexpected encoded entity: %v %v", e.Payload, e.NoIndexProps)
+	}
+	ps, err := e.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Entity
+	if err = loaded.Load(ps); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.decodeEntity(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Payload["name"] != "john" || loaded.Payload["score"] != float64(12) {
+		t.Errorf("unexpected decoded payload: %v", loaded.Payload)
+	}
+	for _, p := range ps {
+		if p.Name == "bio" && !p.NoIndex {
+			t.Error("bio should not be indexed")
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/rest"
+	"github.com/rs/rest-layer/schema/query"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrUnsupportedPredicate is returned by Find and Clear when a filter or a
+// sort can't be translated into a Datastore query. It matches
+// resource.ErrNotImplemented with errors.Is.
+type ErrUnsupportedPredicate struct {
+	// Expression is the unsupported filter or sort.
+	Expression string
+}
+
+// Error implements the error interface
+func (e *ErrUnsupportedPredicate) Error() string {
+	return "unsupported predicate: " + e.Expression
+}
+
+// Is reports whether target is resource.ErrNotImplemented.
+func (e *ErrUnsupportedPredicate) Is(target error) bool {
+	return target == resource.ErrNotImplemented
+}
+
+// RESTError reports the predicate as not implemented, a 501.
+func (e *ErrUnsupportedPredicate) RESTError() *rest.Error {
+	return &rest.Error{Code: http.StatusNotImplemented, Message: e.Error()}
+}
+
+// ErrUnknownField is returned by Find and Clear when a filter references a
+// field unknown to the schema bound with SetSchema.
+type ErrUnknownField struct {
+	// Field is the unknown field.
+	Field string
+}
+
+// Error implements the error interface
+func (e *ErrUnknownField) Error() string {
+	return e.Field + ": unknown query field"
+}
+
+// RESTError reports the invalid filter as a 422.
+func (e *ErrUnknownField) RESTError() *rest.Error {
+	return &rest.Error{
+		Code:    http.StatusUnprocessableEntity,
+		Message: "Invalid `filter` parameter",
+		Issues:  map[string][]interface{}{"filter": {e.Error()}},
+	}
+}
+
+// ErrMissingCompositeIndex is returned when Datastore refuses a query because
+// no composite index serves it. It matches resource.ErrNotImplemented with
+// errors.Is and unwraps to the Datastore error.
+type ErrMissingCompositeIndex struct {
+	// Kind of the query.
+	Kind string
+	// Index is the missing index, as recommended by Datastore or derived
+	// from the query, nil if unknown.
+	Index *CompositeIndex
+	// Cause is the error returned by Datastore.
+	Cause error
+}
+
+// Error implements the error interface, giving the index.yaml stanza of the
+// missing index when known.
+func (e *ErrMissingCompositeIndex) Error() string {
+	if e.Index != nil {
+		return fmt.Sprintf("missing composite index for %s, add to index.yaml:\n%s", e.Kind, e.Index.YAML())
+	}
+	return fmt.Sprintf("missing composite index for %s: %v", e.Kind, e.Cause)
+}
+
+// Unwrap returns the Datastore error.
+func (e *ErrMissingCompositeIndex) Unwrap() error {
+	return e.Cause
+}
+
+// Is reports whether target is resource.ErrNotImplemented.
+func (e *ErrMissingCompositeIndex) Is(target error) bool {
+	return target == resource.ErrNotImplemented
+}
+
+// RESTError gives REST clients a 501 with the index to add.
+func (e *ErrMissingCompositeIndex) RESTError() *rest.Error {
+	return &rest.Error{Code: http.StatusNotImplemented, Message: e.Error()}
+}
+
+// SetTypedErrors makes the operations of the handler return the typed errors
+// of the package, such as *ErrUnsupportedPredicate, instead of the REST layer
+// error they convert to, so callers can branch on the failure class with
+// errors.As. The REST layer only knows *rest.Error values and the
+// resource.Err* sentinels, reporting other errors with a 520 status: Storers
+// wrapping a handler with typed errors convert them with ToRESTError.
+func (d *Handler) SetTypedErrors(enabled bool) *Handler {
+	d.typedErrors = enabled
+	return d
+}
+
+// restSentinels are the errors of the REST layer wrapped errors are collapsed
+// to.
+var restSentinels = []error{resource.ErrNotImplemented, resource.ErrConflict, resource.ErrNotFound}
+
+// ToRESTError converts the typed errors of the package, wrapped or not, into
+// the *rest.Error given by their RESTError method, and the errors wrapping a
+// resource.Err* value into that value, which the REST layer compares with ==.
+// Other errors are returned as is.
+func ToRESTError(err error) error {
+	var re interface{ RESTError() *rest.Error }
+	if errors.As(err, &re) {
+		return re.RESTError()
+	}
+	for _, s := range restSentinels {
+		if errors.Is(err, s) {
+			return s
+		}
+	}
+	return err
+}
+
+// translateError translates the errors returned to the REST layer by the
+// storage operations, of query q for Find and Clear.
+func (d *Handler) translateError(err error, q *query.Query) error {
+	err = d.translateStatus(err, q)
+	if err == nil || d.typedErrors {
+		return err
+	}
+	return ToRESTError(err)
+}
+
+// translateStatus maps the gRPC errors returned by Datastore to the errors of
+// the REST layer, so clients get meaningful status codes. Other errors are
+// returned as is.
+func (d *Handler) translateStatus(err error, q *query.Query) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch st.Code() {
+	case codes.NotFound:
+		return resource.ErrNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return resource.ErrConflict
+	case codes.FailedPrecondition:
+		if strings.Contains(st.Message(), "index") {
+			e := &ErrMissingCompositeIndex{Kind: d.entity, Index: recommendedIndex(st.Message()), Cause: err}
+			if e.Index == nil && q != nil {
+				e.Index = d.RequiredIndex(q)
+			}
+			return e
+		}
+	case codes.ResourceExhausted:
+		return &rest.Error{Code: http.StatusTooManyRequests, Message: st.Message()}
+	case codes.InvalidArgument:
+		if strings.Contains(st.Message(), "too big") {
+			return &ErrEntityTooLarge{Cause: err}
+		}
+		return &rest.Error{Code: http.StatusBadRequest, Message: st.Message()}
+	case codes.Unavailable:
+		return &rest.Error{Code: http.StatusServiceUnavailable, Message: st.Message()}
+	case codes.DeadlineExceeded:
+		return rest.ErrGatewayTimeout
+	case codes.Canceled:
+		return rest.ErrClientClosedRequest
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/rest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTranslateError(t *testing.T) {
+	h := NewHandler(nil, "", "users")
+	other := errors.New("other")
+	missingIndex := status.Error(codes.FailedPrecondition, "no matching index found")
+	for _, tc := range []struct {
+		err      error
+		expected error
+	}{
+		{nil, nil},
+		{other, other},
+		{status.Error(codes.NotFound, "missing"), resource.ErrNotFound},
+		{status.Error(codes.AlreadyExists, "exists"), resource.ErrConflict},
+		{fmt.Errorf("unique: %w", resource.ErrConflict), resource.ErrConflict},
+	} {
+		if err := h.translateError(tc.err, nil); err != tc.expected {
+			t.Errorf("translateError(%v) = %v, expected %v", tc.err, err, tc.expected)
+		}
+	}
+	err := h.translateError(status.Error(codes.ResourceExhausted, "quota"), nil)
+	if re, ok := err.(*rest.Error); !ok || re.Code != http.StatusTooManyRequests || re.Message != "quota" {
+		t.Errorf("expected a 429 error, got %v", err)
+	}
+
+	h.SetTypedErrors(true)
+	err = h.translateError(missingIndex, nil)
+	var mi *ErrMissingCompositeIndex
+	if !errors.As(err, &mi) || mi.Kind != "users" || !errors.Is(err, resource.ErrNotImplemented) || errors.Unwrap(err) != missingIndex {
+		t.Errorf("expected an ErrMissingCompositeIndex, got %v", err)
+	}
+	var tl *ErrEntityTooLarge
+	if err = h.translateError(status.Error(codes.InvalidArgument, "entity is too big"), nil); !errors.As(err, &tl) {
+		t.Errorf("expected an ErrEntityTooLarge, got %v", err)
+	}
+}
+
+func TestTypedErrorStatus(t *testing.T) {
+	h := NewHandler(nil, "", "users")
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{&ErrEntityTooLarge{Largest: []PropertySize{{Name: "bio", Size: 2 << 20}}}, 422},
+		{&ErrImmutableField{Field: "owner"}, 422},
+		{&ErrUnknownField{Field: "nickname"}, 422},
+		{&ErrTooManyRows{Limit: 10}, 422},
+		{&ErrReferenced{ID: "1", Kind: "posts", Field: "author"}, 409},
+		{&ErrMaintenance{Kind: "users"}, 503},
+		{&ErrUnavailable{Kind: "users"}, 503},
+		{&TimeoutError{Op: "Insert"}, 504},
+		{&ErrUnsupportedPredicate{Expression: "a != 1"}, 501},
+		{fmt.Errorf("insert: %w", &ErrMissingCompositeIndex{Kind: "users"}), 501},
+		{status.Error(codes.InvalidArgument, "entity is too big"), 422},
+	} {
+		if re := rest.NewError(h.translateError(tc.err, nil)); re.Code != tc.code {
+			t.Errorf("%v: got a %d status, want %d", tc.err, re.Code, tc.code)
+		}
+	}
+	re := rest.NewError(h.translateError(&ErrEntityTooLarge{Largest: []PropertySize{{Name: "bio", Size: 2 << 20}}}, nil))
+	if len(re.Issues["bio"]) != 1 {
+		t.Errorf("expected an issue on the largest property, got %v", re.Issues)
+	}
+}
+
+func TestMissingIndexMessage(t *testing.T) {
+	h := NewHandler(nil, "", "users")
+	cause := status.Error(codes.FailedPrecondition, "no matching index found. recommended index is:\n- kind: users\n  properties:\n  - name: age\n  - name: name\n    direction: desc\n")
+	err := h.translateError(cause, nil)
+	expected := "missing composite index for users, add to index.yaml:\nindexes:\n    - kind: users\n      properties:\n        - name: age\n        - name: name\n          direction: desc\n"
+	if err.Error() != expected {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+}
@@ -79,11 +79,11 @@ func Example() {
 
 	index := resource.NewIndex()
 
-	users := index.Bind("users", user, datastore.NewHandler(client, "default", "users"), resource.Conf{
+	users := index.Bind("users", user, datastore.NewHandler(datastore.WrapClient(client), "default", "users"), resource.Conf{
 		AllowedModes: resource.ReadWrite,
 	})
 
-	users.Bind("posts", "user", post, datastore.NewHandler(client, "default", "posts"), resource.Conf{
+	users.Bind("posts", "user", post, datastore.NewHandler(datastore.WrapClient(client), "default", "posts"), resource.Conf{
 		AllowedModes: resource.ReadWrite,
 	})
 
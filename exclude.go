@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+)
+
+// SetReadExcludedFields sets top level fields omitted from the items returned
+// by Find, like large audit blobs or secrets. Unlike write-only fields, they
+// can be loaded on demand with LoadFields or by using a context returned by
+// WithExcludedFields. Update keeps their stored value when the new payload
+// doesn't set them.
+func (d *Handler) SetReadExcludedFields(fields []string) *Handler {
+	f := make(map[string]bool, len(fields))
+	for _, v := range fields {
+		f[v] = true
+	}
+	d.readExcludedFields = f
+	return d
+}
+
+// WithExcludedFields returns a context making Find return the read-excluded
+// fields. Write-only fields are never returned.
+func WithExcludedFields(ctx context.Context) context.Context {
+	return context.WithValue(ctx, excludedCtxKey, true)
+}
+
+// omittedFields returns the fields which must not be loaded for ctx.
+func (d *Handler) omittedFields(ctx context.Context) map[string]bool {
+	if include, _ := ctx.Value(excludedCtxKey).(bool); include || len(d.readExcludedFields) == 0 {
+		return d.writeOnlyFields
+	}
+	if len(d.writeOnlyFields) == 0 {
+		return d.readExcludedFields
+	}
+	omit := make(map[string]bool, len(d.writeOnlyFields)+len(d.readExcludedFields))
+	for _, fields := range []map[string]bool{d.writeOnlyFields, d.readExcludedFields} {
+		for f := range fields {
+			omit[f] = true
+		}
+	}
+	return omit
+}
+
+// LoadFields lazily loads the given fields of the item with id, typically
+// read-excluded fields. Write-only fields are never returned and fields absent
+// from the entity are absent from the returned map.
+func (d *Handler) LoadFields(ctx context.Context, id string, fields ...string) (map[string]interface{}, error) {
+	key := datastore.NameKey(d.entity, id, nil)
+	key.Namespace = d.getNamespace(ctx)
+	e := Entity{Omit: d.writeOnlyFields}
+	err := d.retry(ctx, true, func() error {
+		if err := d.throttle(ctx, 1); err != nil {
+			return err
+		}
+		return d.client.Get(ctx, key, &e)
+	})
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, resource.ErrNotFound
+		}
+		return nil, err
+	}
+	item, err := d.loadItem(ctx, &e)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		if v, found := item.Payload[f]; found {
+			values[f] = v
+		}
+	}
+	return values, nil
+}
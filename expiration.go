@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// expiresProperty holds the expiration time of an entity.
+const expiresProperty = "_expires"
+
+// SetExpiration derives the _expires property of entities from field, a time
+// field of the payload. Expired entities are filtered out of Find results,
+// and replaced by the entities following the page, until they are deleted by
+// Reap. Entities without expiration time never expire.
+func (d *Handler) SetExpiration(field string) *Handler {
+	d.expirationField = field
+	return d
+}
+
+// expired tells if the entity expiration time has passed.
+func (d *Handler) expired(e *Entity) bool {
+	return d.expirationField != "" && !e.Expires.IsZero() && !e.Expires.After(d.now())
+}
+
+// Reap deletes the expired entities in batches and returns their number.
+func (d *Handler) Reap(ctx context.Context) (int, error) {
+	if d.expirationField == "" {
+		return 0, nil
+	}
+	if err := d.checkFence(ctx); err != nil {
+		return 0, err
+	}
+	qry := datastore.NewQuery(d.entity).
+		Namespace(d.getNamespace(ctx)).
+		Filter(expiresProperty+" <=", d.now())
+	var keys []*datastore.Key
+	err := StreamKeys(ctx, d.client, qry, func(key *datastore.Key) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return d.deleteKeys(ctx, keys)
+}
+
+// StartReaper runs Reap every interval in the background until the returned
+// stop function or Close is called. Errors are passed to onError if not nil.
+func (d *Handler) StartReaper(ctx context.Context, interval time.Duration, onError func(error)) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if _, err := d.Reap(ctx); err != nil && onError != nil && ctx.Err() == nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+	stop = func() {
+		cancel()
+		<-done
+	}
+	d.startedWorker(stop)
+	return stop
+}
@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/rs/rest-layer/schema/query"
+	"google.golang.org/api/iterator"
+)
+
+// Exporter writes the items of the kind of a handler as NDJSON, one JSON
+// object per line in the format read by Importer, for backups and analytics
+// pipelines.
+type Exporter struct {
+	Handler *Handler
+	// Query, if not nil, filters the exported items. Its sort and window are
+	// not supported.
+	Query *query.Query
+	// Shards is the number of key ranges read concurrently, split like by
+	// ParallelScan. Items of different ranges are interleaved in the output.
+	Shards int
+	// Progress, if not nil, is called with the number of exported items after
+	// every MaxMutations items.
+	Progress func(n int64)
+}
+
+// Export writes the items to w and returns their number. It stops at the
+// first read or write error.
+func (ex *Exporter) Export(ctx context.Context, w io.Writer) (int64, error) {
+	q := ex.Query
+	if q == nil {
+		q = &query.Query{}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	its, err := ex.Handler.ParallelScan(ctx, q, ex.Shards)
+	if err != nil {
+		return 0, err
+	}
+	var mu sync.Mutex
+	var n int64
+	var firstErr error
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var wg sync.WaitGroup
+	for _, it := range its {
+		wg.Add(1)
+		go func(it *ScanIterator) {
+			defer wg.Done()
+			for {
+				item, err := it.Next()
+				if err == iterator.Done {
+					return
+				}
+				mu.Lock()
+				if err == nil && firstErr == nil {
+					if err = enc.Encode(item.Payload); err == nil {
+						if n++; n%MaxMutations == 0 && ex.Progress != nil {
+							ex.Progress(n)
+						}
+					}
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+					// Stop the other shards
+					cancel()
+				}
+				stop := firstErr != nil
+				mu.Unlock()
+				if stop {
+					return
+				}
+			}
+		}(it)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return n, firstErr
+	}
+	if err = bw.Flush(); err != nil {
+		return n, err
+	}
+	if ex.Progress != nil && n%MaxMutations != 0 {
+		ex.Progress(n)
+	}
+	return n, nil
+}
@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestExport(t *testing.T) {
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	for _, id := range []string{"1", "2", "3"} {
+		c.put(datastore.NameKey("users", id, nil), datastore.PropertyList{
+			{Name: "_id", Value: id},
+			{Name: "_etag", Value: "etag" + id},
+			{Name: "name", Value: "user " + id},
+		})
+	}
+	var progress []int64
+	ex := &Exporter{Handler: NewHandler(c, "", "users"), Progress: func(n int64) {
+		progress = append(progress, n)
+	}}
+	var buf bytes.Buffer
+	n, err := ex.Export(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || len(progress) != 1 || progress[0] != 3 {
+		t.Errorf("expected 3 exported items and progress, got %d, %v", n, progress)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 3 {
+		t.Errorf("expected one line per item, got %q", buf.String())
+	}
+	// The output is read back by Importer
+	im := &Importer{Handler: ex.Handler}
+	next := ndjsonRecords(&buf)
+	for _, id := range []string{"1", "2", "3"} {
+		payload, _, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		item, err := im.item(context.Background(), payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.ID != id || item.Payload["name"] != "user "+id {
+			t.Errorf("unexpected exported item %v", item)
+		}
+	}
+	if _, _, err = next(); err != io.EOF {
+		t.Errorf("expected EOF after the items, got %v", err)
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestExportErrors(t *testing.T) {
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	c.put(datastore.NameKey("users", "1", nil), datastore.PropertyList{{Name: "_id", Value: "1"}})
+	ctx := context.Background()
+	ex := &Exporter{Handler: NewHandler(c, "", "users")}
+	if _, err := ex.Export(ctx, failingWriter{}); err == nil || err.Error() != "disk full" {
+		t.Errorf("expected the write error, got %v", err)
+	}
+	errRead := errors.New("read failed")
+	ex = &Exporter{Handler: NewHandler(failingClient{err: errRead}, "", "users")}
+	if _, err := ex.Export(ctx, io.Discard); err != errRead {
+		t.Errorf("expected the read error, got %v", err)
+	}
+	ex = &Exporter{Handler: NewHandler(c, "", "users"), Query: &query.Query{Sort: query.Sort{{Name: "name"}}}}
+	if _, err := ex.Export(ctx, io.Discard); err != resource.ErrNotImplemented {
+		t.Errorf("expected sorted exports not to be supported, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/rest"
+)
+
+// fenceKind is the kind of the control entities holding write fences, keyed
+// by the fenced kind.
+const fenceKind = "_write_fences"
+
+// writeFence is the control entity of an enabled write fence.
+type writeFence struct {
+	Reason string    `datastore:"reason,noindex"`
+	Since  time.Time `datastore:"since,noindex"`
+}
+
+// ErrMaintenance is returned by mutating operations while a write fence is
+// enabled on the handler kind.
+type ErrMaintenance struct {
+	// Kind is the fenced kind.
+	Kind string
+	// Reason is the reason given when enabling the fence.
+	Reason string
+	// Since is the time the fence was enabled.
+	Since time.Time
+}
+
+// Error implements the error interface
+func (e *ErrMaintenance) Error() string {
+	msg := fmt.Sprintf("writes to %s are fenced since %s", e.Kind, e.Since.Format(time.RFC3339))
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// RESTError makes REST clients retry later with a 503 status.
+func (e *ErrMaintenance) RESTError() *rest.Error {
+	return &rest.Error{Code: http.StatusServiceUnavailable, Message: e.Error()}
+}
+
+// SetWriteFence enables checking the write fence of the handler kind before
+// every mutating operation. The fence state is cached for ttl, so a fence
+// enabled by another process takes effect after at most ttl.
+func (d *Handler) SetWriteFence(ttl time.Duration) *Handler {
+	d.fenceCheck = true
+	d.fenceTTL = ttl
+	return d
+}
+
+// WithFenceBypass returns a context allowing writes through an enabled write
+// fence, for use by the backfill or migration the fence protects.
+func WithFenceBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fenceBypassCtxKey, true)
+}
+
+// EnableWriteFence fences the writes to the handler kind, making mutating
+// operations fail with an *ErrMaintenance until DisableWriteFence is called.
+func (d *Handler) EnableWriteFence(ctx context.Context, reason string) error {
+	f := &writeFence{Reason: reason, Since: d.now()}
+	if _, err := d.client.Put(ctx, d.fenceKey(), f); err != nil {
+		return err
+	}
+	d.cacheFence(f)
+	return nil
+}
+
+// DisableWriteFence lifts the write fence of the handler kind.
+func (d *Handler) DisableWriteFence(ctx context.Context) error {
+	if err := d.client.Delete(ctx, d.fenceKey()); err != nil {
+		return err
+	}
+	d.cacheFence(nil)
+	return nil
+}
+
+// SetMaintenance toggles the maintenance mode of the handler at runtime:
+// while enabled, mutating operations fail with an *ErrMaintenance, a 503 the
+// clients can retry, and reads continue. Unlike write fences, the mode is
+// local to the handler and costs no Datastore read. Contexts returned by
+// WithFenceBypass write through it.
+func (d *Handler) SetMaintenance(enabled bool) *Handler {
+	d.fenceMu.Lock()
+	d.maintenance = nil
+	if enabled {
+		d.maintenance = &writeFence{Reason: "maintenance mode", Since: d.now()}
+	}
+	d.fenceMu.Unlock()
+	return d
+}
+
+// checkFence returns an *ErrMaintenance if the handler is in maintenance mode
+// or a write fence is enabled on the handler kind, and ctx doesn't bypass it.
+func (d *Handler) checkFence(ctx context.Context) error {
+	if bypass, _ := ctx.Value(fenceBypassCtxKey).(bool); bypass {
+		return nil
+	}
+	d.fenceMu.Lock()
+	f, fresh, m := d.fence, time.Since(d.fenceChecked) < d.fenceTTL, d.maintenance
+	d.fenceMu.Unlock()
+	if m != nil {
+		return &ErrMaintenance{Kind: d.entity, Reason: m.Reason, Since: m.Since}
+	}
+	if !d.fenceCheck {
+		return nil
+	}
+	if !fresh {
+		f = &writeFence{}
+		if err := d.client.Get(ctx, d.fenceKey(), f); err == datastore.ErrNoSuchEntity {
+			f = nil
+		} else if err != nil {
+			return err
+		}
+		d.cacheFence(f)
+	}
+	if f == nil {
+		return nil
+	}
+	return &ErrMaintenance{Kind: d.entity, Reason: f.Reason, Since: f.Since}
+}
+
+func (d *Handler) cacheFence(f *writeFence) {
+	d.fenceMu.Lock()
+	d.fence = f
+	d.fenceChecked = time.Now()
+	d.fenceMu.Unlock()
+}
+
+func (d *Handler) fenceKey() *datastore.Key {
+	key := datastore.NameKey(fenceKind, d.entity, nil)
+	key.Namespace = d.namespace
+	return key
+}
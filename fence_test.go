@@ -0,0 +1,20 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	h := NewHandler(nil, "", "users").SetMaintenance(true)
+	ctx := context.Background()
+	if _, ok := h.checkFence(ctx).(*ErrMaintenance); !ok {
+		t.Error("expected an *ErrMaintenance in maintenance mode")
+	}
+	if err := h.checkFence(WithFenceBypass(ctx)); err != nil {
+		t.Errorf("expected the bypass to write through, got %v", err)
+	}
+	if err := h.SetMaintenance(false).checkFence(ctx); err != nil {
+		t.Errorf("expected writes once maintenance is over, got %v", err)
+	}
+}
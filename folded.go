@@ -0,0 +1,129 @@
+package datastore
+
+import (
+	"regexp/syntax"
+	"strings"
+	"unicode"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// foldedSuffix suffixes the indexed properties holding the normalized copy of
+// folded fields.
+const foldedSuffix = "__lc"
+
+// SetFoldedFields stores a lowercase and unaccented copy of the given top
+// level string fields in a <field>__lc shadow property, so they can be
+// filtered case and accent insensitively. Equality, inequality and in filters
+// on those fields are transparently rewritten to filters on the shadow, as
+// well as $regex filters matching a literal prefix, like ^abc or (?i)^abc,
+// which become range filters. Range filters and sorts keep using the field
+// itself. List fields get the normalized copy of each of their string
+// elements.
+//
+// Entities written before a field was folded only match its filters once
+// rewritten.
+func (d *Handler) SetFoldedFields(fields []string) *Handler {
+	d.foldedFields = make(map[string]bool, len(fields))
+	for _, f := range fields {
+		d.foldedFields[f] = true
+	}
+	return d
+}
+
+// foldString lowercases s and strips its accents.
+func foldString(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	r, _, err := transform.String(t, s)
+	if err != nil {
+		r = s
+	}
+	return strings.ToLower(r)
+}
+
+// foldValue returns the normalized copy of a string value, or value as is.
+func foldValue(value interface{}) interface{} {
+	switch t := value.(type) {
+	case string:
+		return foldString(t)
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, v := range t {
+			l[i] = foldValue(v)
+		}
+		return l
+	}
+	return value
+}
+
+// foldedProperty returns the shadow property of the folded field name.
+func foldedProperty(name string, value interface{}) datastore.Property {
+	return datastore.Property{Name: name + foldedSuffix, Value: foldValue(value)}
+}
+
+// isFoldedProperty returns whether name is the shadow of a folded field.
+func isFoldedProperty(name string) bool {
+	return strings.HasSuffix(name, foldedSuffix)
+}
+
+// foldedFilter rewrites a filter on a folded field to a filter on its shadow,
+// or returns false when the filter must use the field itself.
+func foldedFilter(field, op string, value interface{}) (string, interface{}, bool) {
+	switch op {
+	case "=", "!=", "in":
+		return field + foldedSuffix, foldValue(value), true
+	}
+	return "", nil, false
+}
+
+// foldedRegex translates a regex filter on a folded field matching a literal
+// prefix into range filters on its shadow, or an equality filter when the
+// regex matches a whole literal.
+func (d *Handler) foldedRegex(dsQuery *datastore.Query, r *query.Regex) (*datastore.Query, error) {
+	if !d.foldedFields[r.Field] {
+		return nil, resource.ErrNotImplemented
+	}
+	prefix, exact, ok := literalPrefix(r.Value.String())
+	if !ok {
+		return nil, resource.ErrNotImplemented
+	}
+	name := r.Field + foldedSuffix
+	prefix = foldString(prefix)
+	if exact {
+		return dsQuery.Filter(name+" =", prefix), nil
+	}
+	return dsQuery.Filter(name+" >=", prefix).Filter(name+" <", prefix+"\U0010FFFF"), nil
+}
+
+// literalPrefix returns the literal a regex anchored at the start of the text
+// matches, and whether it must match the whole text.
+func literalPrefix(expr string) (string, bool, bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", false, false
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 || re.Sub[0].Op != syntax.OpBeginText {
+		return "", false, false
+	}
+	lit := re.Sub[1]
+	if lit.Op != syntax.OpLiteral {
+		return "", false, false
+	}
+	rest := re.Sub[2:]
+	switch {
+	case len(rest) == 0:
+		return string(lit.Rune), false, true
+	case len(rest) == 1 && rest[0].Op == syntax.OpEndText:
+		return string(lit.Rune), true, true
+	case len(rest) == 1 && rest[0].Op == syntax.OpStar &&
+		(rest[0].Sub[0].Op == syntax.OpAnyChar || rest[0].Sub[0].Op == syntax.OpAnyCharNotNL):
+		return string(lit.Rune), false, true
+	}
+	return "", false, false
+}
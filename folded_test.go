@@ -0,0 +1,31 @@
+package datastore
+
+import "testing"
+
+func TestFoldString(t *testing.T) {
+	if got := foldString("Élodie ÇA"); got != "elodie ca" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestLiteralPrefix(t *testing.T) {
+	tests := []struct {
+		expr   string
+		prefix string
+		exact  bool
+		ok     bool
+	}{
+		{"^abc", "abc", false, true},
+		{"(?i)^abc", "abc", false, true},
+		{"^abc.*", "abc", false, true},
+		{"^abc$", "abc", true, true},
+		{"abc", "", false, false},
+		{"^a[bc]", "", false, false},
+	}
+	for _, tt := range tests {
+		prefix, exact, ok := literalPrefix(tt.expr)
+		if foldString(prefix) != tt.prefix || exact != tt.exact || ok != tt.ok {
+			t.Errorf("literalPrefix(%q) = %q, %v, %v", tt.expr, prefix, exact, ok)
+		}
+	}
+}
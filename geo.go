@@ -0,0 +1,152 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// earthRadius is the mean radius of the Earth in meters.
+const earthRadius = 6371008.8
+
+// Near is a query expression matching the items whose geo point field is
+// within Radius meters of the point at Lat and Lng, by great-circle distance.
+// The REST layer can't parse it: hooks or handlers add it to queries.
+type Near struct {
+	Field    string
+	Lat, Lng float64
+	// Radius in meters.
+	Radius float64
+}
+
+// Match implements query.Expression.
+func (e *Near) Match(payload map[string]interface{}) bool {
+	p, ok := geoPointValue(payloadField(payload, e.Field))
+	return ok && distance(p, datastore.GeoPoint{Lat: e.Lat, Lng: e.Lng}) <= e.Radius
+}
+
+// Prepare implements query.Expression.
+func (e *Near) Prepare(schema.Validator) error {
+	return nil
+}
+
+// String implements query.Expression.
+func (e *Near) String() string {
+	return fmt.Sprintf("%s: {$near: [%v, %v], $radius: %v}", e.Field, e.Lat, e.Lng, e.Radius)
+}
+
+// WithinBox is a query expression matching the items whose geo point field is
+// within a bounding box. West is greater than East for boxes crossing the
+// antimeridian. The REST layer can't parse it: hooks or handlers add it to
+// queries.
+type WithinBox struct {
+	Field                    string
+	South, West, North, East float64
+}
+
+// Match implements query.Expression.
+func (e *WithinBox) Match(payload map[string]interface{}) bool {
+	p, ok := geoPointValue(payloadField(payload, e.Field))
+	if !ok || p.Lat < e.South || p.Lat > e.North {
+		return false
+	}
+	if e.West <= e.East {
+		return p.Lng >= e.West && p.Lng <= e.East
+	}
+	return p.Lng >= e.West || p.Lng <= e.East
+}
+
+// Prepare implements query.Expression.
+func (e *WithinBox) Prepare(schema.Validator) error {
+	return nil
+}
+
+// String implements query.Expression.
+func (e *WithinBox) String() string {
+	return fmt.Sprintf("%s: {$box: [[%v, %v], [%v, %v]]}", e.Field, e.South, e.West, e.North, e.East)
+}
+
+// geoLatitudes returns the field and latitude band of a geo expression, the
+// only part of it Datastore can filter on, as geo points are ordered by
+// latitude then longitude.
+func geoLatitudes(exp query.Expression) (field string, south, north float64, ok bool) {
+	switch t := exp.(type) {
+	case *Near:
+		dLat := t.Radius / earthRadius * 180 / math.Pi
+		return t.Field, math.Max(t.Lat-dLat, -90), math.Min(t.Lat+dLat, 90), true
+	case *WithinBox:
+		return t.Field, t.South, t.North, true
+	}
+	return "", 0, 0, false
+}
+
+// hasGeo tells whether p has geo expressions, which need a client-side
+// refinement.
+func hasGeo(p query.Predicate) bool {
+	for _, exp := range p {
+		if _, _, _, ok := geoLatitudes(exp); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// findGeo runs q filtering on the latitude bands of its geo expressions and
+// refines, sorts and windows the items in memory.
+func (d *Handler) findGeo(ctx context.Context, q *query.Query) ([]*resource.Item, error) {
+	qry, err := d.getQuery(ctx, &query.Query{Predicate: q.Predicate})
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := d.runQuery(ctx, qry)
+	if err != nil {
+		return nil, err
+	}
+	items := []*resource.Item{}
+	for _, item := range loaded {
+		if q.Predicate.Match(item.Payload) {
+			items = append(items, item)
+		}
+	}
+	sortItems(items, q.Sort)
+	return windowItems(items, q.Window), nil
+}
+
+// geoPointValue converts a stored or payload value to a geo point.
+func geoPointValue(v interface{}) (datastore.GeoPoint, bool) {
+	switch t := v.(type) {
+	case datastore.GeoPoint:
+		return t, true
+	case *datastore.GeoPoint:
+		if t != nil {
+			return *t, true
+		}
+	case map[string]interface{}:
+		lat, ok1 := toFloat(t["lat"])
+		lng, ok2 := toFloat(t["lng"])
+		if ok1 && ok2 {
+			return datastore.GeoPoint{Lat: lat, Lng: lng}, true
+		}
+	}
+	return datastore.GeoPoint{}, false
+}
+
+// payloadField returns the value of the field of payload named with the dot
+// notation.
+func payloadField(payload map[string]interface{}, field string) interface{} {
+	return (&resource.Item{Payload: payload}).GetField(field)
+}
+
+// distance returns the great-circle distance between a and b in meters.
+func distance(a, b datastore.GeoPoint) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
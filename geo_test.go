@@ -0,0 +1,73 @@
+package datastore
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+)
+
+func TestGeoExpressions(t *testing.T) {
+	paris := datastore.GeoPoint{Lat: 48.8566, Lng: 2.3522}
+	london := map[string]interface{}{"lat": 51.5074, "lng": -0.1278}
+	if d := distance(paris, datastore.GeoPoint{Lat: 51.5074, Lng: -0.1278}); math.Abs(d-343500) > 1000 {
+		t.Errorf("distance: got %v, want about 343.5km", d)
+	}
+	near := &Near{Field: "loc", Lat: paris.Lat, Lng: paris.Lng, Radius: 350000}
+	if !near.Match(map[string]interface{}{"loc": london}) {
+		t.Error("london should be within 350km of paris")
+	}
+	if near.Radius = 300000; near.Match(map[string]interface{}{"loc": london}) {
+		t.Error("london should not be within 300km of paris")
+	}
+	_, south, north, _ := geoLatitudes(near)
+	if south > 46.16 || south < 46.15 || north < 51.55 || north > 51.56 {
+		t.Errorf("latitudes: got %v, %v", south, north)
+	}
+	pacific := &WithinBox{Field: "loc", South: -30, West: 170, North: 0, East: -170}
+	if !pacific.Match(map[string]interface{}{"loc": datastore.GeoPoint{Lat: -17.7, Lng: 178}}) ||
+		pacific.Match(map[string]interface{}{"loc": datastore.GeoPoint{Lat: -17.7, Lng: 160}}) {
+		t.Error("boxes crossing the antimeridian")
+	}
+}
+
+func TestGeoPointCodec(t *testing.T) {
+	s := &schema.Schema{Fields: schema.Fields{
+		"location": {Validator: &GeoPoint{}},
+		"stops":    {Validator: &schema.Array{Values: schema.Field{Validator: &GeoPoint{}}}},
+	}}
+	if _, err := (GeoPoint{}).Validate(map[string]interface{}{"lat": 91.0, "lng": 0.0}); err == nil {
+		t.Error("validate: out of range latitude accepted")
+	}
+	h := NewHandler(nil, "", "shops").SetSchema(s)
+	item := &resource.Item{ID: "1", Payload: map[string]interface{}{
+		"id":       "1",
+		"location": map[string]interface{}{"lat": 48.8566, "lng": 2.3522},
+		"stops":    []interface{}{map[string]interface{}{"lat": 1.0, "lng": 2.0}},
+	}}
+	encoded, err := h.encodeItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"id":       "1",
+		"location": datastore.GeoPoint{Lat: 48.8566, Lng: 2.3522},
+		"stops":    []interface{}{datastore.GeoPoint{Lat: 1, Lng: 2}},
+	}
+	if !reflect.DeepEqual(encoded.Payload, want) {
+		t.Errorf("encode: got %v, want %v", encoded.Payload, want)
+	}
+	if err = h.decodeValues(encoded.Payload, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(encoded.Payload, item.Payload) {
+		t.Errorf("decode: got %v, want %v", encoded.Payload, item.Payload)
+	}
+	v, err := h.encodeFilterValue("location", datastore.GeoPoint{Lat: 10, Lng: 20}, false)
+	if err != nil || v != (datastore.GeoPoint{Lat: 10, Lng: 20}) {
+		t.Errorf("filter: got %v, %v", v, err)
+	}
+}
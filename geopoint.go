@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"errors"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema"
+)
+
+// GeoPoint validates geographic points given as {"lat": ..., "lng": ...}
+// objects or datastore.GeoPoint values, normalized to objects. Their fields
+// are stored as Datastore geo points instead of nested entities, so they can
+// be filtered with Near and WithinBox, and loaded back as objects. The same
+// conversion is applied to query values.
+type GeoPoint struct{}
+
+var errInvalidGeoPoint = errors.New("not a valid geo point")
+
+// Validate implements the schema.FieldValidator interface
+func (v GeoPoint) Validate(value interface{}) (interface{}, error) {
+	p, ok := geoPointValue(value)
+	if !ok || !p.Valid() {
+		return nil, errInvalidGeoPoint
+	}
+	return geoPointMap(p), nil
+}
+
+// ValidateQuery implements the schema.FieldQueryValidator interface
+func (v GeoPoint) ValidateQuery(value interface{}) (interface{}, error) {
+	return v.Validate(value)
+}
+
+// GeoPointCodec stores {"lat": ..., "lng": ...} objects as Datastore geo
+// points and loads them back as objects. It applies to the fields validated
+// by GeoPoint without being registered, and can be registered for other
+// validators of such objects.
+type GeoPointCodec struct{}
+
+// Encode implements ValueCodec.
+func (GeoPointCodec) Encode(value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	p, ok := geoPointValue(value)
+	if !ok || !p.Valid() {
+		return nil, errInvalidGeoPoint
+	}
+	return p, nil
+}
+
+// Decode implements ValueCodec.
+func (GeoPointCodec) Decode(value interface{}) (interface{}, error) {
+	if p, ok := value.(datastore.GeoPoint); ok {
+		return geoPointMap(p), nil
+	}
+	if m, ok := toMap(value); ok {
+		// Points written as nested entities before the codec applied
+		return m, nil
+	}
+	return value, nil
+}
+
+func geoPointMap(p datastore.GeoPoint) map[string]interface{} {
+	return map[string]interface{}{"lat": p.Lat, "lng": p.Lng}
+}
+
+// isGeoPoint tells whether v is a GeoPoint validator.
+func isGeoPoint(v schema.FieldValidator) bool {
+	switch v.(type) {
+	case GeoPoint, *GeoPoint:
+		return true
+	}
+	return false
+}
+
+// hasGeoPoints tells whether s has GeoPoint fields, at any depth.
+func hasGeoPoints(s *schema.Schema) bool {
+	if s == nil {
+		return false
+	}
+	for _, f := range s.Fields {
+		if isGeoPoint(f.Validator) || hasGeoPoints(f.Schema) {
+			return true
+		}
+		if a, ok := f.Validator.(*schema.Array); ok && isGeoPoint(a.Values.Validator) {
+			return true
+		}
+		if o, ok := f.Validator.(*schema.Object); ok && hasGeoPoints(o.Schema) {
+			return true
+		}
+	}
+	return false
+}
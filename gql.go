@@ -0,0 +1,506 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+)
+
+// GQLParam is a named parameter of a GQL query, bound with @name.
+type GQLParam struct {
+	Name  string
+	Value interface{}
+}
+
+// RunGQL runs a GQL query on the kind of the handler, for the read paths the
+// translation of rest-layer queries can't express, and returns the matching
+// items decoded like by Find. The namespace of ctx is injected in the query
+// and its keys. Parameters are bound by position with @1, @2... or by name
+// with @name when given as a GQLParam.
+//
+// The supported GQL is:
+//
+//	SELECT * FROM <kind>
+//	  [WHERE <condition> [AND <condition>...]]
+//	  [ORDER BY <property> [ASC|DESC] [, ...]]
+//	  [LIMIT <n>] [OFFSET <n>]
+//
+// where conditions compare properties with =, !=, <, <=, >, >=, IN, NOT IN,
+// CONTAINS and IS NULL, or select descendants with __key__ HAS ANCESTOR,
+// against literals, bindings, KEY(kind, id, ...), DATETIME('RFC 3339') and
+// ARRAY(...) values. Filters apply to the stored properties, so values are
+// not encoded by the codecs of the handler.
+func (d *Handler) RunGQL(ctx context.Context, gql string, params ...interface{}) (list *resource.ItemList, err error) {
+	ctx, op := d.startOperation(ctx, "RunGQL")
+	defer func() {
+		n := 0
+		if list != nil {
+			n = len(list.Items)
+		}
+		err = op.end(n, err)
+	}()
+	p, err := newGQLParser(gql, params)
+	if err != nil {
+		return nil, err
+	}
+	p.namespace = d.getNamespace(ctx)
+	qry, offset, limit, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if qry.kind != d.entity {
+		return nil, fmt.Errorf("gql: FROM %s doesn't match the kind %s of the handler", qry.kind, d.entity)
+	}
+	items, err := d.runQuery(ctx, qry.Namespace(p.namespace))
+	if err != nil {
+		return nil, err
+	}
+	return &resource.ItemList{Total: -1, Offset: offset, Limit: limit, Items: items}, nil
+}
+
+// gqlQuery is a parsed query with its kind.
+type gqlQuery struct {
+	*datastore.Query
+	kind string
+}
+
+// Kinds of GQL tokens.
+const (
+	gqlEOF = iota
+	gqlIdent
+	gqlString
+	gqlNumber
+	gqlBinding
+	gqlSymbol
+)
+
+type gqlToken struct {
+	kind int
+	text string
+}
+
+// gqlParser parses a GQL query.
+type gqlParser struct {
+	tokens    []gqlToken
+	pos       int
+	params    []interface{}
+	named     map[string]interface{}
+	namespace string
+}
+
+func newGQLParser(gql string, params []interface{}) (*gqlParser, error) {
+	p := &gqlParser{named: map[string]interface{}{}}
+	for _, v := range params {
+		if np, ok := v.(GQLParam); ok {
+			p.named[np.Name] = np.Value
+		} else {
+			p.params = append(p.params, v)
+		}
+	}
+	var err error
+	p.tokens, err = tokenizeGQL(gql)
+	return p, err
+}
+
+// tokenizeGQL splits gql in tokens, ending with an EOF token.
+func tokenizeGQL(gql string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	r := []rune(gql)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			// Quotes are escaped by doubling them or with a backslash
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(r); j++ {
+				if r[j] == '\\' && j+1 < len(r) {
+					j++
+				} else if r[j] == c {
+					if j+1 < len(r) && r[j+1] == c {
+						j++
+					} else {
+						break
+					}
+				}
+				b.WriteRune(r[j])
+			}
+			if j == len(r) {
+				return nil, fmt.Errorf("gql: unterminated string at %d", i)
+			}
+			kind := gqlString
+			if c == '`' {
+				kind = gqlIdent
+			}
+			tokens = append(tokens, gqlToken{kind, b.String()})
+			i = j + 1
+		case c == '@':
+			j := i + 1
+			for j < len(r) && (unicode.IsLetter(r[j]) || unicode.IsDigit(r[j]) || r[j] == '_') {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("gql: empty binding at %d", i)
+			}
+			tokens = append(tokens, gqlToken{gqlBinding, string(r[i+1 : j])})
+			i = j
+		case unicode.IsDigit(c) || (c == '-' || c == '.') && i+1 < len(r) && unicode.IsDigit(r[i+1]):
+			j := i + 1
+			for j < len(r) && (unicode.IsDigit(r[j]) || strings.ContainsRune(".eE", r[j]) ||
+				(r[j] == '-' || r[j] == '+') && (r[j-1] == 'e' || r[j-1] == 'E')) {
+				j++
+			}
+			tokens = append(tokens, gqlToken{gqlNumber, string(r[i:j])})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(r) && (unicode.IsLetter(r[j]) || unicode.IsDigit(r[j]) || r[j] == '_' || r[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, gqlToken{gqlIdent, string(r[i:j])})
+			i = j
+		default:
+			sym := string(c)
+			if i+1 < len(r) && (c == '<' || c == '>' || c == '!') && r[i+1] == '=' {
+				sym += "="
+			}
+			if !strings.Contains("* , ( ) = != < <= > >=", sym) || sym == "!" {
+				return nil, fmt.Errorf("gql: unexpected %q at %d", sym, i)
+			}
+			tokens = append(tokens, gqlToken{gqlSymbol, sym})
+			i += len(sym)
+		}
+	}
+	return append(tokens, gqlToken{kind: gqlEOF}), nil
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != gqlEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the next token if it is the keyword kw.
+func (p *gqlParser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == gqlIdent && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// symbol consumes the next token if it is the symbol sym.
+func (p *gqlParser) symbol(sym string) bool {
+	if t := p.peek(); t.kind == gqlSymbol && t.text == sym {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	t := p.peek()
+	at := "end of query"
+	if t.kind != gqlEOF {
+		at = fmt.Sprintf("%q", t.text)
+	}
+	return fmt.Errorf("gql: "+format+" at %s", append(args, at)...)
+}
+
+// expect consumes the keywords kws or fails.
+func (p *gqlParser) expect(kws ...string) error {
+	for _, kw := range kws {
+		if !p.keyword(kw) {
+			return p.errorf("expected %s", kw)
+		}
+	}
+	return nil
+}
+
+// property parses a property name, quoted for FilterField and Order when
+// needed.
+func (p *gqlParser) property() (string, error) {
+	t := p.next()
+	if t.kind != gqlIdent {
+		return "", p.errorf("expected a property")
+	}
+	if strings.ContainsAny(t.text, " \"'<>=!-+") {
+		return strconv.Quote(t.text), nil
+	}
+	return t.text, nil
+}
+
+// parse parses the query and returns it with its offset and limit, -1 when
+// unlimited.
+func (p *gqlParser) parse() (*gqlQuery, int, int, error) {
+	offset, limit := 0, -1
+	if err := p.expect("SELECT"); err != nil {
+		return nil, 0, 0, err
+	}
+	if !p.symbol("*") {
+		return nil, 0, 0, p.errorf("only SELECT * is supported")
+	}
+	if err := p.expect("FROM"); err != nil {
+		return nil, 0, 0, err
+	}
+	t := p.next()
+	if t.kind != gqlIdent {
+		return nil, 0, 0, p.errorf("expected a kind")
+	}
+	q := &gqlQuery{Query: datastore.NewQuery(t.text), kind: t.text}
+	if p.keyword("WHERE") {
+		for {
+			if err := p.condition(q); err != nil {
+				return nil, 0, 0, err
+			}
+			if !p.keyword("AND") {
+				break
+			}
+		}
+	}
+	if p.keyword("ORDER") {
+		if err := p.expect("BY"); err != nil {
+			return nil, 0, 0, err
+		}
+		for {
+			name, err := p.property()
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			if p.keyword("DESC") {
+				name = "-" + name
+			} else {
+				p.keyword("ASC")
+			}
+			q.Query = q.Order(name)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	for _, clause := range []string{"LIMIT", "OFFSET"} {
+		if !p.keyword(clause) {
+			continue
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		n, ok := v.(int64)
+		if !ok || n < 0 {
+			return nil, 0, 0, fmt.Errorf("gql: invalid %s %v", clause, v)
+		}
+		if clause == "LIMIT" {
+			limit = int(n)
+			q.Query = q.Limit(limit)
+		} else {
+			offset = int(n)
+			q.Query = q.Offset(offset)
+		}
+	}
+	if p.peek().kind != gqlEOF {
+		return nil, 0, 0, p.errorf("unexpected token")
+	}
+	return q, offset, limit, nil
+}
+
+// condition parses a condition of the WHERE clause and adds it to q.
+func (p *gqlParser) condition(q *gqlQuery) error {
+	name, err := p.property()
+	if err != nil {
+		return err
+	}
+	var op string
+	switch {
+	case p.keyword("HAS"):
+		if err := p.expect("ANCESTOR"); err != nil {
+			return err
+		}
+		v, err := p.value()
+		if err != nil {
+			return err
+		}
+		key, ok := v.(*datastore.Key)
+		if name != "__key__" || !ok {
+			return fmt.Errorf("gql: HAS ANCESTOR needs __key__ and a key")
+		}
+		q.Query = q.Ancestor(key)
+		return nil
+	case p.keyword("IS"):
+		if err := p.expect("NULL"); err != nil {
+			return err
+		}
+		q.Query = q.FilterField(name, "=", nil)
+		return nil
+	case p.keyword("IN"):
+		op = "in"
+	case p.keyword("NOT"):
+		if err := p.expect("IN"); err != nil {
+			return err
+		}
+		op = "not-in"
+	case p.keyword("CONTAINS"):
+		op = "="
+	case p.peek().kind == gqlSymbol:
+		op = p.next().text
+		if !strings.Contains("= != < <= > >=", op) {
+			return p.errorf("expected an operator")
+		}
+	default:
+		return p.errorf("expected an operator")
+	}
+	var v interface{}
+	if (op == "in" || op == "not-in") && p.symbol("(") {
+		v, err = p.list()
+	} else {
+		v, err = p.value()
+	}
+	if err != nil {
+		return err
+	}
+	if op == "in" || op == "not-in" {
+		if v, err = toInterfaces(v); err != nil {
+			return err
+		}
+	}
+	q.Query = q.FilterField(name, op, v)
+	return nil
+}
+
+// list parses the values of a list up to its closing parenthesis.
+func (p *gqlParser) list() ([]interface{}, error) {
+	var values []interface{}
+	if p.symbol(")") {
+		return values, nil
+	}
+	for {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		if p.symbol(")") {
+			return values, nil
+		}
+		if !p.symbol(",") {
+			return nil, p.errorf("expected , or )")
+		}
+	}
+}
+
+// value parses a literal, binding, KEY, DATETIME or ARRAY value.
+func (p *gqlParser) value() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case gqlString:
+		return t.text, nil
+	case gqlNumber:
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("gql: invalid number %s", t.text)
+		}
+		return f, nil
+	case gqlBinding:
+		if n, err := strconv.Atoi(t.text); err == nil {
+			if n < 1 || n > len(p.params) {
+				return nil, fmt.Errorf("gql: no parameter @%d", n)
+			}
+			return p.params[n-1], nil
+		}
+		v, ok := p.named[t.text]
+		if !ok {
+			return nil, fmt.Errorf("gql: no parameter @%s", t.text)
+		}
+		return v, nil
+	case gqlIdent:
+		switch strings.ToUpper(t.text) {
+		case "TRUE":
+			return true, nil
+		case "FALSE":
+			return false, nil
+		case "NULL":
+			return nil, nil
+		case "KEY", "DATETIME", "ARRAY":
+			if !p.symbol("(") {
+				return nil, p.errorf("expected (")
+			}
+			args, err := p.list()
+			if err != nil {
+				return nil, err
+			}
+			switch strings.ToUpper(t.text) {
+			case "KEY":
+				return p.key(args)
+			case "DATETIME":
+				if len(args) == 1 {
+					if s, ok := args[0].(string); ok {
+						return time.Parse(time.RFC3339Nano, s)
+					}
+				}
+				return nil, fmt.Errorf("gql: DATETIME needs a string")
+			}
+			return args, nil
+		}
+	}
+	p.pos--
+	return nil, p.errorf("expected a value")
+}
+
+// key builds a key in the namespace of the query from its kind and id pairs.
+func (p *gqlParser) key(args []interface{}) (*datastore.Key, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, fmt.Errorf("gql: KEY needs kind and id pairs")
+	}
+	var key *datastore.Key
+	for i := 0; i < len(args); i += 2 {
+		kind, ok := args[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("gql: invalid KEY kind %v", args[i])
+		}
+		switch id := args[i+1].(type) {
+		case string:
+			key = datastore.NameKey(kind, id, key)
+		case int64:
+			key = datastore.IDKey(kind, id, key)
+		default:
+			return nil, fmt.Errorf("gql: invalid KEY id %v", args[i+1])
+		}
+		key.Namespace = p.namespace
+	}
+	return key, nil
+}
+
+// toInterfaces converts the slice v to the []interface{} expected by IN
+// filters.
+func toInterfaces(v interface{}) ([]interface{}, error) {
+	if s, ok := v.([]interface{}); ok {
+		return s, nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("gql: IN needs a list, got %T", v)
+	}
+	s := make([]interface{}, rv.Len())
+	for i := range s {
+		s[i] = rv.Index(i).Interface()
+	}
+	return s, nil
+}
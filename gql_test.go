@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestParseGQL(t *testing.T) {
+	parent := datastore.NameKey("orgs", "acme", nil)
+	parent.Namespace = "ns"
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		gql    string
+		params []interface{}
+		want   *datastore.Query
+		offset int
+		limit  int
+	}{
+		{"SELECT * FROM users", nil, datastore.NewQuery("users"), 0, -1},
+		{
+			"select * from users where age >= 18 and `first name` = 'O''Brien' order by age desc, name limit 10 offset @2",
+			[]interface{}{nil, int64(20)},
+			datastore.NewQuery("users").FilterField("age", ">=", int64(18)).FilterField(`"first name"`, "=", "O'Brien").
+				Order("-age").Order("name").Limit(10).Offset(20),
+			20, 10,
+		},
+		{
+			"SELECT * FROM users WHERE __key__ HAS ANCESTOR KEY('orgs', 'acme') AND created > DATETIME('2024-01-01T00:00:00Z') AND role IN @roles AND deleted IS NULL",
+			[]interface{}{GQLParam{Name: "roles", Value: []string{"admin", "owner"}}},
+			datastore.NewQuery("users").Ancestor(parent).FilterField("created", ">", since).
+				FilterField("role", "in", []interface{}{"admin", "owner"}).FilterField("deleted", "=", nil),
+			0, -1,
+		},
+		{
+			"SELECT * FROM users WHERE tags NOT IN ('a', 'b') AND score < -1.5",
+			nil,
+			datastore.NewQuery("users").FilterField("tags", "not-in", []interface{}{"a", "b"}).FilterField("score", "<", -1.5),
+			0, -1,
+		},
+	}
+	for _, tt := range tests {
+		p, err := newGQLParser(tt.gql, tt.params)
+		if err != nil {
+			t.Errorf("%s: %v", tt.gql, err)
+			continue
+		}
+		p.namespace = "ns"
+		q, offset, limit, err := p.parse()
+		if err != nil {
+			t.Errorf("%s: %v", tt.gql, err)
+			continue
+		}
+		if !reflect.DeepEqual(q.Query, tt.want) || offset != tt.offset || limit != tt.limit {
+			t.Errorf("%s: got %+v (%d, %d), want %+v (%d, %d)", tt.gql, q.Query, offset, limit, tt.want, tt.offset, tt.limit)
+		}
+	}
+	for _, gql := range []string{
+		"SELECT name FROM users",
+		"SELECT * FROM users WHERE age",
+		"SELECT * FROM users WHERE age = @1",
+		"SELECT * FROM users LIMIT 'a'",
+		"SELECT * FROM users WHERE name = 'open",
+		"SELECT * FROM users extra",
+	} {
+		p, err := newGQLParser(gql, nil)
+		if err == nil {
+			_, _, _, err = p.parse()
+		}
+		if err == nil {
+			t.Errorf("%s: want an error", gql)
+		}
+	}
+}
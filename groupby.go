@@ -0,0 +1,185 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/rest"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// DefaultGroupByLimit is the number of items GroupBy reads at most, unless
+// changed with SetGroupByLimit.
+const DefaultGroupByLimit = 10000
+
+// ErrTooManyRows is returned by GroupBy when more items than its limit match
+// the query.
+type ErrTooManyRows struct {
+	Limit int
+}
+
+// Error implements the error interface
+func (e *ErrTooManyRows) Error() string {
+	return fmt.Sprintf("more than %d items to group, narrow the query", e.Limit)
+}
+
+// RESTError reports the query as too broad to group, a 422.
+func (e *ErrTooManyRows) RESTError() *rest.Error {
+	return &rest.Error{Code: http.StatusUnprocessableEntity, Message: e.Error()}
+}
+
+// SetGroupByLimit sets the number of items GroupBy reads at most,
+// DefaultGroupByLimit when n is not positive.
+func (d *Handler) SetGroupByLimit(n int) *Handler {
+	d.groupByLimit = n
+	return d
+}
+
+// Group is a group of the items sharing the values of the fields of a
+// GroupBy.
+type Group struct {
+	// Values of the fields, nil for the items lacking one.
+	Values []interface{}
+	// Aggregates of the items of the group by alias.
+	Aggregates AggregateResult
+}
+
+// GroupBy finds the items matching the predicate and window of q, groups them
+// by the values of fields and aggregates each group in memory, for the small
+// result sets server-side aggregations can't group. Groups are sorted by
+// their values.
+//
+// Besides counts, sums and averages, computed like by Aggregate, GroupBy
+// supports AggregateMin and AggregateMax, the lowest and highest values of a
+// field following the Datastore ordering. It fails with ErrTooManyRows when
+// more items than the limit set with SetGroupByLimit match the query.
+func (d *Handler) GroupBy(ctx context.Context, q *query.Query, fields []string, aggs ...Aggregation) (groups []Group, err error) {
+	ctx, op := d.startOperation(ctx, "GroupBy", queryAttrs(q)...)
+	defer func() { err = op.end(len(groups), err) }()
+	limit := d.groupByLimit
+	if limit <= 0 {
+		limit = DefaultGroupByLimit
+	}
+	nq := *q
+	nq.Sort = nil
+	w := query.Window{Limit: limit + 1}
+	if q.Window != nil {
+		w.Offset = q.Window.Offset
+		if q.Window.Limit > -1 && q.Window.Limit <= limit {
+			w.Limit = q.Window.Limit
+		}
+	}
+	nq.Window = &w
+	list, err := d.findList(ctx, &nq)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) > limit {
+		return nil, &ErrTooManyRows{Limit: limit}
+	}
+	return groupItems(list.Items, fields, aggs)
+}
+
+// groupItems groups and aggregates items.
+func groupItems(items []*resource.Item, fields []string, aggs []Aggregation) ([]Group, error) {
+	type group struct {
+		values []interface{}
+		items  []*resource.Item
+	}
+	byKey := map[string]*group{}
+	var all []*group
+	for _, item := range items {
+		values := make([]interface{}, len(fields))
+		names := make([]string, len(fields))
+		for i, f := range fields {
+			values[i] = item.GetField(f)
+			names[i] = fmt.Sprintf("%T:%v", values[i], values[i])
+		}
+		key := strings.Join(names, "\x00")
+		g := byKey[key]
+		if g == nil {
+			g = &group{values: values}
+			byKey[key] = g
+			all = append(all, g)
+		}
+		g.items = append(g.items, item)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		for k := range fields {
+			if c := CompareValues(all[i].values[k], all[j].values[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	groups := make([]Group, len(all))
+	for i, g := range all {
+		groups[i] = Group{Values: g.values, Aggregates: AggregateResult{}}
+		for _, a := range aggs {
+			v, err := aggregateItems(g.items, a)
+			if err != nil {
+				return nil, err
+			}
+			groups[i].Aggregates[a.Alias] = v
+		}
+	}
+	return groups, nil
+}
+
+// aggregateItems computes the aggregation a of items.
+func aggregateItems(items []*resource.Item, a Aggregation) (interface{}, error) {
+	if a.Op == AggregateCount {
+		return int64(len(items)), nil
+	}
+	var isum int64
+	var fsum float64
+	var extreme interface{}
+	n, floats := 0, false
+	for _, item := range items {
+		v := item.GetField(a.Field)
+		if v == nil {
+			continue
+		}
+		switch a.Op {
+		case AggregateMin, AggregateMax:
+			c := CompareValues(v, extreme)
+			if extreme == nil || (a.Op == AggregateMin && c < 0) || (a.Op == AggregateMax && c > 0) {
+				extreme = v
+			}
+			continue
+		}
+		f, ok := toFloat(v)
+		if !ok {
+			continue
+		}
+		n++
+		fsum += f
+		switch i := v.(type) {
+		case int:
+			isum += int64(i)
+		case int64:
+			isum += i
+		default:
+			floats = true
+		}
+	}
+	switch a.Op {
+	case AggregateMin, AggregateMax:
+		return extreme, nil
+	case AggregateSum:
+		if floats {
+			return fsum, nil
+		}
+		return isum, nil
+	case AggregateAvg:
+		if n == 0 {
+			return nil, nil
+		}
+		return fsum / float64(n), nil
+	}
+	return nil, fmt.Errorf("unknown aggregation %d", a.Op)
+}
@@ -0,0 +1,34 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+)
+
+func TestGroupItems(t *testing.T) {
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"country": "fr", "total": 10}},
+		{ID: "2", Payload: map[string]interface{}{"country": "de", "total": 5}},
+		{ID: "3", Payload: map[string]interface{}{"country": "fr", "total": 20}},
+		{ID: "4", Payload: map[string]interface{}{"total": 1.5}},
+	}
+	groups, err := groupItems(items, []string{"country"}, []Aggregation{
+		{Alias: "n", Op: AggregateCount},
+		{Alias: "sum", Op: AggregateSum, Field: "total"},
+		{Alias: "avg", Op: AggregateAvg, Field: "total"},
+		{Alias: "max", Op: AggregateMax, Field: "total"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Group{
+		{Values: []interface{}{nil}, Aggregates: AggregateResult{"n": int64(1), "sum": 1.5, "avg": 1.5, "max": 1.5}},
+		{Values: []interface{}{"de"}, Aggregates: AggregateResult{"n": int64(1), "sum": int64(5), "avg": 5.0, "max": 5}},
+		{Values: []interface{}{"fr"}, Aggregates: AggregateResult{"n": int64(2), "sum": int64(30), "avg": 15.0, "max": 20}},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("got %v, want %v", groups, want)
+	}
+}
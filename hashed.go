@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+)
+
+// hashPrefix prefixes the indexed properties holding the hash of the values
+// of hashed fields.
+const hashPrefix = "_hash_"
+
+// SetHashedFields stores the given top level string fields unindexed, so
+// their values may exceed the 1500 bytes limit of indexed strings, along with
+// an indexed property holding the SHA-256 hash of their value. Equality,
+// inequality and in filters on those fields are transparently rewritten to
+// filters on the hash; range filters and sorts are not supported. List
+// fields get the hash of each of their string elements.
+//
+// Entities written before a field was hashed only match its filters once
+// rewritten.
+func (d *Handler) SetHashedFields(fields []string) *Handler {
+	d.hashedFields = make(map[string]bool, len(fields))
+	for _, f := range fields {
+		d.hashedFields[f] = true
+	}
+	return d
+}
+
+// hashValue returns the hash stored for a string value, or value as is.
+func hashValue(value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashProperty returns the indexed hash property of the hashed field name.
+func hashProperty(name string, value interface{}) datastore.Property {
+	if l, ok := value.([]interface{}); ok {
+		h := make([]interface{}, len(l))
+		for i, v := range l {
+			h[i] = hashValue(v)
+		}
+		value = h
+	} else {
+		value = hashValue(value)
+	}
+	return datastore.Property{Name: hashPrefix + name, Value: value}
+}
+
+// hashedFilter rewrites the filter on a hashed field to a filter on its hash.
+func hashedFilter(field, op string, value interface{}) (string, interface{}, error) {
+	switch op {
+	case "=", "!=":
+		return hashPrefix + field, hashValue(value), nil
+	case "in":
+		l, _ := value.([]interface{})
+		h := make([]interface{}, len(l))
+		for i, v := range l {
+			h[i] = hashValue(v)
+		}
+		return hashPrefix + field, h, nil
+	}
+	return "", nil, resource.ErrNotImplemented
+}
+
+// isHashProperty returns whether name is the hash property of a hashed field.
+func isHashProperty(name string) bool {
+	return strings.HasPrefix(name, hashPrefix)
+}
@@ -0,0 +1,41 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+)
+
+func TestHashedFields(t *testing.T) {
+	h := NewHandler(nil, "", "docs").SetHashedFields([]string{"body"})
+	e := h.newEntity(&resource.Item{ID: "1", Payload: map[string]interface{}{"id": "1", "body": "text"}})
+	ps, err := e.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body, hash bool
+	for _, p := range ps {
+		switch p.Name {
+		case "body":
+			body = p.NoIndex
+		case hashPrefix + "body":
+			hash = !p.NoIndex && p.Value == hashValue("text")
+		}
+	}
+	if !body || !hash {
+		t.Errorf("expected an unindexed body and an indexed hash, got %v", ps)
+	}
+	var loaded Entity
+	if err := loaded.Load(ps); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := loaded.Payload[hashPrefix+"body"]; found || loaded.Payload["body"] != "text" {
+		t.Errorf("unexpected payload %v", loaded.Payload)
+	}
+	if name, v, err := hashedFilter("body", "in", []interface{}{"text"}); err != nil || name != hashPrefix+"body" || v.([]interface{})[0] != hashValue("text") {
+		t.Errorf("unexpected in filter %s %v %v", name, v, err)
+	}
+	if _, _, err := hashedFilter("body", ">", "text"); err != resource.ErrNotImplemented {
+		t.Errorf("expected ErrNotImplemented for range filters, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package datastore
+
+import (
+	"context"
+	"time"
+)
+
+// SetHedging enables hedged reads: when a lookup or a Find page hasn't
+// returned after delay, a second identical request is issued and the first
+// response is used, the other request being canceled. It trades extra reads
+// for a lower tail latency on latency critical resources. A delay of zero
+// disables hedging.
+func (d *Handler) SetHedging(delay time.Duration) *Handler {
+	d.hedgeDelay = delay
+	return d
+}
+
+// hedged calls f, and calls it again concurrently if it hasn't returned after
+// the hedging delay, returning the first result.
+func (d *Handler) hedged(ctx context.Context, f func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if d.hedgeDelay <= 0 {
+		return f(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		v   interface{}
+		err error
+	}
+	results := make(chan result, 2)
+	run := func() {
+		v, err := f(ctx)
+		results <- result{v, err}
+	}
+	go run()
+	t := time.NewTimer(d.hedgeDelay)
+	defer t.Stop()
+	select {
+	case r := <-results:
+		return r.v, r.err
+	case <-t.C:
+		go run()
+	case <-ctx.Done():
+	}
+	r := <-results
+	return r.v, r.err
+}
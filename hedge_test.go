@@ -0,0 +1,24 @@
+package datastore
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedged(t *testing.T) {
+	h := NewHandler(nil, "", "users").SetHedging(10 * time.Millisecond)
+	var calls int32
+	v, err := h.hedged(context.Background(), func(ctx context.Context) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// The first attempt is slow
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return "second", nil
+	})
+	if err != nil || v != "second" || atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("expected the hedged attempt to win, got %v %v after %d calls", v, err, calls)
+	}
+}
@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	revisedProperty    = "_revised"
+	revisionOpProperty = "_op"
+)
+
+// Revision is a previous version of an item, replaced by an update or removed
+// by a deletion.
+type Revision struct {
+	// Item is the item as it was stored before the operation.
+	Item *resource.Item
+	// Op is the operation which replaced the item, "update" or "delete".
+	Op string
+	// Revised is the time of the operation.
+	Revised time.Time
+}
+
+// revisionEntity stores a revision in the history kind, with the same
+// layout as the item entity plus the operation meta properties.
+type revisionEntity struct {
+	Entity
+	Op      string
+	Revised time.Time
+}
+
+// Load implements the PropertyLoadSaver interface
+func (r *revisionEntity) Load(ps []datastore.Property) error {
+	rest := make([]datastore.Property, 0, len(ps))
+	for _, p := range ps {
+		switch p.Name {
+		case revisionOpProperty:
+			r.Op, _ = p.Value.(string)
+		case revisedProperty:
+			r.Revised, _ = p.Value.(time.Time)
+		default:
+			rest = append(rest, p)
+		}
+	}
+	return r.Entity.Load(rest)
+}
+
+// Save implements the PropertyLoadSaver interface
+func (r *revisionEntity) Save() ([]datastore.Property, error) {
+	ps, err := r.Entity.Save()
+	if err != nil {
+		return nil, err
+	}
+	return append(ps,
+		datastore.Property{Name: revisionOpProperty, Value: r.Op},
+		datastore.Property{Name: revisedProperty, Value: r.Revised},
+	), nil
+}
+
+// SetHistory enables keeping the revision history of items: Update, Delete,
+// Clear and Reap write the previous version of the item to kind, in the same
+// transaction. The kind defaults to the handler kind suffixed with
+// "_history". Clear and Reap record the version read before their commit,
+// which misses the updates committed in between.
+//
+// Overflow objects are not purged on deletion when history is enabled, as
+// they may still be referenced by revisions.
+func (d *Handler) SetHistory(kind string) *Handler {
+	if kind == "" {
+		kind = d.entity + "_history"
+	}
+	d.historyKind = kind
+	return d
+}
+
+// historyMutation returns the mutation recording e, stored with key, as
+// replaced by op, or nil if history is disabled.
+func (d *Handler) historyMutation(key *datastore.Key, e *Entity, op string) *datastore.Mutation {
+	if d.historyKind == "" {
+		return nil
+	}
+	prev := *d.configureEntity(e)
+	prev.Sample = false
+	hkey := datastore.IncompleteKey(d.historyKind, key)
+	hkey.Namespace = key.Namespace
+	return datastore.NewInsert(hkey, &revisionEntity{Entity: prev, Op: op, Revised: d.now()})
+}
+
+// History lists the revisions of the item with id, newest first.
+func (d *Handler) History(ctx context.Context, id string) ([]*Revision, error) {
+	if d.historyKind == "" {
+		return nil, nil
+	}
+	key := datastore.NameKey(d.entity, id, nil)
+	key.Namespace = d.getNamespace(ctx)
+	qry := datastore.NewQuery(d.historyKind).
+		Namespace(key.Namespace).
+		Ancestor(key)
+	var revisions []*Revision
+	for t := d.client.Run(ctx, qry); ; {
+		var r revisionEntity
+		_, err := t.Next(&r)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		item, err := d.loadItem(ctx, &r.Entity)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &Revision{Item: item, Op: r.Op, Revised: r.Revised})
+	}
+	// Sorted in memory to avoid requiring a composite index
+	sort.SliceStable(revisions, func(i, j int) bool {
+		return revisions[i].Revised.After(revisions[j].Revised)
+	})
+	return revisions, nil
+}
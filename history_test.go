@@ -0,0 +1,58 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+)
+
+func TestHistory(t *testing.T) {
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	h := NewHandler(c, "", "users")
+	ctx := context.Background()
+	if revisions, err := h.History(ctx, "1"); revisions != nil || err != nil {
+		t.Errorf("expected no history when disabled, got %v, %v", revisions, err)
+	}
+	if h.historyMutation(datastore.NameKey("users", "1", nil), &Entity{}, "update") != nil {
+		t.Error("expected no history mutation when disabled")
+	}
+	h.SetHistory("")
+	if h.historyKind != "users_history" {
+		t.Errorf("expected the default history kind, got %q", h.historyKind)
+	}
+	// The mock returns every stored entity, only revisions are stored
+	key := datastore.NameKey("users", "1", nil)
+	now := time.Now()
+	for i, op := range []string{"update", "delete", "update"} {
+		item := &resource.Item{ID: "1", ETag: string(rune('a' + i)), Payload: map[string]interface{}{"id": "1", "name": op}}
+		e, err := h.prepareEntity(ctx, key, item, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Revisions are stored out of order
+		revised := now.Add(time.Duration((i+1)%3) * time.Minute)
+		props, err := (&revisionEntity{Entity: *e, Op: op, Revised: revised}).Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.put(datastore.IDKey("users_history", int64(i+1), key), props)
+	}
+	revisions, err := h.History(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 {
+		t.Fatalf("expected 3 revisions, got %v", revisions)
+	}
+	for i, want := range []string{"b", "a", "c"} {
+		if r := revisions[i]; r.Item.ETag != want || r.Item.ID != "1" {
+			t.Errorf("revision %d: got %v, want etag %s", i, r.Item, want)
+		}
+	}
+	if r := revisions[0]; r.Op != "delete" || !r.Revised.Equal(now.Add(2*time.Minute)) || r.Item.Payload["name"] != "delete" {
+		t.Errorf("unexpected newest revision %+v", r)
+	}
+}
@@ -0,0 +1,34 @@
+package datastore
+
+import (
+	"context"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// Hooks are functions called around the storage operations of a handler, to
+// implement validation, enrichment, cache invalidation or metrics without
+// wrapping the whole storer. Nil hooks are ignored.
+//
+// Before hooks are called first and abort the operation when they return an
+// error. After hooks are called with the outcome of the operation, including
+// when a before hook failed; they may modify the returned items.
+type Hooks struct {
+	BeforeInsert func(ctx context.Context, items []*resource.Item) error
+	AfterInsert  func(ctx context.Context, items []*resource.Item, err error)
+	BeforeUpdate func(ctx context.Context, item, original *resource.Item) error
+	AfterUpdate  func(ctx context.Context, item, original *resource.Item, err error)
+	BeforeDelete func(ctx context.Context, item *resource.Item) error
+	AfterDelete  func(ctx context.Context, item *resource.Item, err error)
+	BeforeClear  func(ctx context.Context, q *query.Query) error
+	AfterClear   func(ctx context.Context, q *query.Query, deleted int, err error)
+	BeforeFind   func(ctx context.Context, q *query.Query) error
+	AfterFind    func(ctx context.Context, q *query.Query, list *resource.ItemList, err error)
+}
+
+// SetHooks sets the hooks called around the storage operations.
+func (d *Handler) SetHooks(hooks Hooks) *Handler {
+	d.hooks = hooks
+	return d
+}
@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/rest"
+)
+
+// ErrImmutableField is returned by Update when the new version of an item
+// changes a field declared immutable with SetImmutableFields.
+type ErrImmutableField struct {
+	Field string
+}
+
+// Error implements the error interface
+func (e *ErrImmutableField) Error() string {
+	return fmt.Sprintf("%s: field is immutable", e.Field)
+}
+
+// RESTError converts the error into a 422 rest.Error with a field issue.
+func (e *ErrImmutableField) RESTError() *rest.Error {
+	return &rest.Error{
+		Code:    422,
+		Message: e.Error(),
+		Issues:  map[string][]interface{}{e.Field: {"field is immutable"}},
+	}
+}
+
+// SetImmutableFields sets the top level fields which can't be changed once the
+// item has been created. Update checks them against the stored entity inside
+// its transaction.
+func (d *Handler) SetImmutableFields(fields []string) *Handler {
+	d.immutableFields = fields
+	return d
+}
+
+// decodedPayload returns the payload of the stored entity e decoded as on
+// read, with its references, encrypted and offloaded values resolved, leaving
+// e untouched, so it can be compared with a new payload.
+func (d *Handler) decodedPayload(ctx context.Context, e *Entity) (map[string]interface{}, error) {
+	c := *e
+	c.Payload = make(map[string]interface{}, len(e.Payload))
+	for k, v := range e.Payload {
+		c.Payload[k] = v
+	}
+	if err := d.decodeEntity(&c); err != nil {
+		return nil, err
+	}
+	if err := d.rehydrate(ctx, c.Payload); err != nil {
+		return nil, err
+	}
+	if err := d.decryptFields(ctx, c.Payload); err != nil {
+		return nil, err
+	}
+	if err := d.decodeValues(c.Payload, ""); err != nil {
+		return nil, err
+	}
+	return c.Payload, nil
+}
+
+// checkImmutable compares the immutable fields of the stored payload with the
+// new one.
+func (d *Handler) checkImmutable(stored, payload map[string]interface{}) error {
+	for _, f := range d.immutableFields {
+		if !equalValues(stored[f], payload[f]) {
+			return &ErrImmutableField{Field: f}
+		}
+	}
+	return nil
+}
+
+// equalValues compares a value loaded from Datastore with a payload value,
+// ignoring representation differences introduced by the storage (integer
+// widths, time precision and location, nested entities and JSON blobs).
+func equalValues(stored, value interface{}) bool {
+	switch s := stored.(type) {
+	case *datastore.Entity:
+		m := make(map[string]interface{}, len(s.Properties))
+		for _, p := range s.Properties {
+			m[p.Name] = p.Value
+		}
+		return equalValues(m, value)
+	case map[string]interface{}:
+		v, ok := value.(map[string]interface{})
+		if !ok || len(s) != len(v) {
+			return false
+		}
+		for k := range s {
+			if !equalValues(s[k], v[k]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		v, ok := value.([]interface{})
+		if !ok || len(s) != len(v) {
+			return false
+		}
+		for i := range s {
+			if !equalValues(s[i], v[i]) {
+				return false
+			}
+		}
+		return true
+	case time.Time:
+		v, ok := value.(time.Time)
+		return ok && s.Truncate(time.Microsecond).Equal(v.Truncate(time.Microsecond))
+	case string:
+		// Times stored in JSON blobs are loaded back as strings
+		if v, ok := value.(time.Time); ok {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			return err == nil && t.Equal(v)
+		}
+	}
+	if sf, ok := toFloat(stored); ok {
+		vf, ok := toFloat(value)
+		return ok && sf == vf
+	}
+	return reflect.DeepEqual(stored, value)
+}
+
+// toFloat converts any numeric value to a float64.
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
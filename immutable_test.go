@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestCheckImmutable(t *testing.T) {
+	now := time.Now()
+	d := (&Handler{}).SetImmutableFields([]string{"owner", "created", "meta"})
+	stored := map[string]interface{}{
+		"owner":   "john",
+		"created": now.UTC().Truncate(time.Microsecond),
+		"meta": &datastore.Entity{Properties: []datastore.Property{
+			{Name: "rev", Value: int64(1)},
+		}},
+	}
+	payload := map[string]interface{}{
+		"owner":   "john",
+		"created": now,
+		"meta":    map[string]interface{}{"rev": 1},
+		"name":    "changed",
+	}
+	if err := d.checkImmutable(stored, payload); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	payload["owner"] = "jane"
+	err := d.checkImmutable(stored, payload)
+	if e, ok := err.(*ErrImmutableField); !ok || e.Field != "owner" {
+		t.Fatalf("expected an immutable owner error, got %v", err)
+	}
+}
+
+// storeItem writes item to c as the handler would.
+func storeItem(t *testing.T, c *mockClient, h *Handler, item *resource.Item) {
+	t.Helper()
+	key := datastore.NameKey(h.entity, item.ID.(string), nil)
+	e, err := h.prepareEntity(context.Background(), key, item, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	props, err := e.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.put(key, props)
+}
+
+func TestUpdateImmutableReference(t *testing.T) {
+	s := &schema.Schema{Fields: schema.Fields{
+		"id":    schema.IDField,
+		"owner": {Validator: &schema.Reference{Path: "users"}},
+		"title": {Validator: &schema.String{}},
+	}}
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	h := NewHandler(c, "", "posts").
+		SetSchema(s).
+		SetReferenceKinds(map[string]string{"users": "User"}).
+		SetImmutableFields([]string{"owner"}).
+		SetTypedErrors(true)
+	original := &resource.Item{ID: "1", ETag: "e1", Payload: map[string]interface{}{"id": "1", "owner": "alice", "title": "a"}}
+	storeItem(t, c, h, original)
+	ctx := context.Background()
+	item := &resource.Item{ID: "1", Payload: map[string]interface{}{"id": "1", "owner": "alice", "title": "b"}}
+	if err := h.Update(ctx, item, original); err != nil {
+		t.Fatalf("expected an unchanged reference to be accepted, got %v", err)
+	}
+	current, err := h.getMulti(ctx, []query.Value{"1"})
+	if err != nil || len(current) != 1 {
+		t.Fatal(current, err)
+	}
+	item = &resource.Item{ID: "1", Payload: map[string]interface{}{"id": "1", "owner": "bob", "title": "b"}}
+	var immutable *ErrImmutableField
+	if err := h.Update(ctx, item, current[0]); !errors.As(err, &immutable) {
+		t.Errorf("expected an immutable owner error, got %v", err)
+	}
+}
+
+func TestUpdateImmutableEncrypted(t *testing.T) {
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	h := NewHandler(c, "", "users").
+		SetEncryptedFields(xorKeyProvider(42), []string{"ssn"}).
+		SetImmutableFields([]string{"ssn"}).
+		SetTypedErrors(true)
+	original := &resource.Item{ID: "1", ETag: "e1", Payload: map[string]interface{}{"id": "1", "ssn": "123-45-6789", "name": "a"}}
+	storeItem(t, c, h, original)
+	item := &resource.Item{ID: "1", Payload: map[string]interface{}{"id": "1", "ssn": "123-45-6789", "name": "b"}}
+	if err := h.Update(context.Background(), item, original); err != nil {
+		t.Errorf("expected an unchanged encrypted field to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+)
+
+// maxImportErrors bounds the number of rejected records detailed by an
+// import report.
+const maxImportErrors = 100
+
+// Record formats of imports and exports.
+const (
+	// NDJSON is one JSON object per line.
+	NDJSON = "ndjson"
+	// CSV has a header row naming the fields, nested fields using the dot
+	// notation, followed by a row per record. Empty cells are omitted.
+	CSV = "csv"
+)
+
+// Importer loads records into the kind of a handler, for initial data loads.
+// Records are validated against the schema bound with SetSchema, which fills
+// their default values such as the id, and written in batches like by
+// UpsertMulti with ReplaceMerge, replacing the items with the same id.
+type Importer struct {
+	Handler *Handler
+	// Format of the records, NDJSON when empty.
+	Format string
+	// BatchSize is the number of records written per batch, MaxMutations
+	// when not set.
+	BatchSize int
+	// Progress, if not nil, is called with the report after every batch.
+	Progress func(r *ImportReport)
+}
+
+// ImportReport counts the records of an import.
+type ImportReport struct {
+	Read     int
+	Imported int
+	Rejected int
+	// Errors details the first rejected records.
+	Errors []*ImportError
+}
+
+// ImportError is a record rejected by an import.
+type ImportError struct {
+	// Line of the record, from 1, the header row of CSV included.
+	Line int
+	Err  error
+}
+
+// Error implements the error interface
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (r *ImportReport) reject(line int, err error) {
+	r.Rejected++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, &ImportError{Line: line, Err: err})
+	}
+}
+
+// Import reads the records of r and writes the valid ones. Invalid records
+// are counted and reported without stopping the import, which stops at the
+// first failing batch or read error.
+func (im *Importer) Import(ctx context.Context, r io.Reader) (*ImportReport, error) {
+	size := im.BatchSize
+	if size <= 0 || size > MaxMutations {
+		size = MaxMutations
+	}
+	var next func() (map[string]interface{}, int, error)
+	switch im.Format {
+	case NDJSON, "":
+		next = ndjsonRecords(r)
+	case CSV:
+		next = im.csvRecords(r)
+	default:
+		return nil, fmt.Errorf("unknown import format %q", im.Format)
+	}
+	report := &ImportReport{}
+	batch := make([]*resource.Item, 0, size)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := im.Handler.UpsertMulti(ctx, batch, ReplaceMerge); err != nil {
+			return err
+		}
+		report.Imported += len(batch)
+		batch = batch[:0]
+		if im.Progress != nil {
+			im.Progress(report)
+		}
+		return nil
+	}
+	for {
+		payload, line, err := next()
+		if err == io.EOF {
+			break
+		}
+		var perr *ImportError
+		if errors.As(err, &perr) {
+			report.Read++
+			report.reject(perr.Line, perr.Err)
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Read++
+		item, err := im.item(ctx, payload)
+		if err != nil {
+			report.reject(line, err)
+			continue
+		}
+		if batch = append(batch, item); len(batch) == size {
+			if err = flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, flush()
+}
+
+// item validates payload against the schema of the handler and returns the
+// resulting item.
+func (im *Importer) item(ctx context.Context, payload map[string]interface{}) (*resource.Item, error) {
+	if s := im.Handler.schema; s != nil {
+		changes, base := s.Prepare(ctx, payload, nil, false)
+		doc, errs := s.Validate(changes, base)
+		if len(errs) > 0 {
+			return nil, schema.ErrorMap(errs)
+		}
+		payload = doc
+	}
+	return resource.NewItem(payload)
+}
+
+// ndjsonRecords returns a function reading the next record of r.
+func ndjsonRecords(r io.Reader) func() (map[string]interface{}, int, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, MaxEntitySize)
+	line := 0
+	return func() (map[string]interface{}, int, error) {
+		for s.Scan() {
+			line++
+			if len(strings.TrimSpace(s.Text())) == 0 {
+				continue
+			}
+			var payload map[string]interface{}
+			if err := json.Unmarshal(s.Bytes(), &payload); err != nil {
+				return nil, line, &ImportError{Line: line, Err: err}
+			}
+			return payload, line, nil
+		}
+		if err := s.Err(); err != nil {
+			return nil, line, err
+		}
+		return nil, line, io.EOF
+	}
+}
+
+// csvRecords returns a function reading the next record of r, converting
+// the cells of the numeric and boolean fields of the schema.
+func (im *Importer) csvRecords(r io.Reader) func() (map[string]interface{}, int, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 0
+	var header []string
+	line := 0
+	return func() (map[string]interface{}, int, error) {
+		if header == nil {
+			line++
+			h, err := cr.Read()
+			if err != nil {
+				return nil, line, err
+			}
+			header = h
+		}
+		line++
+		row, err := cr.Read()
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			return nil, line, &ImportError{Line: line, Err: err}
+		}
+		if err != nil {
+			return nil, line, err
+		}
+		payload := map[string]interface{}{}
+		for i, name := range header {
+			if row[i] == "" {
+				continue
+			}
+			v, err := im.csvValue(name, row[i])
+			if err != nil {
+				return nil, line, &ImportError{Line: line, Err: fmt.Errorf("%s: %v", name, err)}
+			}
+			setPath(payload, name, v)
+		}
+		return payload, line, nil
+	}
+}
+
+// csvValue converts the cell of field into the type expected by its
+// validator.
+func (im *Importer) csvValue(field, cell string) (interface{}, error) {
+	s := im.Handler.schema
+	if s == nil {
+		return cell, nil
+	}
+	f := s.GetField(field)
+	if f == nil {
+		return cell, nil
+	}
+	switch f.Validator.(type) {
+	case *schema.Integer, schema.Integer, *schema.Float, schema.Float:
+		// Like JSON numbers
+		return strconv.ParseFloat(cell, 64)
+	case *schema.Bool, schema.Bool:
+		return strconv.ParseBool(cell)
+	}
+	return cell, nil
+}
+
+// setPath sets the value of the field of payload named with the dot
+// notation, creating the nested objects.
+func setPath(payload map[string]interface{}, name string, v interface{}) {
+	parts := strings.Split(name, ".")
+	for _, p := range parts[:len(parts)-1] {
+		m, ok := payload[p].(map[string]interface{})
+		if !ok {
+			m = map[string]interface{}{}
+			payload[p] = m
+		}
+		payload = m
+	}
+	payload[parts[len(parts)-1]] = v
+}
@@ -0,0 +1,44 @@
+package datastore
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rs/rest-layer/schema"
+)
+
+func TestImportRecords(t *testing.T) {
+	s := &schema.Schema{Fields: schema.Fields{
+		"id":   {Required: true, Validator: &schema.String{}},
+		"age":  {Validator: &schema.Integer{}},
+		"meta": {Schema: &schema.Schema{Fields: schema.Fields{"vip": {Validator: &schema.Bool{}}}}},
+	}}
+	im := &Importer{Handler: NewHandler(nil, "", "users").SetSchema(s), Format: CSV}
+	next := im.csvRecords(strings.NewReader("id,age,meta.vip\n1,42,true\n2,,\n3,old,\n"))
+	want := []map[string]interface{}{
+		{"id": "1", "age": 42, "meta": map[string]interface{}{"vip": true}},
+		{"id": "2"},
+	}
+	for i, w := range want {
+		payload, _, err := next()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		item, err := im.item(context.Background(), payload)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(item.Payload, w) {
+			t.Errorf("record %d: got %v, want %v", i, item.Payload, w)
+		}
+	}
+	if _, _, err := next(); err == nil || err.(*ImportError).Line != 4 {
+		t.Errorf("invalid age: got %v, want an error on line 4", err)
+	}
+	if _, _, err := next(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
@@ -0,0 +1,277 @@
+package datastore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// maxIndexRows bounds the number of rows of an emulated index written for a
+// single item.
+const maxIndexRows = 1000
+
+// EmulatedIndex declares a companion kind indexing the items by the values of
+// some fields, for the queries Datastore can't serve natively, such as
+// inequalities on several fields or filters on noindex lists too large for
+// the built-in indexes.
+type EmulatedIndex struct {
+	// Name of the index, whose rows are stored in the <kind>_index_<name>
+	// kind.
+	Name string
+	// Fields are the top level fields held by the rows. Items get one row
+	// per combination of the elements of their list fields.
+	Fields []string
+}
+
+// SetEmulatedIndexes declares emulated indexes, maintained in the same commit
+// as the writes of Insert, Update, Delete, Clear and UpsertMulti. Find uses the
+// index covering the most filtered fields when the predicate has inequalities
+// on more than one field or filters a noindex property: the index rows are
+// queried with the equality filters and the inequalities of one field, and
+// the matching items are loaded and filtered, sorted and windowed in memory.
+//
+// Items written before an index was declared are not indexed until they are
+// written again.
+func (d *Handler) SetEmulatedIndexes(indexes ...EmulatedIndex) *Handler {
+	d.emulatedIndexes = indexes
+	return d
+}
+
+// indexKind returns the kind of the rows of idx.
+func (d *Handler) indexKind(idx EmulatedIndex) string {
+	return d.entity + "_index_" + idx.Name
+}
+
+// indexRows returns the rows of idx for payload, keyed by their key under
+// the item key.
+func (d *Handler) indexRows(key *datastore.Key, idx EmulatedIndex, payload map[string]interface{}) (map[string]*datastore.Entity, error) {
+	rows := []map[string]interface{}{{}}
+	for _, f := range idx.Fields {
+		values, ok := payload[f].([]interface{})
+		if !ok {
+			values = []interface{}{payload[f]}
+		}
+		if len(values) == 0 {
+			values = []interface{}{nil}
+		}
+		if len(rows)*len(values) > maxIndexRows {
+			return nil, fmt.Errorf("%s: emulated index %s would need more than %d rows", key.Name, idx.Name, maxIndexRows)
+		}
+		next := make([]map[string]interface{}, 0, len(rows)*len(values))
+		for _, r := range rows {
+			for _, v := range values {
+				ev, err := d.encodeValue(f, v)
+				if err != nil {
+					return nil, err
+				}
+				n := make(map[string]interface{}, len(r)+1)
+				for k, rv := range r {
+					n[k] = rv
+				}
+				n[f] = ev
+				next = append(next, n)
+			}
+		}
+		rows = next
+	}
+	entities := make(map[string]*datastore.Entity, len(rows))
+	for _, r := range rows {
+		e := &datastore.Entity{Properties: []datastore.Property{{Name: "_id", Value: key.Name}}}
+		for _, f := range idx.Fields {
+			e.Properties = append(e.Properties, datastore.Property{Name: f, Value: r[f]})
+		}
+		k := datastore.NameKey(d.indexKind(idx), rowName(idx.Fields, r), key)
+		k.Namespace = key.Namespace
+		entities[k.String()] = e
+		e.Key = k
+	}
+	return entities, nil
+}
+
+// rowName derives the name of a row from its values.
+func rowName(fields []string, row map[string]interface{}) string {
+	h := sha256.New()
+	for _, f := range fields {
+		fmt.Fprintf(h, "%T:%v\x00", row[f], row[f])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// indexChanges returns the mutations moving the emulated index rows of the
+// item with key from the before to the after payload, either of which may be
+// nil for an insertion or a deletion.
+func (d *Handler) indexChanges(key *datastore.Key, before, after map[string]interface{}) ([]*datastore.Mutation, error) {
+	var muts []*datastore.Mutation
+	for _, idx := range d.emulatedIndexes {
+		old := map[string]*datastore.Entity{}
+		rows := map[string]*datastore.Entity{}
+		var err error
+		if before != nil {
+			if old, err = d.indexRows(key, idx, before); err != nil {
+				return nil, err
+			}
+		}
+		if after != nil {
+			if rows, err = d.indexRows(key, idx, after); err != nil {
+				return nil, err
+			}
+		}
+		for k, e := range old {
+			if _, found := rows[k]; !found {
+				muts = append(muts, datastore.NewDelete(e.Key))
+			}
+		}
+		for k, e := range rows {
+			if _, found := old[k]; !found {
+				muts = append(muts, datastore.NewUpsert(e.Key, e))
+			}
+		}
+	}
+	return muts, nil
+}
+
+// emulatedIndexFor returns the emulated index to use for p, if p can't be
+// served natively, and the part of p its rows can be filtered with.
+func (d *Handler) emulatedIndexFor(p query.Predicate) (*EmulatedIndex, query.Predicate) {
+	if len(d.emulatedIndexes) == 0 {
+		return nil, nil
+	}
+	inequalities := map[string]bool{}
+	unindexed := false
+	for _, exp := range p {
+		switch t := exp.(type) {
+		case *query.GreaterThan, *query.GreaterOrEqual, *query.LowerThan, *query.LowerOrEqual, *query.NotEqual:
+			inequalities[expressionFields(t)[0]] = true
+		}
+		for _, f := range expressionFields(exp) {
+			if d.entityNoIndex()[f] {
+				unindexed = true
+			}
+		}
+	}
+	if len(inequalities) < 2 && !unindexed {
+		return nil, nil
+	}
+	var best *EmulatedIndex
+	var bestPredicate query.Predicate
+	for i, idx := range d.emulatedIndexes {
+		rp := d.rowPredicate(idx, p)
+		if len(rp) > len(bestPredicate) {
+			best, bestPredicate = &d.emulatedIndexes[i], rp
+		}
+	}
+	return best, bestPredicate
+}
+
+// rowPredicate returns the expressions of p which can filter the rows of idx:
+// the equalities on its fields and the inequalities of one of them.
+func (d *Handler) rowPredicate(idx EmulatedIndex, p query.Predicate) query.Predicate {
+	indexed := make(map[string]bool, len(idx.Fields))
+	for _, f := range idx.Fields {
+		indexed[f] = !d.hashedFields[f]
+	}
+	var rp query.Predicate
+	inequality := ""
+	for _, exp := range p {
+		switch t := exp.(type) {
+		case *query.Equal:
+			if _, list := t.Value.([]interface{}); indexed[t.Field] && !list {
+				rp = append(rp, t)
+			}
+		case *query.In:
+			if indexed[t.Field] && len(t.Values) <= MaxInValues {
+				rp = append(rp, t)
+			}
+		case *query.GreaterThan, *query.GreaterOrEqual, *query.LowerThan, *query.LowerOrEqual:
+			f := expressionFields(t)[0]
+			if indexed[f] && (inequality == "" || inequality == f) {
+				inequality = f
+				rp = append(rp, t)
+			}
+		}
+	}
+	return rp
+}
+
+// findEmulated serves q with the rows of idx filtered by rp.
+func (d *Handler) findEmulated(ctx context.Context, q *query.Query, idx *EmulatedIndex, rp query.Predicate) ([]*resource.Item, error) {
+	qry, err := d.translateRows(datastore.NewQuery(d.indexKind(*idx)), rp)
+	if err != nil {
+		return nil, err
+	}
+	qry = qry.Namespace(d.getNamespace(ctx)).KeysOnly()
+	seen := map[string]bool{}
+	var ids []query.Value
+	rows := 0
+	err = StreamKeys(ctx, d.client, qry, func(key *datastore.Key) error {
+		rows++
+		if id := key.Parent.Name; !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	profileOf(ctx).fetched(rows)
+	if err != nil {
+		return nil, err
+	}
+	items := []*resource.Item{}
+	for _, chunk := range chunkValues(ids, maxGetMulti) {
+		loaded, err := d.getMulti(ctx, chunk)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range loaded {
+			if q.Predicate.Match(item.Payload) {
+				items = append(items, item)
+			}
+		}
+	}
+	sortItems(items, q.Sort)
+	return windowItems(items, q.Window), nil
+}
+
+// translateRows adds the filters of rp, made of comparisons, to a query on
+// index rows.
+func (d *Handler) translateRows(qry *datastore.Query, rp query.Predicate) (*datastore.Query, error) {
+	for _, exp := range rp {
+		var field, op string
+		var value interface{}
+		switch t := exp.(type) {
+		case *query.Equal:
+			field, op, value = t.Field, "=", t.Value
+		case *query.In:
+			field, op, value = t.Field, "in", t.Values
+		case *query.GreaterThan:
+			field, op, value = t.Field, ">", t.Value
+		case *query.GreaterOrEqual:
+			field, op, value = t.Field, ">=", t.Value
+		case *query.LowerThan:
+			field, op, value = t.Field, "<", t.Value
+		case *query.LowerOrEqual:
+			field, op, value = t.Field, "<=", t.Value
+		}
+		if e, ok := value.(DateMath); ok {
+			t, err := e.Resolve(d.now())
+			if err != nil {
+				return nil, err
+			}
+			value = t
+		} else {
+			var err error
+			if value, err = d.encodeFilterValue(field, value, op == "in"); err != nil {
+				return nil, err
+			}
+		}
+		if field == "id" {
+			field = "_id"
+		}
+		qry = qry.Filter(field+" "+op, value)
+	}
+	return qry, nil
+}
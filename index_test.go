@@ -0,0 +1,147 @@
+package datastore
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestEmulatedIndexRows(t *testing.T) {
+	h := NewHandler(nil, "", "products").
+		SetEmulatedIndexes(EmulatedIndex{Name: "tags_price", Fields: []string{"tags", "price"}})
+	key := datastore.NameKey("products", "1", nil)
+	before := map[string]interface{}{"tags": []interface{}{"a", "b"}, "price": 10.0}
+	after := map[string]interface{}{"tags": []interface{}{"b", "c"}, "price": 10.0}
+	rows, err := h.indexRows(key, h.emulatedIndexes[0], before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+	for _, r := range rows {
+		if r.Key.Kind != "products_index_tags_price" || !r.Key.Parent.Equal(key) {
+			t.Errorf("unexpected row key %v", r.Key)
+		}
+	}
+	muts, err := h.indexChanges(key, before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Row a is deleted and row c written, row b is left as is
+	if len(muts) != 2 {
+		t.Errorf("expected 2 mutations, got %d", len(muts))
+	}
+}
+
+func TestEmulatedIndexFor(t *testing.T) {
+	h := NewHandler(nil, "", "products").
+		SetEmulatedIndexes(
+			EmulatedIndex{Name: "price", Fields: []string{"price"}},
+			EmulatedIndex{Name: "kind_price", Fields: []string{"kind", "price", "stock"}},
+		)
+	p := query.Predicate{
+		&query.Equal{Field: "kind", Value: "book"},
+		&query.GreaterThan{Field: "price", Value: 10.0},
+		&query.LowerThan{Field: "stock", Value: 5.0},
+	}
+	idx, rp := h.emulatedIndexFor(p)
+	if idx == nil || idx.Name != "kind_price" {
+		t.Fatalf("expected the kind_price index, got %v", idx)
+	}
+	// Only the inequalities of one field filter the rows
+	if len(rp) != 2 {
+		t.Errorf("expected 2 row filters, got %v", rp)
+	}
+	if idx, _ := h.emulatedIndexFor(p[:2]); idx != nil {
+		t.Errorf("expected natively supported queries to skip the index, got %v", idx)
+	}
+}
+
+func TestRequiredIndex(t *testing.T) {
+	h := NewHandler(nil, "", "users").SetFoldedFields([]string{"name"})
+	for _, tc := range []struct {
+		filter, sort string
+		expected     []IndexProperty
+	}{
+		{`{"age": {"$gt": 18}}`, "", nil},
+		{`{"age": 18, "country": "fr"}`, "", nil},
+		{`{"age": {"$gt": 18}}`, "age", nil},
+		{`{"name": "ada", "age": {"$gt": 18}}`, "", []IndexProperty{{Name: "name__lc"}, {Name: "age"}}},
+		{`{"country": "fr"}`, "-age,id", []IndexProperty{{Name: "country"}, {Name: "age", Direction: "desc"}, {Name: "_id"}}},
+	} {
+		q, err := query.New("", tc.filter, tc.sort, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx := h.RequiredIndex(q)
+		if tc.expected == nil {
+			if idx != nil {
+				t.Errorf("%s %s: expected no index, got %v", tc.filter, tc.sort, idx)
+			}
+			continue
+		}
+		if idx == nil || !reflect.DeepEqual(idx.Properties, tc.expected) {
+			t.Errorf("%s %s: expected %v, got %v", tc.filter, tc.sort, tc.expected, idx)
+		}
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	h := NewHandler(nil, "", "users")
+	indexes, err := h.Indexes(nil,
+		QueryPattern{Filter: `{"country": "fr"}`, Sort: "-age"},
+		QueryPattern{Filter: `{"country": "uk"}`, Sort: "-age"},
+		QueryPattern{Filter: `{"age": {"$gt": 18}}`},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f IndexFile
+	f.Add(indexes...)
+	expected := "indexes:\n    - kind: users\n      properties:\n        - name: country\n        - name: age\n          direction: desc\n"
+	if f.YAML() != expected {
+		t.Errorf("unexpected index.yaml %q", f.YAML())
+	}
+	if _, err := h.Indexes(nil, QueryPattern{Filter: `{"age": `}); err == nil {
+		t.Error("expected an error for an invalid filter")
+	}
+}
+
+func TestUncoveredQueries(t *testing.T) {
+	f, err := ParseIndexFile(strings.NewReader(`indexes:
+- kind: users
+  properties:
+  - name: status
+  - name: country
+  - name: age
+    direction: desc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(nil, "", "users")
+	var queries []*query.Query
+	for _, p := range []QueryPattern{
+		{Filter: `{"country": "fr", "status": "active"}`, Sort: "-age"},
+		{Filter: `{"country": "fr", "status": "active"}`, Sort: "age"},
+		{Filter: `{"country": "fr"}`, Sort: "-age"},
+		{Filter: `{"age": {"$gt": 18}}`},
+	} {
+		q, err := query.New("", p.Filter, p.Sort, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, q)
+	}
+	uncovered := h.UncoveredQueries(f, queries...)
+	if len(uncovered) != 2 || uncovered[0].Query != queries[1] || uncovered[1].Query != queries[2] {
+		t.Fatalf("unexpected uncovered queries %v", uncovered)
+	}
+	if expected := "users(country, age desc)"; uncovered[1].Index.String() != expected {
+		t.Errorf("expected index %s, got %s", expected, uncovered[1].Index)
+	}
+}
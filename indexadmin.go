@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	"context"
+
+	admin "cloud.google.com/go/datastore/admin/apiv1"
+	"cloud.google.com/go/datastore/admin/apiv1/adminpb"
+	"google.golang.org/api/iterator"
+)
+
+// IndexAdmin manages the composite indexes of a project with the Datastore
+// Admin API, so deployments can converge them programmatically instead of
+// deploying index.yaml by hand.
+type IndexAdmin struct {
+	client  *admin.DatastoreAdminClient
+	project string
+}
+
+// NewIndexAdmin returns an IndexAdmin managing the indexes of project with
+// client.
+func NewIndexAdmin(client *admin.DatastoreAdminClient, project string) *IndexAdmin {
+	return &IndexAdmin{client: client, project: project}
+}
+
+// List returns the composite indexes of the project which are ready or being
+// built.
+func (a *IndexAdmin) List(ctx context.Context) ([]CompositeIndex, error) {
+	var indexes []CompositeIndex
+	it := a.client.ListIndexes(ctx, &adminpb.ListIndexesRequest{ProjectId: a.project})
+	for {
+		idx, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if s := idx.GetState(); s != adminpb.Index_READY && s != adminpb.Index_CREATING {
+			continue
+		}
+		i := CompositeIndex{Kind: idx.GetKind(), Ancestor: idx.GetAncestor() == adminpb.Index_ALL_ANCESTORS}
+		for _, p := range idx.GetProperties() {
+			prop := IndexProperty{Name: p.GetName()}
+			if p.GetDirection() == adminpb.Index_DESCENDING {
+				prop.Direction = "desc"
+			}
+			i.Properties = append(i.Properties, prop)
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+// Missing returns the indexes of needed, as returned by Handler.Indexes, which
+// the project lacks.
+func (a *IndexAdmin) Missing(ctx context.Context, needed []CompositeIndex) ([]CompositeIndex, error) {
+	existing, err := a.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[string]bool, len(existing))
+	for _, i := range existing {
+		have[i.String()] = true
+	}
+	var missing []CompositeIndex
+	for _, i := range needed {
+		if !have[i.String()] {
+			have[i.String()] = true
+			missing = append(missing, i)
+		}
+	}
+	return missing, nil
+}
+
+// Create starts building indexes. It doesn't wait for the builds, which can
+// take a while on large kinds: List reports the indexes once started.
+func (a *IndexAdmin) Create(ctx context.Context, indexes ...CompositeIndex) error {
+	for _, i := range indexes {
+		idx := &adminpb.Index{ProjectId: a.project, Kind: i.Kind, Ancestor: adminpb.Index_NONE}
+		if i.Ancestor {
+			idx.Ancestor = adminpb.Index_ALL_ANCESTORS
+		}
+		for _, p := range i.Properties {
+			dir := adminpb.Index_ASCENDING
+			if p.Direction == "desc" {
+				dir = adminpb.Index_DESCENDING
+			}
+			idx.Properties = append(idx.Properties, &adminpb.Index_IndexedProperty{Name: p.Name, Direction: dir})
+		}
+		if _, err := a.client.CreateIndex(ctx, &adminpb.CreateIndexRequest{ProjectId: a.project, Index: idx}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Converge creates the indexes of needed the project lacks and returns them.
+func (a *IndexAdmin) Converge(ctx context.Context, needed []CompositeIndex) ([]CompositeIndex, error) {
+	missing, err := a.Missing(ctx, needed)
+	if err != nil {
+		return nil, err
+	}
+	return missing, a.Create(ctx, missing...)
+}
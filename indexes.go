@@ -0,0 +1,293 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+	"gopkg.in/yaml.v3"
+)
+
+// IndexProperty is a property of a composite index.
+type IndexProperty struct {
+	Name string `yaml:"name"`
+	// Direction is asc or desc, asc when empty.
+	Direction string `yaml:"direction,omitempty"`
+}
+
+// CompositeIndex is the definition of a Datastore composite index, as
+// declared in index.yaml.
+type CompositeIndex struct {
+	Kind       string
+	Ancestor   bool
+	Properties []IndexProperty
+}
+
+// indexYAML is the index.yaml form of a CompositeIndex.
+type indexYAML struct {
+	Kind       string          `yaml:"kind"`
+	Ancestor   string          `yaml:"ancestor,omitempty"`
+	Properties []IndexProperty `yaml:"properties"`
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (i CompositeIndex) MarshalYAML() (interface{}, error) {
+	y := indexYAML{Kind: i.Kind, Properties: i.Properties}
+	if i.Ancestor {
+		y.Ancestor = "yes"
+	}
+	return y, nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (i *CompositeIndex) UnmarshalYAML(n *yaml.Node) error {
+	var y indexYAML
+	if err := n.Decode(&y); err != nil {
+		return err
+	}
+	*i = CompositeIndex{Kind: y.Kind, Ancestor: y.Ancestor == "yes" || y.Ancestor == "true", Properties: y.Properties}
+	return nil
+}
+
+// YAML returns the index.yaml stanza declaring the index.
+func (i CompositeIndex) YAML() string {
+	b, _ := yaml.Marshal(map[string][]CompositeIndex{"indexes": {i}})
+	return string(b)
+}
+
+// IndexFile is the content of an index.yaml file.
+type IndexFile struct {
+	Indexes []CompositeIndex `yaml:"indexes"`
+}
+
+// Add adds the indexes missing from the file.
+func (f *IndexFile) Add(indexes ...CompositeIndex) {
+	for _, idx := range indexes {
+		found := false
+		for _, i := range f.Indexes {
+			if i.String() == idx.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			f.Indexes = append(f.Indexes, idx)
+		}
+	}
+}
+
+// YAML returns the content of the index.yaml file.
+func (f IndexFile) YAML() string {
+	b, _ := yaml.Marshal(f)
+	return string(b)
+}
+
+// String returns a compact representation of the index, such as
+// "users(country, age desc)".
+func (i CompositeIndex) String() string {
+	props := make([]string, 0, len(i.Properties)+1)
+	if i.Ancestor {
+		props = append(props, "ancestor")
+	}
+	for _, p := range i.Properties {
+		if p.Direction == "desc" {
+			props = append(props, p.Name+" desc")
+		} else {
+			props = append(props, p.Name)
+		}
+	}
+	return i.Kind + "(" + strings.Join(props, ", ") + ")"
+}
+
+// ParseIndexFile parses the content of an index.yaml file.
+func ParseIndexFile(r io.Reader) (IndexFile, error) {
+	var f IndexFile
+	if err := yaml.NewDecoder(r).Decode(&f); err != nil && err != io.EOF {
+		return IndexFile{}, err
+	}
+	return f, nil
+}
+
+// serves returns whether an index of the file serves the queries requiring
+// idx, whose equality properties come in any order and direction.
+func (f IndexFile) serves(idx *CompositeIndex, equalities int) bool {
+	for _, i := range f.Indexes {
+		if i.Kind != idx.Kind || i.Ancestor != idx.Ancestor || len(i.Properties) != len(idx.Properties) {
+			continue
+		}
+		prefix := map[string]bool{}
+		for _, p := range i.Properties[:equalities] {
+			prefix[p.Name] = true
+		}
+		ok := true
+		for j, p := range idx.Properties {
+			if j < equalities {
+				ok = prefix[p.Name]
+			} else {
+				ok = i.Properties[j].Name == p.Name && (i.Properties[j].Direction == "desc") == (p.Direction == "desc")
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// UncoveredQuery is a query no index of an index.yaml file serves.
+type UncoveredQuery struct {
+	Query *query.Query
+	// Index is the missing index.
+	Index *CompositeIndex
+}
+
+// Error implements the error interface.
+func (u UncoveredQuery) Error() string {
+	return fmt.Sprintf("query filter %s sort %q needs index %s", u.Query.Predicate, sortString(u.Query.Sort), u.Index)
+}
+
+// UncoveredQueries returns the queries on the handler kind which would fail
+// for lack of a composite index in f, so deployments can check their
+// index.yaml at startup or in a test.
+func (d *Handler) UncoveredQueries(f IndexFile, queries ...*query.Query) []UncoveredQuery {
+	var uncovered []UncoveredQuery
+	for _, q := range queries {
+		if idx, n := d.requiredIndex(q); idx != nil && !f.serves(idx, n) {
+			uncovered = append(uncovered, UncoveredQuery{Query: q, Index: idx})
+		}
+	}
+	return uncovered
+}
+
+// QueryPattern is a filter and sort combination a resource is expected to
+// serve, in the syntax of the filter and sort query parameters.
+type QueryPattern struct {
+	Filter string `yaml:"filter"`
+	Sort   string `yaml:"sort"`
+}
+
+// Indexes returns the composite indexes needed to serve the query patterns
+// on the handler kind, validated against the schema of the resource when v
+// is not nil.
+func (d *Handler) Indexes(v schema.Validator, patterns ...QueryPattern) ([]CompositeIndex, error) {
+	var f IndexFile
+	for _, p := range patterns {
+		q, err := query.New("", p.Filter, p.Sort, nil)
+		if err == nil && v != nil {
+			err = q.Validate(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: filter %q sort %q: %v", d.entity, p.Filter, p.Sort, err)
+		}
+		if idx := d.RequiredIndex(q); idx != nil {
+			f.Add(*idx)
+		}
+	}
+	return f.Indexes, nil
+}
+
+// RequiredIndex returns the composite index Datastore needs to serve q on the
+// handler kind, or nil if the built-in indexes are enough: queries filtering
+// or sorting a single property, and queries made of equality filters only.
+// Equality properties come first, followed by the inequality property and the
+// sort orders.
+func (d *Handler) RequiredIndex(q *query.Query) *CompositeIndex {
+	idx, _ := d.requiredIndex(q)
+	return idx
+}
+
+// requiredIndex returns the index required by q along with its number of
+// equality properties.
+func (d *Handler) requiredIndex(q *query.Query) (*CompositeIndex, int) {
+	var equalities []string
+	inequality := ""
+	seen := map[string]bool{}
+	var walk func(p query.Predicate)
+	walk = func(p query.Predicate) {
+		for _, exp := range p {
+			switch t := exp.(type) {
+			case *query.And:
+				walk(query.Predicate(*t))
+			case *query.Equal:
+				if name := d.filterProperty(t.Field, "="); !seen[name] {
+					seen[name] = true
+					equalities = append(equalities, name)
+				}
+			case *query.In:
+				if name := d.filterProperty(t.Field, "in"); !seen[name] {
+					seen[name] = true
+					equalities = append(equalities, name)
+				}
+			case *query.Regex:
+				if inequality == "" {
+					inequality = t.Field + foldedSuffix
+				}
+			case *query.NotEqual, *query.GreaterThan, *query.GreaterOrEqual, *query.LowerThan, *query.LowerOrEqual:
+				if f := expressionFields(t)[0]; inequality == "" {
+					inequality = d.filterProperty(f, ">")
+				}
+			}
+		}
+	}
+	walk(q.Predicate)
+	idx := &CompositeIndex{Kind: d.entity}
+	for _, name := range equalities {
+		if name != inequality {
+			idx.Properties = append(idx.Properties, IndexProperty{Name: name})
+		}
+	}
+	sorted := map[string]bool{}
+	orders := make([]IndexProperty, 0, len(q.Sort)+1)
+	for _, s := range q.Sort {
+		p := IndexProperty{Name: getField(s.Name)}
+		if s.Reversed {
+			p.Direction = "desc"
+		}
+		if !seen[p.Name] && !sorted[p.Name] {
+			sorted[p.Name] = true
+			orders = append(orders, p)
+		}
+	}
+	if inequality != "" && !sorted[inequality] {
+		orders = append([]IndexProperty{{Name: inequality}}, orders...)
+	}
+	n := len(idx.Properties)
+	idx.Properties = append(idx.Properties, orders...)
+	if len(idx.Properties) < 2 || len(orders) == 0 {
+		return nil, 0
+	}
+	return idx, n
+}
+
+// filterProperty returns the property filtered by a filter on field with op,
+// which is a shadow property for hashed and folded fields.
+func (d *Handler) filterProperty(field, op string) string {
+	if d.hashedFields[field] {
+		return hashPrefix + field
+	}
+	if d.foldedFields[field] {
+		if name, _, ok := foldedFilter(field, op, nil); ok {
+			return name
+		}
+	}
+	return getField(field)
+}
+
+// recommendedIndex parses the index recommended by the message of a missing
+// index error.
+func recommendedIndex(msg string) *CompositeIndex {
+	i := strings.Index(msg, "recommended index is:")
+	if i < 0 {
+		return nil
+	}
+	var indexes []CompositeIndex
+	if err := yaml.Unmarshal([]byte(msg[i+len("recommended index is:"):]), &indexes); err != nil || len(indexes) == 0 {
+		return nil
+	}
+	return &indexes[0]
+}
@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema"
+	"google.golang.org/api/iterator"
+)
+
+var namespaceRegexp = regexp.MustCompile(`^[0-9A-Za-z._-]{0,100}$`)
+
+// SetSchema binds the schema of the resource stored by the handler, so its
+// configuration can be validated against it.
+func (d *Handler) SetSchema(s *schema.Schema) *Handler {
+	d.schema = s
+	d.geoPoints = hasGeoPoints(s)
+	return d
+}
+
+// Init validates the handler configuration and fails fast at service startup
+// instead of surfacing problems on the first live request. It checks the
+// namespace name, that the kind can be queried and, when a schema is bound
+// with SetSchema, that every filterable and sortable field is stored as an
+// indexed property and can be probed with a filter and a sort query.
+func (d *Handler) Init(ctx context.Context) error {
+	var problems []string
+	if !namespaceRegexp.MatchString(d.namespace) || strings.HasPrefix(d.namespace, "__") {
+		problems = append(problems, fmt.Sprintf("invalid namespace %q", d.namespace))
+	}
+	if d.entity == "" || strings.HasPrefix(d.entity, "__") {
+		problems = append(problems, fmt.Sprintf("invalid kind %q", d.entity))
+	} else if kindVarRegexp.MatchString(d.entity) {
+		problems = append(problems, fmt.Sprintf("unresolved kind template %q", d.entity))
+	}
+	if len(problems) > 0 {
+		return initError(d.entity, problems)
+	}
+	base := datastore.NewQuery(d.entity).Namespace(d.namespace).KeysOnly().Limit(1)
+	if err := probe(ctx, d.client, base); err != nil {
+		return initError(d.entity, []string{fmt.Sprintf("kind is not accessible: %v", err)})
+	}
+	if d.schema == nil {
+		return nil
+	}
+	names := make([]string, 0, len(d.schema.Fields))
+	for name := range d.schema.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := d.schema.Fields[name]
+		if !f.Filterable && !f.Sortable {
+			continue
+		}
+		if !d.queryable(name) || d.entityNoIndex()[name] {
+			problems = append(problems, fmt.Sprintf("%s: filterable or sortable field is not indexed", name))
+			continue
+		}
+		if f.Filterable {
+			if err := probe(ctx, d.client, base.Filter(getField(name)+" >", nil)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: filter probe failed: %v", name, err))
+			}
+		}
+		if f.Sortable {
+			if err := probe(ctx, d.client, base.Order(getField(name))); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: sort probe failed: %v", name, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return initError(d.entity, problems)
+	}
+	return nil
+}
+
+func initError(kind string, problems []string) error {
+	return fmt.Errorf("datastore: invalid handler for kind %q: %s", kind, strings.Join(problems, "; "))
+}
+
+// probe runs qry and only reports whether it could be executed.
+func probe(ctx context.Context, client Client, qry *datastore.Query) error {
+	_, err := client.Run(ctx, qry).Next(nil)
+	if err == iterator.Done {
+		return nil
+	}
+	return err
+}
+
+// Check verifies that the kind of the handler can be queried in the namespace
+// of ctx, with a keys-only query returning at most one entity, for readiness
+// probes. It goes through the retry policy and the circuit breaker.
+func (d *Handler) Check(ctx context.Context) error {
+	qry := datastore.NewQuery(d.entity).
+		Namespace(d.getNamespace(ctx)).
+		KeysOnly().
+		Limit(1)
+	return d.retry(ctx, true, func() error {
+		if err := d.throttle(ctx, 1); err != nil {
+			return err
+		}
+		_, err := d.client.GetAll(ctx, qry, nil)
+		return err
+	})
+}
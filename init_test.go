@@ -0,0 +1,31 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	if err := NewHandler(c, "", "users").Check(ctx); err != nil {
+		t.Errorf("expected a healthy handler, got %v", err)
+	}
+	down := status.Error(codes.Unavailable, "down")
+	h := NewHandler(failingClient{err: down}, "", "users").
+		SetRetryPolicy(nil).
+		SetCircuitBreaker(1, time.Minute)
+	if err := h.Check(ctx); err != down {
+		t.Errorf("expected the query error, got %v", err)
+	}
+	var unavailable *ErrUnavailable
+	if err := h.Check(ctx); !errors.As(err, &unavailable) {
+		t.Errorf("expected the open breaker to fail the check, got %v", err)
+	}
+}
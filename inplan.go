@@ -0,0 +1,251 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+const (
+	// MaxInValues is the maximum number of values Datastore accepts in a
+	// single IN filter. Larger lists are split into several queries.
+	MaxInValues = 30
+	// maxGetMulti is the maximum number of keys of a single GetMulti call.
+	maxGetMulti = 1000
+	// maxInParallel bounds the number of concurrent queries of a large IN.
+	maxInParallel = 8
+)
+
+// splitLargeIn returns the first top level IN expression with more values than
+// Datastore accepts and the rest of the predicate.
+func splitLargeIn(p query.Predicate) (*query.In, query.Predicate) {
+	for i, exp := range p {
+		if in, ok := exp.(*query.In); ok && len(in.Values) > MaxInValues {
+			rest := make(query.Predicate, 0, len(p)-1)
+			rest = append(rest, p[:i]...)
+			return in, append(rest, p[i+1:]...)
+		}
+	}
+	return nil, p
+}
+
+// chunkValues splits values into consecutive chunks of at most size values.
+func chunkValues(values []query.Value, size int) [][]query.Value {
+	var chunks [][]query.Value
+	for len(values) > size {
+		chunks = append(chunks, values[:size])
+		values = values[size:]
+	}
+	if len(values) > 0 {
+		chunks = append(chunks, values)
+	}
+	return chunks
+}
+
+// findLargeIn executes a query whose IN expression has too many values for a
+// single Datastore query. Values are split into chunks run in parallel, either
+// as GetMulti calls for a plain id lookup or as queries with the rest of the
+// predicate. Results are merged, sorted and windowed in memory.
+func (d *Handler) findLargeIn(ctx context.Context, q *query.Query, in *query.In, rest query.Predicate) ([]*resource.Item, error) {
+	byKey := in.Field == "id" && len(rest) == 0
+	size := MaxInValues
+	if byKey {
+		size = maxGetMulti
+	}
+	// Every chunk must return enough items to fill the window once merged
+	var window *query.Window
+	if q.Window != nil && q.Window.Limit > -1 {
+		window = &query.Window{Limit: q.Window.Offset + q.Window.Limit}
+	}
+
+	chunks := chunkValues(in.Values, size)
+	results := make([][]*resource.Item, len(chunks))
+	errs := make([]error, len(chunks))
+	sem := make(chan struct{}, maxInParallel)
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, chunk []query.Value) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if byKey {
+				results[i], errs[i] = d.getMulti(ctx, chunk)
+				return
+			}
+			p := append(query.Predicate{&query.In{Field: in.Field, Values: chunk}}, rest...)
+			results[i], errs[i] = d.find(ctx, &query.Query{Predicate: p, Sort: q.Sort, Window: window})
+		}(i, chunk)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Merge the results, an entity can match several chunks when the field is
+	// multi-valued
+	seen := map[interface{}]bool{}
+	items := []*resource.Item{}
+	for _, r := range results {
+		for _, i := range r {
+			if !seen[i.ID] {
+				seen[i.ID] = true
+				items = append(items, i)
+			}
+		}
+	}
+	sortItems(items, q.Sort)
+	return windowItems(items, q.Window), nil
+}
+
+// getMulti fetches the entities with the given ids, ignoring missing ones.
+func (d *Handler) getMulti(ctx context.Context, ids []query.Value) ([]*resource.Item, error) {
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		s, ok := id.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid id %#v", id)
+		}
+		keys[i] = datastore.NameKey(d.entity, s, nil)
+		keys[i].Namespace = d.getNamespace(ctx)
+	}
+	omit := d.omittedFields(ctx)
+	var entities []Entity
+	err := d.retry(ctx, true, func() error {
+		if err := d.throttle(ctx, len(keys)); err != nil {
+			return err
+		}
+		v, err := d.hedged(ctx, func(ctx context.Context) (interface{}, error) {
+			profileOf(ctx).fetched(len(keys))
+			fetched := make([]Entity, len(keys))
+			for i := range fetched {
+				fetched[i].Omit = omit
+			}
+			return fetched, d.client.GetMulti(ctx, keys, fetched)
+		})
+		entities, _ = v.([]Entity)
+		return err
+	})
+	merr, _ := err.(datastore.MultiError)
+	if err != nil && merr == nil {
+		return nil, err
+	}
+	items := make([]*resource.Item, 0, len(keys))
+	for i := range entities {
+		if merr != nil && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, merr[i]
+		}
+		if d.expired(&entities[i]) {
+			continue
+		}
+		item, err := d.loadItem(ctx, &entities[i])
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// sortItems sorts items in memory following s, or by id if s is empty.
+func sortItems(items []*resource.Item, s query.Sort) {
+	if len(s) == 0 {
+		s = query.Sort{{Name: "id"}}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		for _, f := range s {
+			c := CompareValues(items[i].GetField(f.Name), items[j].GetField(f.Name))
+			if c == 0 {
+				continue
+			}
+			if f.Reversed {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// windowItems applies w to a sorted list of items.
+func windowItems(items []*resource.Item, w *query.Window) []*resource.Item {
+	if w == nil {
+		return items
+	}
+	if w.Offset > 0 {
+		if w.Offset >= len(items) {
+			return []*resource.Item{}
+		}
+		items = items[w.Offset:]
+	}
+	if w.Limit > -1 && w.Limit < len(items) {
+		items = items[:w.Limit]
+	}
+	return items
+}
+
+// CompareValues compares two property values following the Datastore
+// ordering of values of the same type, nil first, as the handler does when
+// sorting in memory. It returns -1, 0 or 1.
+func CompareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if af, ok := toFloat(a); ok {
+		if bf, ok := toFloat(b); ok {
+			switch {
+			case af < bf:
+				return -1
+			case af > bf:
+				return 1
+			}
+			return 0
+		}
+	}
+	switch at := a.(type) {
+	case time.Time:
+		if bt, ok := b.(time.Time); ok {
+			switch {
+			case at.Before(bt):
+				return -1
+			case at.After(bt):
+				return 1
+			}
+			return 0
+		}
+	case bool:
+		if bt, ok := b.(bool); ok {
+			switch {
+			case at == bt:
+				return 0
+			case !at:
+				return -1
+			}
+			return 1
+		}
+	case string:
+		if bs, ok := b.(string); ok {
+			return strings.Compare(at, bs)
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
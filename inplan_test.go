@@ -0,0 +1,42 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestSplitLargeIn(t *testing.T) {
+	values := make([]query.Value, MaxInValues+1)
+	large := &query.In{Field: "user", Values: values}
+	eq := &query.Equal{Field: "public", Value: true}
+	in, rest := splitLargeIn(query.Predicate{eq, large})
+	if in != large {
+		t.Fatalf("expected the large IN expression, got %v", in)
+	}
+	if !reflect.DeepEqual(rest, query.Predicate{eq}) {
+		t.Errorf("unexpected rest predicate %v", rest)
+	}
+	small := &query.In{Field: "user", Values: values[:MaxInValues]}
+	if in, _ = splitLargeIn(query.Predicate{small}); in != nil {
+		t.Errorf("unexpected split of a small IN expression")
+	}
+}
+
+func TestSortAndWindowItems(t *testing.T) {
+	item := func(id string, n int) *resource.Item {
+		return &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "n": n}}
+	}
+	items := []*resource.Item{item("a", 2), item("b", 1), item("c", 3), item("d", 1)}
+	sortItems(items, query.Sort{{Name: "n", Reversed: true}, {Name: "id"}})
+	items = windowItems(items, &query.Window{Offset: 1, Limit: 2})
+	var ids []interface{}
+	for _, i := range items {
+		ids = append(ids, i.ID)
+	}
+	if want := []interface{}{"a", "b"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,111 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/rest"
+)
+
+// ReferentialAction defines how Delete handles the entities still referencing
+// the deleted item.
+type ReferentialAction int
+
+const (
+	// RestrictDelete refuses to delete referenced items with an
+	// ErrReferenced.
+	RestrictDelete ReferentialAction = iota
+	// NullifyReferences deletes the item and sets the references to it to
+	// nil.
+	NullifyReferences
+)
+
+// Referrer is a field of another resource referencing the items of the
+// handler.
+type Referrer struct {
+	// Handler storing the referencing resource.
+	Handler *Handler
+	// Field holding the references, a single reference or a list.
+	Field string
+	// Action taken on Delete when references remain.
+	Action ReferentialAction
+}
+
+// ErrReferenced is returned by Delete when the item is still referenced by
+// a RestrictDelete referrer.
+type ErrReferenced struct {
+	// ID of the item which can't be deleted.
+	ID string
+	// Kind and Field of the referencing entities.
+	Kind  string
+	Field string
+}
+
+// Error implements the error interface
+func (e *ErrReferenced) Error() string {
+	return fmt.Sprintf("%s is still referenced by the %s field of %s", e.ID, e.Field, e.Kind)
+}
+
+// RESTError reports the remaining references as a 409 Conflict.
+func (e *ErrReferenced) RESTError() *rest.Error {
+	return &rest.Error{Code: 409, Message: e.Error()}
+}
+
+// SetReferrers makes Delete check the given referencing fields, which must be
+// stored as properties. Referrers with the RestrictDelete action make Delete
+// fail while references remain, the others have their references set to nil
+// after the deletion, with RewriteReferences. Failures to clear references
+// don't fail the deletion, they are reported with SetCleanupErrorHandler.
+//
+// References are checked by queries run in the deletion transaction when both
+// handlers wrap the same *datastore.Client, so a concurrent write of a
+// reference makes the deletion retry. With other clients, the queries run
+// outside of the transaction.
+func (d *Handler) SetReferrers(refs ...Referrer) *Handler {
+	d.referrers = refs
+	return d
+}
+
+// checkReferrers returns an ErrReferenced if a RestrictDelete referrer still
+// references id, querying in tx when possible.
+func (d *Handler) checkReferrers(ctx context.Context, tx Transaction, id string) error {
+	for _, r := range d.referrers {
+		if r.Action != RestrictDelete {
+			continue
+		}
+		value, err := r.Handler.encodeFilterValue(r.Field, id, false)
+		if err != nil {
+			return err
+		}
+		qry := datastore.NewQuery(r.Handler.entity).
+			Namespace(r.Handler.getNamespace(ctx)).
+			Filter(r.Field+" =", value).
+			Limit(1).
+			KeysOnly()
+		if t, ok := tx.(*datastore.Transaction); ok && sameClient(r.Handler.client, d.client) {
+			qry = qry.Transaction(t)
+		}
+		keys, err := r.Handler.client.GetAll(ctx, qry, nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			return &ErrReferenced{ID: id, Kind: r.Handler.entity, Field: r.Field}
+		}
+	}
+	return nil
+}
+
+// nullifyReferrers sets the references to the deleted id held by the
+// NullifyReferences referrers to nil, reporting the failures.
+func (d *Handler) nullifyReferrers(ctx context.Context, id string) {
+	for _, r := range d.referrers {
+		if r.Action != NullifyReferences {
+			continue
+		}
+		if _, err := r.Handler.RewriteReferences(ctx, r.Field, id, nil); err != nil {
+			d.cleanupFailed(ctx, fmt.Errorf("%s deleted but its references from %s.%s were not cleared: %v", id, r.Handler.entity, r.Field, err))
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package datastore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// Keyset is the boundary of a keyset ("seek") paginated Find: the page starts
+// right after the item with the given sort value and id, following the query
+// sort. Unlike offsets, starting a page costs the same whatever its position.
+type Keyset struct {
+	// Value is the value of the sort field of the last item of the previous
+	// page. It is ignored when the query has no sort.
+	Value interface{}
+	// ID is the id of the last item of the previous page.
+	ID string
+}
+
+// ErrInvalidKeyset is returned when a keyset token can't be parsed.
+var ErrInvalidKeyset = errors.New("invalid keyset token")
+
+// keysetToken is the JSON form of a keyset. Times and integers have their own
+// fields, as JSON would decode them as strings and floats, which Datastore
+// orders apart from times and integers.
+type keysetToken struct {
+	Value interface{} `json:"v,omitempty"`
+	Time  *time.Time  `json:"t,omitempty"`
+	Int   *int64      `json:"i,omitempty"`
+	ID    string      `json:"id"`
+}
+
+// Token encodes the keyset as an opaque string suitable for a query parameter.
+func (k Keyset) Token() string {
+	t := keysetToken{Value: k.Value, ID: k.ID}
+	switch v := k.Value.(type) {
+	case time.Time:
+		t.Value, t.Time = nil, &v
+	case int:
+		n := int64(v)
+		t.Value, t.Int = nil, &n
+	case int32:
+		n := int64(v)
+		t.Value, t.Int = nil, &n
+	case int64:
+		t.Value, t.Int = nil, &v
+	}
+	b, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseKeyset decodes a token returned by Keyset.Token.
+func ParseKeyset(token string) (Keyset, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Keyset{}, ErrInvalidKeyset
+	}
+	var t keysetToken
+	if err = json.Unmarshal(b, &t); err != nil || t.ID == "" {
+		return Keyset{}, ErrInvalidKeyset
+	}
+	k := Keyset{Value: t.Value, ID: t.ID}
+	if t.Time != nil {
+		k.Value = *t.Time
+	}
+	if t.Int != nil {
+		k.Value = *t.Int
+	}
+	return k, nil
+}
+
+// NextKeyset returns the keyset starting the page following list, sorted on
+// field (empty when sorted by id only), or false if list is empty.
+func NextKeyset(list *resource.ItemList, field string) (Keyset, bool) {
+	if len(list.Items) == 0 {
+		return Keyset{}, false
+	}
+	last := list.Items[len(list.Items)-1]
+	k := Keyset{ID: last.ID.(string)}
+	if field != "" {
+		k.Value = last.GetField(field)
+	}
+	return k, true
+}
+
+// WithKeyset returns a context making Find return the page starting after k.
+// The query can be sorted on at most one field, besides the id used as tie
+// breaker, and its window offset is ignored.
+func WithKeyset(ctx context.Context, k Keyset) context.Context {
+	return context.WithValue(ctx, keysetCtxKey, k)
+}
+
+// findKeyset runs a keyset paginated query. As Datastore has no OR filter, a
+// page sorted on a field is made of the remaining items sharing the boundary
+// sort value, followed by the items with the next sort values.
+func (d *Handler) findKeyset(ctx context.Context, q *query.Query, k Keyset) ([]*resource.Item, error) {
+	if len(q.Sort) > 1 {
+		return nil, resource.ErrNotImplemented
+	}
+	limit := -1
+	if q.Window != nil {
+		limit = q.Window.Limit
+	}
+	ns := d.getNamespace(ctx)
+	key := datastore.NameKey(d.entity, k.ID, nil)
+	key.Namespace = ns
+	op, keyOrder := ">", "__key__"
+	if len(q.Sort) == 1 && q.Sort[0].Reversed {
+		op, keyOrder = "<", "-__key__"
+	}
+
+	run := func(qry *datastore.Query, limit int) ([]*resource.Item, error) {
+		qry = qry.Order(keyOrder)
+		if limit > -1 {
+			qry = qry.Limit(limit)
+		}
+		qry, err := applySample(ctx, qry)
+		if err != nil {
+			return nil, err
+		}
+		return d.runQuery(ctx, qry)
+	}
+
+	if len(q.Sort) == 0 || q.Sort[0].Name == "id" {
+		qry, err := d.getQuery(ctx, &query.Query{Predicate: q.Predicate})
+		if err != nil {
+			return nil, err
+		}
+		return run(qry.Filter("__key__ "+op, key), limit)
+	}
+
+	field := getField(q.Sort[0].Name)
+	base, err := d.getQuery(ctx, &query.Query{Predicate: q.Predicate, Sort: q.Sort})
+	if err != nil {
+		return nil, err
+	}
+	// The boundary is a payload value, stored in its encoded form
+	value, err := d.encodeFilterValue(q.Sort[0].Name, k.Value, false)
+	if err != nil {
+		return nil, err
+	}
+	items, err := run(base.Filter(field+" =", value).Filter("__key__ "+op, key), limit)
+	if err != nil {
+		return nil, err
+	}
+	if limit > -1 {
+		if limit -= len(items); limit == 0 {
+			return items, nil
+		}
+	}
+	next, err := run(base.Filter(field+" "+op, value), limit)
+	if err != nil {
+		return nil, err
+	}
+	return append(items, next...), nil
+}
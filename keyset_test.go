@@ -0,0 +1,36 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeysetToken(t *testing.T) {
+	now := time.Date(2017, time.March, 15, 13, 45, 30, 123, time.UTC)
+	for _, k := range []Keyset{
+		{ID: "a"},
+		{Value: "John", ID: "b"},
+		{Value: 42.5, ID: "c"},
+		{Value: int64(42), ID: "d"},
+		{Value: now, ID: "e"},
+	} {
+		got, err := ParseKeyset(k.Token())
+		if err != nil {
+			t.Fatalf("%v: %v", k, err)
+		}
+		if tv, ok := k.Value.(time.Time); ok {
+			if gv, ok := got.Value.(time.Time); !ok || !gv.Equal(tv) || got.ID != k.ID {
+				t.Errorf("got %v, want %v", got, k)
+			}
+		} else if got != k {
+			t.Errorf("got %v, want %v", got, k)
+		}
+	}
+	// Integers keep their type, as Datastore orders floats after integers
+	if got, err := ParseKeyset(Keyset{Value: 42, ID: "f"}.Token()); err != nil || got.Value != int64(42) {
+		t.Errorf("expected an int64 value, got %#v, %v", got.Value, err)
+	}
+	if _, err := ParseKeyset("not a token"); err != ErrInvalidKeyset {
+		t.Errorf("expected ErrInvalidKeyset, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package datastore
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// kindVarRegexp matches the {{name}} placeholders of kind templates.
+var kindVarRegexp = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// ExpandKind replaces the {{name}} placeholders of a kind template, such as
+// "{{env}}_users", with the values of vars. It fails if a placeholder has no
+// value.
+func ExpandKind(template string, vars map[string]string) (string, error) {
+	var err error
+	kind := kindVarRegexp.ReplaceAllStringFunc(template, func(m string) string {
+		name := kindVarRegexp.FindStringSubmatch(m)[1]
+		v, ok := vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("kind %q: no value for {{%s}}", template, name)
+		}
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+	return kind, nil
+}
+
+// SetKindVars resolves the placeholders of the kind given to NewHandler, such
+// as "{{env}}_users", and of the companion kinds derived from it, with vars,
+// so one binary can target several datasets of a project. Placeholders
+// without a value are left as is and reported by Init.
+func (d *Handler) SetKindVars(vars map[string]string) *Handler {
+	for _, kind := range []*string{&d.entity, &d.changesKind, &d.historyKind, &d.outboxKind, &d.tombstoneKind} {
+		*kind = kindVarRegexp.ReplaceAllStringFunc(*kind, func(m string) string {
+			if v, ok := vars[kindVarRegexp.FindStringSubmatch(m)[1]]; ok {
+				return v
+			}
+			return m
+		})
+	}
+	return d
+}
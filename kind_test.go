@@ -0,0 +1,38 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+)
+
+func TestExpandKind(t *testing.T) {
+	kind, err := ExpandKind("{{env}}_{{ tenant }}_orders", map[string]string{"env": "prod", "tenant": "acme"})
+	if err != nil || kind != "prod_acme_orders" {
+		t.Errorf("unexpected kind %q, %v", kind, err)
+	}
+	if _, err := ExpandKind("{{env}}_orders", nil); err == nil {
+		t.Error("expected an error for a placeholder without value")
+	}
+}
+
+func TestSetKindVars(t *testing.T) {
+	h := NewHandler(nil, "", "{{env}}_users").SetHistory("").SetKindVars(map[string]string{"env": "staging"})
+	if h.entity != "staging_users" || h.historyKind != "staging_users_history" {
+		t.Errorf("unexpected kinds %q and %q", h.entity, h.historyKind)
+	}
+	err := NewHandler(nil, "", "{{env}}_users").Init(context.Background())
+	if err == nil {
+		t.Error("expected Init to report the unresolved template")
+	}
+}
+
+func TestTenantKindTemplate(t *testing.T) {
+	f := NewTenantHandlerFactory(nil, "{{env}}_{{tenant}}_orders").SetNamespace("").SetKindVars(map[string]string{"env": "prod"})
+	h, err := f.Handler("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.namespace != "" || h.entity != "prod_acme_orders" {
+		t.Errorf("unexpected namespace %q and kind %q", h.namespace, h.entity)
+	}
+}
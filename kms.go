@@ -0,0 +1,42 @@
+package datastore
+
+import (
+	"context"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+)
+
+// KMSKeyProvider is a KeyProvider wrapping data encryption keys with a Cloud
+// KMS symmetric key.
+type KMSKeyProvider struct {
+	// Client is the Cloud KMS client.
+	Client *kms.KeyManagementClient
+	// KeyName is the resource name of the CryptoKey, i.e.
+	// projects/*/locations/*/keyRings/*/cryptoKeys/*.
+	KeyName string
+}
+
+// WrapKey implements the KeyProvider interface
+func (p *KMSKeyProvider) WrapKey(ctx context.Context, key []byte) ([]byte, error) {
+	resp, err := p.Client.Encrypt(ctx, &kmspb.EncryptRequest{
+		Name:      p.KeyName,
+		Plaintext: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Ciphertext, nil
+}
+
+// UnwrapKey implements the KeyProvider interface
+func (p *KMSKeyProvider) UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	resp, err := p.Client.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:       p.KeyName,
+		Ciphertext: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"context"
+	"strings"
+
+	"github.com/rs/rest-layer/schema/query"
+	"github.com/rs/zerolog"
+)
+
+// Logger receives the debug logs of the Datastore requests made by handlers.
+type Logger interface {
+	Debug(ctx context.Context, msg string, fields map[string]interface{})
+}
+
+// SetLogger logs at debug level the queries run by Find with their plan and
+// normalized filter, sort and window, the size of the mutation commits, and
+// the duration, outcome and touched item IDs of the storage operations, so
+// the Datastore requests produced by a REST call can be followed. A nil
+// logger disables logging.
+func (d *Handler) SetLogger(l Logger) *Handler {
+	d.logger = l
+	return d
+}
+
+// planned records the plan chosen to serve q in the query profile and the
+// debug log.
+func (d *Handler) planned(ctx context.Context, plan string, q *query.Query) {
+	profileOf(ctx).setPlan(plan)
+	if d.logger == nil {
+		return
+	}
+	fields := map[string]interface{}{
+		"kind":      d.entity,
+		"namespace": d.getNamespace(ctx),
+		"plan":      plan,
+		"filter":    q.Predicate.String(),
+	}
+	if len(q.Sort) > 0 {
+		fields["sort"] = sortString(q.Sort)
+	}
+	if q.Window != nil {
+		fields["offset"], fields["limit"] = q.Window.Offset, q.Window.Limit
+	}
+	d.logger.Debug(ctx, "datastore query", fields)
+}
+
+// sortString returns s in the syntax of the sort query parameter.
+func sortString(s query.Sort) string {
+	fields := make([]string, len(s))
+	for i, f := range s {
+		fields[i] = f.Name
+		if f.Reversed {
+			fields[i] = "-" + f.Name
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// zerologLogger adapts a zerolog logger to Logger.
+type zerologLogger struct {
+	l *zerolog.Logger
+}
+
+// ZerologLogger returns a Logger writing to l, or to the logger of the context
+// of each request, as returned by zerolog.Ctx, when l is nil.
+func ZerologLogger(l *zerolog.Logger) Logger {
+	return zerologLogger{l: l}
+}
+
+// Debug implements Logger.
+func (z zerologLogger) Debug(ctx context.Context, msg string, fields map[string]interface{}) {
+	l := z.l
+	if l == nil {
+		l = zerolog.Ctx(ctx)
+	}
+	l.Debug().Fields(fields).Msg(msg)
+}
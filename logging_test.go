@@ -0,0 +1,31 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/rest-layer/schema/query"
+)
+
+type recordingLogger []map[string]interface{}
+
+func (r *recordingLogger) Debug(ctx context.Context, msg string, fields map[string]interface{}) {
+	*r = append(*r, fields)
+}
+
+func TestLogQuery(t *testing.T) {
+	var logs recordingLogger
+	h := NewHandler(nil, "", "users").SetLogger(&logs)
+	q, err := query.New("", `{"age": {"$gt": 18}}`, "-age", query.Page(2, 10, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.planned(context.Background(), "query", q)
+	if len(logs) != 1 {
+		t.Fatalf("expected one log, got %v", logs)
+	}
+	f := logs[0]
+	if f["kind"] != "users" || f["plan"] != "query" || f["sort"] != "-age" || f["offset"] != 10 || f["limit"] != 10 {
+		t.Errorf("unexpected fields %v", f)
+	}
+}
@@ -1,11 +1,12 @@
 package datastore
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"time"
 
 	"cloud.google.com/go/datastore"
-	"github.com/rs/rest-layer/resource"
 	"github.com/rs/rest-layer/schema/query"
 )
 
@@ -28,8 +29,8 @@ func getField(f string) string {
 }
 
 // getQuery transform a resource.Lookup into a Google Datastore query
-func getQuery(e string, ns string, q *query.Query) (*datastore.Query, error) {
-	query, err := translateQuery(datastore.NewQuery(e), q.Predicate)
+func (d *Handler) getQuery(ctx context.Context, q *query.Query) (*datastore.Query, error) {
+	query, err := d.translateQuery(datastore.NewQuery(d.entity), q.Predicate, d.now())
 	if err != nil {
 		return nil, err
 	}
@@ -37,6 +38,9 @@ func getQuery(e string, ns string, q *query.Query) (*datastore.Query, error) {
 	if len(q.Sort) > 0 {
 		s := make([]string, len(q.Sort))
 		for i, sort := range q.Sort {
+			if !d.queryable(sort.Name) || d.hashedFields[sort.Name] {
+				return nil, &ErrUnsupportedPredicate{Expression: "sort " + sort.Name}
+			}
 			if sort.Reversed {
 				s[i] = "-" + getField(sort.Name)
 			} else {
@@ -46,11 +50,64 @@ func getQuery(e string, ns string, q *query.Query) (*datastore.Query, error) {
 		query = getSort(query, s)
 	}
 	// Set namespace for this query
-	query = query.Namespace(ns)
+	query = query.Namespace(d.getNamespace(ctx))
+	if modify, ok := ctx.Value(modifierCtxKey).(QueryModifier); ok {
+		query = modify(query)
+	}
 	return query, err
 }
 
-func translateQuery(dsQuery *datastore.Query, q query.Predicate) (*datastore.Query, error) {
+// ValidateQuery returns the error Find would return for the filter and sort
+// of q without running it, such as a 501 for a predicate which can't be
+// translated into a Datastore query. Fakes use it to reject the queries the
+// handler rejects.
+func (d *Handler) ValidateQuery(ctx context.Context, q *query.Query) error {
+	p, _, err := d.normalizePredicate(q.Predicate)
+	if err == nil {
+		if in, rest := splitLargeIn(p); in != nil {
+			// Large lists are split by the execution planner
+			p = append(rest, &query.In{Field: in.Field, Values: in.Values[:MaxInValues]})
+		}
+		nq := *q
+		nq.Predicate = p
+		_, err = d.getQuery(ctx, &nq)
+	}
+	return d.translateError(err, q)
+}
+
+// addFilter adds a single filter to the query, resolving relative values
+// like DateMath against now.
+func (d *Handler) addFilter(dsQuery *datastore.Query, field, op string, value interface{}, now time.Time) (*datastore.Query, error) {
+	if !d.queryable(field) {
+		return nil, &ErrUnsupportedPredicate{Expression: field + " " + op}
+	}
+	if e, ok := value.(DateMath); ok {
+		t, err := e.Resolve(now)
+		if err != nil {
+			return nil, err
+		}
+		value = t
+	} else {
+		var err error
+		if value, err = d.encodeFilterValue(field, value, op == "in"); err != nil {
+			return nil, err
+		}
+	}
+	name := getField(field)
+	if d.hashedFields[field] {
+		var err error
+		if name, value, err = hashedFilter(field, op, value); err != nil {
+			return nil, err
+		}
+	} else if d.foldedFields[field] {
+		if n, v, ok := foldedFilter(field, op, value); ok {
+			name, value = n, v
+		}
+	}
+	return dsQuery.Filter(fmt.Sprintf("%s %s", name, op), value), nil
+}
+
+func (d *Handler) translateQuery(dsQuery *datastore.Query, q query.Predicate, now time.Time) (*datastore.Query, error) {
 	var err error
 	// process each schema.Expression into a datastore filter
 	for _, exp := range q {
@@ -59,32 +116,52 @@ func translateQuery(dsQuery *datastore.Query, q query.Predicate) (*datastore.Que
 			// If our Query contains a slice, add each as an additional filter
 			if reflect.TypeOf(t.Value).Kind() == reflect.Slice {
 				for _, v := range t.Value.([]interface{}) {
-					dsQuery = dsQuery.Filter(fmt.Sprintf("%s =", getField(t.Field)), v)
+					if dsQuery, err = d.addFilter(dsQuery, t.Field, "=", v, now); err != nil {
+						return nil, err
+					}
 				}
 			} else {
-				dsQuery = dsQuery.Filter(fmt.Sprintf("%s =", getField(t.Field)), t.Value)
+				dsQuery, err = d.addFilter(dsQuery, t.Field, "=", t.Value, now)
 			}
 		case *query.NotEqual:
-			dsQuery = dsQuery.Filter(fmt.Sprintf("%s !=", getField(t.Field)), t.Value)
+			dsQuery, err = d.addFilter(dsQuery, t.Field, "!=", t.Value, now)
 		case *query.GreaterThan:
-			dsQuery = dsQuery.Filter(fmt.Sprintf("%s >", getField(t.Field)), t.Value)
+			dsQuery, err = d.addFilter(dsQuery, t.Field, ">", t.Value, now)
 		case *query.GreaterOrEqual:
-			dsQuery = dsQuery.Filter(fmt.Sprintf("%s >=", getField(t.Field)), t.Value)
+			dsQuery, err = d.addFilter(dsQuery, t.Field, ">=", t.Value, now)
 		case *query.LowerThan:
-			dsQuery = dsQuery.Filter(fmt.Sprintf("%s <", getField(t.Field)), t.Value)
+			dsQuery, err = d.addFilter(dsQuery, t.Field, "<", t.Value, now)
 		case *query.LowerOrEqual:
-			dsQuery = dsQuery.Filter(fmt.Sprintf("%s <=", getField(t.Field)), t.Value)
+			dsQuery, err = d.addFilter(dsQuery, t.Field, "<=", t.Value, now)
+		case *query.In:
+			// Larger lists are split by the execution planner in Find
+			if len(t.Values) > MaxInValues {
+				return nil, &ErrUnsupportedPredicate{Expression: t.String()}
+			}
+			dsQuery, err = d.addFilter(dsQuery, t.Field, "in", t.Values, now)
+		case *query.Regex:
+			dsQuery, err = d.foldedRegex(dsQuery, t)
+		case *Near, *WithinBox:
+			// Longitudes and distances are refined in memory by findGeo
+			field, south, north, _ := geoLatitudes(t)
+			if dsQuery, err = d.addFilter(dsQuery, field, ">=", datastore.GeoPoint{Lat: south, Lng: -180}, now); err != nil {
+				return nil, err
+			}
+			dsQuery, err = d.addFilter(dsQuery, field, "<=", datastore.GeoPoint{Lat: north, Lng: 180}, now)
 		case *query.And:
 			for _, subExp := range *t {
-				dsQuery, err = translateQuery(dsQuery, query.Predicate{subExp})
+				dsQuery, err = d.translateQuery(dsQuery, query.Predicate{subExp}, now)
 				if err != nil {
 					return nil, err
 				}
 			}
 		default:
-			// return resource.ErrNotImplemented for:
-			// schema.Or, schema.In, schema,NotIn
-			return nil, resource.ErrNotImplemented
+			// return an ErrUnsupportedPredicate for:
+			// schema.Or, schema,NotIn
+			return nil, &ErrUnsupportedPredicate{Expression: exp.String()}
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
 	return dsQuery, nil
@@ -0,0 +1,178 @@
+package datastore
+
+import (
+	"context"
+
+	admin "cloud.google.com/go/datastore/admin/apiv1"
+	"cloud.google.com/go/datastore/admin/apiv1/adminpb"
+)
+
+// Kinds returns the kind of the items and the kinds of the companion
+// entities written along with them: change log, history, outbox, tombstones,
+// views, emulated indexes and unique field sentinels, so backups and restores
+// keep them consistent.
+func (d *Handler) Kinds() []string {
+	kinds := []string{d.entity}
+	for _, k := range []string{d.changesKind, d.historyKind, d.outboxKind, d.tombstoneKind} {
+		if k != "" {
+			kinds = append(kinds, k)
+		}
+	}
+	for _, v := range d.views {
+		kinds = append(kinds, v.Kind)
+	}
+	for _, idx := range d.emulatedIndexes {
+		kinds = append(kinds, d.indexKind(idx))
+	}
+	for _, f := range d.uniqueFields {
+		kinds = append(kinds, d.entity+"_unique_"+f)
+	}
+	return kinds
+}
+
+// ManagedExport runs managed exports of the entities of handlers to Cloud
+// Storage, and imports of these exports, with the Datastore Admin API.
+type ManagedExport struct {
+	client  *admin.DatastoreAdminClient
+	project string
+}
+
+// NewManagedExport returns a ManagedExport of the entities of project using
+// client.
+func NewManagedExport(client *admin.DatastoreAdminClient, project string) *ManagedExport {
+	return &ManagedExport{client: client, project: project}
+}
+
+// entityFilter returns the filter of the kinds of handlers in the namespaces
+// of ctx. Filters select the entities of any of their kinds in any of their
+// namespaces.
+func entityFilter(ctx context.Context, handlers []*Handler) *adminpb.EntityFilter {
+	f := &adminpb.EntityFilter{}
+	kinds := map[string]bool{}
+	namespaces := map[string]bool{}
+	for _, d := range handlers {
+		for _, k := range d.Kinds() {
+			if !kinds[k] {
+				kinds[k] = true
+				f.Kinds = append(f.Kinds, k)
+			}
+		}
+		if ns := d.getNamespace(ctx); !namespaces[ns] {
+			namespaces[ns] = true
+			f.NamespaceIds = append(f.NamespaceIds, ns)
+		}
+	}
+	return f
+}
+
+// Export starts exporting the entities of the kinds of handlers, in their
+// namespace for ctx, under the gs://bucket/path outputURLPrefix.
+func (m *ManagedExport) Export(ctx context.Context, outputURLPrefix string, handlers ...*Handler) (*ExportOperation, error) {
+	op, err := m.client.ExportEntities(ctx, &adminpb.ExportEntitiesRequest{
+		ProjectId:       m.project,
+		EntityFilter:    entityFilter(ctx, handlers),
+		OutputUrlPrefix: outputURLPrefix,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ExportOperation{op: op}, nil
+}
+
+// Import starts importing the entities of the kinds of handlers, in their
+// namespace for ctx, from the export of inputURL, the overall_export_metadata
+// file returned by ExportOperation.Wait. Imported entities replace the
+// existing ones with the same keys.
+func (m *ManagedExport) Import(ctx context.Context, inputURL string, handlers ...*Handler) (*ImportOperation, error) {
+	op, err := m.client.ImportEntities(ctx, &adminpb.ImportEntitiesRequest{
+		ProjectId:    m.project,
+		EntityFilter: entityFilter(ctx, handlers),
+		InputUrl:     inputURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ImportOperation{op: op}, nil
+}
+
+// ExportOperation returns the export operation with name, to follow an export
+// started by another process.
+func (m *ManagedExport) ExportOperation(name string) *ExportOperation {
+	return &ExportOperation{op: m.client.ExportEntitiesOperation(name)}
+}
+
+// ImportOperation returns the import operation with name, to follow an import
+// started by another process.
+func (m *ManagedExport) ImportOperation(name string) *ImportOperation {
+	return &ImportOperation{op: m.client.ImportEntitiesOperation(name)}
+}
+
+// OperationProgress is the progress of a managed export or import.
+type OperationProgress struct {
+	// State is the state of the operation, such as PROCESSING or SUCCESSFUL.
+	State string
+	// Entities and Bytes processed, and their estimated totals.
+	Entities, EntitiesEstimated int64
+	Bytes, BytesEstimated       int64
+}
+
+func operationProgress(common *adminpb.CommonMetadata, entities, bytes *adminpb.Progress) OperationProgress {
+	return OperationProgress{
+		State:             common.GetState().String(),
+		Entities:          entities.GetWorkCompleted(),
+		EntitiesEstimated: entities.GetWorkEstimated(),
+		Bytes:             bytes.GetWorkCompleted(),
+		BytesEstimated:    bytes.GetWorkEstimated(),
+	}
+}
+
+// ExportOperation is a running managed export.
+type ExportOperation struct {
+	op *admin.ExportEntitiesOperation
+}
+
+// Name returns the name of the operation.
+func (o *ExportOperation) Name() string {
+	return o.op.Name()
+}
+
+// Poll fetches the state of the operation and returns its progress and
+// whether it is done. It returns the error of a failed export.
+func (o *ExportOperation) Poll(ctx context.Context) (OperationProgress, bool, error) {
+	_, err := o.op.Poll(ctx)
+	md, _ := o.op.Metadata()
+	return operationProgress(md.GetCommon(), md.GetProgressEntities(), md.GetProgressBytes()), o.op.Done(), err
+}
+
+// Wait polls the operation until it is done and returns the URL of the
+// overall_export_metadata file of the export, to import it.
+func (o *ExportOperation) Wait(ctx context.Context) (string, error) {
+	res, err := o.op.Wait(ctx)
+	if err != nil {
+		return "", err
+	}
+	return res.GetOutputUrl(), nil
+}
+
+// ImportOperation is a running managed import.
+type ImportOperation struct {
+	op *admin.ImportEntitiesOperation
+}
+
+// Name returns the name of the operation.
+func (o *ImportOperation) Name() string {
+	return o.op.Name()
+}
+
+// Poll fetches the state of the operation and returns its progress and
+// whether it is done. It returns the error of a failed import.
+func (o *ImportOperation) Poll(ctx context.Context) (OperationProgress, bool, error) {
+	err := o.op.Poll(ctx)
+	md, _ := o.op.Metadata()
+	return operationProgress(md.GetCommon(), md.GetProgressEntities(), md.GetProgressBytes()), o.op.Done(), err
+}
+
+// Wait polls the operation until it is done.
+func (o *ImportOperation) Wait(ctx context.Context) error {
+	return o.op.Wait(ctx)
+}
@@ -0,0 +1,56 @@
+package datastore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore/admin/apiv1/adminpb"
+)
+
+func TestKinds(t *testing.T) {
+	h := NewHandler(nil, "", "users")
+	if kinds := h.Kinds(); !reflect.DeepEqual(kinds, []string{"users"}) {
+		t.Errorf("expected only the item kind, got %v", kinds)
+	}
+	h.SetChanges("users_changes").
+		SetHistory("users_history").
+		SetOutbox("users_outbox").
+		SetTombstones("users_tombstones", time.Hour).
+		SetViews(View{Kind: "users_slim", Fields: []string{"name"}}).
+		SetEmulatedIndexes(EmulatedIndex{Name: "age", Fields: []string{"age"}}).
+		SetUniqueFields([]string{"email"})
+	want := []string{"users", "users_changes", "users_history", "users_outbox", "users_tombstones", "users_slim", "users_index_age", "users_unique_email"}
+	if kinds := h.Kinds(); !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got kinds %v, want %v", kinds, want)
+	}
+}
+
+func TestEntityFilter(t *testing.T) {
+	users := NewHandler(nil, "app", "users").SetHistory("users_history")
+	posts := NewHandler(nil, "app", "posts").SetHistory("users_history")
+	f := entityFilter(context.Background(), []*Handler{users, posts})
+	if !reflect.DeepEqual(f.Kinds, []string{"users", "users_history", "posts"}) {
+		t.Errorf("expected the kinds of both handlers once, got %v", f.Kinds)
+	}
+	if !reflect.DeepEqual(f.NamespaceIds, []string{"app"}) {
+		t.Errorf("expected the handler namespace, got %v", f.NamespaceIds)
+	}
+	ctx := context.WithValue(context.Background(), "namespace", "tenant")
+	if f = entityFilter(ctx, []*Handler{users}); !reflect.DeepEqual(f.NamespaceIds, []string{"tenant"}) {
+		t.Errorf("expected the namespace of the context, got %v", f.NamespaceIds)
+	}
+}
+
+func TestOperationProgress(t *testing.T) {
+	p := operationProgress(
+		&adminpb.CommonMetadata{State: adminpb.CommonMetadata_PROCESSING},
+		&adminpb.Progress{WorkCompleted: 10, WorkEstimated: 100},
+		nil,
+	)
+	want := OperationProgress{State: "PROCESSING", Entities: 10, EntitiesEstimated: 100}
+	if p != want {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+}
@@ -0,0 +1,70 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/rest"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics receives measurements of the storage operations of handlers. The
+// kind and namespace are given so one implementation can be shared by several
+// handlers and label its series with them.
+type Metrics interface {
+	// ObserveOperation records an Insert, Update, Delete, Clear or Find
+	// operation, the code of its error, OK on success, its latency and the
+	// number of written, deleted or returned items.
+	ObserveOperation(kind, namespace, op, code string, latency time.Duration, items int)
+	// ObserveBatch records the number of mutations of a commit.
+	ObserveBatch(kind, namespace string, mutations int)
+}
+
+// SetMetrics reports the latency, outcome and size of the storage operations
+// and the size of the mutation commits to m, such as a *PrometheusMetrics. A
+// nil m disables metrics.
+func (d *Handler) SetMetrics(m Metrics) *Handler {
+	d.metrics = m
+	return d
+}
+
+// observeCommit reports and logs a commit of n mutations.
+func (d *Handler) observeCommit(ctx context.Context, n int) {
+	if d.metrics != nil {
+		d.metrics.ObserveBatch(d.entity, d.getNamespace(ctx), n)
+	}
+	if d.logger != nil {
+		d.logger.Debug(ctx, "datastore commit", map[string]interface{}{
+			"kind":      d.entity,
+			"namespace": d.getNamespace(ctx),
+			"mutations": n,
+		})
+	}
+}
+
+// errorCode classifies err for metrics: OK for nil errors, the name of the
+// HTTP status of REST layer errors and the gRPC code of the others.
+func errorCode(err error) string {
+	var re interface{ RESTError() *rest.Error }
+	switch {
+	case err == nil:
+		return "OK"
+	case err == resource.ErrNotFound:
+		return "NotFound"
+	case err == resource.ErrConflict:
+		return "Conflict"
+	case err == resource.ErrNotImplemented:
+		return "NotImplemented"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "DeadlineExceeded"
+	case errors.Is(err, context.Canceled):
+		return "Canceled"
+	case errors.As(err, &re):
+		return strings.ReplaceAll(http.StatusText(re.RESTError().Code), " ", "")
+	}
+	return status.Code(err).String()
+}
@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code string
+	}{
+		{nil, "OK"},
+		{resource.ErrConflict, "Conflict"},
+		{fmt.Errorf("get: %w", context.DeadlineExceeded), "DeadlineExceeded"},
+		{&TimeoutError{Op: "insert"}, "GatewayTimeout"},
+		{status.Error(codes.Unavailable, "down"), "Unavailable"},
+		{errors.New("other"), "Unknown"},
+	} {
+		if code := errorCode(tc.err); code != tc.code {
+			t.Errorf("errorCode(%v) = %s, expected %s", tc.err, code, tc.code)
+		}
+	}
+}
+
+type sizeMetrics struct {
+	Metrics
+	size    int
+	largest PropertySize
+}
+
+func (m *sizeMetrics) ObserveEntitySize(kind, namespace string, size int, largest PropertySize) {
+	m.size, m.largest = size, largest
+}
+
+func TestCheckWriteSize(t *testing.T) {
+	m := &sizeMetrics{}
+	d := NewHandler(nil, "", "users").SetMetrics(m)
+	e := &Entity{ID: "1", Payload: map[string]interface{}{"bio": string(make([]byte, 2000)), "name": "ada"}}
+	if err := d.checkWriteSize(context.Background(), datastore.NameKey("users", "1", nil), e); err != nil {
+		t.Fatal(err)
+	}
+	if m.largest.Name != "bio" || m.largest.Size != 2005 || m.size <= 2005 {
+		t.Errorf("got size %d and largest %v", m.size, m.largest)
+	}
+}
@@ -0,0 +1,154 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/datastore"
+	rld "github.com/ajcrowe/rest-layer-datastore"
+	"golang.org/x/time/rate"
+)
+
+// Backfill describes a pass over the entities of a kind rewriting those a
+// function changes, to fill new properties or repair bad data.
+type Backfill struct {
+	// Name identifies the backfill; the progress of its partitions is saved
+	// as the migrations Name/0, Name/1...
+	Name string
+	// Namespace and Kind of the entities.
+	Namespace string
+	Kind      string
+	// Repair returns the new properties of the entity with key, or nil to
+	// leave it unchanged. It runs in the transaction writing the batch and
+	// can be called again for the same entity when the transaction retries.
+	Repair func(ctx context.Context, key *datastore.Key, props datastore.PropertyList) (datastore.PropertyList, error)
+	// Partitions is the number of key ranges processed concurrently, split
+	// with the __scatter__ property on the first run.
+	Partitions int
+	// BatchSize is the number of entities read and written per transaction.
+	BatchSize int
+	// Limiter, if not nil, caps the number of entities processed per second,
+	// across partitions.
+	Limiter *rate.Limiter
+}
+
+// Backfill runs b in partitions run concurrently and resumed from their
+// saved progress, and returns the progress of each partition. Batches are
+// read and written in transactions, so concurrent writes of the entities
+// are not lost. It returns the first error of the partitions; the others
+// keep running until they complete.
+func (t *Tracker) Backfill(ctx context.Context, b *Backfill) ([]*Progress, error) {
+	return t.runPartitions(ctx, b.Name, b.Namespace, b.Kind, b.Partitions, b.BatchSize, func(ctx context.Context, keys []*datastore.Key) (int, error) {
+		return t.backfillBatch(ctx, b, keys)
+	})
+}
+
+// backfillBatch repairs the entities with keys and returns the number of
+// written entities.
+func (t *Tracker) backfillBatch(ctx context.Context, b *Backfill, keys []*datastore.Key) (int, error) {
+	if err := wait(ctx, b.Limiter, len(keys)); err != nil {
+		return 0, err
+	}
+	var written int
+	_, err := t.client.RunInTransaction(ctx, func(tx rld.Transaction) error {
+		written = 0
+		props := make([]datastore.PropertyList, len(keys))
+		err := tx.GetMulti(keys, props)
+		merr, _ := err.(datastore.MultiError)
+		if err != nil && merr == nil {
+			return err
+		}
+		var changed []*datastore.Key
+		var lists []datastore.PropertyList
+		for i, key := range keys {
+			if merr != nil && merr[i] != nil {
+				if merr[i] == datastore.ErrNoSuchEntity {
+					// Deleted since the keys were read
+					continue
+				}
+				return merr[i]
+			}
+			list, err := b.Repair(ctx, key, props[i])
+			if err != nil {
+				return err
+			}
+			if list != nil {
+				changed = append(changed, key)
+				lists = append(lists, list)
+			}
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		written = len(changed)
+		_, err = tx.PutMulti(changed, lists)
+		return err
+	})
+	return written, err
+}
+
+// runPartitions runs the migrations name/0, name/1... processing the
+// partitions of the entities of kind with process, concurrently, and returns
+// their progress and first error.
+func (t *Tracker) runPartitions(ctx context.Context, name, namespace, kind string, partitions, batchSize int, process func(ctx context.Context, keys []*datastore.Key) (int, error)) ([]*Progress, error) {
+	ranges, err := t.partitions(ctx, name, namespace, kind, partitions)
+	if err != nil {
+		return nil, err
+	}
+	progress := make([]*Progress, len(ranges))
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r [2]*datastore.Key) {
+			defer wg.Done()
+			progress[i], errs[i] = t.Run(ctx, &Migration{
+				Name:      fmt.Sprintf("%s/%d", name, i),
+				Namespace: namespace,
+				Kind:      kind,
+				BatchSize: batchSize,
+				Start:     r[0],
+				End:       r[1],
+				Process:   process,
+			})
+		}(i, r)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return progress, err
+		}
+	}
+	return progress, nil
+}
+
+// partitions returns the key ranges of the n partitions of the entities of
+// kind processed by the migrations name/0, name/1..., those saved by a
+// previous run if any.
+func (t *Tracker) partitions(ctx context.Context, name, namespace, kind string, n int) ([][2]*datastore.Key, error) {
+	var ranges [][2]*datastore.Key
+	for i := 0; ; i++ {
+		p, err := t.Status(ctx, fmt.Sprintf("%s/%d", name, i))
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			break
+		}
+		ranges = append(ranges, [2]*datastore.Key{p.Start, p.End})
+	}
+	if len(ranges) > 0 {
+		return ranges, nil
+	}
+	splits, err := rld.SplitPoints(ctx, t.client, namespace, kind, n)
+	if err != nil {
+		return nil, err
+	}
+	var start *datastore.Key
+	for _, s := range splits {
+		ranges = append(ranges, [2]*datastore.Key{start, s})
+		start = s
+	}
+	return append(ranges, [2]*datastore.Key{start, nil}), nil
+}
@@ -0,0 +1,104 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/time/rate"
+)
+
+// fillOdd adds a "filled" property to the entities with an odd v, leaving
+// the others unchanged.
+func fillOdd(ctx context.Context, key *datastore.Key, props datastore.PropertyList) (datastore.PropertyList, error) {
+	if props[0].Value.(int64)%2 == 0 {
+		return nil, nil
+	}
+	return append(props, datastore.Property{Name: "filled", Value: true}), nil
+}
+
+func TestBackfill(t *testing.T) {
+	tests := []struct {
+		name      string
+		items     int
+		batchSize int
+		limiter   *rate.Limiter
+		written   int64
+	}{
+		{name: "single batch", items: 5, written: 3},
+		{name: "batches", items: 5, batchSize: 2, written: 3},
+		{name: "unchanged batches", items: 6, batchSize: 1, written: 3},
+		{name: "rate limited", items: 5, batchSize: 2, limiter: rate.NewLimiter(rate.Inf, 1), written: 3},
+		{name: "empty kind", items: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newMockClient()
+			keys := putItems(t, c, "users", tt.items)
+			tr := NewTracker(c, "")
+			progress, err := tr.Backfill(context.Background(), &Backfill{
+				Name:      "fill",
+				Kind:      "users",
+				Repair:    fillOdd,
+				BatchSize: tt.batchSize,
+				Limiter:   tt.limiter,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(progress) != 1 || progress[0].State != StateDone || progress[0].Processed != int64(tt.items) || progress[0].Written != tt.written {
+				t.Errorf("unexpected progress %v", progress)
+			}
+			for _, key := range keys {
+				var props datastore.PropertyList
+				if err := c.get(key, &props); err != nil {
+					t.Fatal(err)
+				}
+				if filled := len(props) == 2; filled != (key.ID%2 == 1) {
+					t.Errorf("unexpected backfill of %v: %v", key, props)
+				}
+			}
+		})
+	}
+}
+
+func TestBackfillResume(t *testing.T) {
+	c := newMockClient()
+	putItems(t, c, "users", 6)
+	tr := NewTracker(c, "")
+	var calls int
+	fail := true
+	b := &Backfill{
+		Name:      "fill",
+		Kind:      "users",
+		BatchSize: 2,
+		Repair: func(ctx context.Context, key *datastore.Key, props datastore.PropertyList) (datastore.PropertyList, error) {
+			if fail && key.ID == 4 {
+				return nil, errors.New("bad entity")
+			}
+			calls++
+			return fillOdd(ctx, key, props)
+		},
+	}
+	ctx := context.Background()
+	progress, err := tr.Backfill(ctx, b)
+	if err == nil || progress[0].State != StateFailed || progress[0].Processed != 2 || progress[0].Failed != 2 {
+		t.Fatalf("expected the second batch to fail, got %v, %v", progress, err)
+	}
+	var props datastore.PropertyList
+	if err = c.get(datastore.IDKey("users", 3, nil), &props); err != nil || len(props) != 1 {
+		t.Errorf("expected the failed batch not to be written, got %v, %v", props, err)
+	}
+	fail = false
+	calls = 0
+	if progress, err = tr.Backfill(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 4 {
+		t.Errorf("expected the backfill to resume at the failed batch, got %d repairs", calls)
+	}
+	if p := progress[0]; p.State != StateDone || p.Processed != 6 || p.Written != 3 {
+		t.Errorf("unexpected progress %+v", p)
+	}
+}
@@ -0,0 +1,184 @@
+package migrate
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	rld "github.com/ajcrowe/rest-layer-datastore"
+	"google.golang.org/api/iterator"
+)
+
+// mockClient stores entities in memory. Queries return the entities of their
+// kind and namespace in insertion order, from their start cursor and up to
+// their limit; filters and orders are ignored.
+type mockClient struct {
+	rld.Client
+	keys     []*datastore.Key
+	entities map[string]datastore.PropertyList
+}
+
+// entityID identifies key in the mock, Key.String leaving out namespaces.
+func entityID(key *datastore.Key) string {
+	return key.Namespace + key.String()
+}
+
+func newMockClient() *mockClient {
+	return &mockClient{entities: map[string]datastore.PropertyList{}}
+}
+
+func (c *mockClient) put(key *datastore.Key, src interface{}) error {
+	props, ok := src.(datastore.PropertyList)
+	if !ok {
+		var err error
+		if props, err = datastore.SaveStruct(src); err != nil {
+			return err
+		}
+	}
+	if _, found := c.entities[entityID(key)]; !found {
+		c.keys = append(c.keys, key)
+	}
+	c.entities[entityID(key)] = props
+	return nil
+}
+
+func (c *mockClient) get(key *datastore.Key, dst interface{}) error {
+	props, found := c.entities[entityID(key)]
+	if !found {
+		return datastore.ErrNoSuchEntity
+	}
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return pls.Load(props)
+	}
+	return datastore.LoadStruct(dst, props)
+}
+
+func (c *mockClient) getMulti(keys []*datastore.Key, dst interface{}) error {
+	lists := dst.([]datastore.PropertyList)
+	var merr datastore.MultiError
+	for i, key := range keys {
+		if err := c.get(key, &lists[i]); err != nil {
+			if merr == nil {
+				merr = make(datastore.MultiError, len(keys))
+			}
+			merr[i] = err
+		}
+	}
+	if merr != nil {
+		return merr
+	}
+	return nil
+}
+
+func (c *mockClient) putMulti(keys []*datastore.Key, src interface{}) error {
+	for i, props := range src.([]datastore.PropertyList) {
+		if err := c.put(keys[i], props); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *mockClient) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	return c.get(key, dst)
+}
+
+func (c *mockClient) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	return c.getMulti(keys, dst)
+}
+
+func (c *mockClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return keys, c.putMulti(keys, src)
+}
+
+func (c *mockClient) Delete(ctx context.Context, key *datastore.Key) error {
+	delete(c.entities, entityID(key))
+	return nil
+}
+
+func (c *mockClient) Run(ctx context.Context, q *datastore.Query) rld.Iterator {
+	// datastore.Query doesn't expose its fields
+	v := reflect.ValueOf(q).Elem()
+	it := &mockIterator{c: c, kind: v.FieldByName("kind").String(), namespace: v.FieldByName("namespace").String()}
+	it.limit = int(v.FieldByName("limit").Int())
+	if start := v.FieldByName("start").Bytes(); len(start) > 0 {
+		it.offset, _ = strconv.Atoi(string(start))
+	}
+	it.i = it.offset
+	return it
+}
+
+func (c *mockClient) RunInTransaction(ctx context.Context, f func(tx rld.Transaction) error, opts ...datastore.TransactionOption) (*datastore.Commit, error) {
+	return nil, f(&mockTx{c: c})
+}
+
+// mockIterator iterates over the entities of a kind, its cursor being the
+// position of the next entity.
+type mockIterator struct {
+	c               *mockClient
+	kind, namespace string
+	offset, limit   int
+	i               int
+}
+
+func (it *mockIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if it.limit > 0 && it.i-it.offset >= it.limit {
+		return nil, iterator.Done
+	}
+	var n int
+	for _, key := range it.c.keys {
+		if _, found := it.c.entities[entityID(key)]; !found || key.Kind != it.kind || key.Namespace != it.namespace {
+			continue
+		}
+		if n++; n <= it.i {
+			continue
+		}
+		it.i++
+		if dst == nil {
+			return key, nil
+		}
+		return key, it.c.get(key, dst)
+	}
+	return nil, iterator.Done
+}
+
+func (it *mockIterator) Cursor() (datastore.Cursor, error) {
+	return datastore.DecodeCursor(base64.URLEncoding.EncodeToString([]byte(strconv.Itoa(it.i))))
+}
+
+type mockTx struct {
+	rld.Transaction
+	c *mockClient
+}
+
+func (tx *mockTx) Get(key *datastore.Key, dst interface{}) error {
+	return tx.c.get(key, dst)
+}
+
+func (tx *mockTx) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	return tx.c.getMulti(keys, dst)
+}
+
+func (tx *mockTx) Put(key *datastore.Key, src interface{}) (*datastore.PendingKey, error) {
+	return nil, tx.c.put(key, src)
+}
+
+func (tx *mockTx) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error) {
+	return nil, tx.c.putMulti(keys, src)
+}
+
+// putItems stores n entities of kind with ids 1 to n and a "v" property.
+func putItems(t *testing.T, c *mockClient, kind string, n int) []*datastore.Key {
+	var keys []*datastore.Key
+	for i := 1; i <= n; i++ {
+		key := datastore.IDKey(kind, int64(i), nil)
+		if err := c.put(key, datastore.PropertyList{{Name: "v", Value: int64(i)}}); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
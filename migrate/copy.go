@@ -0,0 +1,174 @@
+package migrate
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	rld "github.com/ajcrowe/rest-layer-datastore"
+	"golang.org/x/time/rate"
+)
+
+// maxMissing bounds the number of missing keys reported by a verification.
+const maxMissing = 100
+
+// Copy describes the copy of the entities of a kind to another kind, to
+// rename a kind or backfill a new layout.
+type Copy struct {
+	// Name identifies the copy; the progress of its partitions is saved as
+	// the migrations Name/0, Name/1...
+	Name string
+	// Namespace and Kind of the copied entities.
+	Namespace string
+	Kind      string
+	// TargetNamespace and TargetKind of the written entities, Namespace and
+	// Kind when empty. Entities keep their id and ancestors.
+	TargetNamespace string
+	TargetKind      string
+	// Transform returns the properties written for the entity with key, the
+	// same properties when nil.
+	Transform func(ctx context.Context, key *datastore.Key, props datastore.PropertyList) (datastore.PropertyList, error)
+	// Partitions is the number of key ranges copied concurrently, split
+	// with the __scatter__ property on the first run.
+	Partitions int
+	// BatchSize is the number of entities copied per batch.
+	BatchSize int
+	// Limiter, if not nil, caps the number of entities copied per second.
+	Limiter *rate.Limiter
+}
+
+// CopyResult is the outcome of a copy.
+type CopyResult struct {
+	// Progress of each partition.
+	Progress []*Progress
+	// Verified counts the entities found in the target kind by the
+	// verification pass, and Missing lists the first keys of the source
+	// entities it didn't find.
+	Verified int64
+	Missing  []*datastore.Key
+}
+
+// Copy copies the entities of the kind of c to its target kind, in
+// partitions run concurrently and resumed from their saved progress, and
+// verifies every source entity exists in the target kind once done. It
+// returns the first error of the partitions; the others keep running until
+// they complete.
+func (t *Tracker) Copy(ctx context.Context, c *Copy) (*CopyResult, error) {
+	progress, err := t.runPartitions(ctx, c.Name, c.Namespace, c.Kind, c.Partitions, c.BatchSize, func(ctx context.Context, keys []*datastore.Key) (int, error) {
+		return t.copyBatch(ctx, c, keys)
+	})
+	res := &CopyResult{Progress: progress}
+	if err != nil {
+		return res, err
+	}
+	return res, t.verify(ctx, c, res)
+}
+
+// copyBatch copies the entities with keys and returns the number of written
+// entities.
+func (t *Tracker) copyBatch(ctx context.Context, c *Copy, keys []*datastore.Key) (int, error) {
+	if err := wait(ctx, c.Limiter, len(keys)); err != nil {
+		return 0, err
+	}
+	props := make([]datastore.PropertyList, len(keys))
+	err := t.client.GetMulti(ctx, keys, props)
+	merr, _ := err.(datastore.MultiError)
+	if err != nil && merr == nil {
+		return 0, err
+	}
+	var targets []*datastore.Key
+	var lists []datastore.PropertyList
+	for i, key := range keys {
+		if merr != nil && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				// Deleted since the keys were read
+				continue
+			}
+			return 0, merr[i]
+		}
+		list := props[i]
+		if c.Transform != nil {
+			if list, err = c.Transform(ctx, key, list); err != nil {
+				return 0, err
+			}
+		}
+		targets = append(targets, c.targetKey(key))
+		lists = append(lists, list)
+	}
+	if _, err = t.client.PutMulti(ctx, targets, lists); err != nil {
+		return 0, err
+	}
+	return len(targets), nil
+}
+
+// wait waits until limiter, if not nil, allows n events, at most its burst.
+func wait(ctx context.Context, limiter *rate.Limiter, n int) error {
+	if limiter == nil {
+		return nil
+	}
+	if b := limiter.Burst(); n > b {
+		n = b
+	}
+	return limiter.WaitN(ctx, n)
+}
+
+// targetKey returns the key of the copy of the entity with key.
+func (c *Copy) targetKey(key *datastore.Key) *datastore.Key {
+	k := *key
+	if c.TargetKind != "" {
+		k.Kind = c.TargetKind
+	}
+	if c.TargetNamespace != "" {
+		// Ancestors must be in the same namespace
+		for a := &k; a != nil; a = a.Parent {
+			a.Namespace = c.TargetNamespace
+			if a.Parent != nil {
+				p := *a.Parent
+				a.Parent = &p
+			}
+		}
+	}
+	return &k
+}
+
+// verify checks the copy of every entity of the kind of c exists.
+func (t *Tracker) verify(ctx context.Context, c *Copy, res *CopyResult) error {
+	qry := datastore.NewQuery(c.Kind).Namespace(c.Namespace).KeysOnly()
+	var keys []*datastore.Key
+	check := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		targets := make([]*datastore.Key, len(keys))
+		for i, key := range keys {
+			targets[i] = c.targetKey(key)
+		}
+		// Keys-only lookups aren't available, the entities are read
+		err := t.client.GetMulti(ctx, targets, make([]datastore.PropertyList, len(targets)))
+		merr, _ := err.(datastore.MultiError)
+		if err != nil && merr == nil {
+			return err
+		}
+		for i, key := range keys {
+			if merr == nil || merr[i] == nil {
+				res.Verified++
+			} else if merr[i] != datastore.ErrNoSuchEntity {
+				return merr[i]
+			} else if len(res.Missing) < maxMissing {
+				res.Missing = append(res.Missing, key)
+			}
+		}
+		keys = keys[:0]
+		return nil
+	}
+	err := rld.StreamKeys(ctx, t.client, qry, func(key *datastore.Key) error {
+		keys = append(keys, key)
+		if len(keys) < rld.MaxMutations {
+			return nil
+		}
+		return check()
+	})
+	if err != nil {
+		return err
+	}
+	return check()
+}
@@ -0,0 +1,116 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+// lossyClient drops the writes of the entity with id drop.
+type lossyClient struct {
+	*mockClient
+	drop int64
+}
+
+func (c lossyClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	lists := src.([]datastore.PropertyList)
+	for i, key := range keys {
+		if key.ID != c.drop {
+			if err := c.put(key, lists[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return keys, nil
+}
+
+func TestCopy(t *testing.T) {
+	double := func(ctx context.Context, key *datastore.Key, props datastore.PropertyList) (datastore.PropertyList, error) {
+		return datastore.PropertyList{{Name: "v", Value: props[0].Value.(int64) * 2}}, nil
+	}
+	tests := []struct {
+		name      string
+		copy      Copy
+		drop      int64
+		kind      string
+		namespace string
+		factor    int64
+		missing   []int64
+		err       error
+	}{
+		{name: "rename", copy: Copy{TargetKind: "people"}, kind: "people", factor: 1},
+		{name: "namespace", copy: Copy{TargetNamespace: "archive"}, kind: "users", namespace: "archive", factor: 1},
+		{name: "transform", copy: Copy{TargetKind: "people", Transform: double, BatchSize: 2}, kind: "people", factor: 2},
+		{name: "missing", copy: Copy{TargetKind: "people"}, drop: 2, kind: "people", factor: 1, missing: []int64{2}},
+		{name: "failing transform", copy: Copy{TargetKind: "people", Transform: func(ctx context.Context, key *datastore.Key, props datastore.PropertyList) (datastore.PropertyList, error) {
+			return nil, errors.New("bad entity")
+		}}, err: errors.New("bad entity")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newMockClient()
+			keys := putItems(t, c, "users", 5)
+			tr := NewTracker(lossyClient{c, tt.drop}, "")
+			cp := tt.copy
+			cp.Name = "copy"
+			cp.Kind = "users"
+			res, err := tr.Copy(context.Background(), &cp)
+			if tt.err != nil {
+				if err == nil || err.Error() != tt.err.Error() {
+					t.Errorf("expected %v, got %v", tt.err, err)
+				}
+				if len(res.Progress) != 1 || res.Progress[0].State != StateFailed {
+					t.Errorf("expected a failed partition, got %v", res.Progress)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Progress) != 1 || res.Progress[0].Name != "copy/0" || res.Progress[0].Processed != 5 {
+				t.Errorf("unexpected progress %v", res.Progress)
+			}
+			if res.Verified != int64(5-len(tt.missing)) || len(res.Missing) != len(tt.missing) {
+				t.Errorf("expected %v missing, got %d verified and %v missing", tt.missing, res.Verified, res.Missing)
+			}
+			for i, id := range tt.missing {
+				if res.Missing[i].ID != id {
+					t.Errorf("expected %v missing, got %v", tt.missing, res.Missing)
+				}
+			}
+			for _, key := range keys {
+				var source datastore.PropertyList
+				if err := c.get(key, &source); err != nil || source[0].Value.(int64) != key.ID {
+					t.Errorf("expected the source of %v to be left unchanged, got %v, %v", key, source, err)
+				}
+				if key.ID == tt.drop {
+					continue
+				}
+				target := datastore.IDKey(tt.kind, key.ID, nil)
+				target.Namespace = tt.namespace
+				var props datastore.PropertyList
+				if err := c.get(target, &props); err != nil {
+					t.Fatalf("expected %v to be copied, got %v", target, err)
+				}
+				if v := props[0].Value.(int64); v != key.ID*tt.factor {
+					t.Errorf("unexpected copy of %v: %v", key, props)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyTargetKey(t *testing.T) {
+	parent := datastore.NameKey("orgs", "o", nil)
+	key := datastore.IDKey("users", 1, parent)
+	c := &Copy{TargetKind: "people", TargetNamespace: "archive"}
+	target := c.targetKey(key)
+	if target.Kind != "people" || target.Namespace != "archive" || target.Parent.Namespace != "archive" || target.Parent.Kind != "orgs" {
+		t.Errorf("unexpected target key %v", target)
+	}
+	if key.Kind != "users" || parent.Namespace != "" {
+		t.Errorf("expected the source key to be left unchanged, got %v", key)
+	}
+}
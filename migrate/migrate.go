@@ -0,0 +1,136 @@
+// Package migrate runs migrations over the entities of a Datastore kind in
+// batches, persisting their progress so interrupted migrations resume where
+// they stopped.
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultBatchSize is the number of entities processed per batch when not
+// set by the migration.
+const DefaultBatchSize = 100
+
+// DefaultLease is the time a runner holds a migration without saving
+// progress before another runner can take it over.
+const DefaultLease = 5 * time.Minute
+
+// Migration describes a migration of the entities of a kind.
+type Migration struct {
+	// Name identifies the migration and its progress.
+	Name string
+	// Namespace and Kind of the migrated entities.
+	Namespace string
+	Kind      string
+	// BatchSize is the number of entities processed per batch.
+	BatchSize int
+	// Lease is the time the runner holds the migration between two batches.
+	Lease time.Duration
+	// Start and End bound the keys of the migrated entities, Start included
+	// and End excluded, when not nil. They are saved with the progress on
+	// the first run, later runs keeping the saved range.
+	Start, End *datastore.Key
+	// Process migrates the entities with keys, in key order, and returns
+	// the number of written entities. A batch is retried from its start when
+	// the migration resumes after an error.
+	Process func(ctx context.Context, keys []*datastore.Key) (written int, err error)
+}
+
+// Run runs m from its last saved progress and returns its final progress.
+// Only one runner can run a migration at a time; other runners get
+// ErrLocked until the lease of the running one expires. The migration stops
+// at the first batch failing, with a failed state, and can be resumed by
+// running it again.
+func (t *Tracker) Run(ctx context.Context, m *Migration) (*Progress, error) {
+	size := m.BatchSize
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	lease := m.Lease
+	if lease <= 0 {
+		lease = DefaultLease
+	}
+	p, err := t.claim(ctx, m, newOwner(), lease)
+	if err != nil {
+		return nil, err
+	}
+	if p.State == StateDone {
+		return p, nil
+	}
+	for {
+		qry := datastore.NewQuery(m.Kind).
+			Namespace(m.Namespace).
+			Order("__key__").
+			KeysOnly().
+			Limit(size)
+		if p.Start != nil {
+			qry = qry.Filter("__key__ >=", p.Start)
+		}
+		if p.End != nil {
+			qry = qry.Filter("__key__ <", p.End)
+		}
+		if p.Cursor != "" {
+			c, err := datastore.DecodeCursor(p.Cursor)
+			if err != nil {
+				return p, err
+			}
+			qry = qry.Start(c)
+		}
+		var keys []*datastore.Key
+		it := t.client.Run(ctx, qry)
+		for {
+			key, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return p, t.fail(ctx, p, 0, err, lease)
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			p.State = StateDone
+			p.Finished = time.Now()
+			return p, t.save(ctx, p, lease)
+		}
+		cursor, err := it.Cursor()
+		if err != nil {
+			return p, t.fail(ctx, p, 0, err, lease)
+		}
+		written, err := m.Process(ctx, keys)
+		if err != nil {
+			return p, t.fail(ctx, p, len(keys), err, lease)
+		}
+		p.Cursor = cursor.String()
+		p.Processed += int64(len(keys))
+		p.Written += int64(written)
+		if err = t.save(ctx, p, lease); err != nil {
+			return p, err
+		}
+	}
+}
+
+// fail records err in the progress of a migration stopped by a batch of n
+// entities and returns err.
+func (t *Tracker) fail(ctx context.Context, p *Progress, n int, err error, lease time.Duration) error {
+	p.State = StateFailed
+	p.Failed += int64(n)
+	p.addError(err)
+	if serr := t.save(ctx, p, lease); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// newOwner returns a random runner identifier.
+func newOwner() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
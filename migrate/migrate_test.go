@@ -0,0 +1,174 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestRun(t *testing.T) {
+	errBatch := errors.New("batch failed")
+	tests := []struct {
+		name      string
+		items     int
+		batchSize int
+		// failAt fails the batch starting with the entity of this id.
+		failAt    int64
+		state     string
+		processed int64
+		failed    int64
+	}{
+		{name: "single batch", items: 3, batchSize: 10, state: StateDone, processed: 3},
+		{name: "batches", items: 5, batchSize: 2, state: StateDone, processed: 5},
+		{name: "default batch size", items: 150, state: StateDone, processed: 150},
+		{name: "empty kind", items: 0, batchSize: 2, state: StateDone},
+		{name: "failing batch", items: 5, batchSize: 2, failAt: 3, state: StateFailed, processed: 2, failed: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newMockClient()
+			putItems(t, c, "users", tt.items)
+			tr := NewTracker(c, "")
+			var seen []int64
+			m := &Migration{
+				Name:      "m",
+				Kind:      "users",
+				BatchSize: tt.batchSize,
+				Process: func(ctx context.Context, keys []*datastore.Key) (int, error) {
+					if keys[0].ID == tt.failAt {
+						return 0, errBatch
+					}
+					for _, key := range keys {
+						seen = append(seen, key.ID)
+					}
+					return len(keys) - 1, nil
+				},
+			}
+			p, err := tr.Run(context.Background(), m)
+			if tt.failAt != 0 && err != errBatch {
+				t.Errorf("expected the batch error, got %v", err)
+			} else if tt.failAt == 0 && err != nil {
+				t.Fatal(err)
+			}
+			if p.State != tt.state || p.Processed != tt.processed || p.Failed != tt.failed {
+				t.Errorf("unexpected progress %+v", p)
+			}
+			if int64(len(seen)) != tt.processed {
+				t.Errorf("expected %d processed entities, got %v", tt.processed, seen)
+			}
+			for i, id := range seen {
+				if id != int64(i+1) {
+					t.Errorf("expected the entities in key order, got %v", seen)
+					break
+				}
+			}
+			saved, err := tr.Status(context.Background(), "m")
+			if err != nil || saved == nil {
+				t.Fatalf("expected saved progress, got %v, %v", saved, err)
+			}
+			if saved.State != tt.state || saved.Processed != tt.processed || saved.Cursor != p.Cursor {
+				t.Errorf("unexpected saved progress %+v", saved)
+			}
+			if tt.failAt != 0 && (len(saved.Errors) != 1 || saved.Errors[0] != errBatch.Error()) {
+				t.Errorf("expected the batch error to be saved, got %v", saved.Errors)
+			}
+		})
+	}
+}
+
+func TestRunResume(t *testing.T) {
+	c := newMockClient()
+	putItems(t, c, "users", 5)
+	tr := NewTracker(c, "")
+	var seen []int64
+	fail := true
+	m := &Migration{
+		Name:      "m",
+		Kind:      "users",
+		BatchSize: 2,
+		Process: func(ctx context.Context, keys []*datastore.Key) (int, error) {
+			if fail && keys[0].ID == 3 {
+				return 0, errors.New("batch failed")
+			}
+			for _, key := range keys {
+				seen = append(seen, key.ID)
+			}
+			return len(keys), nil
+		},
+	}
+	ctx := context.Background()
+	if _, err := tr.Run(ctx, m); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	fail = false
+	p, err := tr.Run(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 5 || seen[2] != 3 || seen[4] != 5 {
+		t.Errorf("expected the failed batch to be retried once, got %v", seen)
+	}
+	if p.State != StateDone || p.Processed != 5 || p.Written != 5 || p.Failed != 2 || p.Finished.IsZero() {
+		t.Errorf("unexpected progress %+v", p)
+	}
+	// Done migrations don't run again
+	seen = nil
+	if p, err = tr.Run(ctx, m); err != nil || p.State != StateDone || len(seen) != 0 {
+		t.Errorf("expected the done migration to be skipped, got %v, %v, %v", p, err, seen)
+	}
+	if err = tr.Reset(ctx, "m"); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = tr.Run(ctx, m); err != nil || p.Processed != 5 || len(seen) != 5 {
+		t.Errorf("expected the reset migration to start over, got %v, %v, %v", p, err, seen)
+	}
+}
+
+func TestRunLocked(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		owner      string
+		leaseUntil time.Time
+		err        error
+	}{
+		{name: "active lease", owner: "other", leaseUntil: now.Add(time.Minute), err: ErrLocked},
+		{name: "expired lease", owner: "other", leaseUntil: now.Add(-time.Minute)},
+		{name: "released lease", owner: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newMockClient()
+			putItems(t, c, "users", 3)
+			tr := NewTracker(c, "")
+			held := &Progress{Name: "m", Kind: "users", State: StateRunning, Owner: tt.owner, LeaseUntil: tt.leaseUntil}
+			if err := c.put(tr.key("m"), held); err != nil {
+				t.Fatal(err)
+			}
+			var n int
+			p, err := tr.Run(context.Background(), &Migration{
+				Name: "m",
+				Kind: "users",
+				Process: func(ctx context.Context, keys []*datastore.Key) (int, error) {
+					n += len(keys)
+					return len(keys), nil
+				},
+			})
+			if err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if tt.err != nil {
+				if n != 0 {
+					t.Errorf("expected the locked migration not to run, got %d entities", n)
+				}
+				return
+			}
+			if n != 3 || p.State != StateDone || p.Owner == tt.owner {
+				t.Errorf("expected the migration to be taken over, got %+v", p)
+			}
+		})
+	}
+}
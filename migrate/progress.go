@@ -0,0 +1,175 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	rld "github.com/ajcrowe/rest-layer-datastore"
+	"google.golang.org/api/iterator"
+)
+
+// ProgressKind is the kind of the control entities holding the progress of
+// migrations, keyed by migration name.
+const ProgressKind = "_migrations"
+
+// maxErrors bounds the number of errors kept in a progress entity.
+const maxErrors = 20
+
+// Migration states.
+const (
+	StateRunning = "running"
+	StateFailed  = "failed"
+	StateDone    = "done"
+)
+
+// ErrLocked is returned when a migration is already run by another runner.
+var ErrLocked = errors.New("migration is locked by another runner")
+
+// Progress is the persisted state of a migration. It is saved after every
+// batch so interrupted migrations resume after the last completed batch.
+type Progress struct {
+	Name      string `datastore:"name"`
+	Namespace string `datastore:"namespace"`
+	Kind      string `datastore:"kind"`
+	State     string `datastore:"state"`
+	// Cursor points after the last completed batch.
+	Cursor string `datastore:"cursor,noindex"`
+	// Start and End bound the keys of the migrated entities.
+	Start *datastore.Key `datastore:"start,noindex"`
+	End   *datastore.Key `datastore:"end,noindex"`
+	// Processed counts the entities read, Written the entities written and
+	// Failed the entities of failed batches.
+	Processed int64 `datastore:"processed,noindex"`
+	Written   int64 `datastore:"written,noindex"`
+	Failed    int64 `datastore:"failed,noindex"`
+	// Errors holds the last errors, most recent last.
+	Errors   []string  `datastore:"errors,noindex"`
+	Started  time.Time `datastore:"started,noindex"`
+	Updated  time.Time `datastore:"updated"`
+	Finished time.Time `datastore:"finished,noindex"`
+	// Owner identifies the runner holding the migration until LeaseUntil.
+	Owner      string    `datastore:"owner,noindex"`
+	LeaseUntil time.Time `datastore:"lease_until,noindex"`
+}
+
+// addError records err, keeping the last maxErrors errors.
+func (p *Progress) addError(err error) {
+	p.Errors = append(p.Errors, err.Error())
+	if len(p.Errors) > maxErrors {
+		p.Errors = p.Errors[len(p.Errors)-maxErrors:]
+	}
+}
+
+// Tracker persists the progress of migrations in the ProgressKind kind of a
+// namespace.
+type Tracker struct {
+	client    rld.Client
+	namespace string
+}
+
+// NewTracker creates a tracker storing progress entities in namespace.
+func NewTracker(client rld.Client, namespace string) *Tracker {
+	return &Tracker{client: client, namespace: namespace}
+}
+
+func (t *Tracker) key(name string) *datastore.Key {
+	key := datastore.NameKey(ProgressKind, name, nil)
+	key.Namespace = t.namespace
+	return key
+}
+
+// Status returns the progress of the migration with name, nil if it never
+// ran.
+func (t *Tracker) Status(ctx context.Context, name string) (*Progress, error) {
+	var p Progress
+	if err := t.client.Get(ctx, t.key(name), &p); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &p, nil
+}
+
+// List returns the progress of all migrations, most recently updated first,
+// for dashboards.
+func (t *Tracker) List(ctx context.Context) ([]*Progress, error) {
+	qry := datastore.NewQuery(ProgressKind).
+		Namespace(t.namespace).
+		Order("-updated")
+	var list []*Progress
+	for it := t.client.Run(ctx, qry); ; {
+		var p Progress
+		_, err := it.Next(&p)
+		if err == iterator.Done {
+			return list, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, &p)
+	}
+}
+
+// Reset deletes the progress of the migration with name, so it starts over on
+// its next run.
+func (t *Tracker) Reset(ctx context.Context, name string) error {
+	return t.client.Delete(ctx, t.key(name))
+}
+
+// claim loads the progress of m and leases it to owner, failing with
+// ErrLocked if another runner holds an active lease.
+func (t *Tracker) claim(ctx context.Context, m *Migration, owner string, lease time.Duration) (*Progress, error) {
+	var p Progress
+	_, err := t.client.RunInTransaction(ctx, func(tx rld.Transaction) error {
+		p = Progress{}
+		err := tx.Get(t.key(m.Name), &p)
+		now := time.Now()
+		switch {
+		case err == datastore.ErrNoSuchEntity:
+			p = Progress{Name: m.Name, Namespace: m.Namespace, Kind: m.Kind, Start: m.Start, End: m.End, Started: now}
+		case err != nil:
+			return err
+		case p.Owner != owner && p.LeaseUntil.After(now):
+			return ErrLocked
+		}
+		if p.State != StateDone {
+			p.State = StateRunning
+		}
+		p.Owner = owner
+		p.LeaseUntil = now.Add(lease)
+		p.Updated = now
+		_, err = tx.Put(t.key(m.Name), &p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// save persists p, extending the lease of its owner. It fails with ErrLocked
+// if the lease was taken over by another runner.
+func (t *Tracker) save(ctx context.Context, p *Progress, lease time.Duration) error {
+	_, err := t.client.RunInTransaction(ctx, func(tx rld.Transaction) error {
+		var current Progress
+		if err := tx.Get(t.key(p.Name), &current); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if current.Owner != "" && current.Owner != p.Owner {
+			return ErrLocked
+		}
+		now := time.Now()
+		p.Updated = now
+		if p.State == StateRunning {
+			p.LeaseUntil = now.Add(lease)
+		} else {
+			p.LeaseUntil = time.Time{}
+		}
+		_, err := tx.Put(t.key(p.Name), p)
+		return err
+	})
+	return err
+}
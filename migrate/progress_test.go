@@ -0,0 +1,94 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTrackerStatus(t *testing.T) {
+	c := newMockClient()
+	tr := NewTracker(c, "ops")
+	ctx := context.Background()
+	if p, err := tr.Status(ctx, "m"); p != nil || err != nil {
+		t.Errorf("expected no progress before the first run, got %v, %v", p, err)
+	}
+	m := &Migration{Name: "m", Namespace: "tenant", Kind: "users"}
+	p, err := tr.claim(ctx, m, "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.State != StateRunning || p.Owner != "a" || p.Started.IsZero() || !p.LeaseUntil.After(time.Now()) {
+		t.Errorf("unexpected claimed progress %+v", p)
+	}
+	if key := tr.key("m"); key.Namespace != "ops" || key.Kind != ProgressKind {
+		t.Errorf("expected the progress in the tracker namespace, got %v", key)
+	}
+	if _, err = tr.claim(ctx, m, "b", time.Minute); err != ErrLocked {
+		t.Errorf("expected ErrLocked for another runner, got %v", err)
+	}
+	if _, err = tr.claim(ctx, m, "a", time.Minute); err != nil {
+		t.Errorf("expected the owner to claim its migration again, got %v", err)
+	}
+	p.Processed = 10
+	p.Cursor = "c"
+	if err = tr.save(ctx, p, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := tr.Status(ctx, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Processed != 10 || saved.Cursor != "c" || saved.Namespace != "tenant" || saved.Kind != "users" {
+		t.Errorf("unexpected saved progress %+v", saved)
+	}
+	// A runner whose lease was taken over can't save anymore
+	stale := *saved
+	stale.Owner = "b"
+	if err = tr.save(ctx, &stale, time.Minute); err != ErrLocked {
+		t.Errorf("expected ErrLocked saving a taken over migration, got %v", err)
+	}
+	p.State = StateDone
+	if err = tr.save(ctx, p, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err = tr.Status(ctx, "m"); err != nil || !saved.LeaseUntil.IsZero() {
+		t.Errorf("expected the lease to be released once done, got %v, %v", saved, err)
+	}
+	if err = tr.Reset(ctx, "m"); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = tr.Status(ctx, "m"); p != nil || err != nil {
+		t.Errorf("expected no progress after a reset, got %v, %v", p, err)
+	}
+}
+
+func TestTrackerList(t *testing.T) {
+	c := newMockClient()
+	tr := NewTracker(c, "")
+	ctx := context.Background()
+	for _, name := range []string{"a", "b"} {
+		if _, err := tr.claim(ctx, &Migration{Name: name, Kind: "users"}, "owner", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := tr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "a" || list[1].Name != "b" {
+		t.Errorf("unexpected progress list %v", list)
+	}
+}
+
+func TestAddError(t *testing.T) {
+	var p Progress
+	for i := 0; i < maxErrors+5; i++ {
+		p.addError(errors.New(fmt.Sprint(i)))
+	}
+	if len(p.Errors) != maxErrors || p.Errors[0] != "5" || p.Errors[maxErrors-1] != fmt.Sprint(maxErrors+4) {
+		t.Errorf("expected the last %d errors, got %v", maxErrors, p.Errors)
+	}
+}
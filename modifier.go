@@ -0,0 +1,19 @@
+package datastore
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+// QueryModifier alters a Datastore query built from a rest-layer query.
+type QueryModifier func(*datastore.Query) *datastore.Query
+
+// WithQueryModifier returns a context making the handler apply modify to the
+// Datastore queries built by Find and Clear, after the filters, sort and
+// namespace are set and before the window is applied. It gives access to
+// features not surfaced by the query translation, like ancestor filters or
+// another namespace.
+func WithQueryModifier(ctx context.Context, modify QueryModifier) context.Context {
+	return context.WithValue(ctx, modifierCtxKey, modify)
+}
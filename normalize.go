@@ -0,0 +1,207 @@
+package datastore
+
+import (
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// normalizePredicate flattens nested AND expressions and removes duplicated
+// expressions. It returns false if the predicate is contradictory and can't
+// match any entity, and an ErrUnknownField if it references a field unknown
+// to the bound schema.
+func (d *Handler) normalizePredicate(p query.Predicate) (query.Predicate, bool, error) {
+	flat := flattenAnd(p, nil)
+	seen := make(map[string]bool, len(flat))
+	norm := make(query.Predicate, 0, len(flat))
+	for _, exp := range flat {
+		s := exp.String()
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		norm = append(norm, exp)
+	}
+	if d.schema != nil {
+		for _, exp := range norm {
+			for _, f := range expressionFields(exp) {
+				if f != "id" && d.schema.GetField(f) == nil {
+					return nil, false, &ErrUnknownField{Field: f}
+				}
+			}
+		}
+	}
+	return norm, d.satisfiable(norm), nil
+}
+
+// flattenAnd appends the expressions of p to flat, expanding AND expressions.
+func flattenAnd(p query.Predicate, flat query.Predicate) query.Predicate {
+	for _, exp := range p {
+		if and, ok := exp.(*query.And); ok {
+			flat = flattenAnd(query.Predicate(*and), flat)
+			continue
+		}
+		flat = append(flat, exp)
+	}
+	return flat
+}
+
+// expressionFields returns the fields referenced by exp.
+func expressionFields(exp query.Expression) []string {
+	switch t := exp.(type) {
+	case *query.Equal:
+		return []string{t.Field}
+	case *query.NotEqual:
+		return []string{t.Field}
+	case *query.GreaterThan:
+		return []string{t.Field}
+	case *query.GreaterOrEqual:
+		return []string{t.Field}
+	case *query.LowerThan:
+		return []string{t.Field}
+	case *query.LowerOrEqual:
+		return []string{t.Field}
+	case *query.In:
+		return []string{t.Field}
+	case *query.NotIn:
+		return []string{t.Field}
+	case *query.Exist:
+		return []string{t.Field}
+	case *query.NotExist:
+		return []string{t.Field}
+	case *query.Regex:
+		return []string{t.Field}
+	case *Near:
+		return []string{t.Field}
+	case *WithinBox:
+		return []string{t.Field}
+	case *query.And:
+		return predicateFields(query.Predicate(*t))
+	case *query.Or:
+		return predicateFields(query.Predicate(*t))
+	}
+	return nil
+}
+
+func predicateFields(p query.Predicate) []string {
+	var fields []string
+	for _, exp := range p {
+		fields = append(fields, expressionFields(exp)...)
+	}
+	return fields
+}
+
+// bounds holds the constraints of a flat predicate on a single field.
+type bounds struct {
+	equal        []interface{}
+	lower, upper interface{}
+	lowerStrict  bool
+	upperStrict  bool
+	hasLower     bool
+	hasUpper     bool
+}
+
+// setLower keeps the most restrictive lower bound.
+func (b *bounds) setLower(v interface{}, strict bool) {
+	if c := CompareValues(v, b.lower); !b.hasLower || c > 0 || (c == 0 && strict) {
+		b.lower, b.lowerStrict, b.hasLower = v, strict, true
+	}
+}
+
+// setUpper keeps the most restrictive upper bound.
+func (b *bounds) setUpper(v interface{}, strict bool) {
+	if c := CompareValues(v, b.upper); !b.hasUpper || c < 0 || (c == 0 && strict) {
+		b.upper, b.upperStrict, b.hasUpper = v, strict, true
+	}
+}
+
+// inRange tells if v satisfies the bounds.
+func (b *bounds) inRange(v interface{}) bool {
+	if b.hasLower {
+		if c := CompareValues(v, b.lower); c < 0 || (c == 0 && b.lowerStrict) {
+			return false
+		}
+	}
+	if b.hasUpper {
+		if c := CompareValues(v, b.upper); c > 0 || (c == 0 && b.upperStrict) {
+			return false
+		}
+	}
+	return true
+}
+
+// satisfiable detects contradictions between the expressions of a flat
+// predicate. Range constraints on a field must all be satisfied by the same
+// value, even for multi-valued properties. Equality constraints are only
+// checked for fields known to be single valued through the bound schema, as
+// an entity with a list property can match several equality filters.
+func (d *Handler) satisfiable(p query.Predicate) bool {
+	fields := map[string]*bounds{}
+	get := func(f string) *bounds {
+		if b, found := fields[f]; found {
+			return b
+		}
+		b := &bounds{}
+		fields[f] = b
+		return b
+	}
+	for _, exp := range p {
+		switch t := exp.(type) {
+		case *query.Equal:
+			if d.singleValued(t.Field) && isConstant(t.Value) {
+				get(t.Field).equal = append(get(t.Field).equal, t.Value)
+			}
+		case *query.GreaterThan:
+			if isConstant(t.Value) {
+				get(t.Field).setLower(t.Value, true)
+			}
+		case *query.GreaterOrEqual:
+			if isConstant(t.Value) {
+				get(t.Field).setLower(t.Value, false)
+			}
+		case *query.LowerThan:
+			if isConstant(t.Value) {
+				get(t.Field).setUpper(t.Value, true)
+			}
+		case *query.LowerOrEqual:
+			if isConstant(t.Value) {
+				get(t.Field).setUpper(t.Value, false)
+			}
+		}
+	}
+	for _, b := range fields {
+		if b.hasLower && b.hasUpper {
+			c := CompareValues(b.lower, b.upper)
+			if c > 0 || (c == 0 && (b.lowerStrict || b.upperStrict)) {
+				return false
+			}
+		}
+		for _, v := range b.equal {
+			if CompareValues(v, b.equal[0]) != 0 || !b.inRange(v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isConstant tells if a filter value can be compared before translation.
+func isConstant(v interface{}) bool {
+	switch v.(type) {
+	case DateMath, []interface{}:
+		return false
+	}
+	return true
+}
+
+// singleValued tells if the bound schema declares field as a non list field.
+func (d *Handler) singleValued(field string) bool {
+	if d.schema == nil {
+		return false
+	}
+	f := d.schema.GetField(field)
+	if f == nil {
+		return false
+	}
+	_, isArray := f.Validator.(*schema.Array)
+	return !isArray
+}
@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/rs/rest-layer/schema"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestNormalizePredicate(t *testing.T) {
+	s := &schema.Schema{Fields: schema.Fields{
+		"id":   schema.IDField,
+		"name": {Filterable: true, Validator: &schema.String{}},
+		"age":  {Filterable: true, Validator: &schema.Integer{}},
+		"tags": {Filterable: true, Validator: &schema.Array{}},
+	}}
+	d := (&Handler{}).SetSchema(s)
+	tests := []struct {
+		predicate string
+		len       int
+		ok        bool
+	}{
+		{`{name: "a", $and: [{age: {$gt: 1}}, {$and: [{name: "a"}]}]}`, 2, true},
+		{`{name: "a", $and: [{name: "b"}]}`, 2, false},
+		{`{tags: "a", $and: [{tags: "b"}]}`, 2, true},
+		{`{age: {$gt: 10}, $and: [{age: {$lt: 5}}]}`, 2, false},
+		{`{age: {$gte: 5}, $and: [{age: {$lte: 5}}]}`, 2, true},
+		{`{age: {$gt: 5}, $and: [{age: {$lte: 5}}]}`, 2, false},
+		{`{age: 3, $and: [{age: {$gt: 5}}]}`, 2, false},
+	}
+	for _, tt := range tests {
+		p, err := query.ParsePredicate(tt.predicate)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.predicate, err)
+		}
+		norm, ok, err := d.normalizePredicate(p)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.predicate, err)
+			continue
+		}
+		if len(norm) != tt.len || ok != tt.ok {
+			t.Errorf("%s: got %d expressions and ok=%v, want %d and %v", tt.predicate, len(norm), ok, tt.len, tt.ok)
+		}
+	}
+	p, _ := query.ParsePredicate(`{unknown: 1}`)
+	if _, _, err := d.normalizePredicate(p); !isUnknownField(err, "unknown") {
+		t.Errorf("expected an unknown field error, got %v", err)
+	}
+}
+
+func isUnknownField(err error, field string) bool {
+	e, ok := err.(*ErrUnknownField)
+	return ok && e.Field == field
+}
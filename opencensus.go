@@ -0,0 +1,157 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// OpenCensus measures and tags of the storage metrics.
+var (
+	ocLatency   = stats.Float64("datastore/operation_latency", "Latency of the Datastore storage operations", stats.UnitMilliseconds)
+	ocItems     = stats.Int64("datastore/operation_items", "Items written, deleted or returned by the Datastore storage operations", stats.UnitDimensionless)
+	ocMutations = stats.Int64("datastore/commit_mutations", "Mutations per Datastore commit", stats.UnitDimensionless)
+	ocShadows   = stats.Int64("datastore/shadow_reads", "Shadow reads by result", stats.UnitDimensionless)
+	ocSizes     = stats.Int64("datastore/entity_size", "Estimated size of the written Datastore entities", stats.UnitBytes)
+	ocLargest   = stats.Int64("datastore/entity_largest_property_size", "Estimated size of the largest property of the written Datastore entities", stats.UnitBytes)
+	ocCache     = stats.Int64("datastore/cache_events", "Cache events by entry and event", stats.UnitDimensionless)
+
+	ocKind      = tag.MustNewKey("kind")
+	ocNamespace = tag.MustNewKey("namespace")
+	ocOp        = tag.MustNewKey("op")
+	ocCode      = tag.MustNewKey("code")
+	ocResult    = tag.MustNewKey("result")
+	ocProperty  = tag.MustNewKey("property")
+	ocEntry     = tag.MustNewKey("entry")
+	ocEvent     = tag.MustNewKey("event")
+)
+
+// OpenCensusViews are the views of the storage metrics registered by
+// NewOpenCensusMetrics, mirroring the collectors of NewPrometheusMetrics.
+var OpenCensusViews = []*view.View{
+	{
+		Name:        "datastore/operation_latency",
+		Description: "Latency of the Datastore storage operations",
+		Measure:     ocLatency,
+		TagKeys:     []tag.Key{ocKind, ocNamespace, ocOp, ocCode},
+		Aggregation: view.Distribution(5, 10, 20, 40, 80, 160, 320, 640, 1280, 2560, 5120, 10240),
+	},
+	{
+		Name:        "datastore/operation_count",
+		Description: "Datastore storage operations by error code",
+		Measure:     ocLatency,
+		TagKeys:     []tag.Key{ocKind, ocNamespace, ocOp, ocCode},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "datastore/operation_items",
+		Description: "Items written, deleted or returned by the Datastore storage operations",
+		Measure:     ocItems,
+		TagKeys:     []tag.Key{ocKind, ocNamespace, ocOp},
+		Aggregation: view.Distribution(1, 4, 16, 64, 256, 1024, 4096, 16384),
+	},
+	{
+		Name:        "datastore/commit_mutations",
+		Description: "Mutations per Datastore commit",
+		Measure:     ocMutations,
+		TagKeys:     []tag.Key{ocKind, ocNamespace},
+		Aggregation: view.Distribution(1, 2, 4, 8, 16, 32, 64, 128, 256, 512),
+	},
+	{
+		Name:        "datastore/shadow_reads",
+		Description: "Shadow reads by result",
+		Measure:     ocShadows,
+		TagKeys:     []tag.Key{ocKind, ocNamespace, ocResult},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "datastore/entity_size",
+		Measure:     ocSizes,
+		TagKeys:     []tag.Key{ocKind, ocNamespace},
+		Aggregation: view.Distribution(1<<10, 1<<11, 1<<12, 1<<13, 1<<14, 1<<15, 1<<16, 1<<17, 1<<18, 1<<19, 1<<20),
+	},
+	{
+		Name:        "datastore/entity_largest_property_size",
+		Measure:     ocLargest,
+		TagKeys:     []tag.Key{ocKind, ocNamespace, ocProperty},
+		Aggregation: view.Distribution(1<<10, 1<<11, 1<<12, 1<<13, 1<<14, 1<<15, 1<<16, 1<<17, 1<<18, 1<<19, 1<<20),
+	},
+	{
+		Name:        "datastore/cache_events",
+		Description: "Cache events by entry and event",
+		Measure:     ocCache,
+		TagKeys:     []tag.Key{ocKind, ocNamespace, ocEntry, ocEvent},
+		Aggregation: view.Count(),
+	},
+}
+
+// OpenCensusMetrics implements Metrics by recording OpenCensus stats, which
+// can be exported to Cloud Monitoring with the Stackdriver exporter.
+type OpenCensusMetrics struct{}
+
+// NewOpenCensusMetrics registers OpenCensusViews and returns the Metrics
+// recording them. The error rate is given by the operation_count view
+// grouped by code.
+func NewOpenCensusMetrics() (*OpenCensusMetrics, error) {
+	if err := view.Register(OpenCensusViews...); err != nil {
+		return nil, err
+	}
+	return &OpenCensusMetrics{}, nil
+}
+
+// ObserveOperation implements Metrics.
+func (OpenCensusMetrics) ObserveOperation(kind, namespace, op, code string, latency time.Duration, items int) {
+	ms := []stats.Measurement{ocLatency.M(float64(latency) / float64(time.Millisecond))}
+	if code == "OK" {
+		ms = append(ms, ocItems.M(int64(items)))
+	}
+	stats.RecordWithTags(context.Background(), []tag.Mutator{
+		tag.Upsert(ocKind, kind),
+		tag.Upsert(ocNamespace, namespace),
+		tag.Upsert(ocOp, op),
+		tag.Upsert(ocCode, code),
+	}, ms...)
+}
+
+// ObserveBatch implements Metrics.
+func (OpenCensusMetrics) ObserveBatch(kind, namespace string, mutations int) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{
+		tag.Upsert(ocKind, kind),
+		tag.Upsert(ocNamespace, namespace),
+	}, ocMutations.M(int64(mutations)))
+}
+
+// ObserveShadowRead implements ShadowMetrics.
+func (OpenCensusMetrics) ObserveShadowRead(kind, namespace, result string) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{
+		tag.Upsert(ocKind, kind),
+		tag.Upsert(ocNamespace, namespace),
+		tag.Upsert(ocResult, result),
+	}, ocShadows.M(1))
+}
+
+// ObserveEntitySize implements SizeMetrics.
+func (OpenCensusMetrics) ObserveEntitySize(kind, namespace string, size int, largest PropertySize) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{
+		tag.Upsert(ocKind, kind),
+		tag.Upsert(ocNamespace, namespace),
+	}, ocSizes.M(int64(size)))
+	stats.RecordWithTags(context.Background(), []tag.Mutator{
+		tag.Upsert(ocKind, kind),
+		tag.Upsert(ocNamespace, namespace),
+		tag.Upsert(ocProperty, largest.Name),
+	}, ocLargest.M(int64(largest.Size)))
+}
+
+// ObserveCache implements CacheMetrics.
+func (OpenCensusMetrics) ObserveCache(kind, namespace, entry, event string) {
+	stats.RecordWithTags(context.Background(), []tag.Mutator{
+		tag.Upsert(ocKind, kind),
+		tag.Upsert(ocNamespace, namespace),
+		tag.Upsert(ocEntry, entry),
+		tag.Upsert(ocEvent, event),
+	}, ocCache.M(1))
+}
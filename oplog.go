@@ -0,0 +1,170 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+)
+
+// LoggedOp is a mutation written to the operation log.
+type LoggedOp struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"ns,omitempty"`
+	Kind      string    `json:"kind"`
+	// Op is one of ChangeInsert, ChangeUpdate or ChangeDelete.
+	Op string `json:"op"`
+	ID string `json:"id"`
+	// Payload is the written payload, with times and bytes wrapped in
+	// {"$time": ...} and {"$bytes": ...} objects to keep their type.
+	Payload map[string]interface{} `json:"payload,omitempty"`
+}
+
+// opLog serializes the operations logged by one or more handlers.
+type opLog struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	onError func(error)
+}
+
+// SetOpLog writes every successful mutation to w as a line of JSON holding a
+// LoggedOp, with enough information to replay it with Replay against a fresh
+// project, for disaster recovery drills. The writer can be a local file or a
+// Cloud Storage object writer, and may be shared by several handlers; writes
+// are serialized. Write errors are reported to onError, if not nil, without
+// failing the mutation.
+func (d *Handler) SetOpLog(w io.Writer, onError func(error)) *Handler {
+	d.opLog = nil
+	if w != nil {
+		d.opLog = &opLog{enc: json.NewEncoder(w), onError: onError}
+	}
+	return d
+}
+
+// logOps writes an operation of type op for each of items, or for each of ids
+// when items is nil.
+func (d *Handler) logOps(ctx context.Context, op string, items []*resource.Item, ids []string) {
+	l := d.opLog
+	if l == nil {
+		return
+	}
+	ns, now := d.getNamespace(ctx), d.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	write := func(o LoggedOp) {
+		if err := l.enc.Encode(o); err != nil && l.onError != nil {
+			l.onError(err)
+		}
+	}
+	for _, item := range items {
+		payload, _ := logValue(item.Payload).(map[string]interface{})
+		write(LoggedOp{Time: now, Namespace: ns, Kind: d.entity, Op: op, ID: item.ID.(string), Payload: payload})
+	}
+	for _, id := range ids {
+		write(LoggedOp{Time: now, Namespace: ns, Kind: d.entity, Op: op, ID: id})
+	}
+}
+
+// Replay applies the operations of the handler kind read from r, an
+// operation log written by SetOpLog, in order and returns the number of
+// applied operations. Inserted and updated items are written with
+// UpsertMulti, replacing any existing entity, so a log can be replayed more
+// than once; operations of other kinds are skipped.
+func (d *Handler) Replay(ctx context.Context, r io.Reader) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	dec.UseNumber()
+	applied := 0
+	for {
+		var o LoggedOp
+		if err := dec.Decode(&o); err == io.EOF {
+			return applied, nil
+		} else if err != nil {
+			return applied, err
+		}
+		if o.Kind != d.entity {
+			continue
+		}
+		octx := context.WithValue(ctx, "namespace", o.Namespace)
+		if o.Op == ChangeDelete {
+			key := datastore.NameKey(d.entity, o.ID, nil)
+			key.Namespace = o.Namespace
+			if _, err := d.deleteKeys(octx, []*datastore.Key{key}); err != nil {
+				return applied, err
+			}
+		} else {
+			payload, _ := replayValue(o.Payload).(map[string]interface{})
+			item, err := resource.NewItem(payload)
+			if err != nil {
+				return applied, err
+			}
+			if err := d.UpsertMulti(octx, []*resource.Item{item}, ReplaceMerge); err != nil {
+				return applied, err
+			}
+		}
+		applied++
+	}
+}
+
+// logValue wraps the values which don't survive a JSON round trip.
+func logValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case time.Time:
+		return map[string]interface{}{"$time": t.Format(time.RFC3339Nano)}
+	case []byte:
+		return map[string]interface{}{"$bytes": base64.StdEncoding.EncodeToString(t)}
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = logValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = logValue(e)
+		}
+		return l
+	}
+	return v
+}
+
+// replayValue unwraps the values wrapped by logValue and restores integers.
+func replayValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		if s, ok := t["$time"].(string); ok && len(t) == 1 {
+			if tm, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return tm
+			}
+		}
+		if s, ok := t["$bytes"].(string); ok && len(t) == 1 {
+			if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+				return b
+			}
+		}
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = replayValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = replayValue(e)
+		}
+		return l
+	}
+	return v
+}
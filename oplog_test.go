@@ -0,0 +1,48 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+)
+
+func TestOpLog(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	var buf bytes.Buffer
+	h := NewHandler(nil, "ns", "items").
+		SetClock(func() time.Time { return now }).
+		SetOpLog(&buf, func(err error) { t.Error(err) })
+	payload := map[string]interface{}{
+		"id":    "1",
+		"at":    now,
+		"raw":   []byte("raw"),
+		"count": int64(3),
+		"ratio": 0.5,
+		"tags":  []interface{}{map[string]interface{}{"at": now}},
+	}
+	h.logOps(context.Background(), ChangeInsert, []*resource.Item{{ID: "1", Payload: payload}}, nil)
+	h.logOps(context.Background(), ChangeDelete, nil, []string{"1"})
+	dec := json.NewDecoder(&buf)
+	dec.UseNumber()
+	var ins, del LoggedOp
+	if err := dec.Decode(&ins); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&del); err != nil {
+		t.Fatal(err)
+	}
+	if ins.Op != ChangeInsert || ins.Kind != "items" || ins.Namespace != "ns" || ins.ID != "1" || !ins.Time.Equal(now) {
+		t.Errorf("unexpected insert %+v", ins)
+	}
+	if got := replayValue(ins.Payload); !reflect.DeepEqual(got, payload) {
+		t.Errorf("payload round trip: got %#v, want %#v", got, payload)
+	}
+	if del.Op != ChangeDelete || del.ID != "1" || del.Payload != nil {
+		t.Errorf("unexpected delete %+v", del)
+	}
+}
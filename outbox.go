@@ -0,0 +1,149 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// OutboxEvent is a notification stored in the outbox, waiting to be relayed.
+type OutboxEvent struct {
+	Key *datastore.Key `datastore:"__key__"`
+	Notification
+	Created time.Time `datastore:"created,noindex"`
+	// ClaimedUntil is the end of the lease of the relay which drained the
+	// event, zero if it was never drained.
+	ClaimedUntil time.Time `datastore:"claimed_until"`
+}
+
+// SetOutbox enables the transactional outbox: every mutation done by the
+// handler also writes an OutboxEvent to kind in the same transaction, Insert,
+// Clear and the reaper included, so events can't be lost or emitted for
+// failed writes. The kind defaults to the handler kind suffixed with
+// "_outbox". A relay process reads the events with Drain and removes them
+// with Ack once delivered. With a Pub/Sub topic set, RetryNotifications is
+// such a relay.
+func (d *Handler) SetOutbox(kind string) *Handler {
+	if kind == "" {
+		kind = d.entity + "_outbox"
+	}
+	d.outboxKind = kind
+	d.outboxTx = true
+	return d
+}
+
+// outboxMutation returns the mutation writing the outbox event of op on the
+// item with key, or nil if the transactional outbox is disabled.
+func (d *Handler) outboxMutation(key *datastore.Key, op, etag string) *datastore.Mutation {
+	if !d.outboxTx {
+		return nil
+	}
+	okey := datastore.IncompleteKey(d.outboxKind, nil)
+	okey.Namespace = key.Namespace
+	return datastore.NewInsert(okey, &OutboxEvent{
+		Notification: Notification{Kind: d.entity, Op: op, ID: key.Name, ETag: etag},
+		Created:      d.now(),
+	})
+}
+
+// saveOutbox saves notifications to the outbox kind.
+func (d *Handler) saveOutbox(ctx context.Context, notes []Notification) error {
+	keys := make([]*datastore.Key, len(notes))
+	events := make([]*OutboxEvent, len(notes))
+	for i, n := range notes {
+		keys[i] = datastore.IncompleteKey(d.outboxKind, nil)
+		keys[i].Namespace = d.getNamespace(ctx)
+		events[i] = &OutboxEvent{Notification: n, Created: d.now()}
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > MaxMutations {
+			n = MaxMutations
+		}
+		if _, err := d.client.PutMulti(ctx, keys[:n], events[:n]); err != nil {
+			return err
+		}
+		keys, events = keys[n:], events[n:]
+	}
+	return nil
+}
+
+// Drain claims at most limit outbox events for lease and returns them. Events
+// are claimed in a transaction so concurrent relays don't get the same
+// events; events which are not acknowledged before the end of their lease
+// are returned again by a later Drain. Events are not strictly ordered.
+func (d *Handler) Drain(ctx context.Context, limit int, lease time.Duration) ([]*OutboxEvent, error) {
+	if d.outboxKind == "" {
+		return nil, nil
+	}
+	if limit < 1 || limit > MaxMutations {
+		limit = MaxMutations
+	}
+	now := d.now()
+	qry := datastore.NewQuery(d.outboxKind).
+		Namespace(d.getNamespace(ctx)).
+		Filter("claimed_until <=", now).
+		Order("claimed_until").
+		Limit(limit).
+		KeysOnly()
+	keys, err := d.client.GetAll(ctx, qry, nil)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	var claimed []*OutboxEvent
+	err = d.runTx(ctx, func(tx Transaction) error {
+		claimed = nil
+		events := make([]*OutboxEvent, len(keys))
+		for i := range events {
+			events[i] = &OutboxEvent{}
+		}
+		err := tx.GetMulti(keys, events)
+		merr, _ := err.(datastore.MultiError)
+		if err != nil && merr == nil {
+			return err
+		}
+		var ckeys []*datastore.Key
+		for i, e := range events {
+			if merr != nil && merr[i] != nil {
+				if merr[i] == datastore.ErrNoSuchEntity {
+					// Acknowledged in the meantime
+					continue
+				}
+				return merr[i]
+			}
+			if e.ClaimedUntil.After(now) {
+				// Claimed by another relay in the meantime
+				continue
+			}
+			e.ClaimedUntil = now.Add(lease)
+			ckeys = append(ckeys, keys[i])
+			claimed = append(claimed, e)
+		}
+		_, err = tx.PutMulti(ckeys, claimed)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// Ack removes delivered events from the outbox.
+func (d *Handler) Ack(ctx context.Context, events []*OutboxEvent) error {
+	keys := make([]*datastore.Key, len(events))
+	for i, e := range events {
+		keys[i] = e.Key
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > MaxMutations {
+			n = MaxMutations
+		}
+		if err := d.client.DeleteMulti(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
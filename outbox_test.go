@@ -0,0 +1,135 @@
+package datastore
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// outboxClient stores outbox events in memory. Its keys-only queries return
+// the events whose lease has ended at now, like the query of Drain.
+type outboxClient struct {
+	Client
+	now    *time.Time
+	nextID int64
+	events map[int64]OutboxEvent
+}
+
+func (c *outboxClient) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	for i, e := range src.([]*OutboxEvent) {
+		key := keys[i]
+		if key.Incomplete() {
+			c.nextID++
+			k := *key
+			k.ID = c.nextID
+			key = &k
+		}
+		c.events[key.ID] = *e
+	}
+	return keys, nil
+}
+
+func (c *outboxClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	var keys []*datastore.Key
+	for id, e := range c.events {
+		if !e.ClaimedUntil.After(*c.now) {
+			keys = append(keys, datastore.IDKey("users_outbox", id, nil))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+func (c *outboxClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	for _, key := range keys {
+		delete(c.events, key.ID)
+	}
+	return nil
+}
+
+func (c *outboxClient) RunInTransaction(ctx context.Context, f func(tx Transaction) error, opts ...datastore.TransactionOption) (*datastore.Commit, error) {
+	return nil, f(outboxTx{c: c})
+}
+
+type outboxTx struct {
+	Transaction
+	c *outboxClient
+}
+
+func (tx outboxTx) GetMulti(keys []*datastore.Key, dst interface{}) error {
+	events := dst.([]*OutboxEvent)
+	merr := make(datastore.MultiError, len(keys))
+	missing := false
+	for i, key := range keys {
+		e, found := tx.c.events[key.ID]
+		if !found {
+			merr[i] = datastore.ErrNoSuchEntity
+			missing = true
+			continue
+		}
+		e.Key = key
+		*events[i] = e
+	}
+	if missing {
+		return merr
+	}
+	return nil
+}
+
+func (tx outboxTx) PutMulti(keys []*datastore.Key, src interface{}) ([]*datastore.PendingKey, error) {
+	_, err := tx.c.PutMulti(context.Background(), keys, src)
+	return nil, err
+}
+
+func TestOutbox(t *testing.T) {
+	now := time.Now()
+	c := &outboxClient{now: &now, events: map[int64]OutboxEvent{}}
+	h := NewHandler(c, "", "users").SetClock(func() time.Time { return now })
+	ctx := context.Background()
+	if events, err := h.Drain(ctx, 10, time.Minute); events != nil || err != nil {
+		t.Errorf("expected no events when disabled, got %v, %v", events, err)
+	}
+	if h.outboxMutation(datastore.NameKey("users", "1", nil), ChangeInsert, "a") != nil {
+		t.Error("expected no outbox mutation when disabled")
+	}
+	h.SetOutbox("")
+	if h.outboxKind != "users_outbox" {
+		t.Errorf("expected the default outbox kind, got %q", h.outboxKind)
+	}
+	err := h.saveOutbox(ctx, []Notification{
+		{Kind: "users", Op: ChangeInsert, ID: "1", ETag: "a"},
+		{Kind: "users", Op: ChangeDelete, ID: "2", ETag: "b"},
+		{Kind: "users", Op: ChangeUpdate, ID: "3", ETag: "c"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := h.Drain(ctx, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].ID != "1" || events[1].Op != ChangeDelete || !events[0].Created.Equal(now) {
+		t.Fatalf("expected the saved events, got %v", events)
+	}
+	if !events[0].ClaimedUntil.Equal(now.Add(time.Minute)) || !c.events[events[0].Key.ID].ClaimedUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the events to be claimed for the lease, got %v", events[0].ClaimedUntil)
+	}
+	// Claimed events are not returned until their lease ends
+	if rest, err := h.Drain(ctx, 10, time.Minute); err != nil || len(rest) != 0 {
+		t.Errorf("expected the events to be claimed, got %v, %v", rest, err)
+	}
+	if err = h.Ack(ctx, events[:1]); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	expired, err := h.Drain(ctx, 10, time.Minute)
+	if err != nil || len(expired) != 2 || expired[0].ID != "2" || expired[1].ID != "3" {
+		t.Errorf("expected the events not acknowledged before the end of their lease, got %v, %v", expired, err)
+	}
+	if err = h.Ack(ctx, expired); err != nil || len(c.events) != 0 {
+		t.Errorf("expected the outbox to be empty once acknowledged, got %v, %v", c.events, err)
+	}
+}
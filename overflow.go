@@ -0,0 +1,172 @@
+package datastore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/storage"
+	"github.com/rs/rest-layer/resource"
+)
+
+// overflowProperty marks the nested entity pointing to a payload value stored
+// in Cloud Storage.
+const overflowProperty = "_overflow"
+
+// SetOverflow stores the top level payload values whose estimated size exceeds
+// threshold bytes as JSON objects in bucket, keeping a pointer (bucket, object
+// and generation) in the entity. Values are transparently rehydrated on read.
+//
+// Every write stores the values in new objects, so a failed or concurrent
+// write never replaces the object a committed entity points to. Objects which
+// are no longer pointed to are deleted once the write is committed, unless
+// history is enabled, as revisions keep pointing to them.
+func (d *Handler) SetOverflow(bucket *storage.BucketHandle, threshold int) *Handler {
+	d.overflowBucket = bucket
+	d.overflowThreshold = threshold
+	return d
+}
+
+// overflowObject returns a new name for the object holding field of item id.
+func (d *Handler) overflowObject(ctx context.Context, id, field string) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/%s/%s/%s", d.getNamespace(ctx), d.entity, id, field, hex.EncodeToString(suffix)), nil
+}
+
+// offload writes the large payload values of item to Cloud Storage and returns
+// a copy of item where they are replaced by pointers.
+func (d *Handler) offload(ctx context.Context, item *resource.Item) (*resource.Item, error) {
+	if d.overflowBucket == nil {
+		return item, nil
+	}
+	var payload map[string]interface{}
+	for k, v := range item.Payload {
+		if k == "id" || valueSize(v) <= d.overflowThreshold {
+			continue
+		}
+		if payload == nil {
+			payload = make(map[string]interface{}, len(item.Payload))
+			for k, v := range item.Payload {
+				payload[k] = v
+			}
+		}
+		name, err := d.overflowObject(ctx, item.ID.(string), k)
+		if err != nil {
+			return nil, err
+		}
+		w := d.overflowBucket.Object(name).NewWriter(ctx)
+		w.ContentType = "application/json"
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			w.Close()
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		payload[k] = map[string]interface{}{
+			overflowProperty: map[string]interface{}{
+				"bucket":     w.Attrs().Bucket,
+				"object":     name,
+				"generation": w.Attrs().Generation,
+			},
+		}
+	}
+	if payload == nil {
+		return item, nil
+	}
+	i := *item
+	i.Payload = payload
+	return &i, nil
+}
+
+// overflowPointer returns the location of the object a payload value points
+// to, if it is an overflow pointer.
+func overflowPointer(v interface{}) (object string, generation int64, ok bool) {
+	var p interface{}
+	switch t := v.(type) {
+	case *datastore.Entity:
+		for _, prop := range t.Properties {
+			if prop.Name == overflowProperty {
+				p = prop.Value
+			}
+		}
+	case map[string]interface{}:
+		p = t[overflowProperty]
+	}
+	switch t := p.(type) {
+	case *datastore.Entity:
+		for _, prop := range t.Properties {
+			switch prop.Name {
+			case "object":
+				object, ok = prop.Value.(string)
+			case "generation":
+				generation, _ = prop.Value.(int64)
+			}
+		}
+	case map[string]interface{}:
+		// Loaded from a JSON blob
+		object, ok = t["object"].(string)
+		if g, isFloat := t["generation"].(float64); isFloat {
+			generation = int64(g)
+		}
+	}
+	return
+}
+
+// rehydrate replaces the overflow pointers of payload by the values stored in
+// Cloud Storage.
+func (d *Handler) rehydrate(ctx context.Context, payload map[string]interface{}) error {
+	if d.overflowBucket == nil {
+		return nil
+	}
+	for k, v := range payload {
+		object, gen, ok := overflowPointer(v)
+		if !ok {
+			continue
+		}
+		r, err := d.overflowBucket.Object(object).Generation(gen).NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		var value interface{}
+		err = json.NewDecoder(r).Decode(&value)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		payload[k] = value
+	}
+	return nil
+}
+
+// purgeOverflow deletes the objects pointed to by payload. Errors are ignored
+// as the entity referencing them is already gone.
+func (d *Handler) purgeOverflow(ctx context.Context, payload map[string]interface{}) {
+	d.purgeReplaced(ctx, payload, nil)
+}
+
+// purgeReplaced deletes the objects pointed to by before which after doesn't
+// point to anymore, once after is committed. Errors are ignored, an object
+// left behind only wasting space.
+func (d *Handler) purgeReplaced(ctx context.Context, before, after map[string]interface{}) {
+	if d.overflowBucket == nil {
+		return
+	}
+	kept := map[string]bool{}
+	for _, v := range after {
+		if object, _, ok := overflowPointer(v); ok {
+			kept[object] = true
+		}
+	}
+	for _, v := range before {
+		if object, _, ok := overflowPointer(v); ok && !kept[object] {
+			d.overflowBucket.Object(object).Delete(ctx)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// QueryProfile describes how a Find was served, for diagnosing expensive
+// endpoints.
+type QueryProfile struct {
+	mu sync.Mutex
+	// Plan is how the query was served: query, keyset, large in or
+	// emulated index <name>.
+	Plan string
+	// Pages holds the number of entities or keys fetched by each query run
+	// or lookup, in order.
+	Pages []int
+	// RoundTrips is the number of query runs and lookups. A run returning
+	// many entities may take several batches.
+	RoundTrips int
+	// Scanned is the number of entities or keys fetched, Returned the number
+	// of items returned once filtered in memory and windowed.
+	Scanned  int
+	Returned int
+	// Cached is set when the result was served from the cache, in which case
+	// no request was made.
+	Cached   bool
+	Duration time.Duration
+}
+
+// WithProfile returns a context in which Find fills the returned profile
+// with the plan, fetch counts and round trips of the query. Profiled queries
+// bypass request coalescing but not the cache.
+func WithProfile(ctx context.Context) (context.Context, *QueryProfile) {
+	p := &QueryProfile{}
+	return context.WithValue(ctx, profileCtxKey, p), p
+}
+
+// profileOf returns the profile of ctx, nil if it is not profiled.
+func profileOf(ctx context.Context) *QueryProfile {
+	p, _ := ctx.Value(profileCtxKey).(*QueryProfile)
+	return p
+}
+
+// setPlan records how the query is served.
+func (p *QueryProfile) setPlan(plan string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Plan = plan
+}
+
+// fetched records a round trip fetching n entities or keys.
+func (p *QueryProfile) fetched(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Pages = append(p.Pages, n)
+	p.RoundTrips++
+	p.Scanned += n
+}
+
+// finish records the outcome of the query.
+func (p *QueryProfile) finish(returned int, cached bool, elapsed time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Returned, p.Cached, p.Duration = returned, cached, elapsed
+}
@@ -0,0 +1,21 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+)
+
+func TestQueryProfile(t *testing.T) {
+	profileOf(context.Background()).fetched(3) // no-op without a profile
+	ctx, p := WithProfile(context.Background())
+	profileOf(ctx).setPlan("large in")
+	profileOf(ctx).fetched(30)
+	profileOf(ctx).fetched(12)
+	profileOf(ctx).finish(10, false, 0)
+	if p.Plan != "large in" || p.RoundTrips != 2 || p.Scanned != 42 || p.Returned != 10 || len(p.Pages) != 2 || p.Pages[1] != 12 {
+		t.Errorf("unexpected profile %+v", p)
+	}
+	if _, ok := NewHandler(nil, "", "users").SetCoalescing(true).coalesceKey(ctx, nil); ok {
+		t.Error("expected profiled queries not to be coalesced")
+	}
+}
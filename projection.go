@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"context"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// WithProjection returns a context making Find apply the selection of the
+// query projection to the loaded payloads, so unselected fields and nested
+// entities are trimmed before being returned to the API layer.
+//
+// The REST layer finds the original item of PATCH and PUT requests with the
+// request query, so projections must only be pushed down for read requests.
+func WithProjection(ctx context.Context) context.Context {
+	return context.WithValue(ctx, projectionCtxKey, true)
+}
+
+// projectItems returns copies of items with the selection of proj applied to
+// their payload, if enabled by the context.
+func projectItems(ctx context.Context, items []*resource.Item, proj query.Projection) []*resource.Item {
+	if enabled, _ := ctx.Value(projectionCtxKey).(bool); !enabled || len(proj) == 0 {
+		return items
+	}
+	projected := make([]*resource.Item, len(items))
+	for i, item := range items {
+		p := *item
+		p.Payload = projectPayload(item.Payload, proj)
+		p.Payload["id"] = item.Payload["id"]
+		projected[i] = &p
+	}
+	return projected
+}
+
+// projectPayload returns the fields of payload selected by proj, recursively
+// selecting the children of nested objects and lists of objects. Fields keep
+// their stored name: aliases and field parameters are left to the REST layer,
+// which evaluates the projection again on the trimmed payload.
+func projectPayload(payload map[string]interface{}, proj query.Projection) map[string]interface{} {
+	// A field may be selected several times under different aliases, in
+	// which case the union of its selections is kept. A nil selection means
+	// the whole value.
+	sel := make(map[string]query.Projection, len(proj))
+	add := func(name string, children query.Projection) {
+		prev, found := sel[name]
+		switch {
+		case !found:
+			sel[name] = children
+		case prev == nil || len(children) == 0:
+			sel[name] = nil
+		default:
+			sel[name] = append(prev[:len(prev):len(prev)], children...)
+		}
+	}
+	for _, pf := range proj {
+		if pf.Name != "*" {
+			add(pf.Name, pf.Children)
+			continue
+		}
+		for k := range payload {
+			add(k, pf.Children)
+		}
+	}
+	res := make(map[string]interface{}, len(sel))
+	for name, children := range sel {
+		v, found := payload[name]
+		if !found {
+			continue
+		}
+		if len(children) > 0 {
+			v = projectValue(v, children)
+		}
+		res[name] = v
+	}
+	return res
+}
+
+// projectValue applies proj to nested objects. Other values, like references,
+// are returned as is for the REST layer to resolve.
+func projectValue(v interface{}, proj query.Projection) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return projectPayload(t, proj)
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = projectValue(e, proj)
+		}
+		return l
+	default:
+		return v
+	}
+}
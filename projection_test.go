@@ -0,0 +1,69 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestProjectPayload(t *testing.T) {
+	payload := map[string]interface{}{
+		"id":    "1",
+		"name":  "john",
+		"email": "john@example.com",
+		"address": map[string]interface{}{
+			"city":   "Paris",
+			"street": "rue de Rivoli",
+		},
+		"phones": []interface{}{
+			map[string]interface{}{"type": "home", "number": "1234"},
+			map[string]interface{}{"type": "work", "number": "5678"},
+		},
+		"owner": "u1",
+	}
+	tests := []struct {
+		proj string
+		want map[string]interface{}
+	}{
+		{"name", map[string]interface{}{"name": "john"}},
+		{"n:name,address{city}", map[string]interface{}{
+			"name":    "john",
+			"address": map[string]interface{}{"city": "Paris"},
+		}},
+		{"phones{number}", map[string]interface{}{
+			"phones": []interface{}{
+				map[string]interface{}{"number": "1234"},
+				map[string]interface{}{"number": "5678"},
+			},
+		}},
+		{"a:address{city},b:address{street}", map[string]interface{}{
+			"address": map[string]interface{}{"city": "Paris", "street": "rue de Rivoli"},
+		}},
+		{"a:address{city},address", map[string]interface{}{
+			"address": payload["address"],
+		}},
+		{"owner{name},missing", map[string]interface{}{"owner": "u1"}},
+	}
+	for _, tt := range tests {
+		got := projectPayload(payload, query.MustParseProjection(tt.proj))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.proj, got, tt.want)
+		}
+	}
+}
+
+func TestProjectPayloadStar(t *testing.T) {
+	payload := map[string]interface{}{
+		"name":    "john",
+		"address": map[string]interface{}{"city": "Paris", "street": "rue de Rivoli"},
+	}
+	got := projectPayload(payload, query.MustParseProjection("*{city}"))
+	want := map[string]interface{}{
+		"name":    "john",
+		"address": map[string]interface{}{"city": "Paris"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
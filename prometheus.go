@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusMetrics implements Metrics with Prometheus collectors labelled by
+// kind, namespace, operation and error code. A single instance should be
+// shared by the handlers of a registry.
+type PrometheusMetrics struct {
+	latency *prometheus.HistogramVec
+	errors  *prometheus.CounterVec
+	items   *prometheus.HistogramVec
+	batches *prometheus.HistogramVec
+	shadows *prometheus.CounterVec
+	sizes   *prometheus.HistogramVec
+	largest *prometheus.HistogramVec
+	cache   *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics creates the collectors of the storage metrics and
+// registers them with reg:
+//
+//   - datastore_operation_duration_seconds, the latency of the operations,
+//   - datastore_operation_errors_total, the failed operations by error code,
+//   - datastore_operation_items, the number of items of the operations,
+//   - datastore_commit_mutations, the number of mutations of the commits,
+//   - datastore_shadow_reads_total, the shadow reads by result,
+//   - datastore_entity_bytes, the estimated size of the written entities,
+//   - datastore_entity_largest_property_bytes, the size of their largest
+//     property, by property,
+//   - datastore_cache_events_total, the cache hits, misses, admissions and
+//     evictions, by entry and event.
+func NewPrometheusMetrics(reg prometheus.Registerer) (*PrometheusMetrics, error) {
+	m := &PrometheusMetrics{
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "datastore_operation_duration_seconds",
+			Help:    "Latency of the Datastore storage operations.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"kind", "namespace", "op", "code"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "datastore_operation_errors_total",
+			Help: "Failed Datastore storage operations.",
+		}, []string{"kind", "namespace", "op", "code"}),
+		items: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "datastore_operation_items",
+			Help:    "Items written, deleted or returned by the Datastore storage operations.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}, []string{"kind", "namespace", "op"}),
+		batches: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "datastore_commit_mutations",
+			Help:    "Mutations per Datastore commit.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{"kind", "namespace"}),
+		shadows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "datastore_shadow_reads_total",
+			Help: "Shadow reads by result.",
+		}, []string{"kind", "namespace", "result"}),
+		sizes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "datastore_entity_bytes",
+			Help:    "Estimated size of the written Datastore entities.",
+			Buckets: prometheus.ExponentialBuckets(1024, 2, 11),
+		}, []string{"kind", "namespace"}),
+		largest: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "datastore_entity_largest_property_bytes",
+			Help:    "Estimated size of the largest property of the written Datastore entities.",
+			Buckets: prometheus.ExponentialBuckets(1024, 2, 11),
+		}, []string{"kind", "namespace", "property"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "datastore_cache_events_total",
+			Help: "Cache events by entry and event.",
+		}, []string{"kind", "namespace", "entry", "event"}),
+	}
+	for _, c := range []prometheus.Collector{m.latency, m.errors, m.items, m.batches, m.shadows, m.sizes, m.largest, m.cache} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ObserveOperation implements Metrics.
+func (m *PrometheusMetrics) ObserveOperation(kind, namespace, op, code string, latency time.Duration, items int) {
+	m.latency.WithLabelValues(kind, namespace, op, code).Observe(latency.Seconds())
+	if code != "OK" {
+		m.errors.WithLabelValues(kind, namespace, op, code).Inc()
+		return
+	}
+	m.items.WithLabelValues(kind, namespace, op).Observe(float64(items))
+}
+
+// ObserveBatch implements Metrics.
+func (m *PrometheusMetrics) ObserveBatch(kind, namespace string, mutations int) {
+	m.batches.WithLabelValues(kind, namespace).Observe(float64(mutations))
+}
+
+// ObserveShadowRead implements ShadowMetrics.
+func (m *PrometheusMetrics) ObserveShadowRead(kind, namespace, result string) {
+	m.shadows.WithLabelValues(kind, namespace, result).Inc()
+}
+
+// ObserveEntitySize implements SizeMetrics.
+func (m *PrometheusMetrics) ObserveEntitySize(kind, namespace string, size int, largest PropertySize) {
+	m.sizes.WithLabelValues(kind, namespace).Observe(float64(size))
+	m.largest.WithLabelValues(kind, namespace, largest.Name).Observe(float64(largest.Size))
+}
+
+// ObserveCache implements CacheMetrics.
+func (m *PrometheusMetrics) ObserveCache(kind, namespace, entry, event string) {
+	m.cache.WithLabelValues(kind, namespace, entry, event).Inc()
+}
@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// notifyTimeout bounds the time spent publishing the notifications of a
+// mutation, including their fallback write.
+const notifyTimeout = time.Minute
+
+// Notification is the message published to Pub/Sub after a successful
+// mutation.
+type Notification struct {
+	Kind string `json:"kind" datastore:"kind,noindex"`
+	// Op is one of ChangeInsert, ChangeUpdate or ChangeDelete.
+	Op   string `json:"op" datastore:"op,noindex"`
+	ID   string `json:"id" datastore:"id,noindex"`
+	ETag string `json:"etag,omitempty" datastore:"etag,noindex"`
+}
+
+// SetPubSub publishes a Notification to topic after every successful Insert,
+// Update, Delete and Clear. Messages carry the JSON encoded notification, and
+// its kind, op and id as attributes. The mutation waits for the messages to
+// be acknowledged by Pub/Sub. With outbox set, messages which can't be
+// published are saved to the outbox kind, <kind>_outbox unless set by
+// SetOutbox, to be published later by RetryNotifications, so no notification
+// is lost. Remaining errors are passed to onError if not nil; they never fail
+// the mutation, which already succeeded.
+//
+// When the outbox is written in the mutation transactions with SetOutbox,
+// notifications are only published by RetryNotifications.
+func (d *Handler) SetPubSub(topic *pubsub.Topic, outbox bool, onError func(error)) *Handler {
+	d.topic = topic
+	d.notifyError = onError
+	if outbox && d.outboxKind == "" {
+		d.outboxKind = d.entity + "_outbox"
+	}
+	return d
+}
+
+// notify publishes the notifications of a successful mutation.
+func (d *Handler) notify(ctx context.Context, op string, ids, etags []string) {
+	if d.topic == nil || d.outboxTx || len(ids) == 0 {
+		return
+	}
+	// The mutation is done, the notifications must not be lost if the
+	// request is canceled
+	ctx, cancel := context.WithTimeout(detach(ctx), notifyTimeout)
+	defer cancel()
+	notes := make([]Notification, len(ids))
+	results := make([]*pubsub.PublishResult, len(ids))
+	for i, id := range ids {
+		notes[i] = Notification{Kind: d.entity, Op: op, ID: id}
+		if etags != nil {
+			notes[i].ETag = etags[i]
+		}
+		results[i] = d.publish(ctx, notes[i])
+	}
+	var failed []Notification
+	var err error
+	for i, r := range results {
+		if _, perr := r.Get(ctx); perr != nil {
+			failed = append(failed, notes[i])
+			err = perr
+		}
+	}
+	if len(failed) > 0 && d.outboxKind != "" {
+		err = d.saveOutbox(ctx, failed)
+	}
+	if err != nil && d.notifyError != nil {
+		d.notifyError(err)
+	}
+}
+
+func (d *Handler) publish(ctx context.Context, n Notification) *pubsub.PublishResult {
+	data, _ := json.Marshal(n)
+	return d.topic.Publish(ctx, &pubsub.Message{
+		Data: data,
+		Attributes: map[string]string{
+			"kind": n.Kind,
+			"op":   n.Op,
+			"id":   n.ID,
+		},
+	})
+}
+
+// RetryNotifications publishes the notifications waiting in the outbox and
+// acknowledges them once published, until the outbox is empty. It returns the
+// number of published notifications.
+func (d *Handler) RetryNotifications(ctx context.Context) (int, error) {
+	if d.topic == nil || d.outboxKind == "" {
+		return 0, nil
+	}
+	published := 0
+	for {
+		events, err := d.Drain(ctx, MaxMutations, notifyTimeout)
+		if err != nil || len(events) == 0 {
+			return published, err
+		}
+		results := make([]*pubsub.PublishResult, len(events))
+		for i, e := range events {
+			results[i] = d.publish(ctx, e.Notification)
+		}
+		acked := make([]*OutboxEvent, 0, len(events))
+		for i, r := range results {
+			if _, err = r.Get(ctx); err == nil {
+				acked = append(acked, events[i])
+			}
+		}
+		if aerr := d.Ack(ctx, acked); aerr != nil {
+			return published, aerr
+		}
+		published += len(acked)
+		if err != nil {
+			return published, err
+		}
+	}
+}
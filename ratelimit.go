@@ -0,0 +1,44 @@
+package datastore
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// SetRateLimit caps the rate of the Datastore requests of the handler to qps
+// units per second, with bursts of up to burst units, so bulk endpoints and
+// Clear can't exhaust shared quotas or the write rate of entity groups.
+// Commits cost a unit per mutation, lookups a unit per key, and transactions
+// and query runs a unit each. Calls wait for their units, failing when the
+// request context would expire first. Handlers can share a limit by sharing
+// the limiter given to SetRateLimiter. A qps of zero or less removes the
+// limit.
+func (d *Handler) SetRateLimit(qps float64, burst int) *Handler {
+	if qps <= 0 {
+		return d.SetRateLimiter(nil)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return d.SetRateLimiter(rate.NewLimiter(rate.Limit(qps), burst))
+}
+
+// SetRateLimiter caps the rate of the Datastore requests of the handler with
+// l, which may be shared by several handlers. A nil l removes the limit.
+func (d *Handler) SetRateLimiter(l *rate.Limiter) *Handler {
+	d.limiter = l
+	return d
+}
+
+// throttle waits until n units can be spent.
+func (d *Handler) throttle(ctx context.Context, n int) error {
+	l := d.limiter
+	if l == nil {
+		return nil
+	}
+	if b := l.Burst(); n > b {
+		n = b
+	}
+	return l.WaitN(ctx, n)
+}
@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+)
+
+// rewriteBatchSize is the number of entities rewritten per transaction by
+// RewriteReferences.
+const rewriteBatchSize = 100
+
+// RewriteReferences points the references to oldID held by field to newID,
+// for instance after merging two duplicate referenced resources. Entities
+// are found with an equality filter on field, so list fields are rewritten
+// too, and updated in batched transactions with a recomputed etag. It returns
+// the number of rewritten entities.
+func (d *Handler) RewriteReferences(ctx context.Context, field string, oldID, newID interface{}) (int, error) {
+	if err := d.checkFence(ctx); err != nil {
+		return 0, err
+	}
+	if !d.queryable(field) {
+		return 0, fmt.Errorf("field %s is not stored as a property and can't be searched", field)
+	}
+	value, err := d.encodeFilterValue(field, oldID, false)
+	if err != nil {
+		return 0, err
+	}
+	qry := datastore.NewQuery(d.entity).
+		Namespace(d.getNamespace(ctx)).
+		Filter(field+" =", value)
+	var keys []*datastore.Key
+	err = StreamKeys(ctx, d.client, qry, func(key *datastore.Key) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	err = d.withDeadline(ctx, "rewrite", func(ctx context.Context) error {
+		for len(keys) > 0 {
+			n := len(keys)
+			if n > rewriteBatchSize {
+				n = rewriteBatchSize
+			}
+			if err := d.rewriteChunk(ctx, keys[:n], field, oldID, newID); err != nil {
+				return err
+			}
+			rewritten += n
+			keys = keys[n:]
+		}
+		return nil
+	})
+	if rewritten > 0 {
+		// The rewritten ids are not tracked, drop all the cached items
+		d.invalidateCache(nil)
+	}
+	return rewritten, err
+}
+
+func (d *Handler) rewriteChunk(ctx context.Context, keys []*datastore.Key, field string, oldID, newID interface{}) error {
+	written := make([]*resource.Item, len(keys))
+	err := d.runTx(ctx, func(tx Transaction) error {
+		current := make([]Entity, len(keys))
+		if err := tx.GetMulti(keys, current); err != nil {
+			return err
+		}
+		entities := make([]*Entity, len(keys))
+		var records []*datastore.Mutation
+		for i := range current {
+			stored, err := d.loadItem(ctx, &current[i])
+			if err != nil {
+				return err
+			}
+			stored.Payload[field] = replaceReference(stored.Payload[field], oldID, newID)
+			item, err := resource.NewItem(stored.Payload)
+			if err != nil {
+				return err
+			}
+			if item, err = d.computeFields(item); err != nil {
+				return err
+			}
+			if entities[i], err = d.prepareEntity(ctx, keys[i], item, false); err != nil {
+				return err
+			}
+			written[i] = item
+			d.stampAudit(ctx, entities[i], &current[i])
+			records = append(records, d.recordMutations(keys[i], ChangeUpdate, current[i].ETag, item.ETag)...)
+		}
+		if _, err := tx.PutMulti(keys, entities); err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			_, err := tx.Mutate(records...)
+			return err
+		}
+		return nil
+	})
+	if err == nil {
+		d.logOps(ctx, ChangeUpdate, written, nil)
+	}
+	return err
+}
+
+// replaceReference replaces oldID by newID in value, a single reference or a
+// list of references.
+func replaceReference(value, oldID, newID interface{}) interface{} {
+	if l, ok := value.([]interface{}); ok {
+		r := make([]interface{}, len(l))
+		for i, v := range l {
+			r[i] = replaceReference(v, oldID, newID)
+		}
+		return r
+	}
+	if equalValues(value, oldID) {
+		return newID
+	}
+	return value
+}
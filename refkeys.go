@@ -0,0 +1,69 @@
+package datastore
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema"
+)
+
+// SetReferenceKinds stores the values of schema.Reference fields as Datastore
+// keys, for the referenced resources listed in kinds by path with the kind
+// their handler stores. Keys are converted back to the referenced ids on load
+// and filter values on those fields are converted to keys as well, enabling
+// key filters and joins from Datastore tools. It requires the schema bound
+// with SetSchema.
+//
+// Reference keys are built without a namespace, the referenced entity living
+// in the namespace of the request.
+func (d *Handler) SetReferenceKinds(kinds map[string]string) *Handler {
+	d.referenceKinds = kinds
+	return d
+}
+
+// referenceCodec converts reference ids to keys of kind.
+type referenceCodec struct {
+	kind string
+}
+
+// Encode implements ValueCodec.
+func (c referenceCodec) Encode(value interface{}) (interface{}, error) {
+	switch t := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return datastore.NameKey(c.kind, t, nil), nil
+	case int:
+		return datastore.IDKey(c.kind, int64(t), nil), nil
+	case int64:
+		return datastore.IDKey(c.kind, t, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported reference id type %T", value)
+}
+
+// Decode implements ValueCodec.
+func (c referenceCodec) Decode(value interface{}) (interface{}, error) {
+	k, ok := value.(*datastore.Key)
+	if !ok {
+		// Values written before the references were stored as keys
+		return value, nil
+	}
+	if k.Name != "" {
+		return k.Name, nil
+	}
+	return k.ID, nil
+}
+
+// referenceCodec returns the codec of the reference validated by v, if its
+// resource is stored as keys.
+func (d *Handler) referenceCodec(v schema.FieldValidator) (ValueCodec, bool) {
+	r, ok := v.(*schema.Reference)
+	if !ok {
+		return nil, false
+	}
+	kind, found := d.referenceKinds[r.Path]
+	if !found {
+		return nil, false
+	}
+	return referenceCodec{kind: kind}, true
+}
@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema"
+)
+
+func TestReferenceKinds(t *testing.T) {
+	s := &schema.Schema{Fields: schema.Fields{
+		"owner":    {Validator: &schema.Reference{Path: "users"}},
+		"tags":     {Validator: &schema.Array{Values: schema.Field{Validator: &schema.Reference{Path: "tags"}}}},
+		"category": {Validator: &schema.Reference{Path: "categories"}},
+	}}
+	h := NewHandler(nil, "", "posts").
+		SetSchema(s).
+		SetReferenceKinds(map[string]string{"users": "User", "tags": "Tag"})
+	item := &resource.Item{ID: "1", Payload: map[string]interface{}{
+		"id":       "1",
+		"owner":    "alice",
+		"tags":     []interface{}{"go", "db"},
+		"category": "news",
+	}}
+	encoded, err := h.encodeItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := encoded.Payload["owner"].(*datastore.Key); !ok || k.Kind != "User" || k.Name != "alice" {
+		t.Errorf("owner: got %v", encoded.Payload["owner"])
+	}
+	tags := encoded.Payload["tags"].([]interface{})
+	if k, ok := tags[1].(*datastore.Key); !ok || k.Kind != "Tag" || k.Name != "db" {
+		t.Errorf("tags: got %v", tags)
+	}
+	if encoded.Payload["category"] != "news" {
+		t.Errorf("category: got %v", encoded.Payload["category"])
+	}
+	if err := h.decodeValues(encoded.Payload, ""); err != nil {
+		t.Fatal(err)
+	}
+	if encoded.Payload["owner"] != "alice" || encoded.Payload["tags"].([]interface{})[0] != "go" {
+		t.Errorf("decoded: got %v", encoded.Payload)
+	}
+	v, err := h.encodeFilterValue("tags", []interface{}{"go"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := v.([]interface{})[0].(*datastore.Key); !ok || k.Name != "go" {
+		t.Errorf("filter: got %v", v)
+	}
+}
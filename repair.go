@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// repairQueueSize bounds the number of entities waiting for read repair.
+// Entities found while the queue is full are repaired on a later read.
+const repairQueueSize = 100
+
+// SetReadRepair enables writing back the synthesized meta properties of legacy
+// entities found missing _etag or _updated when loaded, so the dataset
+// converges to the handler conventions without a dedicated migration. Repairs
+// run in the background, at most one every interval.
+func (d *Handler) SetReadRepair(interval time.Duration) *Handler {
+	d.repairInterval = interval
+	return d
+}
+
+// scheduleRepair queues the entity with id for read repair, if enabled.
+func (d *Handler) scheduleRepair(ctx context.Context, id string) {
+	if d.repairInterval <= 0 {
+		return
+	}
+	d.repairOnce.Do(func() {
+		d.repairKeys = make(chan *datastore.Key, repairQueueSize)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			d.repairLoop(ctx)
+		}()
+		d.startedWorker(func() {
+			cancel()
+			<-done
+		})
+	})
+	key := datastore.NameKey(d.entity, id, nil)
+	key.Namespace = d.getNamespace(ctx)
+	select {
+	case d.repairKeys <- key:
+	default:
+	}
+}
+
+// repairLoop repairs the queued entities, throttled by the repair interval,
+// until ctx is done. Entities still queued are repaired on a later read.
+func (d *Handler) repairLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key := <-d.repairKeys:
+			d.repair(ctx, key)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.repairInterval):
+		}
+	}
+}
+
+// repair writes the synthesized meta properties of a legacy entity back.
+// Errors are ignored as the entity will be queued again on its next read.
+func (d *Handler) repair(ctx context.Context, key *datastore.Key) error {
+	if err := d.checkFence(ctx); err != nil {
+		return err
+	}
+	return d.runTx(ctx, func(tx Transaction) error {
+		var e Entity
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		if !e.Legacy {
+			// Already repaired or updated
+			return nil
+		}
+		if e.Updated.IsZero() {
+			e.Updated = d.now()
+		}
+		_, err := tx.Put(key, d.configureEntity(&e))
+		return err
+	})
+}
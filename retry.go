@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy configures the retries of the Datastore calls failing with a
+// transient error.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts of a call, the first one
+	// included.
+	Attempts int
+	// InitialBackoff is the wait before the first retry, multiplied by
+	// Multiplier before each of the next ones, up to MaxBackoff. Waits are
+	// jittered between half and all of their value.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+// DefaultRetryPolicy is a retry policy suitable for most handlers.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       4,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+}
+
+// SetRetryPolicy retries the transactions, commits, lookups and queries of the
+// handler failing with UNAVAILABLE, DEADLINE_EXCEEDED or ABORTED according to
+// p, with jittered exponential backoff. Retries stop when the request context
+// is done or its deadline would be reached during the wait. Non-transactional
+// commits which may have been applied, such as those of Insert, are only
+// retried when ABORTED. Queries are run again from the start. A nil p
+// disables retries.
+func (d *Handler) SetRetryPolicy(p *RetryPolicy) *Handler {
+	d.retryPolicy = p
+	return d
+}
+
+// retryable returns whether a call failing with err can be retried. Calls
+// which are not idempotent are only retried when they were not applied.
+func retryable(err error, idempotent bool) bool {
+	switch status.Code(err) {
+	case codes.Aborted:
+		return true
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return idempotent
+	}
+	return false
+}
+
+// backoff returns the jittered wait before the retry following attempt.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		wait *= p.Multiplier
+		if wait >= float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+	return time.Duration(wait/2 + rand.Float64()*wait/2)
+}
+
+// retry calls f until it succeeds, fails with an error which can't be retried
+// or the retry policy gives up. Calls are refused while the circuit breaker
+// is open, which is timed with the wall clock rather than the handler clock.
+func (d *Handler) retry(ctx context.Context, idempotent bool, f func() error) error {
+	p := d.retryPolicy
+	for attempt := 1; ; attempt++ {
+		if err := d.breaker.allow(d.entity, time.Now()); err != nil {
+			return err
+		}
+		err := f()
+		d.breaker.record(err, time.Now())
+		if err == nil || p == nil || attempt >= p.Attempts || !retryable(err, idempotent) {
+			return err
+		}
+		wait := p.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// DefaultTxAttempts is the default number of attempts of the transactions
+// failing because of a concurrent transaction.
+const DefaultTxAttempts = 3
+
+// SetTxAttempts sets the number of times the transactions of Update, Delete
+// and the other transactional operations are attempted when they fail because
+// of contention with a concurrent transaction, DefaultTxAttempts by default.
+// Once attempts are exhausted, operations return resource.ErrConflict.
+func (d *Handler) SetTxAttempts(attempts int) *Handler {
+	d.txAttempts = attempts
+	return d
+}
+
+// runTx runs f in a transaction with the attempts and retry policy of the
+// handler, translating contention into resource.ErrConflict.
+func (d *Handler) runTx(ctx context.Context, f func(tx Transaction) error) error {
+	attempts := d.txAttempts
+	if attempts < 1 {
+		attempts = DefaultTxAttempts
+	}
+	err := d.retry(ctx, true, func() error {
+		if err := d.throttle(ctx, 1); err != nil {
+			return err
+		}
+		return RunWithRetryableTx(ctx, d.client, attempts, f)
+	})
+	if err == datastore.ErrConcurrentTransaction {
+		return resource.ErrConflict
+	}
+	return err
+}
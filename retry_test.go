@@ -0,0 +1,44 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBackoff(t *testing.T) {
+	p := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond, Multiplier: 2}
+	for attempt, limit := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 300 * time.Millisecond, 4: 300 * time.Millisecond} {
+		if b := p.backoff(attempt); b < limit/2 || b > limit {
+			t.Errorf("backoff(%d) = %s, expected between %s and %s", attempt, b, limit/2, limit)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	h := NewHandler(nil, "", "users").SetRetryPolicy(&RetryPolicy{Attempts: 3, InitialBackoff: time.Millisecond, Multiplier: 1})
+	unavailable := status.Error(codes.Unavailable, "down")
+	calls := 0
+	err := h.retry(context.Background(), true, func() error {
+		calls++
+		if calls < 3 {
+			return unavailable
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected 3 calls and success, got %d calls and %v", calls, err)
+	}
+	calls = 0
+	if err = h.retry(context.Background(), false, func() error { calls++; return unavailable }); err != unavailable || calls != 1 {
+		t.Errorf("expected non idempotent calls not to be retried, got %d calls", calls)
+	}
+	calls = 0
+	if err = h.retry(context.Background(), true, func() error { calls++; return errors.New("fatal") }); calls != 1 {
+		t.Errorf("expected permanent errors not to be retried, got %d calls", calls)
+	}
+}
@@ -0,0 +1,218 @@
+package datastore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// rotateBatchSize is the number of entities rotated per transaction.
+const rotateBatchSize = 100
+
+// VersionedKeyProvider is a KeyProvider whose wrapping key has a version.
+// Values encrypted with it are tagged with the version, so they can be
+// decrypted once it is replaced and found by RotateKeys.
+type VersionedKeyProvider interface {
+	KeyProvider
+	// KeyVersion identifies the wrapping key, up to 255 bytes.
+	KeyVersion() string
+}
+
+// AddDecryptionKeys registers previous versions of the key provider set with
+// SetEncryptedFields, used to decrypt the values tagged with their version
+// until they are rotated.
+func (d *Handler) AddDecryptionKeys(kps ...VersionedKeyProvider) *Handler {
+	if d.decryptionKeys == nil {
+		d.decryptionKeys = map[string]KeyProvider{}
+	}
+	for _, kp := range kps {
+		d.decryptionKeys[kp.KeyVersion()] = kp
+	}
+	return d
+}
+
+// keyVersion returns the version of kp, empty if it is not versioned.
+func keyVersion(kp KeyProvider) string {
+	if v, ok := kp.(VersionedKeyProvider); ok {
+		return v.KeyVersion()
+	}
+	return ""
+}
+
+// decryptionKey returns the key provider of the values tagged with version.
+func (d *Handler) decryptionKey(version string) KeyProvider {
+	if version != "" && version != keyVersion(d.keyProvider) {
+		if kp, found := d.decryptionKeys[version]; found {
+			return kp
+		}
+	}
+	return d.keyProvider
+}
+
+// envelopeHeader returns the header of an encrypted value holding wrapped.
+func envelopeHeader(version string, wrapped []byte) []byte {
+	var b []byte
+	if version == "" {
+		b = []byte{encryptedVersion}
+	} else {
+		b = append([]byte{taggedVersion, byte(len(version))}, version...)
+	}
+	b = append(b, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(wrapped)))
+	return append(b, wrapped...)
+}
+
+// parseEnvelope splits an encrypted value into its key version, wrapped key
+// and the nonce and ciphertext.
+func parseEnvelope(b []byte) (string, []byte, []byte, error) {
+	version := ""
+	switch {
+	case len(b) > 1 && b[0] == taggedVersion:
+		n := int(b[1])
+		if len(b) < 2+n {
+			return "", nil, nil, ErrInvalidCiphertext
+		}
+		version, b = string(b[2:2+n]), b[2+n:]
+	case len(b) > 0 && b[0] == encryptedVersion:
+		b = b[1:]
+	default:
+		return "", nil, nil, ErrInvalidCiphertext
+	}
+	if len(b) < 2 {
+		return "", nil, nil, ErrInvalidCiphertext
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, nil, ErrInvalidCiphertext
+	}
+	return version, b[2 : 2+n], b[2+n:], nil
+}
+
+// RotateKeys rewraps the data encryption keys of the encrypted fields of the
+// items matching q from oldKey to newKey, in transactions of rotateBatchSize
+// entities, and returns the number of rotated entities. The ciphertexts and
+// etags are left unchanged, so items can be served and updated meanwhile,
+// provided the handler can decrypt both versions, for instance with newKey
+// set by SetEncryptedFields and oldKey added with AddDecryptionKeys.
+//
+// Values tagged with another version than oldKey are skipped, as well as
+// untagged values, written before versioning, which oldKey can't unwrap, so
+// an interrupted rotation can simply be run again.
+func (d *Handler) RotateKeys(ctx context.Context, q *query.Query, oldKey, newKey KeyProvider) (int, error) {
+	if err := d.checkFence(ctx); err != nil {
+		return 0, err
+	}
+	qry, err := d.getQuery(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	var keys []*datastore.Key
+	err = StreamKeys(ctx, d.client, qry.KeysOnly(), func(key *datastore.Key) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > rotateBatchSize {
+			n = rotateBatchSize
+		}
+		r, err := d.rotateChunk(ctx, keys[:n], oldKey, newKey)
+		rotated += r
+		if err != nil {
+			return rotated, err
+		}
+		keys = keys[n:]
+	}
+	return rotated, nil
+}
+
+func (d *Handler) rotateChunk(ctx context.Context, keys []*datastore.Key, oldKey, newKey KeyProvider) (int, error) {
+	rotated := 0
+	err := d.runTx(ctx, func(tx Transaction) error {
+		rotated = 0
+		entities := make([]Entity, len(keys))
+		if err := tx.GetMulti(keys, entities); err != nil {
+			return err
+		}
+		var changed []*datastore.Key
+		var puts []*Entity
+		for i := range entities {
+			e := &entities[i]
+			modified := false
+			// The fields of an item share their data key, which is
+			// rewrapped once so reads keep unwrapping a single key
+			rewrapped := map[string][]byte{}
+			for _, f := range d.encryptedFields {
+				v, ok, err := rewrap(ctx, e.Payload[f], oldKey, newKey, rewrapped)
+				if err != nil {
+					return err
+				}
+				if ok {
+					e.Payload[f] = v
+					modified = true
+				}
+			}
+			if modified {
+				changed = append(changed, keys[i])
+				puts = append(puts, d.configureEntity(e))
+			}
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		rotated = len(changed)
+		_, err := tx.PutMulti(changed, puts)
+		return err
+	})
+	return rotated, err
+}
+
+// rewrap returns the encrypted value v with its data key wrapped by newKey
+// instead of oldKey, or false if v is not wrapped by oldKey. Rewrapped holds
+// the keys already rewrapped, by their old wrapped form.
+func rewrap(ctx context.Context, v interface{}, oldKey, newKey KeyProvider, rewrapped map[string][]byte) (interface{}, bool, error) {
+	var b []byte
+	switch t := v.(type) {
+	case []byte:
+		b = t
+	case string:
+		// Encoded as base64 in JSON blobs
+		var err error
+		if b, err = base64.StdEncoding.DecodeString(t); err != nil {
+			return nil, false, nil
+		}
+	default:
+		return nil, false, nil
+	}
+	version, wrapped, rest, err := parseEnvelope(b)
+	if err != nil {
+		return nil, false, nil
+	}
+	if version != "" && version != keyVersion(oldKey) {
+		return nil, false, nil
+	}
+	if w, found := rewrapped[string(wrapped)]; found {
+		return append(envelopeHeader(keyVersion(newKey), w), rest...), true, nil
+	}
+	key, err := oldKey.UnwrapKey(ctx, wrapped)
+	if err != nil {
+		if version == "" {
+			// Untagged values may have been wrapped by another key
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	w, err := newKey.WrapKey(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	rewrapped[string(wrapped)] = w
+	return append(envelopeHeader(keyVersion(newKey), w), rest...), true, nil
+}
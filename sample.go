@@ -0,0 +1,68 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"cloud.google.com/go/datastore"
+)
+
+// MaxSampleRate is the largest sampling rate supported by sampled finds.
+const MaxSampleRate = 1024
+
+// sampleProperty is the name of the multi-valued property holding the key hash
+// residues used to select samples.
+const sampleProperty = "_sample"
+
+// WithSample returns a context making Find return a deterministic sample of
+// roughly one in n matching entities, selected by the hash of their key
+// modulo n. The rate n must be a power of two between 2 and MaxSampleRate, and
+// the handler must have sampling enabled with SetSampling when the entities
+// were written.
+func WithSample(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, sampleCtxKey, n)
+}
+
+// sampleRate returns the sampling rate set in the context or 0.
+func sampleRate(ctx context.Context) int {
+	n, _ := ctx.Value(sampleCtxKey).(int)
+	return n
+}
+
+// SetSampling enables writing the sample property needed by sampled finds.
+// Entities written before sampling was enabled are never part of a sample.
+func (d *Handler) SetSampling(enabled bool) *Handler {
+	d.sampling = enabled
+	return d
+}
+
+// sampleValue formats the residue r of the key hash modulo n.
+func sampleValue(n int, r uint32) string {
+	return fmt.Sprintf("%d:%d", n, r)
+}
+
+// sampleValues returns the key hash residues modulo every supported rate, so a
+// sample can be selected with a single equality filter.
+func sampleValues(id string) []interface{} {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	sum := h.Sum32()
+	var v []interface{}
+	for n := 2; n <= MaxSampleRate; n *= 2 {
+		v = append(v, sampleValue(n, sum%uint32(n)))
+	}
+	return v
+}
+
+// applySample restricts qry to the sample requested in ctx if any.
+func applySample(ctx context.Context, qry *datastore.Query) (*datastore.Query, error) {
+	n := sampleRate(ctx)
+	if n == 0 {
+		return qry, nil
+	}
+	if n < 2 || n > MaxSampleRate || n&(n-1) != 0 {
+		return nil, fmt.Errorf("invalid sample rate %d: must be a power of two between 2 and %d", n, MaxSampleRate)
+	}
+	return qry.Filter(sampleProperty+" =", sampleValue(n, 0)), nil
+}
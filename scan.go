@@ -0,0 +1,171 @@
+package datastore
+
+import (
+	"context"
+	"sort"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"google.golang.org/api/iterator"
+)
+
+// scatterOversampling is the number of scatter keys sampled per shard to
+// compute the split points of a parallel scan.
+const scatterOversampling = 32
+
+// ScanIterator iterates over the items of one shard of a parallel scan.
+type ScanIterator struct {
+	d   *Handler
+	ctx context.Context
+	qry *datastore.Query
+	it  Iterator
+}
+
+// Next returns the next item of the shard, or iterator.Done when the shard
+// is exhausted.
+func (s *ScanIterator) Next() (*resource.Item, error) {
+	if s.it == nil {
+		s.it = s.d.client.Run(s.ctx, s.qry)
+	}
+	for {
+		e := Entity{Omit: s.d.omittedFields(s.ctx)}
+		if _, err := s.it.Next(&e); err != nil {
+			return nil, err
+		}
+		if s.d.expired(&e) {
+			continue
+		}
+		return s.d.loadItem(s.ctx, &e)
+	}
+}
+
+// ParallelScan splits the items matching the predicate of q into at most
+// shards disjoint key ranges and returns an independent iterator for each,
+// so they can be processed concurrently at full throughput. Split points are
+// sampled with the __scatter__ property, so shards are roughly balanced.
+//
+// Items are returned in key order within a shard. The sort and window of q
+// are not supported, nor are inequality filters, which can't be combined with
+// the key range filters.
+func (d *Handler) ParallelScan(ctx context.Context, q *query.Query, shards int) ([]*ScanIterator, error) {
+	if len(q.Sort) > 0 || q.Window != nil {
+		return nil, resource.ErrNotImplemented
+	}
+	p, ok, err := d.normalizePredicate(q.Predicate)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	base, err := d.getQuery(ctx, &query.Query{Predicate: p})
+	if err != nil {
+		return nil, err
+	}
+	splits, err := d.splitPoints(ctx, shards)
+	if err != nil {
+		return nil, err
+	}
+	its := make([]*ScanIterator, 0, len(splits)+1)
+	for i := 0; i <= len(splits); i++ {
+		qry := base
+		if i > 0 {
+			qry = qry.Filter("__key__ >=", splits[i-1])
+		}
+		if i < len(splits) {
+			qry = qry.Filter("__key__ <", splits[i])
+		}
+		its = append(its, &ScanIterator{d: d, ctx: ctx, qry: qry.Order("__key__")})
+	}
+	return its, nil
+}
+
+// splitPoints returns at most shards-1 sorted keys splitting the kind in
+// ranges of similar sizes.
+func (d *Handler) splitPoints(ctx context.Context, shards int) ([]*datastore.Key, error) {
+	return SplitPoints(ctx, d.client, d.getNamespace(ctx), d.entity, shards)
+}
+
+// SplitPoints returns at most shards-1 sorted keys splitting the entities of
+// kind in namespace in key ranges of similar sizes, sampled with the
+// __scatter__ property.
+func SplitPoints(ctx context.Context, client Client, namespace, kind string, shards int) ([]*datastore.Key, error) {
+	if shards < 2 {
+		return nil, nil
+	}
+	qry := datastore.NewQuery(kind).
+		Namespace(namespace).
+		Order("__scatter__").
+		Limit(shards * scatterOversampling).
+		KeysOnly()
+	var keys []*datastore.Key
+	err := StreamKeys(ctx, client, qry, func(key *datastore.Key) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil && err != iterator.Done {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compareKeys(keys[i], keys[j]) < 0
+	})
+	return pickSplits(keys, shards), nil
+}
+
+// pickSplits picks shards-1 evenly spaced distinct keys from sorted keys.
+func pickSplits(keys []*datastore.Key, shards int) []*datastore.Key {
+	var splits []*datastore.Key
+	for i := 1; i < shards; i++ {
+		j := i * len(keys) / shards
+		if j >= len(keys) {
+			break
+		}
+		if len(splits) > 0 && compareKeys(splits[len(splits)-1], keys[j]) >= 0 {
+			continue
+		}
+		splits = append(splits, keys[j])
+	}
+	return splits
+}
+
+// compareKeys compares keys in Datastore order: ancestors first, then kind,
+// then ids before names.
+func compareKeys(a, b *datastore.Key) int {
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+		if x.Kind != y.Kind {
+			if x.Kind < y.Kind {
+				return -1
+			}
+			return 1
+		}
+		switch {
+		case x.Name == "" && y.Name != "":
+			return -1
+		case x.Name != "" && y.Name == "":
+			return 1
+		case x.Name != y.Name:
+			if x.Name < y.Name {
+				return -1
+			}
+			return 1
+		case x.ID != y.ID:
+			if x.ID < y.ID {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+// keyPath returns the path of k from its root ancestor.
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
@@ -0,0 +1,47 @@
+package datastore
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestCompareKeys(t *testing.T) {
+	parent := datastore.NameKey("a", "p", nil)
+	tests := []struct {
+		a, b *datastore.Key
+		want int
+	}{
+		{datastore.NameKey("k", "a", nil), datastore.NameKey("k", "b", nil), -1},
+		{datastore.IDKey("k", 10, nil), datastore.NameKey("k", "a", nil), -1},
+		{datastore.IDKey("k", 10, nil), datastore.IDKey("k", 9, nil), 1},
+		{parent, datastore.NameKey("k", "a", parent), -1},
+		{datastore.NameKey("k", "a", nil), datastore.NameKey("k", "a", nil), 0},
+	}
+	for _, tt := range tests {
+		got := compareKeys(tt.a, tt.b)
+		if (got < 0 && tt.want >= 0) || (got > 0 && tt.want <= 0) || (got == 0 && tt.want != 0) {
+			t.Errorf("compareKeys(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPickSplits(t *testing.T) {
+	var keys []*datastore.Key
+	for _, n := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		keys = append(keys, datastore.NameKey("k", n, nil))
+	}
+	splits := pickSplits(keys, 4)
+	want := []string{"c", "e", "g"}
+	if len(splits) != len(want) {
+		t.Fatalf("got %d splits, want %d", len(splits), len(want))
+	}
+	for i, k := range splits {
+		if k.Name != want[i] {
+			t.Errorf("split %d: got %s, want %s", i, k.Name, want[i])
+		}
+	}
+	if got := pickSplits(keys[:2], 4); len(got) != 2 {
+		t.Errorf("expected duplicate splits to be dropped, got %v", got)
+	}
+}
@@ -0,0 +1,46 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	from := time.Date(2024, 1, 31, 10, 17, 30, 0, time.UTC) // a Wednesday
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 1, 31, 10, 30, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * 1-5", time.Date(2024, 2, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 3 * 3 *", time.Date(2024, 3, 1, 3, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 0", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@every 6h", from.Add(6 * time.Hour)},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "@every 1ms"} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("%s: want an error", spec)
+		}
+	}
+}
+
+func TestExpiredBackups(t *testing.T) {
+	now := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	prefixes := []string{"users/20240101T000000Z/", "users/20240130T000000Z/", "users/tmp/", "users/20240102T000000Z/"}
+	got := expiredBackups("users", prefixes, now, 7*24*time.Hour, 2)
+	if len(got) != 1 || got[0] != "users/20240101T000000Z/" {
+		t.Errorf("got %v, want the oldest backup", got)
+	}
+}
@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// ShadowDiff describes the divergences found between the primary results of a
+// Find and the results of the same query run against the shadow store.
+type ShadowDiff struct {
+	// Query is the query run against both stores.
+	Query *query.Query
+	// Missing lists the ids returned by the primary store only.
+	Missing []interface{}
+	// Unexpected lists the ids returned by the shadow store only.
+	Unexpected []interface{}
+	// Mismatched lists the ids returned by both stores with different etags.
+	Mismatched []interface{}
+	// Err is set when the shadow read failed.
+	Err error
+}
+
+// Diverged tells if the shadow read failed or returned different results.
+func (d *ShadowDiff) Diverged() bool {
+	return d.Err != nil || len(d.Missing) > 0 || len(d.Unexpected) > 0 || len(d.Mismatched) > 0
+}
+
+// ShadowReporter is called with the result of each shadow read comparison.
+type ShadowReporter func(ctx context.Context, diff *ShadowDiff)
+
+// SetShadowRead sets the secondary store used to validate migrations. Finds
+// run with a context returned by WithShadowRead are executed again against
+// shadow in the background, and report, if not nil, is called with the
+// comparison. The primary results are returned without waiting.
+func (d *Handler) SetShadowRead(shadow resource.Storer, report ShadowReporter) *Handler {
+	d.shadow = shadow
+	d.shadowReport = report
+	return d
+}
+
+// SetShadowSampling shadow reads a fraction rate, between 0 and 1, of the
+// Find calls, besides those using a context returned by WithShadowRead, so
+// migrations can be validated on live traffic.
+func (d *Handler) SetShadowSampling(rate float64) *Handler {
+	d.shadowRate = rate
+	return d
+}
+
+// ShadowMetrics is implemented by the Metrics counting shadow reads, such as
+// *PrometheusMetrics and *OpenCensusMetrics.
+type ShadowMetrics interface {
+	// ObserveShadowRead records a shadow read and its result: match,
+	// diverged or error.
+	ObserveShadowRead(kind, namespace, result string)
+}
+
+// WithShadowRead returns a context enabling shadow reads for the Find calls
+// using it.
+func WithShadowRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, shadowCtxKey, true)
+}
+
+// shadowFind runs q against the shadow store in the background and reports the
+// divergences with the primary list.
+func (d *Handler) shadowFind(ctx context.Context, q *query.Query, list *resource.ItemList) {
+	sm, _ := d.metrics.(ShadowMetrics)
+	if d.shadow == nil || (d.shadowReport == nil && sm == nil) {
+		return
+	}
+	if enabled, _ := ctx.Value(shadowCtxKey).(bool); !enabled && (d.shadowRate <= 0 || rand.Float64() >= d.shadowRate) {
+		return
+	}
+	ctx = detach(ctx)
+	d.pending.Add(1)
+	go func() {
+		defer d.pending.Done()
+		diff := &ShadowDiff{Query: q}
+		shadowList, err := d.shadow.Find(ctx, q)
+		if err != nil {
+			diff.Err = err
+		} else {
+			compareLists(diff, list, shadowList)
+		}
+		if sm != nil {
+			result := "match"
+			if diff.Err != nil {
+				result = "error"
+			} else if diff.Diverged() {
+				result = "diverged"
+			}
+			sm.ObserveShadowRead(d.entity, d.getNamespace(ctx), result)
+		}
+		if d.shadowReport != nil {
+			d.shadowReport(ctx, diff)
+		}
+	}()
+}
+
+// compareLists fills diff with the divergences between the two lists.
+func compareLists(diff *ShadowDiff, primary, shadow *resource.ItemList) {
+	etags := make(map[interface{}]string, len(shadow.Items))
+	for _, i := range shadow.Items {
+		etags[i.ID] = i.ETag
+	}
+	for _, i := range primary.Items {
+		etag, found := etags[i.ID]
+		switch {
+		case !found:
+			diff.Missing = append(diff.Missing, i.ID)
+		case etag != i.ETag:
+			diff.Mismatched = append(diff.Mismatched, i.ID)
+		}
+		delete(etags, i.ID)
+	}
+	for _, i := range shadow.Items {
+		if _, found := etags[i.ID]; found {
+			diff.Unexpected = append(diff.Unexpected, i.ID)
+		}
+	}
+}
+
+// detachedContext keeps the values of its parent but is never canceled, so
+// background work can outlive the request.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// detach returns a context carrying the values of ctx without its
+// cancellation.
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
@@ -0,0 +1,187 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/rest"
+)
+
+// MaxEntitySize is the maximum size of an entity accepted by Datastore.
+const MaxEntitySize = 1048572
+
+// PropertySize holds the estimated storage size of a top level property.
+type PropertySize struct {
+	Name string
+	Size int
+}
+
+// ErrEntityTooLarge is returned by Insert and Update when the serialized entity
+// would exceed MaxEntitySize.
+type ErrEntityTooLarge struct {
+	// ID of the offending item.
+	ID string
+	// Size is the estimated size of the entity in bytes.
+	Size int
+	// Largest lists the largest top level properties, biggest first.
+	Largest []PropertySize
+	// Cause is the error returned by Datastore when it refused the entity
+	// despite its estimated size, in which case the other fields are empty.
+	Cause error
+}
+
+// Error implements the error interface
+func (e *ErrEntityTooLarge) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("entity is too large: %v", e.Cause)
+	}
+	s := make([]string, len(e.Largest))
+	for i, p := range e.Largest {
+		s[i] = fmt.Sprintf("%s (%d bytes)", p.Name, p.Size)
+	}
+	return fmt.Sprintf("entity %s is too large: %d bytes exceeds the %d bytes limit, largest properties: %s",
+		e.ID, e.Size, MaxEntitySize, strings.Join(s, ", "))
+}
+
+// Unwrap returns the Datastore error, if any.
+func (e *ErrEntityTooLarge) Unwrap() error {
+	return e.Cause
+}
+
+// RESTError converts the error into a 422 rest.Error listing the largest
+// properties as field issues.
+func (e *ErrEntityTooLarge) RESTError() *rest.Error {
+	issues := make(map[string][]interface{}, len(e.Largest))
+	for _, p := range e.Largest {
+		issues[p.Name] = []interface{}{fmt.Sprintf("property uses %d bytes", p.Size)}
+	}
+	return &rest.Error{Code: 422, Message: e.Error(), Issues: issues}
+}
+
+// SizeMetrics is implemented by the Metrics recording the size of the written
+// entities, such as *PrometheusMetrics and *OpenCensusMetrics.
+type SizeMetrics interface {
+	// ObserveEntitySize records the estimated size of a written entity and
+	// the name and size of its largest property.
+	ObserveEntitySize(kind, namespace string, size int, largest PropertySize)
+}
+
+// measureEntity estimates the storage size of the entity stored under key and
+// returns it with the sizes of its properties, biggest first.
+func measureEntity(key *datastore.Key, e *Entity) (int, []PropertySize, error) {
+	ps, err := e.Save()
+	if err != nil {
+		return 0, nil, err
+	}
+	size := keySize(key) + 32
+	props := make([]PropertySize, 0, len(ps))
+	for _, p := range ps {
+		s := propertySize(p)
+		size += s
+		props = append(props, PropertySize{Name: p.Name, Size: s})
+	}
+	sort.Slice(props, func(i, j int) bool {
+		return props[i].Size > props[j].Size
+	})
+	return size, props, nil
+}
+
+// checkEntitySize estimates the storage size of the entity and returns an
+// ErrEntityTooLarge if it exceeds MaxEntitySize.
+func checkEntitySize(key *datastore.Key, e *Entity) error {
+	_, _, err := entitySize(key, e)
+	return err
+}
+
+// entitySize returns the estimated size of the entity and its largest
+// property, or an ErrEntityTooLarge if it exceeds MaxEntitySize.
+func entitySize(key *datastore.Key, e *Entity) (int, PropertySize, error) {
+	size, props, err := measureEntity(key, e)
+	if err != nil {
+		return 0, PropertySize{}, err
+	}
+	if size > MaxEntitySize {
+		if len(props) > 3 {
+			props = props[:3]
+		}
+		return size, props[0], &ErrEntityTooLarge{ID: e.ID, Size: size, Largest: props}
+	}
+	return size, props[0], nil
+}
+
+// checkWriteSize checks the size of an entity about to be written, like
+// checkEntitySize, and reports it to the metrics and logger, so entities
+// growing toward the limit can be spotted before their writes fail.
+func (d *Handler) checkWriteSize(ctx context.Context, key *datastore.Key, e *Entity) error {
+	size, largest, err := entitySize(key, e)
+	if size == 0 {
+		return err
+	}
+	if sm, ok := d.metrics.(SizeMetrics); ok {
+		sm.ObserveEntitySize(d.entity, d.getNamespace(ctx), size, largest)
+	}
+	if d.logger != nil {
+		d.logger.Debug(ctx, "datastore entity size", map[string]interface{}{
+			"kind":             d.entity,
+			"namespace":        d.getNamespace(ctx),
+			"id":               e.ID,
+			"size":             size,
+			"largest_property": largest.Name,
+			"largest_size":     largest.Size,
+		})
+	}
+	return err
+}
+
+// keySize follows https://cloud.google.com/datastore/docs/concepts/storage-size
+func keySize(k *datastore.Key) int {
+	size := 16
+	for ; k != nil; k = k.Parent {
+		size += len(k.Kind) + 1
+		if k.Name != "" {
+			size += len(k.Name) + 1
+		} else {
+			size += 8
+		}
+	}
+	return size
+}
+
+func propertySize(p datastore.Property) int {
+	return len(p.Name) + 1 + valueSize(p.Value)
+}
+
+func valueSize(v interface{}) int {
+	switch t := v.(type) {
+	case nil, bool:
+		return 1
+	case string:
+		return len(t) + 1
+	case []byte:
+		return len(t) + 1
+	case int, int8, int16, int32, int64, float32, float64, time.Time:
+		return 8
+	case datastore.GeoPoint:
+		return 16
+	case *datastore.Key:
+		return keySize(t)
+	case *datastore.Entity:
+		size := 32
+		for _, p := range t.Properties {
+			size += propertySize(p)
+		}
+		return size
+	case []interface{}:
+		size := 0
+		for _, e := range t {
+			size += valueSize(e)
+		}
+		return size
+	default:
+		return len(fmt.Sprint(t)) + 1
+	}
+}
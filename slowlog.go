@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// SlowQuery describes a Find or Clear slower than the slow query threshold.
+type SlowQuery struct {
+	Op        string
+	Kind      string
+	Namespace string
+	// Filter is the predicate of the query, as a string.
+	Filter string
+	Sort   query.Sort
+	// Window is nil when the query has no window.
+	Window   *query.Window
+	Duration time.Duration
+	// Items is the number of returned or deleted items.
+	Items int
+	Err   error
+}
+
+// slowQueryLog reports the queries slower than its threshold.
+type slowQueryLog struct {
+	threshold time.Duration
+	report    func(ctx context.Context, q SlowQuery)
+}
+
+// SetSlowQueryLog calls report with the description of every Find and Clear
+// whose end-to-end latency, hooks included, reaches threshold, to triage
+// performance issues in production, for instance by logging it. A zero
+// threshold or a nil report disables it.
+func (d *Handler) SetSlowQueryLog(threshold time.Duration, report func(ctx context.Context, q SlowQuery)) *Handler {
+	d.slowQueries = nil
+	if threshold > 0 && report != nil {
+		d.slowQueries = &slowQueryLog{threshold: threshold, report: report}
+	}
+	return d
+}
+
+// reportSlow reports the query q of the operation op if it took too long.
+func (d *Handler) reportSlow(ctx context.Context, op string, q *query.Query, elapsed time.Duration, items int, err error) {
+	l := d.slowQueries
+	if l == nil || elapsed < l.threshold {
+		return
+	}
+	l.report(ctx, SlowQuery{
+		Op:        op,
+		Kind:      d.entity,
+		Namespace: d.getNamespace(ctx),
+		Filter:    q.Predicate.String(),
+		Sort:      q.Sort,
+		Window:    q.Window,
+		Duration:  elapsed,
+		Items:     items,
+		Err:       err,
+	})
+}
@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// KindStats are the statistics of a kind computed by Datastore, about once a
+// day.
+type KindStats struct {
+	// Count of the entities.
+	Count int64 `datastore:"count"`
+	// Bytes stored by the entities and their indexes.
+	Bytes               int64 `datastore:"bytes"`
+	EntityBytes         int64 `datastore:"entity_bytes"`
+	BuiltinIndexBytes   int64 `datastore:"builtin_index_bytes"`
+	BuiltinIndexCount   int64 `datastore:"builtin_index_count"`
+	CompositeIndexBytes int64 `datastore:"composite_index_bytes"`
+	CompositeIndexCount int64 `datastore:"composite_index_count"`
+	// Timestamp of the statistics.
+	Timestamp time.Time `datastore:"timestamp"`
+	// Properties are the statistics of each property and value type.
+	Properties []PropertyStats `datastore:"-"`
+}
+
+// PropertyStats are the statistics of the values of a type of a property.
+type PropertyStats struct {
+	Name              string `datastore:"property_name"`
+	Type              string `datastore:"property_type"`
+	Count             int64  `datastore:"count"`
+	Bytes             int64  `datastore:"bytes"`
+	EntityBytes       int64  `datastore:"entity_bytes"`
+	BuiltinIndexBytes int64  `datastore:"builtin_index_bytes"`
+	BuiltinIndexCount int64  `datastore:"builtin_index_count"`
+}
+
+// Stats returns the statistics of the kind in the namespace of ctx, read from
+// the __Stat_Ns_Kind__ and __Stat_Ns_PropertyType_PropertyName_Kind__
+// entities, for capacity dashboards. It returns nil when Datastore hasn't
+// computed them yet. Statistics can be a day old and are not available in
+// the emulator.
+func (d *Handler) Stats(ctx context.Context) (*KindStats, error) {
+	ns := d.getNamespace(ctx)
+	var kinds []KindStats
+	qry := datastore.NewQuery("__Stat_Ns_Kind__").Namespace(ns).Filter("kind_name =", d.entity)
+	err := d.retry(ctx, true, func() error {
+		kinds = nil
+		_, err := d.client.GetAll(ctx, qry, &kinds)
+		return ignoreFieldMismatch(err)
+	})
+	if err != nil || len(kinds) == 0 {
+		return nil, err
+	}
+	stats := &kinds[0]
+	qry = datastore.NewQuery("__Stat_Ns_PropertyType_PropertyName_Kind__").Namespace(ns).Filter("kind_name =", d.entity)
+	err = d.retry(ctx, true, func() error {
+		stats.Properties = nil
+		_, err := d.client.GetAll(ctx, qry, &stats.Properties)
+		return ignoreFieldMismatch(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ignoreFieldMismatch ignores the errors of the statistics properties not
+// loaded in structs, which are still filled.
+func ignoreFieldMismatch(err error) error {
+	if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+		return nil
+	}
+	return err
+}
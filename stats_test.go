@@ -0,0 +1,52 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+)
+
+// statsClient answers the statistics queries with kinds and properties,
+// reporting unknown statistics properties like Datastore.
+type statsClient struct {
+	Client
+	kinds      []KindStats
+	properties []PropertyStats
+}
+
+func (c statsClient) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	switch dst := dst.(type) {
+	case *[]KindStats:
+		*dst = append(*dst, c.kinds...)
+	case *[]PropertyStats:
+		*dst = append(*dst, c.properties...)
+	}
+	return nil, &datastore.ErrFieldMismatch{FieldName: "kind_name", Reason: "no such struct field"}
+}
+
+func TestStats(t *testing.T) {
+	c := statsClient{
+		kinds: []KindStats{{Count: 2, Bytes: 100}},
+		properties: []PropertyStats{
+			{Name: "name", Type: "String", Count: 2},
+			{Name: "age", Type: "Integer", Count: 1},
+		},
+	}
+	ctx := context.Background()
+	stats, err := NewHandler(c, "", "users").Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 2 || stats.Bytes != 100 || len(stats.Properties) != 2 || stats.Properties[1].Name != "age" {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats, err = NewHandler(statsClient{}, "", "users").Stats(ctx); stats != nil || err != nil {
+		t.Errorf("expected no stats before they are computed, got %v, %v", stats, err)
+	}
+	errStats := errors.New("unavailable")
+	if _, err = NewHandler(failingClient{err: errStats}, "", "users").Stats(ctx); err != errStats {
+		t.Errorf("expected the query error, got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/rest"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+var (
+	// ErrNoTenant is returned by the operations of a TenantHandlerFactory
+	// when no tenant can be resolved from the context, a 401.
+	ErrNoTenant = &rest.Error{Code: http.StatusUnauthorized, Message: "no tenant in context"}
+	// ErrTooManyTenants is returned by a TenantHandlerFactory when a new
+	// tenant would exceed the limit set with SetMaxTenants, a 503.
+	ErrTooManyTenants = &rest.Error{Code: http.StatusServiceUnavailable, Message: "too many tenants"}
+)
+
+// TenantResolver returns the tenant of a request.
+type TenantResolver func(ctx context.Context) (string, error)
+
+// TenantHandlerFactory serves a kind stored in a namespace per tenant with a
+// handler per tenant, created on first use and cached, so each tenant keeps
+// its own caches, breaker and limits. It implements resource.Storer by
+// delegating to the handler of the tenant resolved from the context, and can
+// be bound as is.
+//
+// Handlers are kept until Close, so the number of tenants served by a factory
+// must be bounded, by a resolver only accepting known tenants or with
+// SetMaxTenants.
+type TenantHandlerFactory struct {
+	client    Client
+	kind      string
+	namespace string
+	vars      map[string]string
+	resolve   TenantResolver
+	configure func(h *Handler) *Handler
+	max       int
+	mu        sync.Mutex
+	handlers  map[string]*Handler
+}
+
+// NewTenantHandlerFactory returns a factory of handlers storing kind in the
+// namespace of each tenant, resolved with WithTenant by default. The kind can
+// be a template using the {{tenant}} placeholder, such as "{{tenant}}_orders",
+// along with the variables set with SetKindVars.
+func NewTenantHandlerFactory(client Client, kind string) *TenantHandlerFactory {
+	return &TenantHandlerFactory{
+		client:    client,
+		kind:      kind,
+		namespace: "{{tenant}}",
+		resolve:   tenantOf,
+		handlers:  map[string]*Handler{},
+	}
+}
+
+// WithTenant returns a context resolving to tenant with the default resolver
+// of TenantHandlerFactory.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantCtxKey, tenant)
+}
+
+func tenantOf(ctx context.Context) (string, error) {
+	tenant, _ := ctx.Value(tenantCtxKey).(string)
+	if tenant == "" {
+		return "", ErrNoTenant
+	}
+	return tenant, nil
+}
+
+// SetNamespace sets the template of the namespace of the tenants, which is
+// the tenant itself by default. A constant namespace stores all tenants in
+// the same namespace, with a kind template telling them apart.
+func (f *TenantHandlerFactory) SetNamespace(template string) *TenantHandlerFactory {
+	f.namespace = template
+	return f
+}
+
+// SetKindVars sets the variables of the kind and namespace templates, such as
+// the environment, besides the tenant.
+func (f *TenantHandlerFactory) SetKindVars(vars map[string]string) *TenantHandlerFactory {
+	f.vars = vars
+	return f
+}
+
+// SetResolver sets the function resolving the tenant of a request, such as
+// from an authentication token.
+func (f *TenantHandlerFactory) SetResolver(resolve TenantResolver) *TenantHandlerFactory {
+	f.resolve = resolve
+	return f
+}
+
+// SetConfigure sets the function configuring the handlers when they are
+// created, with the SetXxx methods of Handler.
+func (f *TenantHandlerFactory) SetConfigure(configure func(h *Handler) *Handler) *TenantHandlerFactory {
+	f.configure = configure
+	return f
+}
+
+// SetMaxTenants limits the number of handlers created by the factory, so
+// unknown tenants can't make it grow without bound. Once the limit is reached,
+// the operations of new tenants fail with ErrTooManyTenants. Zero, the
+// default, sets no limit.
+func (f *TenantHandlerFactory) SetMaxTenants(max int) *TenantHandlerFactory {
+	f.max = max
+	return f
+}
+
+// Handler returns the handler of tenant, creating it on first use. Tenants
+// must be valid namespace names.
+func (f *TenantHandlerFactory) Handler(tenant string) (*Handler, error) {
+	if !namespaceRegexp.MatchString(tenant) || tenant == "" || strings.HasPrefix(tenant, "__") {
+		return nil, &rest.Error{Code: http.StatusBadRequest, Message: fmt.Sprintf("invalid tenant %q", tenant)}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h := f.handlers[tenant]
+	if h == nil {
+		if f.max > 0 && len(f.handlers) >= f.max {
+			return nil, ErrTooManyTenants
+		}
+		vars := map[string]string{}
+		for k, v := range f.vars {
+			vars[k] = v
+		}
+		vars["tenant"] = tenant
+		namespace, err := ExpandKind(f.namespace, vars)
+		if err != nil {
+			return nil, err
+		}
+		kind, err := ExpandKind(f.kind, vars)
+		if err != nil {
+			return nil, err
+		}
+		h = NewHandler(f.client, namespace, kind)
+		if f.configure != nil {
+			h = f.configure(h)
+		}
+		f.handlers[tenant] = h
+	}
+	return h, nil
+}
+
+// Resolve returns the handler of the tenant of ctx.
+func (f *TenantHandlerFactory) Resolve(ctx context.Context) (*Handler, error) {
+	tenant, err := f.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return f.Handler(tenant)
+}
+
+// Close closes the handlers created by the factory.
+func (f *TenantHandlerFactory) Close(ctx context.Context) error {
+	f.mu.Lock()
+	handlers := f.handlers
+	f.handlers = map[string]*Handler{}
+	f.mu.Unlock()
+	var err error
+	for _, h := range handlers {
+		if cerr := h.Close(ctx); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Insert implements resource.Storer.
+func (f *TenantHandlerFactory) Insert(ctx context.Context, items []*resource.Item) error {
+	h, err := f.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+	return h.Insert(ctx, items)
+}
+
+// Update implements resource.Storer.
+func (f *TenantHandlerFactory) Update(ctx context.Context, item *resource.Item, original *resource.Item) error {
+	h, err := f.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+	return h.Update(ctx, item, original)
+}
+
+// Delete implements resource.Storer.
+func (f *TenantHandlerFactory) Delete(ctx context.Context, item *resource.Item) error {
+	h, err := f.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+	return h.Delete(ctx, item)
+}
+
+// Clear implements resource.Storer.
+func (f *TenantHandlerFactory) Clear(ctx context.Context, q *query.Query) (int, error) {
+	h, err := f.Resolve(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return h.Clear(ctx, q)
+}
+
+// Find implements resource.Storer.
+func (f *TenantHandlerFactory) Find(ctx context.Context, q *query.Query) (*resource.ItemList, error) {
+	h, err := f.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return h.Find(ctx, q)
+}
@@ -0,0 +1,40 @@
+package datastore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/rest-layer/rest"
+)
+
+func TestTenantHandlerFactory(t *testing.T) {
+	f := NewTenantHandlerFactory(nil, "users").SetConfigure(func(h *Handler) *Handler {
+		return h.SetTypedErrors(true)
+	})
+	if _, err := f.Resolve(context.Background()); err != ErrNoTenant {
+		t.Errorf("expected ErrNoTenant, got %v", err)
+	}
+	h, err := f.Resolve(WithTenant(context.Background(), "acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.namespace != "acme" || h.entity != "users" || !h.typedErrors {
+		t.Errorf("unexpected handler %+v", h)
+	}
+	if h2, _ := f.Handler("acme"); h2 != h {
+		t.Error("expected the handler of the tenant to be cached")
+	}
+	if _, err := f.Handler("acme/../other"); rest.NewError(err).Code != 400 {
+		t.Errorf("expected a 400 for an invalid tenant, got %v", err)
+	}
+	if rest.NewError(ErrNoTenant).Code != 401 {
+		t.Error("expected ErrNoTenant to be a 401")
+	}
+	f.SetMaxTenants(1)
+	if _, err := f.Handler("other"); err != ErrTooManyTenants {
+		t.Errorf("expected ErrTooManyTenants, got %v", err)
+	}
+	if _, err := f.Handler("acme"); err != nil {
+		t.Errorf("expected the existing tenant to be served, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Tombstone records the deletion of an item so offline clients can sync
+// deletions.
+type Tombstone struct {
+	ID      string    `datastore:"_id"`
+	Deleted time.Time `datastore:"_deleted"`
+	// Expires can be used as the property of a native TTL policy on the
+	// tombstone kind.
+	Expires time.Time `datastore:"_expires,noindex,omitempty"`
+}
+
+// SetTombstones enables writing a tombstone entity to kind, in the same
+// transaction, whenever an item is deleted by Delete or Clear. The kind defaults to the
+// handler kind suffixed with "_tombstones". Tombstones expire after ttl, zero
+// meaning never.
+func (d *Handler) SetTombstones(kind string, ttl time.Duration) *Handler {
+	if kind == "" {
+		kind = d.entity + "_tombstones"
+	}
+	d.tombstoneKind = kind
+	d.tombstoneTTL = ttl
+	return d
+}
+
+// tombstoneMutation returns the mutation writing the tombstone of key, or nil
+// if tombstones are disabled.
+func (d *Handler) tombstoneMutation(key *datastore.Key) *datastore.Mutation {
+	if d.tombstoneKind == "" {
+		return nil
+	}
+	t := &Tombstone{ID: key.Name, Deleted: d.now()}
+	if d.tombstoneTTL > 0 {
+		t.Expires = t.Deleted.Add(d.tombstoneTTL)
+	}
+	tkey := datastore.NameKey(d.tombstoneKind, key.Name, nil)
+	tkey.Namespace = key.Namespace
+	return datastore.NewUpsert(tkey, t)
+}
+
+// Tombstones lists the tombstones of the items deleted after since, oldest
+// first.
+func (d *Handler) Tombstones(ctx context.Context, since time.Time) ([]*Tombstone, error) {
+	if d.tombstoneKind == "" {
+		return nil, nil
+	}
+	qry := datastore.NewQuery(d.tombstoneKind).
+		Namespace(d.getNamespace(ctx)).
+		Filter("_deleted >", since).
+		Order("_deleted")
+	var tombstones []*Tombstone
+	for t := d.client.Run(ctx, qry); ; {
+		var ts Tombstone
+		_, err := t.Next(&ts)
+		if err == iterator.Done {
+			return tombstones, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, &ts)
+	}
+}
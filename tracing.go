@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans of the package.
+const instrumentationName = "github.com/ajcrowe/rest-layer-datastore"
+
+// SetTracerProvider traces the Insert, Update, Delete, Clear and Find
+// operations with OpenTelemetry client spans, children of the span of the
+// incoming context, so Datastore latency shows up in distributed traces.
+// Spans carry the kind, the namespace, the number of written, deleted or
+// returned items and the filter of queries. A nil provider disables tracing.
+func (d *Handler) SetTracerProvider(tp trace.TracerProvider) *Handler {
+	d.tracer = nil
+	if tp != nil {
+		d.tracer = tp.Tracer(instrumentationName)
+	}
+	return d
+}
+
+// operation is a storage operation being traced and measured.
+type operation struct {
+	d     *Handler
+	ctx   context.Context
+	name  string
+	ns    string
+	start time.Time
+	// span is nil when tracing is disabled.
+	span trace.Span
+	// ids of the touched items, when known.
+	ids []string
+	// query of Find and Clear operations.
+	query *query.Query
+}
+
+// startOperation starts tracing and measuring the operation name.
+func (d *Handler) startOperation(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, *operation) {
+	o := &operation{d: d, ctx: ctx, name: name, ns: d.getNamespace(ctx), start: time.Now()}
+	if d.tracer == nil {
+		return ctx, o
+	}
+	attrs = append(attrs,
+		attribute.String("datastore.kind", d.entity),
+		attribute.String("datastore.namespace", o.ns))
+	o.ctx, o.span = d.tracer.Start(ctx, "datastore."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	return o.ctx, o
+}
+
+// touch records the items touched by the operation, for debug logs.
+func (o *operation) touch(items ...*resource.Item) {
+	if o.d.logger == nil {
+		return
+	}
+	for _, item := range items {
+		if id, ok := item.ID.(string); ok {
+			o.ids = append(o.ids, id)
+		}
+	}
+}
+
+// end records the outcome of the operation, which wrote, deleted or returned
+// items, and returns its error translated for the REST layer.
+func (o *operation) end(items int, err error) error {
+	elapsed, code := time.Since(o.start), errorCode(err)
+	if m := o.d.metrics; m != nil {
+		m.ObserveOperation(o.d.entity, o.ns, o.name, code, elapsed, items)
+	}
+	if l := o.d.logger; l != nil {
+		fields := map[string]interface{}{
+			"kind":      o.d.entity,
+			"namespace": o.ns,
+			"op":        o.name,
+			"code":      code,
+			"duration":  elapsed,
+			"items":     items,
+		}
+		if len(o.ids) > 0 {
+			fields["ids"] = o.ids
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		l.Debug(o.ctx, "datastore operation", fields)
+	}
+	if o.query != nil {
+		o.d.reportSlow(o.ctx, o.name, o.query, elapsed, items, err)
+	}
+	if o.span != nil {
+		o.span.SetAttributes(attribute.Int("datastore.items", items))
+		if err != nil {
+			o.span.RecordError(err)
+			o.span.SetStatus(codes.Error, err.Error())
+		}
+		o.span.End()
+	}
+	return o.d.translateError(err, o.query)
+}
+
+// queryAttrs summarizes q in span attributes.
+func queryAttrs(q *query.Query) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.String("datastore.filter", q.Predicate.String())}
+	if q.Window != nil {
+		attrs = append(attrs,
+			attribute.Int("datastore.offset", q.Window.Offset),
+			attribute.Int("datastore.limit", q.Window.Limit))
+	}
+	return attrs
+}
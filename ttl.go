@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+
+	admin "cloud.google.com/go/firestore/apiv1/admin"
+	"cloud.google.com/go/firestore/apiv1/admin/adminpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// DefaultDatabase is the id of the default database of a project.
+const DefaultDatabase = "(default)"
+
+// EnsureTTLPolicy makes sure a native TTL policy is enabled on the _expires
+// property of the handler kind, and of its tombstone kind if tombstones are
+// enabled, so Datastore deletes expired entities itself. Missing policies are
+// created and the call waits for the operation to complete. An error is
+// returned if a policy needs repair.
+//
+// Native TTL policies are only available with Firestore in Datastore mode.
+func (d *Handler) EnsureTTLPolicy(ctx context.Context, client *admin.FirestoreAdminClient, project, database string) error {
+	if err := EnsureTTLPolicy(ctx, client, project, database, d.entity, expiresProperty); err != nil {
+		return err
+	}
+	if d.tombstoneKind != "" {
+		return EnsureTTLPolicy(ctx, client, project, database, d.tombstoneKind, "_expires")
+	}
+	return nil
+}
+
+// EnsureTTLPolicy makes sure a native TTL policy is enabled on property of
+// kind, creating it if needed.
+func EnsureTTLPolicy(ctx context.Context, client *admin.FirestoreAdminClient, project, database, kind, property string) error {
+	if database == "" {
+		database = DefaultDatabase
+	}
+	name := fmt.Sprintf("projects/%s/databases/%s/collectionGroups/%s/fields/%s", project, database, kind, property)
+	f, err := client.GetField(ctx, &adminpb.GetFieldRequest{Name: name})
+	if err != nil {
+		return err
+	}
+	if ttl := f.GetTtlConfig(); ttl != nil {
+		switch ttl.GetState() {
+		case adminpb.Field_TtlConfig_ACTIVE, adminpb.Field_TtlConfig_CREATING:
+			return nil
+		case adminpb.Field_TtlConfig_NEEDS_REPAIR:
+			return fmt.Errorf("datastore: TTL policy on %s.%s needs repair", kind, property)
+		}
+	}
+	op, err := client.UpdateField(ctx, &adminpb.UpdateFieldRequest{
+		Field: &adminpb.Field{
+			Name:      name,
+			TtlConfig: &adminpb.Field_TtlConfig{},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"ttl_config"}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = op.Wait(ctx)
+	return err
+}
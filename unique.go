@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxUniqueKeyName is the longest value used as is as the key name of a
+// uniqueness sentinel, longer values are hashed.
+const maxUniqueKeyName = 500
+
+// uniqueSentinel is the entity claiming a unique value for an item.
+type uniqueSentinel struct {
+	Owner string `datastore:"_owner"`
+}
+
+// SetUniqueFields enforces the uniqueness of the values of the given top level
+// fields. For each field, a sentinel entity of the <kind>_unique_<field> kind
+// keyed by the value is written along with the item, in the same transaction,
+// so Insert, Update and UpsertMulti return resource.ErrConflict when another
+// item already holds the value. Sentinels are released when their item is deleted
+// or changes its value. Missing and nil values are not constrained.
+//
+// Values are compared by their string form. Entities written before a field
+// was made unique don't hold sentinels and are not checked.
+func (d *Handler) SetUniqueFields(fields []string) *Handler {
+	d.uniqueFields = fields
+	return d
+}
+
+// uniqueKey returns the key of the sentinel for value of field, or nil if
+// value is nil.
+func (d *Handler) uniqueKey(ns, field string, value interface{}) *datastore.Key {
+	if value == nil {
+		return nil
+	}
+	name := fmt.Sprint(value)
+	if len(name) > maxUniqueKeyName {
+		sum := sha256.Sum256([]byte(name))
+		name = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	key := datastore.NameKey(d.entity+"_unique_"+field, name, nil)
+	key.Namespace = ns
+	return key
+}
+
+// uniqueInserts returns the mutations creating the sentinels of a new item,
+// failing the commit if a value is already taken. Claimed holds the sentinels
+// of the other items of the batch, which Datastore rejects as duplicate keys
+// instead of a conflict, so a value claimed twice fails with
+// resource.ErrConflict.
+func (d *Handler) uniqueInserts(key *datastore.Key, payload map[string]interface{}, claimed map[string]bool) ([]*datastore.Mutation, error) {
+	var muts []*datastore.Mutation
+	for _, f := range d.uniqueFields {
+		if k := d.uniqueKey(key.Namespace, f, payload[f]); k != nil {
+			if claimed[k.String()] {
+				return nil, resource.ErrConflict
+			}
+			claimed[k.String()] = true
+			muts = append(muts, datastore.NewInsert(k, &uniqueSentinel{Owner: key.Name}))
+		}
+	}
+	return muts, nil
+}
+
+// uniqueChanges checks in tx that the unique values of the item with key
+// going from before to after are free, and returns the mutations moving its
+// sentinels, or resource.ErrConflict.
+func (d *Handler) uniqueChanges(tx Transaction, key *datastore.Key, before, after map[string]interface{}) ([]*datastore.Mutation, error) {
+	var muts []*datastore.Mutation
+	for _, f := range d.uniqueFields {
+		old := d.uniqueKey(key.Namespace, f, before[f])
+		k := d.uniqueKey(key.Namespace, f, after[f])
+		if k != nil && old != nil && k.Equal(old) {
+			continue
+		}
+		if k != nil {
+			var s uniqueSentinel
+			err := tx.Get(k, &s)
+			if err == nil && s.Owner != key.Name {
+				return nil, resource.ErrConflict
+			}
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, err
+			}
+			muts = append(muts, datastore.NewUpsert(k, &uniqueSentinel{Owner: key.Name}))
+		}
+		if old != nil {
+			muts = append(muts, datastore.NewDelete(old))
+		}
+	}
+	return muts, nil
+}
+
+// uniqueReleases returns the mutations deleting the sentinels of the item
+// with key and payload.
+func (d *Handler) uniqueReleases(key *datastore.Key, payload map[string]interface{}) []*datastore.Mutation {
+	var muts []*datastore.Mutation
+	for _, f := range d.uniqueFields {
+		if k := d.uniqueKey(key.Namespace, f, payload[f]); k != nil {
+			muts = append(muts, datastore.NewDelete(k))
+		}
+	}
+	return muts
+}
+
+// uniqueConflict translates the failure of a commit inserting sentinels
+// because a value is taken into resource.ErrConflict.
+func (d *Handler) uniqueConflict(err error) error {
+	if len(d.uniqueFields) > 0 && status.Code(err) == codes.AlreadyExists {
+		return resource.ErrConflict
+	}
+	return err
+}
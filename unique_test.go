@@ -0,0 +1,32 @@
+package datastore
+
+import (
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+)
+
+func TestUniqueKey(t *testing.T) {
+	h := NewHandler(nil, "", "users").SetUniqueFields([]string{"email"})
+	k := h.uniqueKey("ns", "email", "a@b.c")
+	if k.Kind != "users_unique_email" || k.Name != "a@b.c" || k.Namespace != "ns" {
+		t.Errorf("unexpected key %v", k)
+	}
+	if k := h.uniqueKey("", "email", nil); k != nil {
+		t.Errorf("expected no key for nil values, got %v", k)
+	}
+	long := strings.Repeat("x", maxUniqueKeyName+1)
+	if k := h.uniqueKey("", "email", long); !strings.HasPrefix(k.Name, "sha256:") {
+		t.Errorf("expected long values to be hashed, got %s", k.Name)
+	}
+	claimed := map[string]bool{}
+	muts, err := h.uniqueInserts(datastore.NameKey("users", "1", nil), map[string]interface{}{"email": "a@b.c"}, claimed)
+	if err != nil || len(muts) != 1 {
+		t.Errorf("expected one sentinel, got %d, %v", len(muts), err)
+	}
+	if _, err = h.uniqueInserts(datastore.NameKey("users", "2", nil), map[string]interface{}{"email": "a@b.c"}, claimed); err != resource.ErrConflict {
+		t.Errorf("expected a conflict for a value claimed twice in a batch, got %v", err)
+	}
+}
@@ -0,0 +1,388 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+)
+
+// MergeStrategy defines how UpsertMulti combines an item with the stored
+// entity of the same id.
+type MergeStrategy int
+
+const (
+	// ReplaceMerge replaces the stored payload with the new one.
+	ReplaceMerge MergeStrategy = iota
+	// ShallowMerge sets the top level fields of the new payload over the
+	// stored ones.
+	ShallowMerge
+	// DeepMerge recursively merges nested objects of the new payload into the
+	// stored ones. Other values, including lists, are replaced.
+	DeepMerge
+)
+
+// UpsertMulti creates the items which don't exist yet and merges the existing
+// ones following strategy. Items are written in chunked transactions of at
+// most MaxMutations mutations, records, sentinels, index rows, views and
+// mirrors included; the etag and updated time of every written item are
+// recomputed from the merged payload.
+//
+// Like Insert and Update, the hooks of inserts are called with the created
+// items and the hooks of updates with the merged ones, and the immutable
+// fields of existing items are checked. Items are merged, encrypted and
+// offloaded before their transaction, which only checks the stored entities
+// didn't change since, so retried transactions don't repeat these side
+// effects.
+func (d *Handler) UpsertMulti(ctx context.Context, items []*resource.Item, strategy MergeStrategy) error {
+	if err := d.checkFence(ctx); err != nil {
+		return err
+	}
+	return d.withDeadline(ctx, "upsert", func(ctx context.Context) error {
+		for len(items) > 0 {
+			start := time.Now()
+			n, err := d.upsertChunk(ctx, items, strategy)
+			if d.observeBatch(time.Since(start), err) && n > 1 {
+				// Merging the same items again gives the same result
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			ids := make([]string, n)
+			for i, item := range items[:n] {
+				ids[i] = item.ID.(string)
+			}
+			d.invalidateCache(ids)
+			items = items[n:]
+		}
+		return nil
+	})
+}
+
+// errStaleUpsert aborts the transaction of an upsert chunk when a stored
+// entity changed since the chunk was prepared.
+var errStaleUpsert = errors.New("stored entity changed")
+
+// upsert is an item of an UpsertMulti chunk, prepared before its transaction.
+type upsert struct {
+	key *datastore.Key
+	// original is the stored item, nil when the item is created.
+	original *resource.Item
+	// etag and payload of the stored entity the item was merged with, the
+	// payload as stored, with its overflow pointers.
+	etag   string
+	stored map[string]interface{}
+	item   *resource.Item
+	entity *Entity
+	// muts are the companion mutations which don't depend on the
+	// transaction reads.
+	muts []*datastore.Mutation
+}
+
+// upsertChunk writes the first items fitting in a commit and returns their
+// number. Chunks whose stored entities change before their transaction are
+// prepared again, up to the transaction attempts.
+func (d *Handler) upsertChunk(ctx context.Context, items []*resource.Item, strategy MergeStrategy) (int, error) {
+	attempts := d.txAttempts
+	if attempts < 1 {
+		attempts = DefaultTxAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		chunk, err := d.prepareUpserts(ctx, items, strategy)
+		if err == nil {
+			err = d.commitUpserts(ctx, chunk)
+		}
+		if err != nil {
+			// The values offloaded for the chunk are pointed to by no entity
+			for _, u := range chunk {
+				if u.entity != nil {
+					d.purgeOverflow(ctx, u.entity.Payload)
+				}
+			}
+			if err == errStaleUpsert && attempt < attempts {
+				continue
+			}
+			if err == errStaleUpsert {
+				err = resource.ErrConflict
+			}
+		}
+		d.upsertHooksAfter(ctx, chunk, err)
+		if err != nil {
+			return len(chunk), err
+		}
+		var inserted, updated []*resource.Item
+		keys := make([]*datastore.Key, len(chunk))
+		entities := make([]*Entity, len(chunk))
+		for i, u := range chunk {
+			keys[i], entities[i] = u.key, u.entity
+			if u.original == nil {
+				inserted = append(inserted, u.item)
+				continue
+			}
+			updated = append(updated, u.item)
+			if d.historyKind == "" {
+				d.purgeReplaced(ctx, u.stored, u.entity.Payload)
+			}
+		}
+		d.mirror(ctx, keys, entities)
+		d.logOps(ctx, ChangeInsert, inserted, nil)
+		d.logOps(ctx, ChangeUpdate, updated, nil)
+		return len(chunk), nil
+	}
+}
+
+// prepareUpserts reads the stored entities of the first items fitting in a
+// commit, merges the items with them and prepares the entities to write.
+func (d *Handler) prepareUpserts(ctx context.Context, items []*resource.Item, strategy MergeStrategy) ([]*upsert, error) {
+	limit := d.batchSize()
+	if len(items) < limit {
+		limit = len(items)
+	}
+	ns := d.getNamespace(ctx)
+	keys := make([]*datastore.Key, limit)
+	for i, item := range items[:limit] {
+		keys[i] = datastore.NameKey(d.entity, item.ID.(string), nil)
+		keys[i].Namespace = ns
+	}
+	current := make([]Entity, limit)
+	err := d.retry(ctx, true, func() error {
+		return d.client.GetMulti(ctx, keys, current)
+	})
+	merr, _ := err.(datastore.MultiError)
+	if err != nil && merr == nil {
+		return nil, err
+	}
+	var chunk []*upsert
+	mutations := 0
+	for i, item := range items[:limit] {
+		u := &upsert{key: keys[i]}
+		payload := item.Payload
+		if merr == nil || merr[i] == nil {
+			u.etag = current[i].ETag
+			u.stored = make(map[string]interface{}, len(current[i].Payload))
+			for k, v := range current[i].Payload {
+				u.stored[k] = v
+			}
+			if u.original, err = d.loadItem(ctx, &current[i]); err != nil {
+				return nil, err
+			}
+			payload = mergePayload(u.original.Payload, item.Payload, strategy)
+		} else if merr[i] != datastore.ErrNoSuchEntity {
+			return nil, merr[i]
+		}
+		if u.item, err = resource.NewItem(payload); err != nil {
+			return nil, err
+		}
+		// The index rows of the computed payload give the size of the
+		// write, before hooks
+		computed, err := d.computeFields(u.item)
+		if err != nil {
+			return nil, err
+		}
+		n, err := d.upsertMutations(u, computed.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) > 0 && mutations+n > limit {
+			break
+		}
+		mutations += n
+		chunk = append(chunk, u)
+	}
+	if err = d.upsertHooksBefore(ctx, chunk); err != nil {
+		return nil, err
+	}
+	claimed := map[string]bool{}
+	for _, u := range chunk {
+		if u.item, err = d.computeFields(u.item); err != nil {
+			return chunk, err
+		}
+		var before map[string]interface{}
+		op, etag := ChangeInsert, ""
+		if u.original != nil {
+			before, op, etag = u.original.Payload, ChangeUpdate, u.etag
+			if err = d.checkImmutable(before, u.item.Payload); err != nil {
+				return chunk, err
+			}
+		}
+		if err = d.claimUnique(claimed, u.key, before, u.item.Payload); err != nil {
+			return chunk, err
+		}
+		if u.entity, err = d.prepareEntity(ctx, u.key, u.item, false); err != nil {
+			return chunk, err
+		}
+		u.muts = d.recordMutations(u.key, op, etag, u.entity.ETag)
+		rows, err := d.indexChanges(u.key, before, u.item.Payload)
+		if err != nil {
+			return chunk, err
+		}
+		views, err := d.viewChanges(u.key, u.entity, u.item.Payload)
+		if err != nil {
+			return chunk, err
+		}
+		u.muts = append(append(u.muts, rows...), views...)
+		u.muts = append(u.muts, d.mirrorChanges(u.key, u.entity)...)
+	}
+	return chunk, nil
+}
+
+// upsertMutations returns the number of mutations committed for u with
+// payload, counting the sentinels it may move.
+func (d *Handler) upsertMutations(u *upsert, payload map[string]interface{}) (int, error) {
+	var before map[string]interface{}
+	if u.original != nil {
+		before = u.original.Payload
+	}
+	rows, err := d.indexChanges(u.key, before, payload)
+	if err != nil {
+		return 0, err
+	}
+	n := 1 + d.recordsPerWrite() + 2*len(d.uniqueFields) + len(rows) + len(d.views)
+	return n + len(d.mirrorChanges(u.key, nil)), nil
+}
+
+// claimUnique fails with resource.ErrConflict when the item with key claims a
+// unique value already claimed by another item of the chunk, which Datastore
+// would reject as a duplicate key.
+func (d *Handler) claimUnique(claimed map[string]bool, key *datastore.Key, before, after map[string]interface{}) error {
+	for _, f := range d.uniqueFields {
+		k := d.uniqueKey(key.Namespace, f, after[f])
+		if k == nil {
+			continue
+		}
+		if old := d.uniqueKey(key.Namespace, f, before[f]); old != nil && k.Equal(old) {
+			continue
+		}
+		if claimed[k.String()] {
+			return resource.ErrConflict
+		}
+		claimed[k.String()] = true
+	}
+	return nil
+}
+
+// commitUpserts writes a prepared chunk in a transaction, failing with
+// errStaleUpsert if a stored entity changed since it was prepared.
+func (d *Handler) commitUpserts(ctx context.Context, chunk []*upsert) error {
+	keys := make([]*datastore.Key, len(chunk))
+	entities := make([]*Entity, len(chunk))
+	for i, u := range chunk {
+		keys[i], entities[i] = u.key, u.entity
+	}
+	return d.runTx(ctx, func(tx Transaction) error {
+		current := make([]Entity, len(keys))
+		err := tx.GetMulti(keys, current)
+		merr, _ := err.(datastore.MultiError)
+		if err != nil && merr == nil {
+			return err
+		}
+		var muts []*datastore.Mutation
+		for i, u := range chunk {
+			exists := merr == nil || merr[i] == nil
+			if !exists && merr[i] != datastore.ErrNoSuchEntity {
+				return merr[i]
+			}
+			if exists != (u.original != nil) || exists && current[i].ETag != u.etag {
+				return errStaleUpsert
+			}
+			var previous *Entity
+			var before map[string]interface{}
+			if exists {
+				previous, before = &current[i], u.original.Payload
+			}
+			d.stampAudit(ctx, u.entity, previous)
+			unique, err := d.uniqueChanges(tx, u.key, before, u.item.Payload)
+			if err != nil {
+				return err
+			}
+			muts = append(append(muts, u.muts...), unique...)
+		}
+		if _, err = tx.PutMulti(keys, entities); err != nil {
+			return err
+		}
+		if len(muts) > 0 {
+			_, err = tx.Mutate(muts...)
+		}
+		d.observeCommit(ctx, len(keys)+len(muts))
+		return err
+	})
+}
+
+// upsertHooksBefore calls the before hooks of inserts with the created items
+// of chunk and the before hooks of updates with the merged ones.
+func (d *Handler) upsertHooksBefore(ctx context.Context, chunk []*upsert) error {
+	var inserted []*resource.Item
+	for _, u := range chunk {
+		if u.original == nil {
+			inserted = append(inserted, u.item)
+		} else if h := d.hooks.BeforeUpdate; h != nil {
+			if err := h(ctx, u.item, u.original); err != nil {
+				return err
+			}
+		}
+	}
+	if h := d.hooks.BeforeInsert; h != nil && len(inserted) > 0 {
+		return h(ctx, inserted)
+	}
+	return nil
+}
+
+// upsertHooksAfter calls the after hooks of inserts and updates with the
+// outcome of chunk.
+func (d *Handler) upsertHooksAfter(ctx context.Context, chunk []*upsert, err error) {
+	var inserted []*resource.Item
+	for _, u := range chunk {
+		if u.original == nil {
+			inserted = append(inserted, u.item)
+		} else if h := d.hooks.AfterUpdate; h != nil {
+			h(ctx, u.item, u.original, err)
+		}
+	}
+	if h := d.hooks.AfterInsert; h != nil && len(inserted) > 0 {
+		h(ctx, inserted, err)
+	}
+}
+
+// mergePayload combines the stored payload with the new one.
+func mergePayload(stored, payload map[string]interface{}, strategy MergeStrategy) map[string]interface{} {
+	if strategy == ReplaceMerge {
+		return payload
+	}
+	merged := make(map[string]interface{}, len(stored)+len(payload))
+	for k, v := range stored {
+		merged[k] = v
+	}
+	for k, v := range payload {
+		if strategy == DeepMerge {
+			s, sok := toMap(merged[k])
+			p, pok := v.(map[string]interface{})
+			if sok && pok {
+				v = mergePayload(s, p, DeepMerge)
+			}
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// toMap converts nested entities loaded from the Datastore into maps.
+func toMap(v interface{}) (map[string]interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t, true
+	case *datastore.Entity:
+		m := make(map[string]interface{}, len(t.Properties))
+		for _, p := range t.Properties {
+			if e, ok := toMap(p.Value); ok {
+				m[p.Name] = e
+			} else {
+				m[p.Name] = p.Value
+			}
+		}
+		return m, true
+	}
+	return nil, false
+}
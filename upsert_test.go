@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/resource"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestMergePayload(t *testing.T) {
+	stored := map[string]interface{}{
+		"name": "John",
+		"meta": &datastore.Entity{Properties: []datastore.Property{
+			{Name: "title", Value: "a"},
+			{Name: "body", Value: "b"},
+		}},
+	}
+	payload := map[string]interface{}{
+		"meta": map[string]interface{}{"title": "c"},
+	}
+	tests := []struct {
+		strategy MergeStrategy
+		want     map[string]interface{}
+	}{
+		{ReplaceMerge, map[string]interface{}{
+			"meta": map[string]interface{}{"title": "c"},
+		}},
+		{ShallowMerge, map[string]interface{}{
+			"name": "John",
+			"meta": map[string]interface{}{"title": "c"},
+		}},
+		{DeepMerge, map[string]interface{}{
+			"name": "John",
+			"meta": map[string]interface{}{"title": "c", "body": "b"},
+		}},
+	}
+	for _, tt := range tests {
+		if got := mergePayload(stored, payload, tt.strategy); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("strategy %d: got %v, want %v", tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestUpsertMulti(t *testing.T) {
+	c := &mockClient{entities: map[string]datastore.PropertyList{}}
+	c.put(datastore.NameKey("users", "1", nil), datastore.PropertyList{
+		{Name: "_id", Value: "1"},
+		{Name: "_etag", Value: "etag1"},
+		{Name: "_updated", Value: time.Now()},
+		{Name: "owner", Value: "alice"},
+		{Name: "name", Value: "one"},
+	})
+	var inserted, updated []string
+	h := NewHandler(c, "", "users").SetImmutableFields([]string{"owner"}).SetHooks(Hooks{
+		BeforeInsert: func(ctx context.Context, items []*resource.Item) error {
+			for _, item := range items {
+				inserted = append(inserted, item.ID.(string))
+			}
+			return nil
+		},
+		BeforeUpdate: func(ctx context.Context, item, original *resource.Item) error {
+			updated = append(updated, item.ID.(string))
+			return nil
+		},
+	})
+	ctx := context.Background()
+	err := h.UpsertMulti(ctx, []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "uno"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "owner": "bob", "name": "two"}},
+	}, ShallowMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inserted, []string{"2"}) || !reflect.DeepEqual(updated, []string{"1"}) {
+		t.Errorf("unexpected hook calls: inserted %v, updated %v", inserted, updated)
+	}
+	list, err := h.Find(ctx, &query.Query{})
+	if err != nil || len(list.Items) != 2 || list.Items[0].Payload["name"] != "uno" || list.Items[0].Payload["owner"] != "alice" {
+		t.Fatalf("unexpected items %v, %v", list, err)
+	}
+	err = h.UpsertMulti(ctx, []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "owner": "mallory"}},
+	}, ShallowMerge)
+	if e, ok := err.(*ErrImmutableField); !ok || e.Field != "owner" {
+		t.Errorf("expected an immutable field error, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+// View declares a materialized projection of the items, stored in its own
+// kind under the item IDs.
+type View struct {
+	// Kind of the view entities.
+	Kind string
+	// Fields are the top level fields copied to the view.
+	Fields []string
+	// Filter restricts the view to the items it matches, all items when
+	// empty.
+	Filter query.Predicate
+}
+
+// SetViews declares materialized views kept in sync with the items in the same
+// commit as the writes of Insert, Update, Delete, Clear and UpsertMulti, so hot
+// list endpoints can read slim entities instead of full documents. View
+// entities have the ID, etag and update time of their item and can be served
+// by a handler on the view kind, configured with the same codecs.
+//
+// Fields are copied with their plain values, so encrypted fields should not
+// be projected. Items written before a view was declared are not in the view
+// until they are written again.
+func (d *Handler) SetViews(views ...View) *Handler {
+	d.views = views
+	return d
+}
+
+// viewChanges returns the mutations syncing the views of the item with key
+// with its written entity and payload, or removing it from the views when
+// entity is nil.
+func (d *Handler) viewChanges(key *datastore.Key, entity *Entity, payload map[string]interface{}) ([]*datastore.Mutation, error) {
+	var muts []*datastore.Mutation
+	for _, v := range d.views {
+		k := datastore.NameKey(v.Kind, key.Name, nil)
+		k.Namespace = key.Namespace
+		if entity == nil || !v.Filter.Match(payload) {
+			muts = append(muts, datastore.NewDelete(k))
+			continue
+		}
+		p := make(map[string]interface{}, len(v.Fields))
+		for _, f := range v.Fields {
+			value, found := payload[f]
+			if !found {
+				continue
+			}
+			ev, err := d.encodeValue(f, value)
+			if err != nil {
+				return nil, err
+			}
+			p[f] = d.transformValue(ev, f)
+		}
+		e := &Entity{ID: entity.ID, ETag: entity.ETag, Updated: entity.Updated, Payload: p}
+		muts = append(muts, datastore.NewUpsert(k, e))
+	}
+	return muts, nil
+}
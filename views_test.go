@@ -0,0 +1,30 @@
+package datastore
+
+import (
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"github.com/rs/rest-layer/schema/query"
+)
+
+func TestViewChanges(t *testing.T) {
+	h := NewHandler(nil, "", "posts").SetViews(View{
+		Kind:   "posts_summary",
+		Fields: []string{"title", "missing"},
+		Filter: query.Predicate{&query.Equal{Field: "published", Value: true}},
+	})
+	key := datastore.NameKey("posts", "1", nil)
+	entity := &Entity{ID: "1", ETag: "e"}
+	payload := map[string]interface{}{"title": "t", "body": "b", "published": true}
+	muts, err := h.viewChanges(key, entity, payload)
+	if err != nil || len(muts) != 1 {
+		t.Fatalf("expected one mutation, got %v %v", muts, err)
+	}
+	payload["published"] = false
+	if muts, err = h.viewChanges(key, entity, payload); err != nil || len(muts) != 1 {
+		t.Fatalf("expected a deletion, got %v %v", muts, err)
+	}
+	if muts, err = h.viewChanges(key, nil, nil); err != nil || len(muts) != 1 {
+		t.Fatalf("expected a deletion, got %v %v", muts, err)
+	}
+}